@@ -0,0 +1,170 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+)
+
+// errNoLocalAudio is returned for songs whose audio the server doesn't hold,
+// such as Jamendo tracks.
+var errNoLocalAudio = errors.New("song has no local audio")
+
+// audioAnalysis is what one decoding pass over a song's audio yields.
+type audioAnalysis struct {
+	Loudness    *Loudness
+	LoudnessErr error // Why Loudness is nil, e.g. errSilentAudio
+	Waveform    *waveform
+}
+
+// songAudioPath is where the audio of an upload or a sample lives on disk.
+func songAudioPath(s Song) (string, error) {
+	if s.IsUploaded {
+		return uploadFilePath(s.StoragePath)
+	}
+	if sample := findSampleSong(s.ID); sample != nil {
+		return strings.TrimPrefix(sample.FilePath, "/"), nil
+	}
+	return "", errNoLocalAudio
+}
+
+// analyzeFile decodes the audio at path once, measuring its loudness and
+// gathering its waveform as it goes. channels is the song's channel count
+// as found by extractMetadata.
+func analyzeFile(path string, channels int) (*audioAnalysis, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	format, err := detectAudioFormat(f)
+	if err != nil {
+		return nil, err
+	}
+	dec, err := newPCMDecoder(f, format, channels)
+	if err != nil {
+		return nil, err
+	}
+	channels, rate := dec.Channels(), dec.SampleRate()
+	if channels <= 0 || rate < 8000 {
+		return nil, fmt.Errorf("unusable stream: %d channels at %d Hz", channels, rate)
+	}
+
+	meter := newR128Meter(rate, channels)
+	peaks := newPeaksBuilder(rate, channels)
+	buf := make([]float64, 4096*channels)
+	for {
+		n, err := dec.Read(buf)
+		meter.add(buf[:n])
+		peaks.add(buf[:n])
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	a := &audioAnalysis{Waveform: peaks.finish()}
+	if integrated := meter.integrated(); math.IsInf(integrated, -1) {
+		a.LoudnessErr = errSilentAudio
+	} else {
+		a.Loudness = newLoudness(integrated, meter.peak.peak, loudnessSourceAnalysis)
+	}
+	return a, nil
+}
+
+// analysisQueue feeds new uploads to runAnalysisWorker.
+var analysisQueue = make(chan string, 1024)
+
+// queueAudioAnalysis asks the worker to analyse a new upload. If the queue
+// is full, a pending loudness measurement is picked up on the next start
+// and the waveform when it is first requested.
+func queueAudioAnalysis(songID string) {
+	select {
+	case analysisQueue <- songID:
+	default:
+		log.Warn().Str("song_id", songID).Msg("Audio analysis queue is full; the song will be analysed later")
+	}
+}
+
+// runAnalysisWorker measures every upload whose loudness is still pending,
+// including those from before loudness analysis existed, then the uploads
+// queued since. Decoding is CPU-bound, so one worker keeps it from
+// starving requests. main runs it in its own goroutine.
+func runAnalysisWorker() {
+	analyzePendingLoudness()
+	for songID := range analysisQueue {
+		if s, err := store.GetSong(songID); err == nil {
+			analyzeSong(*s)
+		}
+	}
+}
+
+func analyzePendingLoudness() {
+	songs, err := store.ListPendingLoudness()
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to list songs awaiting loudness analysis")
+		return
+	}
+	for _, s := range songs {
+		analyzeSong(s)
+	}
+}
+
+// analyzeSong decodes an upload once for whatever it still lacks: its
+// loudness while pending, and its cached waveform.
+func analyzeSong(s Song) {
+	needLoudness := s.LoudnessStatus == loudnessPending
+	unlock := lockWaveform(waveformKey(s))
+	defer unlock()
+	needWaveform := !waveformCached(s)
+	if !needLoudness && !needWaveform {
+		return
+	}
+
+	path, err := songAudioPath(s)
+	var a *audioAnalysis
+	if err == nil {
+		a, err = analyzeFile(path, s.Channels)
+	}
+	if a != nil && needWaveform {
+		if err := saveWaveform(s, a.Waveform); err != nil {
+			log.Error().Err(err).Str("song_id", s.ID).Msg("Failed to cache waveform")
+		}
+	}
+	if needLoudness {
+		if a != nil {
+			storeLoudness(s, a.Loudness, a.LoudnessErr)
+		} else {
+			storeLoudness(s, nil, err)
+		}
+	} else if err != nil {
+		log.Warn().Err(err).Str("song_id", s.ID).Str("mime_type", s.MimeType).Msg("Audio analysis failed")
+	}
+}
+
+// analyzeSamples measures the bundled sample songs and caches their
+// waveforms. main calls it before serving, since the samples are shared
+// and never change.
+func analyzeSamples() {
+	for i := range initialSampleSongs {
+		s := &initialSampleSongs[i]
+		a, err := analyzeFile(strings.TrimPrefix(s.FilePath, "/"), s.Channels)
+		if err != nil {
+			log.Warn().Err(err).Str("song_id", s.ID).Msg("Could not analyse a sample")
+			continue
+		}
+		s.Loudness = a.Loudness
+		if !waveformCached(*s) {
+			if err := saveWaveform(*s, a.Waveform); err != nil {
+				log.Error().Err(err).Str("song_id", s.ID).Msg("Failed to cache waveform")
+			}
+		}
+	}
+}
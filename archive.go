@@ -0,0 +1,306 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+)
+
+// defaultArchiveBaseURL is the default for ARCHIVE_API_URL.
+const defaultArchiveBaseURL = "https://archive.org"
+
+// archiveSource is the Internet Archive's provider name and song ID prefix.
+const archiveSource = "archive"
+
+// ArchiveClient searches the Internet Archive's audio collections
+// (https://archive.org/developers/). Its tracks are items: a search result
+// is a whole item, played from its first audio file.
+type ArchiveClient struct {
+	BaseURL string // Without a trailing slash
+	HTTP    *http.Client
+}
+
+func newArchiveClient(baseURL string) *ArchiveClient {
+	return &ArchiveClient{BaseURL: strings.TrimSuffix(baseURL, "/"), HTTP: &http.Client{Timeout: jamendoTimeout}}
+}
+
+// archive is the Internet Archive provider. main configures it from the
+// environment.
+var archive = newArchiveClient(defaultArchiveBaseURL)
+
+// loadArchiveClient reads ARCHIVE_API_URL.
+func loadArchiveClient() *ArchiveClient {
+	v := os.Getenv("ARCHIVE_API_URL")
+	if v == "" {
+		return newArchiveClient(defaultArchiveBaseURL)
+	}
+	if u, err := url.Parse(v); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		log.Fatal().Str("ARCHIVE_API_URL", v).Msg("ARCHIVE_API_URL must be an http(s) URL")
+	}
+	return newArchiveClient(v)
+}
+
+// archiveIdentifier matches Internet Archive item identifiers.
+var archiveIdentifier = regexp.MustCompile(`^[A-Za-z0-9._-]{1,100}$`)
+
+// archiveAudioFormats are the file formats played, most preferred first.
+var archiveAudioFormats = []string{"VBR MP3", "MP3", "128Kbps MP3", "64Kbps MP3", "Ogg Vorbis", "Flac"}
+
+// archiveText is a metadata field the Archive sends as either a string or
+// a list of strings; lists are joined with ", ".
+type archiveText string
+
+func (t *archiveText) UnmarshalJSON(data []byte) error {
+	var list []string
+	if err := json.Unmarshal(data, &list); err == nil {
+		*t = archiveText(strings.Join(list, ", "))
+		return nil
+	}
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	*t = archiveText(s)
+	return nil
+}
+
+type archiveDoc struct {
+	Identifier string      `json:"identifier"`
+	Title      archiveText `json:"title"`
+	Creator    archiveText `json:"creator"`
+	LicenseURL string      `json:"licenseurl"`
+}
+
+type archiveSearchResponse struct {
+	Response struct {
+		NumFound int          `json:"numFound"`
+		Docs     []archiveDoc `json:"docs"`
+	} `json:"response"`
+}
+
+type archiveFile struct {
+	Name    string      `json:"name"`
+	Format  string      `json:"format"`
+	Title   archiveText `json:"title"`
+	Creator archiveText `json:"creator"`
+	Album   archiveText `json:"album"`
+	Length  string      `json:"length"` // Seconds ("215.43") or "mm:ss"
+}
+
+type archiveMetadataResponse struct {
+	Metadata archiveDoc    `json:"metadata"`
+	Files    []archiveFile `json:"files"`
+}
+
+// getJSON fetches path from the Archive and decodes the JSON response.
+func (c *ArchiveClient) getJSON(ctx context.Context, path string, out interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.BaseURL+path, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	resp, err := c.HTTP.Do(req)
+	if err != nil {
+		return fmt.Errorf("archive: %w", err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 8<<20))
+	if err != nil {
+		return fmt.Errorf("archive: reading response: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("archive: HTTP %d: %s", resp.StatusCode, truncate(string(body), 200))
+	}
+	if err := json.Unmarshal(body, out); err != nil {
+		return fmt.Errorf("archive: decoding response: %w", err)
+	}
+	return nil
+}
+
+// archiveEscape escapes Lucene query syntax in user input.
+func archiveEscape(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		if strings.ContainsRune(`+-&|!(){}[]^"~*?:\/`, r) {
+			b.WriteByte('\\')
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// Name implements Provider.
+func (c *ArchiveClient) Name() string { return archiveSource }
+
+// Search implements Provider with the advanced search API. The Archive
+// pages by page number, so offsets are rounded down to a multiple of the
+// limit.
+func (c *ArchiveClient) Search(ctx context.Context, q SearchQuery) (*SearchPage, error) {
+	terms := []string{"mediatype:audio"}
+	if q.Text != "" {
+		terms = append(terms, "("+archiveEscape(q.Text)+")")
+	}
+	for _, tag := range q.Tags {
+		terms = append(terms, "subject:("+archiveEscape(tag)+")")
+	}
+	limit := q.Limit
+	if limit < 1 {
+		limit = defaultSearchPageSize
+	}
+	params := url.Values{
+		"q":      {strings.Join(terms, " AND ")},
+		"fl[]":   {"identifier", "title", "creator", "licenseurl"},
+		"rows":   {strconv.Itoa(limit)},
+		"page":   {strconv.Itoa(q.Offset/limit + 1)},
+		"output": {"json"},
+	}
+	var resp archiveSearchResponse
+	if err := c.getJSON(ctx, "/advancedsearch.php?"+params.Encode(), &resp); err != nil {
+		return nil, err
+	}
+	page := &SearchPage{Songs: []Song{}, Total: resp.Response.NumFound}
+	for _, doc := range resp.Response.Docs {
+		if !archiveIdentifier.MatchString(doc.Identifier) {
+			continue
+		}
+		title := string(doc.Title)
+		if title == "" {
+			title = doc.Identifier
+		}
+		song := Song{
+			ID: archiveSource + "-" + doc.Identifier, Title: title, Artist: string(doc.Creator),
+			// Which file plays is only known from the item's metadata.
+			FilePath:  "/api/tracks/" + archiveSource + "-" + doc.Identifier + "/stream",
+			CoverPath: c.BaseURL + "/services/img/" + doc.Identifier,
+			Source:    archiveSource,
+		}
+		setLicense(&song, doc.LicenseURL, archiveCreatorURL(song.Artist))
+		page.Songs = append(page.Songs, song)
+	}
+	return page, nil
+}
+
+// Track implements Provider from the item's metadata.
+func (c *ArchiveClient) Track(ctx context.Context, id string) (*Song, error) {
+	if !archiveIdentifier.MatchString(id) {
+		return nil, errTrackNotFound
+	}
+	var resp archiveMetadataResponse
+	if err := c.getJSON(ctx, "/metadata/"+id, &resp); err != nil {
+		return nil, err
+	}
+	// Unknown items come back as {}.
+	if resp.Metadata.Identifier == "" {
+		return nil, errTrackNotFound
+	}
+	file := archiveAudioFile(resp.Files)
+	if file == nil {
+		return nil, errTrackNotFound
+	}
+
+	song := &Song{
+		ID: archiveSource + "-" + id, Title: string(resp.Metadata.Title), Artist: string(resp.Metadata.Creator),
+		FilePath:  c.BaseURL + "/download/" + id + "/" + escapePath(file.Name),
+		CoverPath: c.BaseURL + "/services/img/" + id,
+		Duration:  int(parseArchiveLength(file.Length)),
+		Source:    archiveSource,
+	}
+	if file.Title != "" {
+		song.Title, song.Album = string(file.Title), string(resp.Metadata.Title)
+	}
+	if file.Album != "" {
+		song.Album = string(file.Album)
+	}
+	if file.Creator != "" {
+		song.Artist = string(file.Creator)
+	}
+	if song.Title == "" {
+		song.Title = id
+	}
+	setLicense(song, resp.Metadata.LicenseURL, archiveCreatorURL(song.Artist))
+	return song, nil
+}
+
+// archiveCreatorURL lists a creator's items, the nearest the Archive has
+// to an artist page.
+func archiveCreatorURL(creator string) string {
+	if creator == "" {
+		return ""
+	}
+	return "https://archive.org/search?query=" + url.QueryEscape(`creator:"`+creator+`"`)
+}
+
+// DownloadURL implements Downloader. Items without a recognized license
+// are only streamed.
+func (c *ArchiveClient) DownloadURL(ctx context.Context, id string) (string, error) {
+	song, err := c.Track(ctx, id)
+	if err != nil {
+		return "", err
+	}
+	if !licenseAllowsCopies(song.LicenseType) {
+		return "", errLicenseForbids
+	}
+	return song.FilePath, nil
+}
+
+// archiveAudioFile picks the first file in the most preferred audio format.
+func archiveAudioFile(files []archiveFile) *archiveFile {
+	for _, format := range archiveAudioFormats {
+		for i := range files {
+			if files[i].Format == format {
+				return &files[i]
+			}
+		}
+	}
+	return nil
+}
+
+// parseArchiveLength reads a file length in seconds, given as "215.43" or
+// "3:35", or 0 if it can't.
+func parseArchiveLength(s string) float64 {
+	var seconds float64
+	for _, part := range strings.Split(s, ":") {
+		v, err := strconv.ParseFloat(part, 64)
+		if err != nil || v < 0 {
+			return 0
+		}
+		seconds = seconds*60 + v
+	}
+	return seconds
+}
+
+// escapePath escapes each segment of a slash-separated path.
+func escapePath(p string) string {
+	segments := strings.Split(p, "/")
+	for i, s := range segments {
+		segments[i] = url.PathEscape(s)
+	}
+	return strings.Join(segments, "/")
+}
+
+// StreamURL implements Provider.
+func (c *ArchiveClient) StreamURL(ctx context.Context, id string) (string, error) {
+	song, err := c.Track(ctx, id)
+	if err != nil {
+		return "", err
+	}
+	return song.FilePath, nil
+}
+
+// Attribution implements Provider.
+func (c *ArchiveClient) Attribution() Attribution {
+	return Attribution{
+		Name:   "Internet Archive",
+		URL:    "https://archive.org",
+		Notice: "Audio from the Internet Archive; rights and licenses vary by item.",
+	}
+}
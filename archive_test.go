@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// newArchiveFixtures stands in for archive.org. "missing-item" is answered
+// with {}, as the real API answers for items it doesn't have. It points the
+// archive client at itself for the test's duration.
+func newArchiveFixtures(t *testing.T) *fixtureServer {
+	f := newFixtureServer(t, "archive", "", map[string]string{
+		"advancedsearch.php":                "search.json",
+		"metadata/harbour-sessions-2019":    "harbour-sessions-2019.json",
+		"metadata/untitled-field-recording": "untitled-field-recording.json",
+		"metadata/missing-item":             "missing-item.json",
+	})
+	saved := archive
+	archive = newArchiveClient(f.URL)
+	t.Cleanup(func() { archive = saved })
+	return f
+}
+
+func TestArchiveSearch(t *testing.T) {
+	api := newArchiveFixtures(t)
+
+	page, err := archive.Search(context.Background(), SearchQuery{Text: "blue sky?", Tags: []string{"jazz age"}, Offset: 25, Limit: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := api.last().Query()
+	if got.Get("q") != `mediatype:audio AND (blue sky\?) AND subject:(jazz age)` || got.Get("rows") != "10" || got.Get("page") != "3" ||
+		strings.Join(got["fl[]"], ",") != "identifier,title,creator,licenseurl" || got.Get("output") != "json" {
+		t.Errorf("search query %s", got.Encode())
+	}
+
+	// Invalid identifiers are skipped.
+	if page.Total != 42 || len(page.Songs) != 3 {
+		t.Fatalf("%d of %d results", len(page.Songs), page.Total)
+	}
+	want := []Song{
+		{ID: "archive-harbour-sessions-2019", Title: "Harbour Sessions 2019", Artist: "The Tidewaters",
+			FilePath: "/api/tracks/archive-harbour-sessions-2019/stream", CoverPath: api.URL + "/services/img/harbour-sessions-2019", Source: "archive"},
+		{ID: "archive-78_blue-skies_test-orchestra", Title: "Blue Skies", Artist: "Test Orchestra, Irving Berlin",
+			FilePath: "/api/tracks/archive-78_blue-skies_test-orchestra/stream", CoverPath: api.URL + "/services/img/78_blue-skies_test-orchestra", Source: "archive"},
+		{ID: "archive-untitled-field-recording", Title: "untitled-field-recording",
+			FilePath: "/api/tracks/archive-untitled-field-recording/stream", CoverPath: api.URL + "/services/img/untitled-field-recording", Source: "archive"},
+	}
+	for i := range want {
+		if s := page.Songs[i]; s.ID != want[i].ID || s.Title != want[i].Title || s.Artist != want[i].Artist ||
+			s.FilePath != want[i].FilePath || s.CoverPath != want[i].CoverPath || s.Source != want[i].Source {
+			t.Errorf("result %d = %+v, want %+v", i, s, want[i])
+		}
+	}
+	if s := page.Songs[0]; s.LicenseType != "BY" || s.LicenseURL != "https://creativecommons.org/licenses/by/4.0/" ||
+		s.ArtistURL != "https://archive.org/search?query=creator%3A%22The+Tidewaters%22" ||
+		s.AttributionText != `"Harbour Sessions 2019" by The Tidewaters (https://archive.org/details/harbour-sessions-2019), licensed under CC BY 4.0 (https://creativecommons.org/licenses/by/4.0/)` {
+		t.Errorf("licensed result = %+v", s)
+	}
+	if s := page.Songs[2]; s.LicenseURL != "" || s.LicenseType != "" || s.AttributionText != "" {
+		t.Errorf("unlicensed result = %+v", s)
+	}
+
+	api.fail(http.StatusServiceUnavailable)
+	if _, err := archive.Search(context.Background(), SearchQuery{Text: "a", Limit: 10}); err == nil {
+		t.Errorf("search succeeded against a failing Archive")
+	}
+}
+
+func TestArchiveTrack(t *testing.T) {
+	api := newArchiveFixtures(t)
+	ctx := context.Background()
+
+	// The first VBR MP3 plays, with its own tags.
+	song, err := archive.Track(ctx, "harbour-sessions-2019")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if song.ID != "archive-harbour-sessions-2019" || song.Title != "Low Tide" || song.Album != "Harbour Sessions 2019" ||
+		song.Artist != "The Tidewaters & Friends" || song.Duration != 215 ||
+		song.FilePath != api.URL+"/download/harbour-sessions-2019/01%20Low%20Tide.mp3" {
+		t.Errorf("track = %+v", song)
+	}
+	if stream, err := archive.StreamURL(ctx, "harbour-sessions-2019"); err != nil || stream != song.FilePath {
+		t.Errorf("stream URL %q, %v", stream, err)
+	}
+	if song.LicenseType != "BY" || song.AttributionText == "" {
+		t.Errorf("license = %q, attribution %q", song.LicenseType, song.AttributionText)
+	}
+	if download, err := archive.DownloadURL(ctx, "harbour-sessions-2019"); err != nil || download != song.FilePath {
+		t.Errorf("download URL %q, %v", download, err)
+	}
+	// Items without a license are streamed but not downloaded.
+	if _, err := archive.DownloadURL(ctx, "untitled-field-recording"); !errors.Is(err, errLicenseForbids) {
+		t.Errorf("unlicensed download: %v", err)
+	}
+
+	song, err = archive.Track(ctx, "untitled-field-recording")
+	if err != nil || song.Title != "untitled-field-recording" || song.Duration != 61 || !strings.HasSuffix(song.FilePath, "/take%201.ogg") {
+		t.Errorf("untitled track = %+v, %v", song, err)
+	}
+
+	if _, err := archive.Track(ctx, "missing-item"); !errors.Is(err, errTrackNotFound) {
+		t.Errorf("unknown item: %v", err)
+	}
+	calls := api.calls()
+	if _, err := archive.Track(ctx, "../metadata/x"); !errors.Is(err, errTrackNotFound) || api.calls() != calls {
+		t.Errorf("invalid identifier: %v", err)
+	}
+	api.fail(http.StatusInternalServerError)
+	if _, err := archive.Track(ctx, "harbour-sessions-2019"); err == nil || errors.Is(err, errTrackNotFound) {
+		t.Errorf("failing Archive: %v", err)
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/google/uuid"
+	"github.com/rs/zerolog/log"
+)
+
+// Uploaded audio lives in a content-addressed store under
+// uploadsDir/blobs/<first two hex digits>/<sha256><ext>, so identical files
+// uploaded by several users, or twice by one, are kept once. The blobs table
+// counts the songs referencing each blob.
+const blobsDirName = "blobs"
+
+// blobLocks serialize placing, referencing and removing blobs with the same
+// hash, so a delete dropping the last reference can't remove a file that a
+// concurrent upload of identical content is about to reference again.
+var blobLocks [64]sync.Mutex
+
+// lockBlob locks sum's stripe and returns the unlock function.
+func lockBlob(sum string) func() {
+	var b byte
+	if len(sum) > 0 {
+		b = sum[len(sum)-1]
+	}
+	mu := &blobLocks[int(b)%len(blobLocks)]
+	mu.Lock()
+	return mu.Unlock
+}
+
+// blobStoragePath is the blob's location relative to uploadsDir.
+func blobStoragePath(sum, ext string) string {
+	return blobsDirName + "/" + sum[:2] + "/" + sum + ext
+}
+
+// storedFile is what an ingest save step wrote: its size and SHA-256.
+type storedFile struct {
+	Size   int64
+	SHA256 string
+}
+
+// hashingWriter computes the SHA-256 of everything copied through it.
+func hashingWriter(w io.Writer) (io.Writer, hash.Hash) {
+	h := sha256.New()
+	return io.MultiWriter(w, h), h
+}
+
+// hashFile computes the size and SHA-256 of a file already on disk.
+func hashFile(path string) (storedFile, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return storedFile{}, err
+	}
+	defer f.Close()
+	h := sha256.New()
+	n, err := io.Copy(h, f)
+	if err != nil {
+		return storedFile{}, err
+	}
+	return storedFile{Size: n, SHA256: hex.EncodeToString(h.Sum(nil))}, nil
+}
+
+// newBlobTempPath returns a fresh name inside the blob store for a file being
+// received, so moving it into place is a rename on the same filesystem.
+func newBlobTempPath() (string, error) {
+	dir := filepath.Join(uploadsDir, blobsDirName)
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, ".tmp-"+uuid.New().String()), nil
+}
+
+// placeBlob moves the received file at tmp to the blob path for sum, or
+// discards it when that content is already stored. The caller holds
+// lockBlob(sum).
+func placeBlob(tmp, sum, ext string) (string, error) {
+	relative := blobStoragePath(sum, ext)
+	target, err := uploadFilePath(relative)
+	if err != nil {
+		return "", err
+	}
+	if _, err := os.Stat(target); err == nil {
+		return relative, os.Remove(tmp) // Same content uploaded before
+	}
+	if err := os.MkdirAll(filepath.Dir(target), os.ModePerm); err != nil {
+		return "", err
+	}
+	return relative, os.Rename(tmp, target)
+}
+
+// releaseBlob deletes the blob's file once no song references it any more.
+func releaseBlob(s Song) {
+	unlock := lockBlob(s.BlobSHA256)
+	defer unlock()
+	releaseBlobLocked(s)
+}
+
+func releaseBlobLocked(s Song) {
+	inUse, err := store.BlobInUse(s.BlobSHA256)
+	if err != nil {
+		log.Warn().Err(err).Str("blob", s.BlobSHA256).Msg("Failed to check blob references; keeping the file")
+		return
+	}
+	if !inUse {
+		if fullPath, err := uploadFilePath(s.StoragePath); err == nil {
+			removeUploadFile(fullPath, "Failed to remove blob")
+		}
+		removeWaveform(s.BlobSHA256)
+	}
+}
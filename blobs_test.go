@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+)
+
+// blobFiles lists the files in the blob store, relative to uploadsDir.
+func blobFiles(t *testing.T) []string {
+	t.Helper()
+	var files []string
+	filepath.WalkDir(filepath.Join(uploadsDir, blobsDirName), func(path string, d fs.DirEntry, err error) error {
+		if err == nil && !d.IsDir() {
+			relative, _ := filepath.Rel(uploadsDir, path)
+			files = append(files, filepath.ToSlash(relative))
+		}
+		return nil
+	})
+	return files
+}
+
+func TestUploadsShareBlobs(t *testing.T) {
+	forEachStore(t, func(t *testing.T, srv *httptest.Server) {
+		content := testMP3("Same Song")
+		sum := sha256.Sum256(content)
+		want := blobStoragePath(hex.EncodeToString(sum[:]), ".mp3")
+
+		alice := newTestClient(t, srv)
+		alice.registerAndLogin("ada")
+		first, code := alice.uploadFile("a.mp3", content, nil)
+		if code != http.StatusCreated {
+			t.Fatalf("upload: status %d", code)
+		}
+		second, code := alice.uploadFile("again.mp3", content, map[string]string{"title": "Second Copy"})
+		if code != http.StatusCreated {
+			t.Fatalf("upload: status %d", code)
+		}
+		bob := newTestClient(t, srv)
+		bob.registerAndLogin("ben")
+		theirs, code := bob.uploadFile("b.mp3", content, nil)
+		if code != http.StatusCreated {
+			t.Fatalf("upload: status %d", code)
+		}
+		if files := blobFiles(t); len(files) != 1 || files[0] != want {
+			t.Fatalf("blob store holds %v, want just %s", files, want)
+		}
+		// Each song still counts in full against its owner's quota.
+		if first.FileSize != int64(len(content)) || theirs.FileSize != int64(len(content)) {
+			t.Errorf("file sizes %d and %d, want %d", first.FileSize, theirs.FileSize, len(content))
+		}
+
+		alice.do("DELETE", "/api/songs/delete?id="+first.ID, nil, nil)
+		alice.do("DELETE", "/api/songs/delete?id="+second.ID, nil, nil)
+		if files := blobFiles(t); len(files) != 1 {
+			t.Fatalf("blob removed while ben still references it: %v", files)
+		}
+		if resp, body := bob.fetch("GET", theirs.FilePath, nil); resp.StatusCode != http.StatusOK || !bytes.Equal(body, content) {
+			t.Errorf("stream shared blob: status %d", resp.StatusCode)
+		}
+
+		bob.do("DELETE", "/api/songs/delete?id="+theirs.ID, nil, nil)
+		if files := blobFiles(t); len(files) != 0 {
+			t.Errorf("blob left after its last song was deleted: %v", files)
+		}
+
+		// A resumable upload of the same content lands in the same blob.
+		bob.uploadFile("b.mp3", content, nil)
+		location := bob.createUpload(len(content), nil)
+		if resp, _ := bob.patchUpload(location, 0, content); resp.StatusCode != http.StatusOK {
+			t.Fatalf("resumable upload: status %d", resp.StatusCode)
+		}
+		if files := blobFiles(t); len(files) != 1 || files[0] != want {
+			t.Errorf("blob store after resumable upload: %v", files)
+		}
+	})
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Where a user's cover images live, relative to their uploads directory.
+const coversDirName = "covers"
+
+var coverExtensions = map[string]string{
+	"image/jpeg": ".jpg",
+	"image/png":  ".png",
+	"image/gif":  ".gif",
+	"image/webp": ".webp",
+}
+
+// coverStoragePath maps a CoverPath set by saveCoverArt back to the file's
+// location relative to uploadsDir. Other covers (the placeholder, Jamendo
+// artwork) are not ours to manage and report false.
+func coverStoragePath(coverPath string) (string, bool) {
+	rest, ok := strings.CutPrefix(coverPath, "/api/covers/")
+	if !ok {
+		return "", false
+	}
+	user, name, ok := strings.Cut(rest, "/")
+	userID, err := strconv.Atoi(user)
+	if !ok || err != nil || name == "" || name == ".." || strings.ContainsAny(name, `/\`) {
+		return "", false
+	}
+	return strconv.Itoa(userID) + "/" + coversDirName + "/" + name, true
+}
+
+// saveCoverArt stores pic under uploadsDir/<userID>/covers, named after the
+// SHA-256 of its bytes so every track of an album shares one file, and
+// returns the URL the browser loads it from (served by CoverHandler).
+func saveCoverArt(userID int, pic *Picture) (string, error) {
+	ext, ok := coverExtensions[pic.MIMEType]
+	if !ok {
+		return "", fmt.Errorf("unsupported cover image type %q", pic.MIMEType)
+	}
+	sum := sha256.Sum256(pic.Data)
+	name := hex.EncodeToString(sum[:]) + ext
+	dir := filepath.Join(uploadsDir, strconv.Itoa(userID), coversDirName)
+	coverPath := coverURL(userID, name)
+
+	target := filepath.Join(dir, name)
+	if _, err := os.Stat(target); err == nil {
+		return coverPath, nil // Same image already stored for another track
+	}
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return "", err
+	}
+	// Write under a temporary name and rename, so a concurrent upload of the
+	// same album never sees a half-written image.
+	tmp, err := os.CreateTemp(dir, ".cover-*")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(pic.Data); err != nil {
+		tmp.Close()
+		return "", err
+	}
+	if err := tmp.Close(); err != nil {
+		return "", err
+	}
+	if err := os.Rename(tmp.Name(), target); err != nil {
+		return "", err
+	}
+	return coverPath, nil
+}
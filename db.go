@@ -2,6 +2,7 @@ package main
 
 import (
 	"database/sql"
+	"errors"
 	"fmt"
 	// "time"
 
@@ -9,28 +10,91 @@ import (
 	"github.com/google/uuid"
 	"github.com/rs/zerolog/log"
 	"golang.org/x/crypto/bcrypt"
+	_ "modernc.org/sqlite"
 )
 
-var db *sql.DB
+// Supported values for DB_DRIVER.
+const (
+	driverMySQL  = "mysql"
+	driverSQLite = "sqlite"
+	driverMemory = "memory"
+)
+
+// sqlStore implements Store on top of database/sql. MySQL and SQLite share
+// the same queries; the few dialect differences are handled by helpers below.
+type sqlStore struct {
+	db      *sql.DB
+	dialect string
+}
+
+// InitDB connects to the database and applies any pending schema migrations.
+func InitDB(driver, dataSourceName string) *sqlStore {
+	st := openDB(driver, dataSourceName)
 
-func InitDB(dataSourceName string) {
-	var err error
-	db, err = sql.Open("mysql", dataSourceName)
+	migrations, err := loadMigrations(migrationFiles, st.dialect)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Error loading migrations")
+	}
+	if err := migrateUp(st.db, migrations); err != nil {
+		log.Fatal().Err(err).Msg("Error applying migrations")
+	}
+	log.Info().Int("migrations", len(migrations)).Msg("Database schema is up to date")
+	return st
+}
+
+func openDB(driver, dataSourceName string) *sqlStore {
+	if driver != driverMySQL && driver != driverSQLite {
+		log.Fatal().Str("driver", driver).Msg("Unsupported database driver")
+	}
+	db, err := sql.Open(driver, dataSourceName)
 	if err != nil {
 		log.Fatal().Err(err).Msg("Error opening database")
 	}
 	if err = db.Ping(); err != nil {
 		log.Fatal().Err(err).Msg("Error connecting to database")
 	}
-	log.Info().Msg("Successfully connected to the database!")
+	log.Info().Str("driver", driver).Msg("Successfully connected to the database!")
+	return &sqlStore{db: db, dialect: driver}
+}
+
+// RollbackMigrations connects to the database and undoes the given number of
+// applied migrations, newest first.
+func RollbackMigrations(driver, dataSourceName string, steps int) error {
+	if driver == driverMemory {
+		return errors.New("the in-memory store has no schema to roll back")
+	}
+	st := openDB(driver, dataSourceName)
+	defer st.db.Close()
+	migrations, err := loadMigrations(migrationFiles, st.dialect)
+	if err != nil {
+		return err
+	}
+	return migrateDown(st.db, migrations, steps)
 }
 
-func CreateUser(username, password string) (*User, error) {
+// forUpdate returns the row-locking suffix for SELECTs inside a transaction.
+// SQLite has no row locks; its transactions are serialized by _txlock=immediate.
+func (st *sqlStore) forUpdate() string {
+	if st.dialect == driverSQLite {
+		return ""
+	}
+	return " FOR UPDATE"
+}
+
+// insertIgnore returns the dialect's spelling of "INSERT, skipping duplicates".
+func (st *sqlStore) insertIgnore() string {
+	if st.dialect == driverSQLite {
+		return "INSERT OR IGNORE"
+	}
+	return "INSERT IGNORE"
+}
+
+func (st *sqlStore) CreateUser(username, password string) (*User, error) {
 	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
 	if err != nil {
 		return nil, fmt.Errorf("failed to hash password: %w", err)
 	}
-	stmt, err := db.Prepare("INSERT INTO users(username, password_hash) VALUES(?, ?)")
+	stmt, err := st.db.Prepare("INSERT INTO users(username, password_hash) VALUES(?, ?)")
 	if err != nil {
 		return nil, fmt.Errorf("failed to prepare user insert: %w", err)
 	}
@@ -43,9 +107,9 @@ func CreateUser(username, password string) (*User, error) {
 	return &User{ID: int(id), Username: username}, nil
 }
 
-func GetUserByUsername(username string) (*User, error) {
+func (st *sqlStore) GetUserByUsername(username string) (*User, error) {
 	user := &User{}
-	row := db.QueryRow("SELECT id, username, password_hash, created_at FROM users WHERE username = ?", username)
+	row := st.db.QueryRow("SELECT id, username, password_hash, created_at FROM users WHERE username = ?", username)
 	err := row.Scan(&user.ID, &user.Username, &user.PasswordHash, &user.CreatedAt)
 	if err != nil {
 		if err == sql.ErrNoRows {
@@ -56,132 +120,149 @@ func GetUserByUsername(username string) (*User, error) {
 	return user, nil
 }
 
-// Initial sample songs (could also be loaded from DB if pre-populated)
-var initialSampleSongs = []Song{
-	{ID: "sample-1", Title: "Creative Minds", Artist: "Bensound", Album: "Royalty Free", FilePath: "/assets/audio/sample1.mp3", CoverPath: "/static/images/cover1.jpg", IsLocal: true, Duration: 146},
-	{ID: "sample-2", Title: "A New Beginning", Artist: "Bensound", Album: "Inspiring", FilePath: "/assets/audio/sample2.mp3", CoverPath: "/static/images/cover2.jpg", IsLocal: true, Duration: 150},
-}
-
 // GetSongsForUser gets initial samples, user uploads, and marks liked songs
-func GetSongsForUser(userID *int) ([]Song, error) {
-	var finalPlaylist []Song
-	
-	// 1. Add initial sample songs
-	finalPlaylist = append(finalPlaylist, initialSampleSongs...)
-
-	var likedSongIDs = make(map[string]bool)
-	if userID != nil { // If user is logged in
-		// 2. Get user's uploaded songs
-		rows, err := db.Query("SELECT id, title, artist, album, file_path, cover_path, duration FROM songs WHERE user_id = ? AND is_uploaded = TRUE", *userID)
+func (st *sqlStore) GetSongsForUser(userID *int) ([]Song, error) {
+	if userID == nil { // Guests only get the samples
+		return buildSongList(nil, nil, nil), nil
+	}
+
+	// 1. Get user's uploaded songs
+	var uploads []Song
+	rows, err := st.db.Query("SELECT "+songColumns+" FROM songs s WHERE s.user_id = ? AND s.is_uploaded = TRUE", *userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query user uploaded songs: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		s, err := scanSong(rows)
 		if err != nil {
-			return nil, fmt.Errorf("failed to query user uploaded songs: %w", err)
-		}
-		defer rows.Close()
-		for rows.Next() {
-			var s Song
-			s.UserID = userID
-			s.IsLocal = true // User uploads are treated as local from server's perspective
-			s.IsUploaded = true
-			s.CanDelete = true // User can delete their own uploads
-			if err := rows.Scan(&s.ID, &s.Title, &s.Artist, &s.Album, &s.FilePath, &s.CoverPath, &s.Duration); err != nil {
-				log.Error().Err(err).Msg("Failed to scan uploaded song")
-				continue
-			}
-			finalPlaylist = append(finalPlaylist, s)
+			log.Error().Err(err).Msg("Failed to scan uploaded song")
+			continue
 		}
+		s.IsLocal = true // User uploads are treated as local from server's perspective
+		s.CanDelete = true // User can delete their own uploads
+		uploads = append(uploads, s)
+	}
 
-		// 3. Get user's liked songs (Jamendo or Samples)
-		// This query gets songs from the main 'songs' table that the user has liked.
-		likedRows, err := db.Query(`
-			SELECT s.id, s.title, s.artist, s.album, s.file_path, s.cover_path, s.is_local, s.jamendo_id, s.duration
-			FROM songs s
-			JOIN user_liked_songs uls ON s.id = uls.song_id
-			WHERE uls.user_id = ?`, *userID)
+	// 2. Get user's liked songs (Jamendo or Samples)
+	// This query gets songs from the main 'songs' table that the user has liked.
+	var liked []Song
+	likedRows, err := st.db.Query(`
+		SELECT `+songColumns+`
+		FROM songs s
+		JOIN user_liked_songs uls ON s.id = uls.song_id
+		WHERE uls.user_id = ?`, *userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query user liked songs: %w", err)
+	}
+	defer likedRows.Close()
+	for likedRows.Next() {
+		s, err := scanSong(likedRows)
 		if err != nil {
-			return nil, fmt.Errorf("failed to query user liked songs: %w", err)
-		}
-		defer likedRows.Close()
-		
-		tempLikedMap := make(map[string]Song) // To avoid duplicates if a sample is also liked
-
-		for likedRows.Next() {
-			var s Song
-			s.UserID = userID // Mark as associated with user for context, though not "owned"
-			if err := likedRows.Scan(&s.ID, &s.Title, &s.Artist, &s.Album, &s.FilePath, &s.CoverPath, &s.IsLocal, &s.JamendoID, &s.Duration); err != nil {
-				log.Error().Err(err).Msg("Failed to scan liked song")
-				continue
-			}
-			// If it's a liked sample song, it's already in finalPlaylist. We just need to mark it.
-			// If it's a liked Jamendo song, add it to playlist if not already (e.g. from another user's like).
-			isSample := false
-			for _, sample := range initialSampleSongs {
-				if sample.ID == s.ID {
-					isSample = true
-					break
-				}
-			}
-			if !isSample && !s.IsUploaded { // If it's a liked Jamendo song, add to temp map
-			    tempLikedMap[s.ID] = s
-			}
-			likedSongIDs[s.ID] = true // Mark this ID as liked
-		}
-		// Add unique liked Jamendo songs to final playlist
-        for _, likedJamendoSong := range tempLikedMap {
-            found := false
-            for _, existingSong := range finalPlaylist {
-                if existingSong.ID == likedJamendoSong.ID {
-                    found = true
-                    break
-                }
-            }
-            if !found {
-                finalPlaylist = append(finalPlaylist, likedJamendoSong)
-            }
-        }
-
-
-		// Mark liked status for all songs in finalPlaylist
-		for i := range finalPlaylist {
-			if _, ok := likedSongIDs[finalPlaylist[i].ID]; ok {
-				finalPlaylist[i].IsLiked = true
-			}
+			log.Error().Err(err).Msg("Failed to scan liked song")
+			continue
 		}
-	} else {
-        // Not logged in, only initial samples are marked as "not liked" by default
-        for i := range finalPlaylist {
-            finalPlaylist[i].IsLiked = false
-        }
-    }
-
+		s.UserID = userID // Mark as associated with user for context, though not "owned"
+		liked = append(liked, s)
+	}
 
-	return finalPlaylist, nil
+	return buildSongList(userID, uploads, liked), nil
 }
 
-// AddUploadedSong adds a new song uploaded by a user
-func AddUploadedSong(userID int, title, artist, album, relativeFilePath, relativeCoverPath string, duration int) (Song, error) {
-	songID := "local-" + uuid.New().String() // Generate a unique ID for the uploaded song
-	
-	stmt, err := db.Prepare("INSERT INTO songs(id, user_id, title, artist, album, file_path, cover_path, is_local, is_uploaded, duration) VALUES(?, ?, ?, ?, ?, ?, ?, TRUE, TRUE, ?)")
+// AddUploadedSong adds a new song uploaded by a user. ID, ownership, the
+// stream URL and the local/uploaded flags are set here; everything else,
+// including StoragePath, is taken from s.
+func (st *sqlStore) AddUploadedSong(userID int, s Song, quota StorageQuota) (Song, error) {
+	s.ID = "local-" + uuid.New().String() // Generate a unique ID for the uploaded song
+	s.FilePath = streamURL(s.ID)
+	s.UserID = &userID
+	s.IsLocal, s.IsUploaded, s.CanDelete = true, true, true
+	s.JamendoID = nil
+
+	tx, err := st.db.Begin()
 	if err != nil {
-		return Song{}, fmt.Errorf("failed to prepare song insert: %w", err)
+		return Song{}, fmt.Errorf("failed to begin transaction: %w", err)
 	}
-	defer stmt.Close()
+	defer tx.Rollback()
 
-	_, err = stmt.Exec(songID, userID, title, artist, album, relativeFilePath, relativeCoverPath, duration)
+	// Lock the user row so two uploads from the same user check the quota
+	// one after the other (SQLite's write lock already does this).
+	var locked int
+	if err := tx.QueryRow("SELECT id FROM users WHERE id = ?"+st.forUpdate(), userID).Scan(&locked); err != nil {
+		return Song{}, fmt.Errorf("failed to lock user %d: %w", userID, err)
+	}
+	var tracks int
+	var usedBytes int64
+	err = tx.QueryRow("SELECT COUNT(*), COALESCE(SUM(file_size), 0) FROM songs WHERE user_id = ? AND is_uploaded = TRUE", userID).Scan(&tracks, &usedBytes)
+	if err != nil {
+		return Song{}, fmt.Errorf("failed to query storage usage: %w", err)
+	}
+	if err := quota.check(usedBytes, tracks, s.FileSize); err != nil {
+		return Song{}, err
+	}
+
+	if s.BlobSHA256 != "" {
+		// Take a reference on the blob, creating its row for new content.
+		// Callers hold lockBlob, so no one else inserts the same hash meanwhile.
+		res, err := tx.Exec("UPDATE blobs SET ref_count = ref_count + 1 WHERE sha256 = ?", s.BlobSHA256)
+		if err != nil {
+			return Song{}, fmt.Errorf("failed to reference blob: %w", err)
+		}
+		if n, err := res.RowsAffected(); err != nil {
+			return Song{}, fmt.Errorf("failed to reference blob: %w", err)
+		} else if n == 0 {
+			_, err = tx.Exec("INSERT INTO blobs(sha256, storage_path, size, ref_count) VALUES(?, ?, ?, 1)", s.BlobSHA256, s.StoragePath, s.FileSize)
+			if err != nil {
+				return Song{}, fmt.Errorf("failed to insert blob: %w", err)
+			}
+		}
+	}
+
+	_, err = tx.Exec(`INSERT INTO songs(id, user_id, title, artist, album, file_path, cover_path, is_local, is_uploaded, duration,
+			genre, release_year, track_number, disc_number, codec, bitrate, sample_rate, channels, duration_ms, mime_type, original_mime_type, storage_path, file_size, blob_sha256,
+			loudness_status, loudness_source, loudness_lufs, true_peak_dbtp, track_gain_db, track_peak, album_gain_db, album_peak, album_gain_tagged)
+		VALUES(?, ?, ?, ?, ?, ?, ?, TRUE, TRUE, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		append([]interface{}{s.ID, userID, s.Title, s.Artist, s.Album, s.FilePath, s.CoverPath, s.Duration,
+			s.Genre, s.Year, s.TrackNumber, s.DiscNumber, s.Codec, s.Bitrate, s.SampleRate, s.Channels, s.DurationMs, s.MimeType, s.OriginalMimeType, s.StoragePath, s.FileSize, s.BlobSHA256,
+			s.LoudnessStatus}, loudnessValues(s.Loudness)...)...)
 	if err != nil {
 		return Song{}, fmt.Errorf("failed to execute song insert: %w", err)
 	}
-	
-	return Song{
-		ID: songID, UserID: &userID, Title: title, Artist: artist, Album: album,
-		FilePath: relativeFilePath, CoverPath: relativeCoverPath, IsLocal: true, IsUploaded: true, Duration: duration, CanDelete: true,
-	}, nil
+	if err := tx.Commit(); err != nil {
+		return Song{}, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return s, nil
+}
+
+func (st *sqlStore) GetStorageUsage(userID int) (*StorageUsage, error) {
+	rows, err := st.db.Query(`
+		SELECT mime_type, COUNT(*), COALESCE(SUM(file_size), 0)
+		FROM songs
+		WHERE user_id = ? AND is_uploaded = TRUE
+		GROUP BY mime_type
+		ORDER BY mime_type`, userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query storage usage: %w", err)
+	}
+	defer rows.Close()
+	usage := &StorageUsage{Formats: []FormatUsage{}}
+	for rows.Next() {
+		var f FormatUsage
+		if err := rows.Scan(&f.MimeType, &f.Tracks, &f.Bytes); err != nil {
+			return nil, fmt.Errorf("failed to scan storage usage: %w", err)
+		}
+		usage.add(f)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read storage usage: %w", err)
+	}
+	return usage, nil
 }
 
 
 // EnsureSongExists adds a song to the main 'songs' table if it doesn't exist, typically for Jamendo songs.
 // Returns the song's ID (existing or new).
-func EnsureSongExists(s Song) (string, error) {
+func (st *sqlStore) EnsureSongExists(s Song) (string, error) {
     var existingID string
     var query string
     var args []interface{}
@@ -199,39 +280,58 @@ func EnsureSongExists(s Song) (string, error) {
         args = append(args, s.ID)
     }
 
-    err := db.QueryRow(query, args...).Scan(&existingID)
+    err := st.db.QueryRow(query, args...).Scan(&existingID)
     if err == nil {
-        return existingID, nil // Song already exists
+        // Song already exists
+        return existingID, nil
     }
     if err != sql.ErrNoRows {
         return "", fmt.Errorf("error checking for existing song: %w", err)
     }
 
     // Song doesn't exist, insert it
+    // An empty Jamendo ID means "not a Jamendo song"; store NULL so the unique index allows many of them.
+    if s.JamendoID != nil && *s.JamendoID == "" {
+        s.JamendoID = nil
+    }
     // If ID is not set for a Jamendo song, use the convention
     if s.ID == "" && s.JamendoID != nil && *s.JamendoID != "" {
         s.ID = "jamendo-" + *s.JamendoID
     } else if s.ID == "" {
          s.ID = "external-" + uuid.New().String() // Fallback ID for non-Jamendo external
     }
+    // Whatever URL the caller had, the song plays through StreamHandler.
+    s.FilePath = streamURL(s.ID)
 
 
-    stmt, err := db.Prepare("INSERT INTO songs(id, title, artist, album, file_path, cover_path, is_local, jamendo_id, duration, user_id, is_uploaded) VALUES(?, ?, ?, ?, ?, ?, ?, ?, ?, NULL, FALSE)")
+    stmt, err := st.db.Prepare("INSERT INTO songs(id, title, artist, album, file_path, cover_path, is_local, jamendo_id, duration, license_url, license_type, artist_url, attribution, user_id, is_uploaded) VALUES(?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, NULL, FALSE)")
     if err != nil {
         return "", fmt.Errorf("failed to prepare song insert for EnsureSongExists: %w", err)
     }
     defer stmt.Close()
 
-    _, err = stmt.Exec(s.ID, s.Title, s.Artist, s.Album, s.FilePath, s.CoverPath, s.IsLocal, s.JamendoID, s.Duration)
+    _, err = stmt.Exec(s.ID, s.Title, s.Artist, s.Album, s.FilePath, s.CoverPath, s.IsLocal, s.JamendoID, s.Duration, s.LicenseURL, s.LicenseType, s.ArtistURL, s.AttributionText)
     if err != nil {
         return "", fmt.Errorf("failed to insert new song for EnsureSongExists: %w", err)
     }
     return s.ID, nil
 }
 
+func (st *sqlStore) SetSongLicense(songID string, s Song) error {
+	res, err := st.db.Exec("UPDATE songs SET license_url = ?, license_type = ?, artist_url = ?, attribution = ? WHERE id = ?",
+		s.LicenseURL, s.LicenseType, s.ArtistURL, s.AttributionText, songID)
+	if err != nil {
+		return fmt.Errorf("failed to record song license: %w", err)
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return fmt.Errorf("song %s: %w", songID, errNotFound)
+	}
+	return nil
+}
 
-func LikeSong(userID int, songID string) error {
-	stmt, err := db.Prepare("INSERT IGNORE INTO user_liked_songs(user_id, song_id) VALUES(?, ?)")
+
+func (st *sqlStore) LikeSong(userID int, songID string) error {
+	stmt, err := st.db.Prepare(st.insertIgnore() + " INTO user_liked_songs(user_id, song_id) VALUES(?, ?)")
 	if err != nil {
 		return fmt.Errorf("failed to prepare like song statement: %w", err)
 	}
@@ -243,8 +343,8 @@ func LikeSong(userID int, songID string) error {
 	return nil
 }
 
-func UnlikeSong(userID int, songID string) error {
-	stmt, err := db.Prepare("DELETE FROM user_liked_songs WHERE user_id = ? AND song_id = ?")
+func (st *sqlStore) UnlikeSong(userID int, songID string) error {
+	stmt, err := st.db.Prepare("DELETE FROM user_liked_songs WHERE user_id = ? AND song_id = ?")
 	if err != nil {
 		return fmt.Errorf("failed to prepare unlike song statement: %w", err)
 	}
@@ -256,48 +356,127 @@ func UnlikeSong(userID int, songID string) error {
 	return nil
 }
 
-func DeleteUserUploadedSong(userID int, songID string) error {
-    // First, verify the user owns this song and it's an upload
-    var ownerID sql.NullInt64
-    var filePath sql.NullString
-    err := db.QueryRow("SELECT user_id, file_path FROM songs WHERE id = ? AND is_uploaded = TRUE", songID).Scan(&ownerID, &filePath)
-    if err != nil {
-        if err == sql.ErrNoRows {
-            return fmt.Errorf("song not found or not an uploaded song")
-        }
-        return fmt.Errorf("error checking song ownership: %w", err)
-    }
-    if !ownerID.Valid || ownerID.Int64 != int64(userID) {
-        return fmt.Errorf("user does not own this song or invalid owner ID")
-    }
+func (st *sqlStore) DeleteUserUploadedSong(userID int, songID string) (*Song, error) {
+	tx, err := st.db.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
 
-    tx, err := db.Begin()
-    if err != nil {
-        return fmt.Errorf("failed to begin transaction: %w", err)
-    }
+	// First, verify the user owns this song and it's an upload
+	song, err := scanSong(tx.QueryRow("SELECT "+songColumns+" FROM songs s WHERE s.id = ? AND s.is_uploaded = TRUE"+st.forUpdate(), songID))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, fmt.Errorf("song not found or not an uploaded song")
+		}
+		return nil, fmt.Errorf("error checking song ownership: %w", err)
+	}
+	if song.UserID == nil || *song.UserID != userID {
+		return nil, fmt.Errorf("user does not own this song or invalid owner ID")
+	}
 
-    // Delete from user_liked_songs first (referential integrity)
-    _, err = tx.Exec("DELETE FROM user_liked_songs WHERE song_id = ?", songID)
-    if err != nil {
-        tx.Rollback()
-        return fmt.Errorf("failed to delete likes for song: %w", err)
-    }
+	// Delete from user_liked_songs first (referential integrity)
+	if _, err := tx.Exec("DELETE FROM user_liked_songs WHERE song_id = ?", songID); err != nil {
+		return nil, fmt.Errorf("failed to delete likes for song: %w", err)
+	}
+	// Then delete from songs table
+	if _, err := tx.Exec("DELETE FROM songs WHERE id = ? AND user_id = ?", songID, userID); err != nil {
+		return nil, fmt.Errorf("failed to delete song from songs table: %w", err)
+	}
+	// Drop the song's reference on its blob; the last one removes the row.
+	if song.BlobSHA256 != "" {
+		if _, err := tx.Exec("UPDATE blobs SET ref_count = ref_count - 1 WHERE sha256 = ?", song.BlobSHA256); err != nil {
+			return nil, fmt.Errorf("failed to release blob: %w", err)
+		}
+		if _, err := tx.Exec("DELETE FROM blobs WHERE sha256 = ? AND ref_count <= 0", song.BlobSHA256); err != nil {
+			return nil, fmt.Errorf("failed to delete blob: %w", err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return &song, nil
+}
 
-    // Then delete from songs table
-    _, err = tx.Exec("DELETE FROM songs WHERE id = ? AND user_id = ?", songID, userID)
-    if err != nil {
-        tx.Rollback()
-        return fmt.Errorf("failed to delete song from songs table: %w", err)
-    }
+func (st *sqlStore) CoverInUse(coverPath string) (bool, error) {
+	var n int
+	if err := st.db.QueryRow("SELECT COUNT(*) FROM songs WHERE cover_path = ?", coverPath).Scan(&n); err != nil {
+		return false, fmt.Errorf("failed to query cover references: %w", err)
+	}
+	return n > 0, nil
+}
 
-    if err := tx.Commit(); err != nil {
-        return fmt.Errorf("failed to commit transaction: %w", err)
-    }
+func (st *sqlStore) BlobInUse(sha256 string) (bool, error) {
+	var n int
+	if err := st.db.QueryRow("SELECT COUNT(*) FROM blobs WHERE sha256 = ? AND ref_count > 0", sha256).Scan(&n); err != nil {
+		return false, fmt.Errorf("failed to query blob references: %w", err)
+	}
+	return n > 0, nil
+}
+
+func (st *sqlStore) ListUploadedSongs() ([]Song, error) {
+	rows, err := st.db.Query("SELECT " + songColumns + " FROM songs s WHERE s.is_uploaded = TRUE ORDER BY s.id")
+	if err != nil {
+		return nil, fmt.Errorf("failed to query uploaded songs: %w", err)
+	}
+	defer rows.Close()
+	songs := []Song{}
+	for rows.Next() {
+		s, err := scanSong(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan uploaded song: %w", err)
+		}
+		songs = append(songs, s)
+	}
+	return songs, rows.Err()
+}
+
+// songColumns lists the songs columns read by scanSong, in order. Queries
+// alias the songs table as s.
+const songColumns = "s.id, s.user_id, s.title, s.artist, s.album, s.file_path, s.cover_path, s.is_local, s.is_uploaded, s.jamendo_id, s.duration, " +
+	"s.genre, s.release_year, s.track_number, s.disc_number, s.codec, s.bitrate, s.sample_rate, s.channels, s.duration_ms, s.mime_type, s.original_mime_type, s.storage_path, s.file_size, s.blob_sha256, " +
+	"s.loudness_status, s.loudness_source, s.loudness_lufs, s.true_peak_dbtp, s.track_gain_db, s.track_peak, s.album_gain_db, s.album_peak, s.album_gain_tagged, " +
+	"s.license_url, s.license_type, s.artist_url, s.attribution"
 
-    // Optionally, delete the actual file from disk
-    // if filePath.Valid && filePath.String != "" {
-    //     // Construct full path carefully and delete os.Remove(fullPath)
-    //     log.Info().Str("filePath", filePath.String).Msg("Physical file deletion would happen here")
-    // }
-    return nil
-}
\ No newline at end of file
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// scanSong scans songColumns into a Song. Any extra destinations are scanned
+// from the columns selected after songColumns.
+func scanSong(row rowScanner, extra ...interface{}) (Song, error) {
+	var s Song
+	var userID sql.NullInt64
+	var l Loudness
+	var truePeak sql.NullFloat64
+	dest := []interface{}{&s.ID, &userID, &s.Title, &s.Artist, &s.Album, &s.FilePath, &s.CoverPath, &s.IsLocal, &s.IsUploaded, &s.JamendoID, &s.Duration,
+		&s.Genre, &s.Year, &s.TrackNumber, &s.DiscNumber, &s.Codec, &s.Bitrate, &s.SampleRate, &s.Channels, &s.DurationMs, &s.MimeType, &s.OriginalMimeType, &s.StoragePath, &s.FileSize, &s.BlobSHA256,
+		&s.LoudnessStatus, &l.Source, &l.IntegratedLUFS, &truePeak, &l.TrackGainDB, &l.TrackPeak, &l.AlbumGainDB, &l.AlbumPeak, &l.AlbumFromTags,
+		&s.LicenseURL, &s.LicenseType, &s.ArtistURL, &s.AttributionText}
+	err := row.Scan(append(dest, extra...)...)
+	if err != nil {
+		return Song{}, err
+	}
+	if userID.Valid {
+		uid := int(userID.Int64)
+		s.UserID = &uid
+	}
+	if s.LoudnessStatus == loudnessDone {
+		if truePeak.Valid {
+			l.TruePeakDBTP = &truePeak.Float64
+		}
+		s.Loudness = &l
+	}
+	return s, nil
+}
+
+func (st *sqlStore) GetSong(songID string) (*Song, error) {
+	s, err := scanSong(st.db.QueryRow("SELECT "+songColumns+" FROM songs s WHERE s.id = ?", songID))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, fmt.Errorf("song %s: %w", songID, errNotFound)
+		}
+		return nil, fmt.Errorf("failed to query song: %w", err)
+	}
+	return &s, nil
+}
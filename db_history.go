@@ -0,0 +1,90 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+)
+
+func (st *sqlStore) RecordPlay(userID int, ev PlayEvent) (*PlayEvent, error) {
+	ev.StartedAt = ev.StartedAt.UTC().Truncate(time.Millisecond)
+	res, err := st.db.Exec("INSERT INTO play_events(user_id, song_id, started_at, ms_listened, completed, skipped) VALUES(?, ?, ?, ?, ?, ?)",
+		userID, ev.SongID, ev.StartedAt, ev.MsListened, ev.Completed, ev.Skipped)
+	if err != nil {
+		return nil, fmt.Errorf("failed to insert play event: %w", err)
+	}
+	if ev.ID, err = res.LastInsertId(); err != nil {
+		return nil, fmt.Errorf("failed to read play event id: %w", err)
+	}
+	return &ev, nil
+}
+
+func (st *sqlStore) ListPlays(userID int, q HistoryQuery) ([]PlayEvent, error) {
+	where := []string{"p.user_id = ?"}
+	args := []interface{}{userID}
+	if !q.After.IsZero() {
+		where = append(where, "p.started_at >= ?")
+		args = append(args, q.After.UTC())
+	}
+	if !q.Before.IsZero() {
+		before := q.Before.UTC()
+		if q.BeforeID > 0 {
+			where = append(where, "(p.started_at < ? OR (p.started_at = ? AND p.id < ?))")
+			args = append(args, before, before, q.BeforeID)
+		} else {
+			where = append(where, "p.started_at < ?")
+			args = append(args, before)
+		}
+	}
+	args = append(args, q.Limit)
+
+	rows, err := st.db.Query(`
+		SELECT `+songColumns+`, p.id, p.started_at, p.ms_listened, p.completed, p.skipped
+		FROM play_events p
+		JOIN songs s ON s.id = p.song_id
+		WHERE `+strings.Join(where, " AND ")+`
+		ORDER BY p.started_at DESC, p.id DESC
+		LIMIT ?`, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query play history: %w", err)
+	}
+	defer rows.Close()
+	plays := []PlayEvent{}
+	for rows.Next() {
+		var ev PlayEvent
+		song, err := scanSong(rows, &ev.ID, &ev.StartedAt, &ev.MsListened, &ev.Completed, &ev.Skipped)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan play event: %w", err)
+		}
+		ev.SongID, ev.Song = song.ID, &song
+		plays = append(plays, ev)
+	}
+	return plays, rows.Err()
+}
+
+func (st *sqlStore) GetHistoryPaused(userID int) (bool, error) {
+	var paused bool
+	err := st.db.QueryRow("SELECT history_paused FROM users WHERE id = ?", userID).Scan(&paused)
+	if err == sql.ErrNoRows {
+		return false, fmt.Errorf("user %d: %w", userID, errNotFound)
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to query history setting: %w", err)
+	}
+	return paused, nil
+}
+
+func (st *sqlStore) SetHistoryPaused(userID int, paused bool) error {
+	res, err := st.db.Exec("UPDATE users SET history_paused = ? WHERE id = ?", paused, userID)
+	if err != nil {
+		return fmt.Errorf("failed to update history setting: %w", err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		// MySQL reports 0 affected rows when the value is unchanged, so check the user exists.
+		if _, err := st.GetHistoryPaused(userID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
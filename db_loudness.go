@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+)
+
+// loudnessValues are the values of the loudness columns after
+// loudness_status, in songColumns order, for l or for a song not yet
+// analysed.
+func loudnessValues(l *Loudness) []interface{} {
+	if l == nil {
+		return []interface{}{"", 0.0, nil, 0.0, 0.0, 0.0, 0.0, false}
+	}
+	return []interface{}{l.Source, l.IntegratedLUFS, l.TruePeakDBTP, l.TrackGainDB, l.TrackPeak, l.AlbumGainDB, l.AlbumPeak, l.AlbumFromTags}
+}
+
+func (st *sqlStore) ListPendingLoudness() ([]Song, error) {
+	rows, err := st.db.Query("SELECT "+songColumns+" FROM songs s WHERE s.is_uploaded = TRUE AND s.loudness_status = ? ORDER BY s.id", loudnessPending)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query songs pending loudness analysis: %w", err)
+	}
+	defer rows.Close()
+	songs := []Song{}
+	for rows.Next() {
+		s, err := scanSong(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan song: %w", err)
+		}
+		songs = append(songs, s)
+	}
+	return songs, rows.Err()
+}
+
+func (st *sqlStore) SetSongLoudness(songID, status string, l *Loudness) error {
+	res, err := st.db.Exec(`UPDATE songs SET loudness_status = ?, loudness_source = ?, loudness_lufs = ?, true_peak_dbtp = ?,
+			track_gain_db = ?, track_peak = ?, album_gain_db = ?, album_peak = ?, album_gain_tagged = ?
+		WHERE id = ?`, append(append([]interface{}{status}, loudnessValues(l)...), songID)...)
+	if err != nil {
+		return fmt.Errorf("failed to update song loudness: %w", err)
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return fmt.Errorf("song %s: %w", songID, errNotFound)
+	}
+	return nil
+}
+
+func (st *sqlStore) ListAlbumUploads(userID int, album string) ([]Song, error) {
+	rows, err := st.db.Query("SELECT "+songColumns+" FROM songs s WHERE s.user_id = ? AND s.is_uploaded = TRUE AND s.album = ? ORDER BY s.id", userID, album)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query album uploads: %w", err)
+	}
+	defer rows.Close()
+	songs := []Song{}
+	for rows.Next() {
+		s, err := scanSong(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan song: %w", err)
+		}
+		songs = append(songs, s)
+	}
+	return songs, rows.Err()
+}
+
+func (st *sqlStore) SetAlbumGain(songID string, gainDB, peak float64) error {
+	res, err := st.db.Exec("UPDATE songs SET album_gain_db = ?, album_peak = ? WHERE id = ? AND loudness_status = ?", gainDB, peak, songID, loudnessDone)
+	if err != nil {
+		return fmt.Errorf("failed to update album gain: %w", err)
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return fmt.Errorf("song %s: %w", songID, errNotFound)
+	}
+	return nil
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+const offlineTrackColumns = "o.jamendo_id, o.song_id, o.status, o.download_url, o.storage_path, o.mime_type, o.size, o.attempts, o.error, o.created_at, o.updated_at"
+
+func scanOfflineTrack(row rowScanner, extra ...interface{}) (OfflineTrack, error) {
+	var t OfflineTrack
+	dest := []interface{}{&t.JamendoID, &t.SongID, &t.Status, &t.DownloadURL, &t.StoragePath, &t.MimeType, &t.Size, &t.Attempts, &t.Error, &t.CreatedAt, &t.UpdatedAt}
+	if err := row.Scan(append(dest, extra...)...); err != nil {
+		return OfflineTrack{}, err
+	}
+	return t, nil
+}
+
+func (st *sqlStore) queryOfflineTracks(query string, args ...interface{}) ([]OfflineTrack, error) {
+	rows, err := st.db.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query offline tracks: %w", err)
+	}
+	defer rows.Close()
+	tracks := []OfflineTrack{}
+	for rows.Next() {
+		t, err := scanOfflineTrack(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan offline track: %w", err)
+		}
+		tracks = append(tracks, t)
+	}
+	return tracks, rows.Err()
+}
+
+func (st *sqlStore) AddOfflineTrack(userID int, t OfflineTrack) (*OfflineTrack, error) {
+	tx, err := st.db.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	now := time.Now().UTC().Truncate(time.Millisecond)
+	existing, err := scanOfflineTrack(tx.QueryRow("SELECT "+offlineTrackColumns+" FROM offline_tracks o WHERE o.jamendo_id = ?"+st.forUpdate(), t.JamendoID))
+	switch {
+	case err == sql.ErrNoRows:
+		t.Status, t.StoragePath, t.MimeType, t.Size, t.Attempts, t.Error = offlineQueued, "", "", 0, 0, ""
+		t.CreatedAt, t.UpdatedAt = now, now
+		_, err = tx.Exec("INSERT INTO offline_tracks(jamendo_id, song_id, status, download_url, created_at, updated_at) VALUES(?, ?, ?, ?, ?, ?)",
+			t.JamendoID, t.SongID, t.Status, t.DownloadURL, now, now)
+		if err != nil {
+			return nil, fmt.Errorf("failed to insert offline track: %w", err)
+		}
+	case err != nil:
+		return nil, fmt.Errorf("failed to query offline track: %w", err)
+	case existing.Status == offlineFailed:
+		existing.Status, existing.Attempts, existing.Error, existing.UpdatedAt = offlineQueued, 0, "", now
+		if _, err := tx.Exec("UPDATE offline_tracks SET status = ?, attempts = 0, error = '', updated_at = ? WHERE jamendo_id = ?", offlineQueued, now, t.JamendoID); err != nil {
+			return nil, fmt.Errorf("failed to requeue offline track: %w", err)
+		}
+		t = existing
+	default:
+		t = existing
+	}
+	if _, err := tx.Exec(st.insertIgnore()+" INTO user_offline_tracks(user_id, jamendo_id, saved_at) VALUES(?, ?, ?)", userID, t.JamendoID, now); err != nil {
+		return nil, fmt.Errorf("failed to save offline track: %w", err)
+	}
+	if err := tx.QueryRow("SELECT saved_at FROM user_offline_tracks WHERE user_id = ? AND jamendo_id = ?", userID, t.JamendoID).Scan(&t.SavedAt); err != nil {
+		return nil, fmt.Errorf("failed to query offline save: %w", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return &t, nil
+}
+
+func (st *sqlStore) GetOfflineTrack(jamendoID string) (*OfflineTrack, error) {
+	t, err := scanOfflineTrack(st.db.QueryRow("SELECT "+offlineTrackColumns+" FROM offline_tracks o WHERE o.jamendo_id = ?", jamendoID))
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("offline track %s: %w", jamendoID, errNotFound)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to query offline track: %w", err)
+	}
+	return &t, nil
+}
+
+func (st *sqlStore) ListOfflineTracks(userID int) ([]OfflineTrack, error) {
+	rows, err := st.db.Query("SELECT "+offlineTrackColumns+", u.saved_at FROM offline_tracks o JOIN user_offline_tracks u ON u.jamendo_id = o.jamendo_id WHERE u.user_id = ? ORDER BY u.saved_at DESC, o.jamendo_id", userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query offline tracks: %w", err)
+	}
+	defer rows.Close()
+	tracks := []OfflineTrack{}
+	for rows.Next() {
+		var savedAt time.Time
+		t, err := scanOfflineTrack(rows, &savedAt)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan offline track: %w", err)
+		}
+		t.SavedAt = savedAt
+		tracks = append(tracks, t)
+	}
+	return tracks, rows.Err()
+}
+
+func (st *sqlStore) ListPendingOfflineTracks() ([]OfflineTrack, error) {
+	return st.queryOfflineTracks("SELECT "+offlineTrackColumns+" FROM offline_tracks o WHERE o.status IN (?, ?) ORDER BY o.created_at, o.jamendo_id", offlineQueued, offlineDownloading)
+}
+
+func (st *sqlStore) ListAllOfflineTracks() ([]OfflineTrack, error) {
+	return st.queryOfflineTracks("SELECT " + offlineTrackColumns + " FROM offline_tracks o ORDER BY o.jamendo_id")
+}
+
+func (st *sqlStore) UpdateOfflineTrack(t OfflineTrack) error {
+	tx, err := st.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec("UPDATE offline_tracks SET status = ?, storage_path = ?, mime_type = ?, size = ?, attempts = ?, error = ?, updated_at = ? WHERE jamendo_id = ?",
+		t.Status, t.StoragePath, t.MimeType, t.Size, t.Attempts, t.Error, time.Now().UTC().Truncate(time.Millisecond), t.JamendoID)
+	if err != nil {
+		return fmt.Errorf("failed to update offline track: %w", err)
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return fmt.Errorf("offline track %s: %w", t.JamendoID, errNotFound)
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return nil
+}
+
+func (st *sqlStore) RemoveOfflineTrack(userID int, jamendoID string) (*OfflineTrack, error) {
+	tx, err := st.db.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	t, err := scanOfflineTrack(tx.QueryRow("SELECT "+offlineTrackColumns+" FROM offline_tracks o WHERE o.jamendo_id = ?"+st.forUpdate(), jamendoID))
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("offline track %s: %w", jamendoID, errNotFound)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to query offline track: %w", err)
+	}
+	res, err := tx.Exec("DELETE FROM user_offline_tracks WHERE user_id = ? AND jamendo_id = ?", userID, jamendoID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to remove offline save: %w", err)
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return nil, fmt.Errorf("offline track %s: %w", jamendoID, errNotFound)
+	}
+	var others int
+	if err := tx.QueryRow("SELECT COUNT(*) FROM user_offline_tracks WHERE jamendo_id = ?", jamendoID).Scan(&others); err != nil {
+		return nil, fmt.Errorf("failed to count offline saves: %w", err)
+	}
+	if others > 0 {
+		return nil, tx.Commit()
+	}
+	if _, err := tx.Exec("DELETE FROM offline_tracks WHERE jamendo_id = ?", jamendoID); err != nil {
+		return nil, fmt.Errorf("failed to delete offline track: %w", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return &t, nil
+}
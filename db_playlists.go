@@ -0,0 +1,195 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+func (st *sqlStore) CreatePlaylist(userID int, name string) (*Playlist, error) {
+	res, err := st.db.Exec("INSERT INTO playlists(user_id, name) VALUES(?, ?)", userID, name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to insert playlist: %w", err)
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read new playlist id: %w", err)
+	}
+	return st.GetPlaylist(userID, int(id))
+}
+
+func (st *sqlStore) ListPlaylists(userID int) ([]Playlist, error) {
+	rows, err := st.db.Query(`
+		SELECT p.id, p.user_id, p.name, p.created_at, p.updated_at, COUNT(ps.id)
+		FROM playlists p
+		LEFT JOIN playlist_songs ps ON ps.playlist_id = p.id
+		WHERE p.user_id = ?
+		GROUP BY p.id, p.user_id, p.name, p.created_at, p.updated_at
+		ORDER BY p.created_at, p.id`, userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query playlists: %w", err)
+	}
+	defer rows.Close()
+	playlists := []Playlist{}
+	for rows.Next() {
+		var p Playlist
+		if err := rows.Scan(&p.ID, &p.UserID, &p.Name, &p.CreatedAt, &p.UpdatedAt, &p.TrackCount); err != nil {
+			return nil, fmt.Errorf("failed to scan playlist: %w", err)
+		}
+		playlists = append(playlists, p)
+	}
+	return playlists, rows.Err()
+}
+
+func (st *sqlStore) GetPlaylist(userID, playlistID int) (*Playlist, error) {
+	p := &Playlist{}
+	err := st.db.QueryRow("SELECT id, user_id, name, created_at, updated_at FROM playlists WHERE id = ? AND user_id = ?", playlistID, userID).
+		Scan(&p.ID, &p.UserID, &p.Name, &p.CreatedAt, &p.UpdatedAt)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, fmt.Errorf("playlist %d: %w", playlistID, errNotFound)
+		}
+		return nil, fmt.Errorf("failed to query playlist: %w", err)
+	}
+
+	rows, err := st.db.Query(`
+		SELECT `+songColumns+`, ps.added_at
+		FROM playlist_songs ps
+		JOIN songs s ON s.id = ps.song_id
+		WHERE ps.playlist_id = ?
+		ORDER BY ps.position, ps.id`, playlistID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query playlist tracks: %w", err)
+	}
+	defer rows.Close()
+	p.Tracks = []PlaylistTrack{}
+	for rows.Next() {
+		track := PlaylistTrack{Position: len(p.Tracks)}
+		track.Song, err = scanSong(rows, &track.AddedAt)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan playlist track: %w", err)
+		}
+		p.Tracks = append(p.Tracks, track)
+	}
+	p.TrackCount = len(p.Tracks)
+	return p, rows.Err()
+}
+
+func (st *sqlStore) RenamePlaylist(userID, playlistID int, name string) error {
+	res, err := st.db.Exec("UPDATE playlists SET name = ?, updated_at = CURRENT_TIMESTAMP WHERE id = ? AND user_id = ?", name, playlistID, userID)
+	if err != nil {
+		return fmt.Errorf("failed to rename playlist: %w", err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return fmt.Errorf("playlist %d: %w", playlistID, errNotFound)
+	}
+	return nil
+}
+
+func (st *sqlStore) DeletePlaylist(userID, playlistID int) error {
+	res, err := st.db.Exec("DELETE FROM playlists WHERE id = ? AND user_id = ?", playlistID, userID)
+	if err != nil {
+		return fmt.Errorf("failed to delete playlist: %w", err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return fmt.Errorf("playlist %d: %w", playlistID, errNotFound)
+	}
+	return nil
+}
+
+func (st *sqlStore) AddPlaylistTrack(userID, playlistID int, songID string, position int) error {
+	return st.editPlaylistTracks(userID, playlistID, func(tx *sql.Tx, rowIDs []int64) ([]int64, error) {
+		res, err := tx.Exec("INSERT INTO playlist_songs(playlist_id, song_id, position) VALUES(?, ?, ?)", playlistID, songID, len(rowIDs))
+		if err != nil {
+			return nil, fmt.Errorf("failed to insert playlist track: %w", err)
+		}
+		newID, err := res.LastInsertId()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read playlist track id: %w", err)
+		}
+		rowIDs, _ = insertIndex(rowIDs, newID, position)
+		return rowIDs, nil
+	})
+}
+
+func (st *sqlStore) RemovePlaylistTrack(userID, playlistID, position int) error {
+	return st.editPlaylistTracks(userID, playlistID, func(tx *sql.Tx, rowIDs []int64) ([]int64, error) {
+		if position < 0 || position >= len(rowIDs) {
+			return nil, fmt.Errorf("remove %d: %w", position, errOutOfRange)
+		}
+		if _, err := tx.Exec("DELETE FROM playlist_songs WHERE id = ?", rowIDs[position]); err != nil {
+			return nil, fmt.Errorf("failed to delete playlist track: %w", err)
+		}
+		return append(rowIDs[:position], rowIDs[position+1:]...), nil
+	})
+}
+
+func (st *sqlStore) MovePlaylistTrack(userID, playlistID, from, to int) error {
+	return st.editPlaylistTracks(userID, playlistID, func(tx *sql.Tx, rowIDs []int64) ([]int64, error) {
+		if from < 0 || from >= len(rowIDs) || to < 0 || to >= len(rowIDs) {
+			return nil, fmt.Errorf("move %d to %d: %w", from, to, errOutOfRange)
+		}
+		return moveIndex(rowIDs, from, to), nil
+	})
+}
+
+// editPlaylistTracks runs edit inside a transaction with the playlist's
+// playlist_songs row IDs in their current order, then renumbers positions to
+// match the order edit returns. Positions therefore stay contiguous from 0
+// even after songs are deleted out from under the playlist.
+func (st *sqlStore) editPlaylistTracks(userID, playlistID int, edit func(tx *sql.Tx, rowIDs []int64) ([]int64, error)) error {
+	tx, err := st.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	var id int
+	err = tx.QueryRow("SELECT id FROM playlists WHERE id = ? AND user_id = ?"+st.forUpdate(), playlistID, userID).Scan(&id)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return fmt.Errorf("playlist %d: %w", playlistID, errNotFound)
+		}
+		return fmt.Errorf("failed to query playlist: %w", err)
+	}
+
+	rows, err := tx.Query("SELECT id, position FROM playlist_songs WHERE playlist_id = ? ORDER BY position, id", playlistID)
+	if err != nil {
+		return fmt.Errorf("failed to query playlist tracks: %w", err)
+	}
+	var rowIDs []int64
+	oldPositions := make(map[int64]int)
+	for rows.Next() {
+		var rowID int64
+		var position int
+		if err := rows.Scan(&rowID, &position); err != nil {
+			rows.Close()
+			return fmt.Errorf("failed to scan playlist track: %w", err)
+		}
+		rowIDs = append(rowIDs, rowID)
+		oldPositions[rowID] = position
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("failed to read playlist tracks: %w", err)
+	}
+
+	rowIDs, err = edit(tx, rowIDs)
+	if err != nil {
+		return err
+	}
+	for position, rowID := range rowIDs {
+		if old, ok := oldPositions[rowID]; ok && old == position {
+			continue
+		}
+		if _, err := tx.Exec("UPDATE playlist_songs SET position = ? WHERE id = ?", position, rowID); err != nil {
+			return fmt.Errorf("failed to reorder playlist tracks: %w", err)
+		}
+	}
+	if _, err := tx.Exec("UPDATE playlists SET updated_at = CURRENT_TIMESTAMP WHERE id = ?", playlistID); err != nil {
+		return fmt.Errorf("failed to touch playlist: %w", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return nil
+}
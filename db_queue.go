@@ -0,0 +1,84 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+func (st *sqlStore) GetQueue(userID int) (*PlayQueue, error) {
+	q := &PlayQueue{Songs: []Song{}, CurrentIndex: -1}
+	err := st.db.QueryRow("SELECT current_index, position_ms, version, updated_at FROM play_queues WHERE user_id = ?", userID).
+		Scan(&q.CurrentIndex, &q.PositionMs, &q.Version, &q.UpdatedAt)
+	if err == sql.ErrNoRows {
+		return q, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to query play queue: %w", err)
+	}
+
+	rows, err := st.db.Query(`
+		SELECT `+songColumns+`
+		FROM play_queue_songs q
+		JOIN songs s ON s.id = q.song_id
+		WHERE q.user_id = ?
+		ORDER BY q.position`, userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query play queue songs: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		s, err := scanSong(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan play queue song: %w", err)
+		}
+		q.Songs = append(q.Songs, s)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read play queue songs: %w", err)
+	}
+	q.normalize()
+	return q, nil
+}
+
+func (st *sqlStore) SaveQueue(userID int, q *PlayQueue) error {
+	tx, err := st.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	var version int
+	err = tx.QueryRow("SELECT version FROM play_queues WHERE user_id = ?"+st.forUpdate(), userID).Scan(&version)
+	switch {
+	case err == sql.ErrNoRows:
+		if q.Version != 0 {
+			return fmt.Errorf("play queue: %w", errConflict)
+		}
+		_, err = tx.Exec("INSERT INTO play_queues(user_id, current_index, position_ms, version) VALUES(?, ?, ?, 1)", userID, q.CurrentIndex, q.PositionMs)
+	case err != nil:
+		return fmt.Errorf("failed to query play queue: %w", err)
+	case version != q.Version:
+		return fmt.Errorf("play queue: %w", errConflict)
+	default:
+		_, err = tx.Exec("UPDATE play_queues SET current_index = ?, position_ms = ?, version = version + 1, updated_at = CURRENT_TIMESTAMP WHERE user_id = ?", q.CurrentIndex, q.PositionMs, userID)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to save play queue: %w", err)
+	}
+
+	if _, err := tx.Exec("DELETE FROM play_queue_songs WHERE user_id = ?", userID); err != nil {
+		return fmt.Errorf("failed to clear play queue songs: %w", err)
+	}
+	for position, s := range q.Songs {
+		if _, err := tx.Exec("INSERT INTO play_queue_songs(user_id, position, song_id) VALUES(?, ?, ?)", userID, position, s.ID); err != nil {
+			return fmt.Errorf("failed to insert play queue song: %w", err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	q.Version++
+	q.UpdatedAt = time.Now()
+	return nil
+}
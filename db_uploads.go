@@ -0,0 +1,141 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const uploadSessionColumns = "id, user_id, upload_length, upload_offset, metadata, song_id, created_at, expires_at"
+
+func scanUploadSession(row rowScanner) (UploadSession, error) {
+	var u UploadSession
+	var songID sql.NullString
+	if err := row.Scan(&u.ID, &u.UserID, &u.Length, &u.Offset, &u.Metadata, &songID, &u.CreatedAt, &u.ExpiresAt); err != nil {
+		return UploadSession{}, err
+	}
+	if songID.Valid {
+		u.SongID = &songID.String
+	}
+	return u, nil
+}
+
+func (st *sqlStore) CreateUploadSession(userID int, length int64, metadata string, expiresAt time.Time) (*UploadSession, error) {
+	u := UploadSession{
+		ID: uuid.New().String(), UserID: userID, Length: length, Metadata: metadata,
+		CreatedAt: time.Now().UTC().Truncate(time.Millisecond), ExpiresAt: expiresAt.UTC().Truncate(time.Millisecond),
+	}
+	_, err := st.db.Exec("INSERT INTO upload_sessions(id, user_id, upload_length, upload_offset, metadata, created_at, expires_at) VALUES(?, ?, ?, 0, ?, ?, ?)",
+		u.ID, userID, length, metadata, u.CreatedAt, u.ExpiresAt)
+	if err != nil {
+		return nil, fmt.Errorf("failed to insert upload session: %w", err)
+	}
+	return &u, nil
+}
+
+func (st *sqlStore) GetUploadSession(userID int, sessionID string) (*UploadSession, error) {
+	row := st.db.QueryRow("SELECT "+uploadSessionColumns+" FROM upload_sessions WHERE id = ? AND user_id = ?", sessionID, userID)
+	u, err := scanUploadSession(row)
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("upload %s: %w", sessionID, errNotFound)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to query upload session: %w", err)
+	}
+	return &u, nil
+}
+
+func (st *sqlStore) ListUploadSessions(userID int) ([]UploadSession, error) {
+	rows, err := st.db.Query("SELECT "+uploadSessionColumns+" FROM upload_sessions WHERE user_id = ? AND song_id IS NULL ORDER BY created_at, id", userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query upload sessions: %w", err)
+	}
+	defer rows.Close()
+	sessions := []UploadSession{}
+	for rows.Next() {
+		u, err := scanUploadSession(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan upload session: %w", err)
+		}
+		sessions = append(sessions, u)
+	}
+	return sessions, rows.Err()
+}
+
+func (st *sqlStore) AdvanceUploadSession(userID int, sessionID string, from, to int64, expiresAt time.Time) error {
+	res, err := st.db.Exec("UPDATE upload_sessions SET upload_offset = ?, expires_at = ? WHERE id = ? AND user_id = ? AND upload_offset = ? AND song_id IS NULL",
+		to, expiresAt.UTC().Truncate(time.Millisecond), sessionID, userID, from)
+	if err != nil {
+		return fmt.Errorf("failed to update upload session: %w", err)
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return fmt.Errorf("failed to update upload session: %w", err)
+	} else if n == 0 {
+		if _, err := st.GetUploadSession(userID, sessionID); err != nil {
+			return err
+		}
+		return fmt.Errorf("upload %s: %w", sessionID, errConflict)
+	}
+	return nil
+}
+
+func (st *sqlStore) CompleteUploadSession(userID int, sessionID, songID string, expiresAt time.Time) error {
+	res, err := st.db.Exec("UPDATE upload_sessions SET song_id = ?, expires_at = ? WHERE id = ? AND user_id = ?",
+		songID, expiresAt.UTC().Truncate(time.Millisecond), sessionID, userID)
+	if err != nil {
+		return fmt.Errorf("failed to complete upload session: %w", err)
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return fmt.Errorf("upload %s: %w", sessionID, errNotFound)
+	}
+	return nil
+}
+
+func (st *sqlStore) DeleteUploadSession(userID int, sessionID string) error {
+	res, err := st.db.Exec("DELETE FROM upload_sessions WHERE id = ? AND user_id = ?", sessionID, userID)
+	if err != nil {
+		return fmt.Errorf("failed to delete upload session: %w", err)
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return fmt.Errorf("upload %s: %w", sessionID, errNotFound)
+	}
+	return nil
+}
+
+func (st *sqlStore) DeleteExpiredUploadSessions(now time.Time) ([]UploadSession, error) {
+	tx, err := st.db.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	now = now.UTC()
+	rows, err := tx.Query("SELECT "+uploadSessionColumns+" FROM upload_sessions WHERE expires_at < ?"+st.forUpdate(), now)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query expired upload sessions: %w", err)
+	}
+	var expired []UploadSession
+	for rows.Next() {
+		u, err := scanUploadSession(rows)
+		if err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("failed to scan upload session: %w", err)
+		}
+		expired = append(expired, u)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read expired upload sessions: %w", err)
+	}
+	for _, u := range expired {
+		if _, err := tx.Exec("DELETE FROM upload_sessions WHERE id = ?", u.ID); err != nil {
+			return nil, fmt.Errorf("failed to delete upload session: %w", err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return expired, nil
+}
@@ -0,0 +1,414 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+
+	"github.com/hajimehoshi/go-mp3"
+	"github.com/jfreymuth/oggvorbis"
+	"github.com/mewkiz/flac"
+)
+
+// errNoDecoder is returned for formats (and codecs inside them) that the
+// server can read tags from but not decode, such as AAC, ALAC or Opus.
+var errNoDecoder = errors.New("no decoder for this audio")
+
+// pcmDecoder yields the audio of a file as interleaved float64 samples
+// scaled to [-1, 1].
+type pcmDecoder interface {
+	SampleRate() int
+	Channels() int
+	// Read fills buf with whole frames and returns the number of samples
+	// written, or io.EOF once the audio is exhausted.
+	Read(buf []float64) (int, error)
+}
+
+// newPCMDecoder opens r, a file in the given container format, for
+// decoding. channels is the channel count found by extractMetadata; it is
+// needed for MP3, whose decoder always produces stereo.
+//
+// The decoding libraries can panic on corrupt input that got past
+// extractMetadata. Those panics come back as errors, from here and from
+// Read, so one bad upload can't take the analysis worker down.
+func newPCMDecoder(r io.ReadSeeker, format string, channels int) (d pcmDecoder, err error) {
+	defer recoverDecoder(&err)
+	d, err = openPCMDecoder(r, format, channels)
+	if err != nil {
+		return nil, err
+	}
+	if _, ours := d.(*rawPCMDecoder); ours {
+		return d, nil // Our own WAV/AIFF reader, which openRawPCM needs unwrapped
+	}
+	return recoveringDecoder{d}, nil
+}
+
+// recoverDecoder turns a decoder panic into *err. It must be deferred.
+func recoverDecoder(err *error) {
+	if p := recover(); p != nil {
+		*err = fmt.Errorf("corrupt audio: decoder panicked: %v", p)
+	}
+}
+
+// recoveringDecoder reports panics in the wrapped decoder's Read as errors.
+type recoveringDecoder struct{ pcmDecoder }
+
+func (d recoveringDecoder) Read(buf []float64) (n int, err error) {
+	defer recoverDecoder(&err)
+	return d.pcmDecoder.Read(buf)
+}
+
+func openPCMDecoder(r io.ReadSeeker, format string, channels int) (pcmDecoder, error) {
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	switch format {
+	case formatMP3:
+		d, err := mp3.NewDecoder(r)
+		if err != nil {
+			return nil, fmt.Errorf("mp3: %w", err)
+		}
+		return &mp3Decoder{d: d, mono: channels == 1}, nil
+	case formatFLAC:
+		s, err := flac.New(r)
+		if err != nil {
+			return nil, fmt.Errorf("flac: %w", err)
+		}
+		return &flacDecoder{s: s}, nil
+	case formatOgg:
+		d, err := oggvorbis.NewReader(r)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", errNoDecoder, err) // Most likely Opus
+		}
+		return &vorbisDecoder{d: d}, nil
+	case formatWAV:
+		return newWAVDecoder(r)
+	case formatAIFF:
+		return newAIFFDecoder(r)
+	}
+	return nil, errNoDecoder
+}
+
+// mp3Decoder converts go-mp3's 16-bit little-endian stereo output, keeping
+// only the left channel of mono files (the decoder duplicates it).
+type mp3Decoder struct {
+	d    *mp3.Decoder
+	mono bool
+	raw  []byte
+}
+
+func (m *mp3Decoder) SampleRate() int { return m.d.SampleRate() }
+
+func (m *mp3Decoder) Channels() int {
+	if m.mono {
+		return 1
+	}
+	return 2
+}
+
+func (m *mp3Decoder) Read(buf []float64) (int, error) {
+	frames := len(buf) / m.Channels()
+	if cap(m.raw) < frames*4 {
+		m.raw = make([]byte, frames*4)
+	}
+	raw := m.raw[:frames*4]
+	n, err := io.ReadFull(m.d, raw)
+	if err == io.ErrUnexpectedEOF {
+		err = nil
+	}
+	frames = n / 4
+	if frames == 0 && err == nil {
+		err = io.EOF
+	}
+	out := 0
+	for i := 0; i < frames; i++ {
+		buf[out] = float64(int16(binary.LittleEndian.Uint16(raw[i*4:]))) / 32768
+		out++
+		if !m.mono {
+			buf[out] = float64(int16(binary.LittleEndian.Uint16(raw[i*4+2:]))) / 32768
+			out++
+		}
+	}
+	return out, err
+}
+
+// flacDecoder hands out FLAC frames, which the library has already
+// decorrelated into independent channels.
+type flacDecoder struct {
+	s       *flac.Stream
+	pending []float64 // Interleaved samples of the current frame not yet read
+}
+
+func (f *flacDecoder) SampleRate() int { return int(f.s.Info.SampleRate) }
+func (f *flacDecoder) Channels() int   { return int(f.s.Info.NChannels) }
+
+func (f *flacDecoder) Read(buf []float64) (int, error) {
+	if len(f.pending) == 0 {
+		frame, err := f.s.ParseNext()
+		if err != nil {
+			return 0, err
+		}
+		channels := len(frame.Subframes)
+		if channels != f.Channels() {
+			return 0, fmt.Errorf("flac: frame has %d channels, stream %d", channels, f.Channels())
+		}
+		scale := math.Ldexp(1, int(frame.BitsPerSample)-1)
+		n := int(frame.BlockSize)
+		samples := make([]float64, n*channels)
+		for ch, sub := range frame.Subframes {
+			for i := 0; i < n && i < len(sub.Samples); i++ {
+				samples[i*channels+ch] = float64(sub.Samples[i]) / scale
+			}
+		}
+		f.pending = samples
+	}
+	n := copy(buf[:len(buf)/f.Channels()*f.Channels()], f.pending)
+	f.pending = f.pending[n:]
+	return n, nil
+}
+
+type vorbisDecoder struct {
+	d   *oggvorbis.Reader
+	raw []float32
+}
+
+func (v *vorbisDecoder) SampleRate() int { return v.d.SampleRate() }
+func (v *vorbisDecoder) Channels() int   { return v.d.Channels() }
+
+func (v *vorbisDecoder) Read(buf []float64) (int, error) {
+	size := len(buf) / v.Channels() * v.Channels()
+	if cap(v.raw) < size {
+		v.raw = make([]float32, size)
+	}
+	n, err := v.d.Read(v.raw[:size])
+	for i := 0; i < n; i++ {
+		buf[i] = float64(v.raw[i])
+	}
+	if n > 0 && err == io.EOF {
+		err = nil
+	}
+	return n, err
+}
+
+// rawPCMDecoder reads the uncompressed samples of a WAV or AIFF file:
+// integer PCM of 8 to 32 bits, or 32- or 64-bit floats.
+type rawPCMDecoder struct {
+	r          io.Reader
+	float      bool
+	bigEndian  bool // AIFF, except AIFF-C "sowt"
+	unsigned   bool // 8-bit WAV samples are offset by 128
+	sampleRate int
+	channels   int
+	bytes      int // Per sample
+	raw        []byte
+}
+
+func newWAVDecoder(r io.ReadSeeker) (*rawPCMDecoder, error) {
+	if _, err := r.Seek(12, io.SeekStart); err != nil {
+		return nil, err
+	}
+	var formatTag uint16
+	d := &rawPCMDecoder{}
+	for {
+		header := make([]byte, 8)
+		if _, err := io.ReadFull(r, header); err != nil {
+			return nil, errors.New("wav: no data chunk")
+		}
+		length := int64(binary.LittleEndian.Uint32(header[4:]))
+		switch string(header[:4]) {
+		case "fmt ":
+			data, err := readBlock(r, length)
+			if err != nil {
+				return nil, err
+			}
+			if len(data) < 16 {
+				return nil, errors.New("wav: short fmt chunk")
+			}
+			formatTag = binary.LittleEndian.Uint16(data)
+			if formatTag == waveFormatExtensible && len(data) >= 26 {
+				formatTag = binary.LittleEndian.Uint16(data[24:])
+			}
+			d.channels = int(binary.LittleEndian.Uint16(data[2:]))
+			d.sampleRate = int(binary.LittleEndian.Uint32(data[4:]))
+			d.bytes = int(binary.LittleEndian.Uint16(data[14:])+7) / 8
+			if length%2 == 1 {
+				r.Seek(1, io.SeekCurrent)
+			}
+		case "data":
+			if d.channels == 0 {
+				return nil, errors.New("wav: data before fmt chunk")
+			}
+			switch {
+			case formatTag == waveFormatPCM && d.bytes >= 1 && d.bytes <= 4:
+				d.unsigned = d.bytes == 1
+			case formatTag == waveFormatIEEEFloat && (d.bytes == 4 || d.bytes == 8):
+				d.float = true
+			default:
+				return nil, fmt.Errorf("%w: WAVE format 0x%04x with %d-byte samples", errNoDecoder, formatTag, d.bytes)
+			}
+			d.r = r
+			if length != 0xFFFFFFFF {
+				d.r = io.LimitReader(r, length)
+			}
+			return d, nil
+		default:
+			if _, err := r.Seek(length+length%2, io.SeekCurrent); err != nil {
+				return nil, err
+			}
+		}
+	}
+}
+
+// newAIFFDecoder finds the COMM and SSND chunks, which AIFF allows in
+// either order.
+func newAIFFDecoder(r io.ReadSeeker) (*rawPCMDecoder, error) {
+	if _, err := r.Seek(12, io.SeekStart); err != nil {
+		return nil, err
+	}
+	var comm *aiffCommon
+	var dataStart, dataLength int64 = -1, 0
+	for comm == nil || dataStart < 0 {
+		header := make([]byte, 8)
+		if _, err := io.ReadFull(r, header); err != nil {
+			return nil, errors.New("aiff: missing COMM or SSND chunk")
+		}
+		length := int64(binary.BigEndian.Uint32(header[4:]))
+		switch string(header[:4]) {
+		case "COMM":
+			data, err := readBlock(r, length)
+			if err != nil {
+				return nil, err
+			}
+			if comm, err = parseAIFFCommon(data); err != nil {
+				return nil, err
+			}
+			if length%2 == 1 {
+				r.Seek(1, io.SeekCurrent)
+			}
+		case "SSND":
+			// The samples start offset bytes after the offset and block size.
+			var fields [8]byte
+			if _, err := io.ReadFull(r, fields[:]); err != nil {
+				return nil, err
+			}
+			offset := int64(binary.BigEndian.Uint32(fields[:]))
+			pos, err := r.Seek(offset, io.SeekCurrent)
+			if err != nil {
+				return nil, err
+			}
+			dataStart, dataLength = pos, length-8-offset
+			if _, err := r.Seek(dataLength+length%2, io.SeekCurrent); err != nil {
+				return nil, err
+			}
+		default:
+			if _, err := r.Seek(length+length%2, io.SeekCurrent); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	d := &rawPCMDecoder{sampleRate: comm.SampleRate, channels: comm.Channels, bytes: (comm.BitsPerSample + 7) / 8}
+	switch comm.Compression {
+	case "NONE", "twos":
+		d.bigEndian = true
+	case "sowt":
+	case "fl32", "FL32", "fl64", "FL64":
+		d.bigEndian, d.float = true, true
+		d.bytes = 4
+		if comm.Compression[2] == '6' {
+			d.bytes = 8
+		}
+	default:
+		return nil, fmt.Errorf("%w: AIFF-C compression %q", errNoDecoder, comm.Compression)
+	}
+	if d.channels == 0 || (!d.float && (d.bytes < 1 || d.bytes > 4)) {
+		return nil, fmt.Errorf("%w: AIFF with %d channels of %d bits", errNoDecoder, d.channels, comm.BitsPerSample)
+	}
+	if _, err := r.Seek(dataStart, io.SeekStart); err != nil {
+		return nil, err
+	}
+	d.r = io.LimitReader(r, max(0, dataLength))
+	return d, nil
+}
+
+func (d *rawPCMDecoder) SampleRate() int { return d.sampleRate }
+func (d *rawPCMDecoder) Channels() int   { return d.channels }
+
+// BitsPerSample is the width of the integer samples ReadInts returns.
+func (d *rawPCMDecoder) BitsPerSample() int { return 8 * d.bytes }
+
+// readRaw reads up to the bytes of samples samples, whole frames only, and
+// returns them with the number of samples they hold.
+func (d *rawPCMDecoder) readRaw(samples int) ([]byte, int, error) {
+	samples = samples / d.channels * d.channels
+	if cap(d.raw) < samples*d.bytes {
+		d.raw = make([]byte, samples*d.bytes)
+	}
+	raw := d.raw[:samples*d.bytes]
+	n, err := io.ReadFull(d.r, raw)
+	if err == io.ErrUnexpectedEOF {
+		err = nil
+	}
+	samples = n / d.bytes / d.channels * d.channels
+	if samples == 0 && err == nil {
+		err = io.EOF
+	}
+	return raw, samples, err
+}
+
+func (d *rawPCMDecoder) Read(buf []float64) (int, error) {
+	raw, samples, err := d.readRaw(len(buf))
+	scale := math.Ldexp(1, 8*d.bytes-1)
+	for i := 0; i < samples; i++ {
+		b := raw[i*d.bytes:]
+		switch {
+		case d.float && d.bytes == 4:
+			buf[i] = float64(math.Float32frombits(d.order().Uint32(b)))
+		case d.float:
+			buf[i] = math.Float64frombits(d.order().Uint64(b))
+		default:
+			buf[i] = float64(d.intSample(b)) / scale
+		}
+	}
+	return samples, err
+}
+
+// ReadInts is Read for integer PCM, giving the samples unscaled.
+func (d *rawPCMDecoder) ReadInts(buf []int32) (int, error) {
+	if d.float {
+		return 0, errors.New("floating-point samples have no integer form")
+	}
+	raw, samples, err := d.readRaw(len(buf))
+	for i := 0; i < samples; i++ {
+		buf[i] = d.intSample(raw[i*d.bytes:])
+	}
+	return samples, err
+}
+
+func (d *rawPCMDecoder) order() binary.ByteOrder {
+	if d.bigEndian {
+		return binary.BigEndian
+	}
+	return binary.LittleEndian
+}
+
+// intSample sign-extends the integer sample starting at b.
+func (d *rawPCMDecoder) intSample(b []byte) int32 {
+	if d.bytes == 1 && d.unsigned {
+		return int32(b[0]) - 128
+	}
+	if d.bigEndian {
+		v := int32(int8(b[0]))
+		for j := 1; j < d.bytes; j++ {
+			v = v<<8 | int32(b[j])
+		}
+		return v
+	}
+	v := int32(int8(b[d.bytes-1]))
+	for j := d.bytes - 2; j >= 0; j-- {
+		v = v<<8 | int32(b[j])
+	}
+	return v
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Defaults for EXPLORE_REFRESH and EXPLORE_GENRES, and how many tracks each
+// feed holds.
+const (
+	defaultExploreRefresh = time.Hour
+	exploreFeedSize       = 20
+	exploreRefreshTimeout = 2 * time.Minute
+	exploreRetryDelay     = jamendoBreakerCooldown // Before retrying a refresh that found nothing
+)
+
+var defaultExploreGenres = []string{"rock", "electronic", "pop", "hiphop", "jazz", "classical", "ambient", "folk"}
+
+// exploreFeed is one list on the Explore page. Genre is set for per-genre
+// top lists.
+type exploreFeed struct {
+	ID     string `json:"id"`
+	Title  string `json:"title"`
+	Kind   string `json:"kind"` // chart, featured or genre
+	Genre  string `json:"genre,omitempty"`
+	Tracks []Song `json:"tracks"`
+}
+
+// exploreSpec says how to fetch a feed from Jamendo.
+type exploreSpec struct {
+	feed  exploreFeed
+	query JamendoTrackQuery
+	extra map[string]string // Parameters JamendoTrackQuery has no field for
+}
+
+// exploreResponse is GET /api/explore.
+type exploreResponse struct {
+	Feeds       []exploreFeed `json:"feeds"`
+	UpdatedAt   time.Time     `json:"updatedAt"`
+	Attribution Attribution   `json:"attribution"`
+}
+
+// exploreFeeds holds the Explore page, rebuilt from Jamendo every interval
+// by runExploreRefresher rather than per request.
+type exploreFeeds struct {
+	genres []string
+
+	refreshMu sync.Mutex // Held while refreshing, so only one runs
+	mu        sync.RWMutex
+	current   *exploreResponse // nil until the first refresh
+}
+
+func newExploreFeeds(genres []string) *exploreFeeds {
+	return &exploreFeeds{genres: genres}
+}
+
+// explore is the feed set the handler serves. main configures it from the
+// environment.
+var explore = newExploreFeeds(defaultExploreGenres)
+
+// loadExploreConfig reads EXPLORE_GENRES (comma-separated) and
+// EXPLORE_REFRESH, how often the feeds are rebuilt (0 to build them once, on
+// first use).
+func loadExploreConfig() (*exploreFeeds, time.Duration) {
+	genres := defaultExploreGenres
+	if v := os.Getenv("EXPLORE_GENRES"); v != "" {
+		genres = nil
+		for _, g := range strings.Split(v, ",") {
+			if g = strings.ToLower(strings.TrimSpace(g)); g != "" && !containsString(genres, g) {
+				genres = append(genres, g)
+			}
+		}
+	}
+	interval := defaultExploreRefresh
+	if v := os.Getenv("EXPLORE_REFRESH"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 0 || (d > 0 && d < time.Minute) {
+			log.Fatal().Str("EXPLORE_REFRESH", v).Msg("EXPLORE_REFRESH must be a duration of at least 1m, or 0 to disable")
+		}
+		interval = d
+	}
+	return newExploreFeeds(genres), interval
+}
+
+// specs lists the feeds in the order they are shown.
+func (e *exploreFeeds) specs() []exploreSpec {
+	specs := []exploreSpec{
+		{feed: exploreFeed{ID: "trending-week", Title: "Trending this week", Kind: "chart"}, query: JamendoTrackQuery{Order: "popularity_week"}},
+		{feed: exploreFeed{ID: "trending-month", Title: "Top this month", Kind: "chart"}, query: JamendoTrackQuery{Order: "popularity_month"}},
+		{feed: exploreFeed{ID: "featured", Title: "Featured", Kind: "featured"}, query: JamendoTrackQuery{Order: "releasedate"}, extra: map[string]string{"featured": "1"}},
+	}
+	for _, genre := range e.genres {
+		specs = append(specs, exploreSpec{
+			feed:  exploreFeed{ID: "genre-" + genre, Title: "Top " + genre, Kind: "genre", Genre: genre},
+			query: JamendoTrackQuery{Tags: []string{genre}, Order: "popularity_month"},
+		})
+	}
+	return specs
+}
+
+// refresh rebuilds every feed. A feed whose call fails, or that Jamendo
+// only answers from the stale cache, keeps its previous tracks; it is left
+// out if it never had any.
+func (e *exploreFeeds) refresh(ctx context.Context, now time.Time) {
+	e.refreshMu.Lock()
+	defer e.refreshMu.Unlock()
+	e.refreshLocked(ctx, now)
+}
+
+func (e *exploreFeeds) refreshLocked(ctx context.Context, now time.Time) {
+	previous := map[string]exploreFeed{}
+	if old := e.snapshot(); old != nil {
+		for _, f := range old.Feeds {
+			previous[f.ID] = f
+		}
+	}
+
+	next := &exploreResponse{Feeds: []exploreFeed{}, UpdatedAt: now, Attribution: jamendo.Attribution()}
+	failed := 0
+	for _, spec := range e.specs() {
+		feed, stale, err := fetchExploreFeed(ctx, spec)
+		old, hadOld := previous[spec.feed.ID]
+		if err != nil || stale && hadOld {
+			failed++
+			if err != nil {
+				log.Warn().Err(err).Str("feed", spec.feed.ID).Msg("Explore feed refresh failed")
+			}
+			if hadOld {
+				next.Feeds = append(next.Feeds, old)
+			}
+			continue
+		}
+		if len(feed.Tracks) > 0 {
+			next.Feeds = append(next.Feeds, feed)
+		}
+	}
+	e.mu.Lock()
+	e.current = next
+	e.mu.Unlock()
+	log.Info().Int("feeds", len(next.Feeds)).Int("failed", failed).Msg("Explore feeds refreshed")
+}
+
+// fetchExploreFeed runs one feed's query. Stale feeds come from Jamendo
+// responses cached past their TTL while Jamendo is failing.
+func fetchExploreFeed(ctx context.Context, spec exploreSpec) (feed exploreFeed, stale bool, err error) {
+	spec.query.Limit = exploreFeedSize
+	params := spec.query.params()
+	params.Del("fullcount")
+	for k, v := range spec.extra {
+		params.Set(k, v)
+	}
+	var resp JamendoResponse
+	if stale, err = jamendo.get(ctx, "tracks", params, &resp); err != nil {
+		return exploreFeed{}, false, err
+	}
+	feed = spec.feed
+	feed.Tracks = []Song{}
+	for _, track := range resp.Results {
+		if song, ok := jamendoTrackSong(track); ok {
+			feed.Tracks = append(feed.Tracks, song)
+		}
+	}
+	return feed, stale, nil
+}
+
+func (e *exploreFeeds) snapshot() *exploreResponse {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return e.current
+}
+
+// get returns the feeds, building them first if no refresh has finished
+// yet (at startup, or when scheduled refreshes are off) or the last one
+// found nothing a while ago.
+func (e *exploreFeeds) get(ctx context.Context, now time.Time) *exploreResponse {
+	usable := func(feeds *exploreResponse) bool {
+		return feeds != nil && (len(feeds.Feeds) > 0 || now.Sub(feeds.UpdatedAt) < exploreRetryDelay)
+	}
+	if feeds := e.snapshot(); usable(feeds) {
+		return feeds
+	}
+	e.refreshMu.Lock()
+	defer e.refreshMu.Unlock()
+	if !usable(e.snapshot()) {
+		e.refreshLocked(ctx, now)
+	}
+	return e.snapshot()
+}
+
+// runExploreRefresher builds the feeds now and again every interval. main
+// runs it in its own goroutine.
+func runExploreRefresher(interval time.Duration) {
+	refresh := func(now time.Time) {
+		ctx, cancel := context.WithTimeout(context.Background(), exploreRefreshTimeout)
+		defer cancel()
+		explore.refresh(ctx, now)
+	}
+	refresh(time.Now())
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		refresh(now)
+	}
+}
+
+// ExploreHandler serves GET /api/explore: Jamendo charts, featured tracks
+// and per-genre top lists, as songs. ?feed= picks one feed by ID.
+func ExploreHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSONError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	feeds := explore.get(r.Context(), time.Now())
+	if len(feeds.Feeds) == 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(jamendoBreakerCooldown/time.Second)))
+		writeJSONError(w, "Explore feeds are unavailable, try again later", http.StatusServiceUnavailable)
+		return
+	}
+	if id := r.URL.Query().Get("feed"); id != "" {
+		for _, f := range feeds.Feeds {
+			if f.ID == id {
+				writeJSONResponse(w, exploreResponse{Feeds: []exploreFeed{f}, UpdatedAt: feeds.UpdatedAt, Attribution: feeds.Attribution}, http.StatusOK)
+				return
+			}
+		}
+		writeJSONError(w, "Feed not found", http.StatusNotFound)
+		return
+	}
+	writeJSONResponse(w, feeds, http.StatusOK)
+}
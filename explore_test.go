@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// useExploreFeeds makes the handler serve fresh feeds for genres for the
+// test's duration.
+func useExploreFeeds(t *testing.T, genres ...string) *exploreFeeds {
+	saved := explore
+	explore = newExploreFeeds(genres)
+	t.Cleanup(func() { explore = saved })
+	return explore
+}
+
+func TestExplore(t *testing.T) {
+	api := newJamendoFixtures(t, map[string]string{"tracks": "tracks.json"})
+	clock := useTestClock()
+	feeds := useExploreFeeds(t, "jazz")
+	srv := httptest.NewServer(newRouter())
+	defer srv.Close()
+
+	// The first request builds the feeds; later ones are served from memory.
+	var res exploreResponse
+	if resp := getJSON(t, srv, "/api/explore", &res); resp.StatusCode != http.StatusOK {
+		t.Fatalf("status %d", resp.StatusCode)
+	}
+	var ids []string
+	for _, f := range res.Feeds {
+		ids = append(ids, f.ID)
+		if len(f.Tracks) != 2 || f.Tracks[0].ID != "jamendo-1886257" || f.Tracks[0].Source != jamendoSource {
+			t.Errorf("feed %s tracks = %+v", f.ID, f.Tracks)
+		}
+	}
+	if want := []string{"trending-week", "trending-month", "featured", "genre-jazz"}; len(ids) != len(want) || ids[0] != want[0] || ids[2] != want[2] || ids[3] != want[3] {
+		t.Errorf("feeds = %v, want %v", ids, want)
+	}
+	if res.Attribution.Name != "Jamendo" || res.Feeds[3].Genre != "jazz" {
+		t.Errorf("response = %+v", res)
+	}
+	if q := api.last().Query(); q.Get("tags") != "jazz" || q.Get("order") != "popularity_month" || q.Get("limit") != "20" || q.Has("fullcount") {
+		t.Errorf("genre query %s", q.Encode())
+	}
+	calls := api.calls()
+	if calls != 4 {
+		t.Errorf("%d Jamendo calls, want 4", calls)
+	}
+	getJSON(t, srv, "/api/explore", &res)
+	if api.calls() != calls {
+		t.Errorf("a request refreshed the feeds")
+	}
+
+	var one exploreResponse
+	if resp := getJSON(t, srv, "/api/explore?feed=featured", &one); resp.StatusCode != http.StatusOK || len(one.Feeds) != 1 || one.Feeds[0].Kind != "featured" {
+		t.Errorf("one feed: status %d, %+v", resp.StatusCode, one.Feeds)
+	}
+	if resp := getJSON(t, srv, "/api/explore?feed=genre-polka", nil); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("unknown feed: status %d", resp.StatusCode)
+	}
+
+	// A scheduled refresh that finds Jamendo failing keeps the last feeds.
+	clock.advance(time.Hour)
+	api.fail(http.StatusInternalServerError)
+	updated := clock.now()
+	feeds.refresh(context.Background(), updated)
+	getJSON(t, srv, "/api/explore", &res)
+	if len(res.Feeds) != 4 || len(res.Feeds[0].Tracks) != 2 || !res.UpdatedAt.Equal(updated) {
+		t.Errorf("after failed refresh: %d feeds, updated %v", len(res.Feeds), res.UpdatedAt)
+	}
+}
+
+func TestExploreUnavailable(t *testing.T) {
+	api := newJamendoFixtures(t, map[string]string{"tracks": "tracks.json"})
+	feeds := useExploreFeeds(t)
+	srv := httptest.NewServer(newRouter())
+	defer srv.Close()
+
+	api.fail(http.StatusBadGateway)
+	resp := getJSON(t, srv, "/api/explore", nil)
+	if resp.StatusCode != http.StatusServiceUnavailable || resp.Header.Get("Retry-After") == "" {
+		t.Errorf("status %d, Retry-After %q", resp.StatusCode, resp.Header.Get("Retry-After"))
+	}
+	// Nothing is retried until exploreRetryDelay has passed.
+	calls := api.calls()
+	api.fail(0)
+	if resp := getJSON(t, srv, "/api/explore", nil); resp.StatusCode != http.StatusServiceUnavailable || api.calls() != calls {
+		t.Errorf("retried at once: status %d", resp.StatusCode)
+	}
+	if res := feeds.get(context.Background(), time.Now().Add(exploreRetryDelay)); len(res.Feeds) != 3 || api.calls() != calls+3 {
+		t.Errorf("after the retry delay: %d feeds, %d calls", len(res.Feeds), api.calls()-calls)
+	}
+}
@@ -0,0 +1,342 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"math/bits"
+	"strconv"
+
+	"github.com/mewkiz/flac"
+	"github.com/mewkiz/flac/frame"
+	"github.com/mewkiz/flac/meta"
+)
+
+// flacBlockSize is the number of frames per FLAC block, libFLAC's default.
+const flacBlockSize = 4096
+
+// Residuals are Rice coded in up to 2^maxRicePartitionOrder partitions. The
+// 4-bit parameter of the first coding method holds up to maxRice1Param
+// (15 is its escape code); larger parameters need the 5-bit method.
+const (
+	maxRicePartitionOrder = 8
+	maxRice1Param         = 14
+	maxRice2Param         = 30
+)
+
+// flacVendor names the encoder in the Vorbis comment block.
+const flacVendor = "musicplayerwebapp"
+
+// encodeFLAC writes the integer PCM read from src to w as a FLAC stream,
+// preceded by blocks. Each channel of each block is stored with whichever
+// of FLAC's fixed predictors makes it smallest. libFLAC's LPC search would
+// save a few percent more.
+func encodeFLAC(w io.WriteSeeker, src *rawPCMDecoder, blocks []*meta.Block) error {
+	channels, bps, rate := src.Channels(), src.BitsPerSample(), src.SampleRate()
+	if channels > 8 || bps > 24 {
+		return fmt.Errorf("flac: can't encode %d channels of %d-bit audio", channels, bps)
+	}
+	info := &meta.StreamInfo{
+		BlockSizeMin: flacBlockSize, BlockSizeMax: flacBlockSize,
+		SampleRate: uint32(rate), NChannels: uint8(channels), BitsPerSample: uint8(bps),
+	}
+	// Close rewrites the stream info with the sample count and MD5 gathered
+	// while encoding. Hide w's Close method, which it would also call.
+	enc, err := flac.NewEncoder(struct{ io.WriteSeeker }{w}, info, blocks...)
+	if err != nil {
+		return err
+	}
+	buf := make([]int32, flacBlockSize*channels)
+	frames := 0
+	for {
+		n, err := src.ReadInts(buf)
+		if n > 0 {
+			if err := enc.WriteFrame(newFLACFrame(buf[:n], channels, bps, rate)); err != nil {
+				return err
+			}
+			frames += n / channels
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if frames < 16 {
+		return errors.New("flac: too short to encode")
+	}
+	if err := enc.Close(); err != nil {
+		return err
+	}
+	// The encoder counts the last, shorter block towards the minimum block
+	// size, which FLAC defines over the other blocks. It is the 2 bytes after
+	// the signature and the stream info block header.
+	if frames > flacBlockSize {
+		if _, err := w.Seek(8, io.SeekStart); err != nil {
+			return err
+		}
+		if _, err := w.Write(binary.BigEndian.AppendUint16(nil, flacBlockSize)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// newFLACFrame deinterleaves one block of samples into a frame, planning
+// the cheapest encoding of each channel and, for stereo, the cheapest
+// decorrelation. The encoder decorrelates the channels itself.
+func newFLACFrame(samples []int32, channels, bps, rate int) *frame.Frame {
+	n := len(samples) / channels
+	f := &frame.Frame{Header: frame.Header{
+		HasFixedBlockSize: true, BlockSize: uint16(n), SampleRate: uint32(rate),
+		Channels: frame.Channels(channels - 1), BitsPerSample: uint8(bps),
+	}}
+	split := make([][]int32, channels)
+	for ch := range split {
+		split[ch] = make([]int32, n)
+		for i := range split[ch] {
+			split[ch][i] = samples[i*channels+ch]
+		}
+	}
+	headers := make([]frame.SubHeader, channels)
+	if channels == 2 {
+		f.Channels, headers = planStereo(split[0], split[1], uint(bps))
+	} else {
+		for ch := range split {
+			headers[ch], _ = planSubframe(split[ch], uint(bps))
+		}
+	}
+	for ch := range split {
+		f.Subframes = append(f.Subframes, &frame.Subframe{SubHeader: headers[ch], Samples: split[ch], NSamples: n})
+	}
+	return f
+}
+
+// planStereo picks between independent channels and the three ways FLAC
+// can store the difference of the channels (the side channel, which needs
+// an extra bit) in place of one or both of them.
+func planStereo(left, right []int32, bps uint) (frame.Channels, []frame.SubHeader) {
+	mid, side := make([]int32, len(left)), make([]int32, len(left))
+	for i := range left {
+		mid[i] = int32((int64(left[i]) + int64(right[i])) >> 1)
+		side[i] = left[i] - right[i]
+	}
+	l, lSize := planSubframe(left, bps)
+	r, rSize := planSubframe(right, bps)
+	m, mSize := planSubframe(mid, bps)
+	s, sSize := planSubframe(side, bps+1)
+	options := []struct {
+		channels frame.Channels
+		headers  []frame.SubHeader
+		size     int
+	}{
+		{frame.ChannelsLR, []frame.SubHeader{l, r}, lSize + rSize},
+		{frame.ChannelsLeftSide, []frame.SubHeader{l, s}, lSize + sSize},
+		{frame.ChannelsSideRight, []frame.SubHeader{s, r}, sSize + rSize},
+		{frame.ChannelsMidSide, []frame.SubHeader{m, s}, mSize + sSize},
+	}
+	best := options[0]
+	for _, o := range options[1:] {
+		if o.size < best.size {
+			best = o
+		}
+	}
+	return best.channels, best.headers
+}
+
+// planSubframe chooses how to store one channel of a block: as a constant,
+// with a fixed predictor of order 0 to 4 and Rice-coded residuals, or
+// verbatim. It returns the subframe header and the estimated size in bits.
+func planSubframe(samples []int32, bps uint) (frame.SubHeader, int) {
+	var or int32
+	constant := true
+	for _, v := range samples {
+		or |= v
+		constant = constant && v == samples[0]
+	}
+	if constant {
+		return frame.SubHeader{Pred: frame.PredConstant}, int(bps)
+	}
+	// Low bits that are zero throughout (e.g. 20-bit audio in 24-bit
+	// samples) are stored once as "wasted" bits.
+	wasted := uint(bits.TrailingZeros32(uint32(or)))
+	shifted := samples
+	if wasted > 0 {
+		shifted = make([]int32, len(samples))
+		for i, v := range samples {
+			shifted[i] = v >> wasted
+		}
+	}
+	width := int(bps - wasted)
+	best := frame.SubHeader{Pred: frame.PredVerbatim, Wasted: wasted}
+	bestSize := len(samples) * width
+
+	residuals := make([]int32, len(samples))
+	for order := 0; order <= 4 && order < len(samples); order++ {
+		if !fixedResiduals(shifted, order, residuals) {
+			continue
+		}
+		rice, method, size := planRice(residuals, order)
+		if size += order * width; size < bestSize {
+			best = frame.SubHeader{Pred: frame.PredFixed, Order: order, Wasted: wasted, ResidualCodingMethod: method, RiceSubframe: rice}
+			bestSize = size
+		}
+	}
+	return best, bestSize
+}
+
+// fixedResiduals stores in res[order:] what FLAC's fixed predictor of the
+// given order fails to predict of x. It reports false if a residual would
+// not fit in 32 bits.
+func fixedResiduals(x []int32, order int, res []int32) bool {
+	for i := order; i < len(x); i++ {
+		var r int64
+		switch order {
+		case 0:
+			r = int64(x[i])
+		case 1:
+			r = int64(x[i]) - int64(x[i-1])
+		case 2:
+			r = int64(x[i]) - 2*int64(x[i-1]) + int64(x[i-2])
+		case 3:
+			r = int64(x[i]) - 3*int64(x[i-1]) + 3*int64(x[i-2]) - int64(x[i-3])
+		case 4:
+			r = int64(x[i]) - 4*int64(x[i-1]) + 6*int64(x[i-2]) - 4*int64(x[i-3]) + int64(x[i-4])
+		}
+		if r < math.MinInt32 || r > math.MaxInt32 {
+			return false
+		}
+		res[i] = int32(r)
+	}
+	return true
+}
+
+// planRice partitions res[order:], the residuals of a subframe, choosing
+// the partition order and per-partition Rice parameters that estimate
+// smallest. Partitions split the whole block, so the first is order
+// samples short.
+func planRice(res []int32, order int) (*frame.RiceSubframe, frame.ResidualCodingMethod, int) {
+	n := len(res)
+	maxOrder := 0
+	for maxOrder < maxRicePartitionOrder && n%(2<<maxOrder) == 0 && n>>(maxOrder+1) > order {
+		maxOrder++
+	}
+	sums := make([]uint64, 1<<maxOrder)
+	for i := order; i < n; i++ {
+		sums[i/(n>>maxOrder)] += uint64(zigzag(res[i]))
+	}
+
+	var best *frame.RiceSubframe
+	var bestMethod frame.ResidualCodingMethod
+	bestSize := math.MaxInt
+	for partOrder := maxOrder; partOrder >= 0; partOrder-- {
+		if partOrder < maxOrder {
+			merged := make([]uint64, len(sums)/2)
+			for i := range merged {
+				merged[i] = sums[2*i] + sums[2*i+1]
+			}
+			sums = merged
+		}
+		rice := &frame.RiceSubframe{PartOrder: partOrder}
+		method, paramBits := frame.ResidualCodingMethodRice1, 4
+		size := 2 + 4 // Coding method and partition order
+		for i, sum := range sums {
+			count := n >> partOrder
+			if i == 0 {
+				count -= order
+			}
+			param, partSize := riceParam(sum, count)
+			if param > maxRice1Param {
+				method, paramBits = frame.ResidualCodingMethodRice2, 5
+			}
+			rice.Partitions = append(rice.Partitions, frame.RicePartition{Param: param})
+			size += partSize
+		}
+		if size += len(sums) * paramBits; size < bestSize {
+			best, bestMethod, bestSize = rice, method, size
+		}
+	}
+	return best, bestMethod, bestSize
+}
+
+// riceParam picks the Rice parameter for count residuals whose zigzag
+// encodings add up to sum, estimating each one's unary part as if the sum
+// were spread evenly. It returns the parameter and the estimated bits.
+func riceParam(sum uint64, count int) (uint, int) {
+	best, bestSize := uint(0), math.MaxInt
+	for k := uint(0); k <= maxRice2Param; k++ {
+		if size := count*int(k+1) + int(sum>>k); size < bestSize {
+			best, bestSize = k, size
+		}
+	}
+	return best, bestSize
+}
+
+// zigzag maps signed residuals onto unsigned ones as Rice coding expects:
+// 0, -1, 1, -2, ... become 0, 1, 2, 3, ...
+func zigzag(v int32) uint32 {
+	return uint32(v<<1) ^ uint32(v>>31)
+}
+
+// flacMetadataBlocks carries the tags and cover art read from an upload
+// over to the FLAC file it is re-encoded as.
+func flacMetadataBlocks(md *AudioMetadata) []*meta.Block {
+	comment := &meta.VorbisComment{Vendor: flacVendor}
+	add := func(key, value string) {
+		if value != "" {
+			comment.Tags = append(comment.Tags, [2]string{key, value})
+		}
+	}
+	number := func(n int) string {
+		if n <= 0 {
+			return ""
+		}
+		return strconv.Itoa(n)
+	}
+	gain := func(v *float64) string {
+		if v == nil {
+			return ""
+		}
+		return strconv.FormatFloat(*v, 'f', 2, 64) + " dB"
+	}
+	peak := func(v *float64) string {
+		if v == nil {
+			return ""
+		}
+		return strconv.FormatFloat(*v, 'f', 6, 64)
+	}
+	add("TITLE", md.Title)
+	add("ARTIST", md.Artist)
+	add("ALBUM", md.Album)
+	add("ALBUMARTIST", md.AlbumArtist)
+	add("GENRE", md.Genre)
+	add("DATE", number(md.Year))
+	add("TRACKNUMBER", number(md.TrackNumber))
+	add("TRACKTOTAL", number(md.TrackTotal))
+	add("DISCNUMBER", number(md.DiscNumber))
+	add("DISCTOTAL", number(md.DiscTotal))
+	add("REPLAYGAIN_TRACK_GAIN", gain(md.ReplayGain.TrackGain))
+	add("REPLAYGAIN_TRACK_PEAK", peak(md.ReplayGain.TrackPeak))
+	add("REPLAYGAIN_ALBUM_GAIN", gain(md.ReplayGain.AlbumGain))
+	add("REPLAYGAIN_ALBUM_PEAK", peak(md.ReplayGain.AlbumPeak))
+
+	// The encoder writes each block's real length; it only needs to be
+	// non-zero here.
+	length := int64(8 + len(comment.Vendor))
+	for _, tag := range comment.Tags {
+		length += int64(4 + len(tag[0]) + 1 + len(tag[1]))
+	}
+	blocks := []*meta.Block{{Header: meta.Header{Type: meta.TypeVorbisComment, Length: length}, Body: comment}}
+
+	if p := md.Picture; p != nil {
+		picture := &meta.Picture{Type: uint32(p.Type), MIME: p.MIMEType, Data: p.Data}
+		length := int64(32 + len(picture.MIME) + len(picture.Data))
+		if length < 1<<24 { // A metadata block's length has 24 bits
+			blocks = append(blocks, &meta.Block{Header: meta.Header{Type: meta.TypePicture, Length: length}, Body: picture})
+		}
+	}
+	return blocks
+}
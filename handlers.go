@@ -1,7 +1,9 @@
 package main
 
 import (
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
@@ -10,10 +12,7 @@ import (
 	"strconv"
 	"strings"
 	// "io/ioutil" // Deprecated, use io package
-	"net/url"
-	"time"
 
-	"github.com/google/uuid"
 	"github.com/rs/zerolog/log"
 )
 
@@ -24,6 +23,24 @@ func writeJSONError(w http.ResponseWriter, message string, statusCode int) {
 	json.NewEncoder(w).Encode(map[string]string{"error": message})
 }
 
+// writeStoreError maps the store's sentinel errors onto HTTP statuses and
+// logs anything unexpected before answering with a generic message.
+func writeStoreError(w http.ResponseWriter, err error, message string) {
+	switch {
+	case errors.Is(err, errNotFound):
+		writeJSONError(w, "Not found", http.StatusNotFound)
+	case errors.Is(err, errOutOfRange):
+		writeJSONError(w, err.Error(), http.StatusBadRequest)
+	case errors.Is(err, errConflict):
+		writeJSONError(w, "Changed by another request, reload and retry", http.StatusConflict)
+	case errors.Is(err, errQuotaExceeded):
+		writeJSONError(w, err.Error(), http.StatusRequestEntityTooLarge)
+	default:
+		log.Error().Err(err).Msg(message)
+		writeJSONError(w, message, http.StatusInternalServerError)
+	}
+}
+
 func writeJSONResponse(w http.ResponseWriter, data interface{}, statusCode int) {
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(statusCode)
@@ -52,13 +69,13 @@ func RegisterHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	existingUser, _ := GetUserByUsername(req.Username)
+	existingUser, _ := store.GetUserByUsername(req.Username)
 	if existingUser != nil {
 		writeJSONError(w, "Username already taken", http.StatusConflict)
 		return
 	}
 
-	user, err := CreateUser(req.Username, req.Password)
+	user, err := store.CreateUser(req.Username, req.Password)
 	if err != nil {
 		log.Error().Err(err).Msg("Failed to create user")
 		writeJSONError(w, "Registration failed", http.StatusInternalServerError)
@@ -79,7 +96,7 @@ func LoginHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	user, err := GetUserByUsername(req.Username)
+	user, err := store.GetUserByUsername(req.Username)
 	if err != nil || !VerifyPassword(user.PasswordHash, req.Password) {
 		writeJSONError(w, "Invalid username or password", http.StatusUnauthorized)
 		return
@@ -128,7 +145,7 @@ func SongsAPIHandler(w http.ResponseWriter, r *http.Request) { // Protected by T
 		userID = &uid
 	}
 	
-	songs, err := GetSongsForUser(userID)
+	songs, err := store.GetSongsForUser(userID)
 	if err != nil {
 		log.Error().Err(err).Msg("Error fetching songs for user/guest")
 		writeJSONError(w, "Failed to fetch songs", http.StatusInternalServerError)
@@ -137,6 +154,10 @@ func SongsAPIHandler(w http.ResponseWriter, r *http.Request) { // Protected by T
 	writeJSONResponse(w, songs, http.StatusOK)
 }
 
+// multipartFormOverhead is what a multipart upload may carry on top of the
+// audio file: boundaries, part headers and the tag fields.
+const multipartFormOverhead = 64 << 10
+
 func UploadSongHandler(w http.ResponseWriter, r *http.Request) { // Protected by AuthMiddleware
 	if r.Method != http.MethodPost {
 		writeJSONError(w, "Method not allowed", http.StatusMethodNotAllowed)
@@ -148,8 +169,29 @@ func UploadSongHandler(w http.ResponseWriter, r *http.Request) { // Protected by
 		return
 	}
 
-	// Max upload size (e.g., 20MB)
-	r.ParseMultipartForm(20 << 20)
+	// Cap the body at what the user may still store, plus room for the form
+	// around the file, so an oversized upload is cut off while it arrives
+	// rather than after it has filled the disk. Up to 20MB is kept in memory.
+	usage, err := store.GetStorageUsage(claims.UserID)
+	if err != nil {
+		writeStoreError(w, err, "Error uploading file")
+		return
+	}
+	limit := int64(maxResumableUpload)
+	if remaining := uploadQuota.remainingBytes(usage.UsedBytes); remaining >= 0 && remaining < limit {
+		limit = remaining
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, limit+multipartFormOverhead)
+	if err := r.ParseMultipartForm(20 << 20); err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			writeJSONError(w, fmt.Sprintf("Upload is larger than the %d bytes allowed", limit), http.StatusRequestEntityTooLarge)
+			return
+		}
+		log.Warn().Err(err).Msg("Rejected malformed upload form")
+		writeJSONError(w, "Invalid upload form", http.StatusBadRequest)
+		return
+	}
 
 	file, handler, err := r.FormFile("audioFile")
 	if err != nil {
@@ -159,60 +201,220 @@ func UploadSongHandler(w http.ResponseWriter, r *http.Request) { // Protected by
 	}
 	defer file.Close()
 
-	title := r.FormValue("title")
-	artist := r.FormValue("artist")
-	album := r.FormValue("album")
-	// Duration might be extracted on client or with a lib on server
-	durationStr := r.FormValue("duration") 
-	duration, _ := strconv.Atoi(durationStr) // Handle error if needed
-
-	if title == "" { title = strings.TrimSuffix(handler.Filename, filepath.Ext(handler.Filename)) }
-
-
-	// Create user-specific uploads directory if it doesn't exist
-	userUploadDir := filepath.Join("uploads", strconv.Itoa(claims.UserID))
-	if err := os.MkdirAll(userUploadDir, os.ModePerm); err != nil {
-		log.Error().Err(err).Msg("Failed to create upload directory")
-		writeJSONError(w, "Server error during upload", http.StatusInternalServerError)
+	// Client-supplied tags are only explicit overrides of what the file says;
+	// reject malformed numbers up front rather than silently storing 0.
+	overrides, err := parseSongOverrides(r.FormValue)
+	if err != nil {
+		writeJSONError(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	// Sanitize filename and create a unique name to prevent overwrites/collisions
-	safeFilename := uuid.New().String() + filepath.Ext(handler.Filename)
-	filePath := filepath.Join(userUploadDir, safeFilename)
-	
-	dst, err := os.Create(filePath)
+	save := func(dst string) (storedFile, error) {
+		out, err := os.Create(dst)
+		if err != nil {
+			return storedFile{}, err
+		}
+		defer out.Close()
+		if _, err := file.Seek(0, io.SeekStart); err != nil {
+			return storedFile{}, err
+		}
+		w, h := hashingWriter(out)
+		n, err := io.Copy(w, file)
+		if err != nil {
+			return storedFile{}, err
+		}
+		return storedFile{Size: n, SHA256: hex.EncodeToString(h.Sum(nil))}, out.Close()
+	}
+	newSong, err := ingestUpload(claims.UserID, file, handler.Size, handler.Filename, overrides, save)
 	if err != nil {
-		log.Error().Err(err).Msg("Failed to create file on server")
-		writeJSONError(w, "Server error during upload", http.StatusInternalServerError)
+		writeIngestError(w, err)
 		return
 	}
-	defer dst.Close()
 
-	if _, err := io.Copy(dst, file); err != nil {
-		log.Error().Err(err).Msg("Failed to copy uploaded file")
-		writeJSONError(w, "Server error during upload", http.StatusInternalServerError)
-		return
+	log.Info().Str("filename", handler.Filename).Str("user", claims.Username).Msg("File uploaded successfully")
+	writeJSONResponse(w, newSong, http.StatusCreated)
+}
+
+// errUnsupportedAudio is returned by ingestUpload for files that are not one
+// of the supportedFormats.
+var errUnsupportedAudio = errors.New("unsupported audio format")
+
+// ingestUpload turns a received audio file into a song owned by userID. Both
+// the multipart endpoint and resumable uploads end here. src is read for the
+// metadata; save then writes the file to dst (copying or renaming, as suits
+// the caller) and returns its size and SHA-256, which decide its blob.
+func ingestUpload(userID int, src io.ReadSeeker, size int64, filename string, overrides songOverrides, save func(dst string) (storedFile, error)) (Song, error) {
+	// Identify the upload by its content, never by the name the client gave it.
+	md, err := extractMetadata(src, size)
+	if err != nil {
+		log.Warn().Err(err).Str("filename", filename).Msg("Rejected upload that is not a supported audio file")
+		return Song{}, fmt.Errorf("%w: %v", errUnsupportedAudio, err)
+	}
+	format := supportedFormats[md.Format]
+	song := songFromMetadata(md)
+	song.MimeType, song.OriginalMimeType = format.MIME, format.MIME
+	overrides.apply(&song)
+	if song.Title == "" {
+		song.Title = strings.TrimSuffix(filename, filepath.Ext(filename))
+	}
+	// ReplayGain tags spare decoding the file; otherwise the loudness worker
+	// measures it once the song exists.
+	song.LoudnessStatus = loudnessPending
+	if song.Loudness = loudnessFromTags(md.ReplayGain); song.Loudness != nil {
+		song.LoudnessStatus = loudnessDone
 	}
 
-	// Relative path for DB and serving
-	relativeFilePath := "/" + strings.ReplaceAll(filePath, "\\", "/") // Ensure forward slashes for web paths
+	// Refuse files that cannot fit before writing anything to disk. The store
+	// checks again when the song is added, so concurrent uploads can't
+	// overshoot the quota between here and there.
+	usage, err := store.GetStorageUsage(userID)
+	if err != nil {
+		return Song{}, err
+	}
+	if err := uploadQuota.check(usage.UsedBytes, usage.Tracks, size); err != nil {
+		return Song{}, err
+	}
 
-	// For now, no separate cover upload, use default or derive
-	relativeCoverPath := "/static/images/default-cover.jpg"
+	// Receive the file into the blob store, hashing it on the way, then
+	// file it under its SHA-256 unless identical content is already stored.
+	tmp, err := newBlobTempPath()
+	if err != nil {
+		return Song{}, fmt.Errorf("failed to create blob directory: %w", err)
+	}
+	stored, err := save(tmp)
+	if err != nil {
+		os.Remove(tmp)
+		return Song{}, fmt.Errorf("failed to store uploaded file: %w", err)
+	}
+	// Uncompressed PCM is stored as FLAC when that is turned on. The FLAC
+	// file replaces the upload only once it has decoded back to the same
+	// samples; otherwise the upload is kept as sent.
+	if pcmToFLAC && canStoreAsFLAC(md) {
+		if flacPath, flacStored, err := transcodeToFLAC(tmp, md); err != nil {
+			log.Warn().Err(err).Str("filename", filename).Msg("FLAC conversion failed; storing the upload as sent")
+		} else {
+			os.Remove(tmp)
+			tmp, stored, format = flacPath, flacStored, supportedFormats[formatFLAC]
+			song.MimeType, song.Codec = format.MIME, "flac"
+			if song.DurationMs > 0 {
+				song.Bitrate = int(stored.Size * 8 * 1000 / song.DurationMs)
+			}
+		}
+	}
+	song.FileSize, song.BlobSHA256 = stored.Size, stored.SHA256
+
+	// Use the file's embedded artwork when it has any, else the placeholder
+	song.CoverPath = "/static/images/default-cover.jpg"
+	if md.Picture != nil {
+		if coverPath, err := saveCoverArt(userID, md.Picture); err != nil {
+			log.Warn().Err(err).Str("filename", filename).Msg("Failed to store embedded cover art")
+		} else {
+			song.CoverPath = coverPath
+		}
+	}
 
-	newSong, err := AddUploadedSong(claims.UserID, title, artist, album, relativeFilePath, relativeCoverPath, duration)
+	// Hold the blob's lock until the song references it, so a concurrent
+	// delete of the same content can't remove the file in between.
+	unlock := lockBlob(stored.SHA256)
+	// Location under uploadsDir; the player gets a /api/stream/ URL instead
+	if song.StoragePath, err = placeBlob(tmp, stored.SHA256, format.Ext); err != nil {
+		unlock()
+		os.Remove(tmp)
+		removeCoverIfUnused(song.CoverPath)
+		return Song{}, fmt.Errorf("failed to store uploaded file: %w", err)
+	}
+	newSong, err := store.AddUploadedSong(userID, song, uploadQuota)
 	if err != nil {
-		log.Error().Err(err).Msg("Failed to add uploaded song to DB")
-		// Optionally delete the file if DB insert fails: os.Remove(filePath)
-		writeJSONError(w, "Failed to save song metadata", http.StatusInternalServerError)
+		releaseBlobLocked(song)
+		unlock()
+		removeCoverIfUnused(song.CoverPath)
+		return Song{}, err
+	}
+	unlock()
+	// Measure loudness (unless tagged) and draw the waveform in the background.
+	queueAudioAnalysis(newSong.ID)
+	if newSong.LoudnessStatus == loudnessDone {
+		updateAlbumGain(userID, newSong.Album)
+	}
+	return newSong, nil
+}
+
+// writeIngestError reports an ingestUpload failure: 415 for files that are
+// not audio we accept, 413 over quota, 500 otherwise.
+func writeIngestError(w http.ResponseWriter, err error) {
+	if errors.Is(err, errUnsupportedAudio) {
+		writeJSONError(w, "Unsupported audio format: upload an MP3, WAV, AIFF, OGG, M4A or FLAC file", http.StatusUnsupportedMediaType)
 		return
 	}
+	writeStoreError(w, err, "Failed to save uploaded song")
+}
+
+// songFromMetadata maps what was read from an uploaded file onto a Song.
+func songFromMetadata(md *AudioMetadata) Song {
+	return Song{
+		Title: md.Title, Artist: md.Artist, Album: md.Album, Genre: md.Genre, Year: md.Year,
+		TrackNumber: md.TrackNumber, DiscNumber: md.DiscNumber,
+		Codec: md.Codec, Bitrate: md.Bitrate, SampleRate: md.SampleRate, Channels: md.Channels,
+		DurationMs: md.DurationMs, Duration: int((md.DurationMs + 500) / 1000),
+	}
+}
 
-	log.Info().Str("filename", handler.Filename).Str("user", claims.Username).Msg("File uploaded successfully")
-	writeJSONResponse(w, newSong, http.StatusCreated)
+// songOverrides are the tag values a client explicitly set in the upload
+// form. Empty fields leave the file's own metadata alone.
+type songOverrides struct {
+	Title, Artist, Album, Genre   string
+	Year, TrackNumber, DiscNumber int
+	// Duration in seconds is only used when the file could not be measured.
+	Duration int
 }
 
+// parseSongOverrides reads the overrides through get, which is r.FormValue
+// for multipart uploads and the Upload-Metadata lookup for resumable ones.
+func parseSongOverrides(get func(key string) string) (songOverrides, error) {
+	o := songOverrides{
+		Title:  strings.TrimSpace(get("title")),
+		Artist: strings.TrimSpace(get("artist")),
+		Album:  strings.TrimSpace(get("album")),
+		Genre:  strings.TrimSpace(get("genre")),
+	}
+	ints := []struct {
+		field string
+		dst   *int
+	}{{"year", &o.Year}, {"trackNumber", &o.TrackNumber}, {"discNumber", &o.DiscNumber}, {"duration", &o.Duration}}
+	for _, f := range ints {
+		v := strings.TrimSpace(get(f.field))
+		if v == "" {
+			continue
+		}
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return songOverrides{}, fmt.Errorf("%s must be a non-negative whole number", f.field)
+		}
+		*f.dst = n
+	}
+	return o, nil
+}
+
+func (o songOverrides) apply(s *Song) {
+	for _, f := range []struct{ dst *string; v string }{
+		{&s.Title, o.Title}, {&s.Artist, o.Artist}, {&s.Album, o.Album}, {&s.Genre, o.Genre},
+	} {
+		if f.v != "" {
+			*f.dst = f.v
+		}
+	}
+	for _, f := range []struct{ dst *int; v int }{
+		{&s.Year, o.Year}, {&s.TrackNumber, o.TrackNumber}, {&s.DiscNumber, o.DiscNumber},
+	} {
+		if f.v != 0 {
+			*f.dst = f.v
+		}
+	}
+	if s.DurationMs == 0 && o.Duration != 0 {
+		s.Duration = o.Duration
+		s.DurationMs = int64(o.Duration) * 1000
+	}
+}
 
 func LikeSongHandler(w http.ResponseWriter, r *http.Request) { // Protected by AuthMiddleware
     if r.Method != http.MethodPost {
@@ -233,17 +435,14 @@ func LikeSongHandler(w http.ResponseWriter, r *http.Request) { // Protected by A
     }
 
     // Ensure the song exists in our 'songs' table. If it's a Jamendo song, this might add it.
-    dbSongID, err := EnsureSongExists(Song{
-        ID: req.SongID, Title: req.Title, Artist: req.Artist, Album: req.Album,
-        FilePath: req.FilePath, CoverPath: req.CoverPath, IsLocal: req.IsLocal, JamendoID: &req.JamendoID, Duration: req.Duration,
-    })
+    dbSongID, err := ensureRequestedSong(req)
     if err != nil {
         log.Error().Err(err).Str("requestedSongID", req.SongID).Msg("Failed to ensure song exists before liking")
         writeJSONError(w, "Error processing song for liking", http.StatusInternalServerError)
         return
     }
 
-    if err := LikeSong(claims.UserID, dbSongID); err != nil {
+    if err := store.LikeSong(claims.UserID, dbSongID); err != nil {
         log.Error().Err(err).Int("userID", claims.UserID).Str("songID", dbSongID).Msg("Failed to like song")
         writeJSONError(w, "Failed to like song", http.StatusInternalServerError)
         return
@@ -251,6 +450,42 @@ func LikeSongHandler(w http.ResponseWriter, r *http.Request) { // Protected by A
     writeJSONResponse(w, map[string]string{"message": "Song liked successfully", "songId": dbSongID}, http.StatusOK)
 }
 
+// ensureRequestedSong stores the requested song if needed and returns its ID.
+// Songs from a provider get the license the provider reports for them, looked
+// up in the background so a slow provider never holds up the request.
+func ensureRequestedSong(req LikeRequest) (string, error) {
+    songID, err := store.EnsureSongExists(req.Song())
+    if err != nil {
+        return "", err
+    }
+    queueLicenseRefresh(songID)
+    return songID, nil
+}
+
+// ensureVisibleSong stores the requested song if needed (e.g. a Jamendo track
+// seen for the first time) and returns its ID. Uploads belonging to other
+// users are reported as errNotFound. Unlike ensureRequestedSong it never asks
+// the provider, since plays and queues may name many songs at once.
+func ensureVisibleSong(userID int, req LikeRequest) (string, error) {
+    songID, err := store.EnsureSongExists(req.Song())
+    if err != nil {
+        return "", err
+    }
+    return songID, checkSongVisible(userID, songID)
+}
+
+// checkSongVisible reports errNotFound for uploads belonging to other users.
+func checkSongVisible(userID int, songID string) error {
+    song, err := store.GetSong(songID)
+    if err != nil {
+        return err
+    }
+    if song.IsUploaded && (song.UserID == nil || *song.UserID != userID) {
+        return fmt.Errorf("song %s: %w", songID, errNotFound)
+    }
+    return nil
+}
+
 func UnlikeSongHandler(w http.ResponseWriter, r *http.Request) { // Protected by AuthMiddleware
     if r.Method != http.MethodPost {
 		writeJSONError(w, "Method not allowed", http.StatusMethodNotAllowed)
@@ -269,7 +504,7 @@ func UnlikeSongHandler(w http.ResponseWriter, r *http.Request) { // Protected by
         return
     }
 
-    if err := UnlikeSong(claims.UserID, req.SongID); err != nil {
+    if err := store.UnlikeSong(claims.UserID, req.SongID); err != nil {
         log.Error().Err(err).Int("userID", claims.UserID).Str("songID", req.SongID).Msg("Failed to unlike song")
         writeJSONError(w, "Failed to unlike song", http.StatusInternalServerError)
         return
@@ -299,7 +534,7 @@ func DeleteSongHandler(w http.ResponseWriter, r *http.Request) { // Protected by
         }
     }
     
-    err := DeleteUserUploadedSong(claims.UserID, songID)
+    song, err := store.DeleteUserUploadedSong(claims.UserID, songID)
     if err != nil {
         log.Error().Err(err).Int("userID", claims.UserID).Str("songID", songID).Msg("Failed to delete song")
         // Distinguish between "not found/not owner" and server error
@@ -310,72 +545,9 @@ func DeleteSongHandler(w http.ResponseWriter, r *http.Request) { // Protected by
         }
         return
     }
+    // The rows are gone for good, so the files can go too.
+    removeUploadFiles(*song)
+    // The rest of its album no longer includes it.
+    updateAlbumGain(claims.UserID, song.Album)
     writeJSONResponse(w, map[string]string{"message": "Song deleted successfully", "songId": songID}, http.StatusOK)
 }
-
-
-
-// Jamendo search handler (from your original main.go, slightly adapted)
-func JamendoSearchHandler(w http.ResponseWriter, r *http.Request) {
-	// ... (Keep your existing JamendoSearchHandler logic from original main.go)
-	// Ensure it transforms results into the `Song` struct defined in models.go
-	// Example transformation part:
-	// ... (fetch logic) ...
-	// var results []Song
-	// for _, track := range jamendoResp.Results {
-	//     filePath := track.Audio
-	//     if filePath == "" { filePath = track.AudioDownload }
-	//     if filePath == "" { continue }
-	//     coverPath := track.Image
-	//     if coverPath == "" { coverPath = "/static/images/default-cover.jpg" }
-	//     song := Song{
-	//         ID:        fmt.Sprintf("jamendo-%s", track.ID),
-	//         Title:     track.Name, Artist: track.ArtistName, Album: track.AlbumName,
-	//         FilePath:  filePath, CoverPath: coverPath, IsLocal: false, Duration: track.Duration, JamendoID: &track.ID,
-	//     }
-	//     results = append(results, song)
-	// }
-	// writeJSONResponse(w, results, http.StatusOK)
-	// --- PASTE YOUR FULL JAMENDO HANDLER HERE and adapt struct ---
-	if r.Method != http.MethodGet { writeJSONError(w, "Method Not Allowed", 405); return }
-	query := r.URL.Query().Get("query")
-	if query == "" { http.Error(w, "Missing search query", 400); return }
-	clientID := "5a074d04" // Reminder: Use ENV VAR in production
-	apiURL := fmt.Sprintf("https://api.jamendo.com/v3.0/tracks/?client_id=%s&format=json&limit=50&search=%s&imagesize=300", clientID, url.QueryEscape(query))
-	log.Info().Str("query", query).Msg("Calling Jamendo API")
-	client := &http.Client{Timeout: 15 * time.Second}
-	req, err := http.NewRequest("GET", apiURL, nil)
-    if err != nil { log.Error().Err(err).Msg("Failed create Jamendo req"); writeJSONError(w,"API Error",500); return }
-    req.Header.Set("Accept", "application/json")
-	resp, err := client.Do(req)
-	if err != nil { log.Error().Err(err).Msg("Failed Jamendo API call"); writeJSONError(w, "API Error", 502); return }
-	defer resp.Body.Close()
-	body, err := io.ReadAll(resp.Body) // Changed from ioutil.ReadAll
-	if err != nil { log.Error().Err(err).Msg("Failed read Jamendo resp"); writeJSONError(w, "API Error", 500); return }
-	if resp.StatusCode != http.StatusOK {
-		log.Error().Int("status", resp.StatusCode).Str("body", string(body)).Msg("Jamendo API non-OK")
-		writeJSONError(w, fmt.Sprintf("Jamendo API Error (%d)", resp.StatusCode), 502); return
-	}
-	var jamendoResp JamendoResponse
-	if err := json.Unmarshal(body, &jamendoResp); err != nil {
-		log.Error().Err(err).Str("body", string(body)).Msg("Failed parse Jamendo JSON resp");
-		writeJSONError(w, "API Parse Error", 500); return
-	}
-	if jamendoResp.Headers.Status != "success" {
-		log.Error().Interface("headers", jamendoResp.Headers).Msg("Jamendo API reported non-success")
-		writeJSONError(w, "Jamendo API request failed", 502); return
-	}
-	var results []Song
-	for _, track := range jamendoResp.Results {
-		filePath := track.Audio; if filePath == "" { filePath = track.AudioDownload }; if filePath == "" { continue }
-		coverPath := track.Image; if coverPath == "" { coverPath = "/static/images/default-cover.jpg" }
-		jamendoTrackID := track.ID // Store original Jamendo ID
-		song := Song{
-			ID: fmt.Sprintf("jamendo-%s", jamendoTrackID), Title: track.Name, Artist: track.ArtistName, Album: track.AlbumName,
-			FilePath: filePath, CoverPath: coverPath, IsLocal: false, Duration: track.Duration, JamendoID: &jamendoTrackID,
-		}
-		results = append(results, song)
-	}
-	log.Info().Int("count", len(results)).Str("query", query).Msg("Jamendo search yielded results")
-	writeJSONResponse(w, results, http.StatusOK)
-}
\ No newline at end of file
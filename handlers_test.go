@@ -0,0 +1,431 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+func TestMain(m *testing.M) {
+	log.Logger = zerolog.Nop()
+	// Likes look up licenses; tests without a stand-in must not reach the real APIs.
+	jamendo = newJamendoClient("http://127.0.0.1:1/v3.0", "test-client")
+	archive = newArchiveClient("http://127.0.0.1:1")
+	os.Exit(m.Run())
+}
+
+// testStores lists every Store the handler suite runs against.
+var testStores = map[string]func(t *testing.T) Store{
+	"memory": func(t *testing.T) Store { return newMemoryStore() },
+	"sqlite": func(t *testing.T) Store {
+		st := InitDB(driverSQLite, sqliteDSN(filepath.Join(t.TempDir(), "test.db")))
+		t.Cleanup(func() { st.db.Close() })
+		return st
+	},
+}
+
+// forEachStore runs fn once per backend with a fresh server and uploads dir.
+func forEachStore(t *testing.T, fn func(t *testing.T, srv *httptest.Server)) {
+	for name, newStore := range testStores {
+		t.Run(name, func(t *testing.T) {
+			store = newStore(t)
+			uploadsDir = t.TempDir()
+			srv := httptest.NewServer(newRouter())
+			t.Cleanup(srv.Close)
+			fn(t, srv)
+		})
+	}
+}
+
+// testClient is an HTTP client with its own cookie jar, i.e. one browser.
+type testClient struct {
+	t    *testing.T
+	srv  *httptest.Server
+	http *http.Client
+}
+
+func newTestClient(t *testing.T, srv *httptest.Server) *testClient {
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testClient{t: t, srv: srv, http: &http.Client{Jar: jar}}
+}
+
+// do sends body (JSON-encoded unless it is already an io.Reader) and decodes the
+// JSON response into out when out is non-nil and the request succeeded. It
+// returns the status code.
+func (c *testClient) do(method, path string, body interface{}, out interface{}) int {
+	c.t.Helper()
+	var reader io.Reader
+	if r, ok := body.(io.Reader); ok {
+		reader = r
+	} else if body != nil {
+		buf, err := json.Marshal(body)
+		if err != nil {
+			c.t.Fatal(err)
+		}
+		reader = bytes.NewReader(buf)
+	}
+	req, err := http.NewRequest(method, c.srv.URL+path, reader)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	if reader != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	return c.send(req, out)
+}
+
+func (c *testClient) send(req *http.Request, out interface{}) int {
+	c.t.Helper()
+	resp, err := c.http.Do(req)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if out != nil && resp.StatusCode < 300 {
+		if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+			c.t.Fatalf("%s %s: decoding response: %v", req.Method, req.URL.Path, err)
+		}
+	}
+	return resp.StatusCode
+}
+
+// registerAndLogin creates username and leaves the client holding its auth cookie.
+func (c *testClient) registerAndLogin(username string) {
+	c.t.Helper()
+	creds := AuthRequest{Username: username, Password: "password123"}
+	if code := c.do("POST", "/auth/register", creds, nil); code != http.StatusCreated {
+		c.t.Fatalf("register %s: status %d", username, code)
+	}
+	if code := c.do("POST", "/auth/login", creds, nil); code != http.StatusOK {
+		c.t.Fatalf("login %s: status %d", username, code)
+	}
+}
+
+func (c *testClient) songs() []Song {
+	c.t.Helper()
+	var songs []Song
+	if code := c.do("GET", "/api/songs", nil, &songs); code != http.StatusOK {
+		c.t.Fatalf("GET /api/songs: status %d", code)
+	}
+	return songs
+}
+
+// upload posts a small tagged MP3 through the multipart upload endpoint, with
+// title as the tag so tests can tell their uploads apart.
+func (c *testClient) upload(title string) (Song, int) {
+	c.t.Helper()
+	return c.uploadFile("track.mp3", testMP3(title), nil)
+}
+
+// uploadFile posts content as the audio file plus the given form fields.
+func (c *testClient) uploadFile(filename string, content []byte, fields map[string]string) (Song, int) {
+	c.t.Helper()
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	for k, v := range fields {
+		mw.WriteField(k, v)
+	}
+	fw, err := mw.CreateFormFile("audioFile", filename)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	fw.Write(content)
+	mw.Close()
+
+	req, err := http.NewRequest("POST", c.srv.URL+"/api/songs/upload", &body)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	var song Song
+	code := c.send(req, &song)
+	return song, code
+}
+
+func findSong(songs []Song, id string) *Song {
+	for i := range songs {
+		if songs[i].ID == id {
+			return &songs[i]
+		}
+	}
+	return nil
+}
+
+func TestAuthCookieFlow(t *testing.T) {
+	forEachStore(t, func(t *testing.T, srv *httptest.Server) {
+		c := newTestClient(t, srv)
+		if code := c.do("GET", "/auth/me", nil, nil); code != http.StatusUnauthorized {
+			t.Fatalf("GET /auth/me without cookie: status %d, want 401", code)
+		}
+
+		c.registerAndLogin("alice")
+		var me map[string]interface{}
+		if code := c.do("GET", "/auth/me", nil, &me); code != http.StatusOK {
+			t.Fatalf("GET /auth/me: status %d", code)
+		}
+		if me["username"] != "alice" {
+			t.Errorf("username = %v, want alice", me["username"])
+		}
+
+		if code := c.do("POST", "/auth/register", AuthRequest{Username: "alice", Password: "password123"}, nil); code != http.StatusConflict {
+			t.Errorf("duplicate register: status %d, want 409", code)
+		}
+		if code := c.do("POST", "/auth/login", AuthRequest{Username: "alice", Password: "wrong-password"}, nil); code != http.StatusUnauthorized {
+			t.Errorf("bad password: status %d, want 401", code)
+		}
+
+		c.do("POST", "/auth/logout", nil, nil)
+		if code := c.do("GET", "/auth/me", nil, nil); code != http.StatusUnauthorized {
+			t.Errorf("GET /auth/me after logout: status %d, want 401", code)
+		}
+	})
+}
+
+func TestInvalidTokenIsRejectedAndCleared(t *testing.T) {
+	forEachStore(t, func(t *testing.T, srv *httptest.Server) {
+		req, _ := http.NewRequest("GET", srv.URL+"/auth/me", nil)
+		req.AddCookie(&http.Cookie{Name: "harmony_token", Value: "not-a-jwt"})
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusUnauthorized {
+			t.Fatalf("status %d, want 401", resp.StatusCode)
+		}
+		if !strings.Contains(resp.Header.Get("Set-Cookie"), "harmony_token=;") {
+			t.Errorf("invalid cookie was not cleared: Set-Cookie %q", resp.Header.Get("Set-Cookie"))
+		}
+	})
+}
+
+func TestGuestSeesOnlySamples(t *testing.T) {
+	forEachStore(t, func(t *testing.T, srv *httptest.Server) {
+		songs := newTestClient(t, srv).songs()
+		if len(songs) != len(initialSampleSongs) {
+			t.Fatalf("guest got %d songs, want %d samples", len(songs), len(initialSampleSongs))
+		}
+		for _, s := range songs {
+			if s.IsLiked || s.CanDelete {
+				t.Errorf("guest song %s is liked=%v canDelete=%v", s.ID, s.IsLiked, s.CanDelete)
+			}
+		}
+	})
+}
+
+func TestLikeAndUnlike(t *testing.T) {
+	forEachStore(t, func(t *testing.T, srv *httptest.Server) {
+		c := newTestClient(t, srv)
+		if code := c.do("POST", "/api/songs/like", LikeRequest{SongID: "sample-1"}, nil); code != http.StatusUnauthorized {
+			t.Fatalf("like as guest: status %d, want 401", code)
+		}
+		c.registerAndLogin("bob")
+
+		jamendo := LikeRequest{
+			SongID: "jamendo-123", JamendoID: "123", Title: "Remote Song", Artist: "Someone",
+			Duration: 200,
+		}
+		var liked map[string]string
+		if code := c.do("POST", "/api/songs/like", jamendo, &liked); code != http.StatusOK {
+			t.Fatalf("like jamendo: status %d", code)
+		}
+		sample := initialSampleSongs[0]
+		if code := c.do("POST", "/api/songs/like", LikeRequest{SongID: sample.ID, Title: sample.Title, IsLocal: true}, nil); code != http.StatusOK {
+			t.Fatalf("like sample: status %d", code)
+		}
+		// Liking twice is a no-op, not an error.
+		if code := c.do("POST", "/api/songs/like", jamendo, nil); code != http.StatusOK {
+			t.Fatalf("second like: status %d", code)
+		}
+
+		songs := c.songs()
+		if len(songs) != len(initialSampleSongs)+1 {
+			t.Fatalf("got %d songs, want samples plus one liked Jamendo song", len(songs))
+		}
+		if s := findSong(songs, liked["songId"]); s == nil || !s.IsLiked || s.Title != "Remote Song" || s.FilePath != streamURL("jamendo-123") {
+			t.Errorf("liked Jamendo song missing or not marked liked: %+v", s)
+		}
+		if s := findSong(songs, sample.ID); s == nil || !s.IsLiked {
+			t.Errorf("liked sample not marked liked: %+v", s)
+		}
+
+		// Another user's view is unaffected.
+		other := newTestClient(t, srv)
+		other.registerAndLogin("carol")
+		if s := findSong(other.songs(), sample.ID); s == nil || s.IsLiked {
+			t.Errorf("sample liked by bob shows as liked for carol: %+v", s)
+		}
+
+		if code := c.do("POST", "/api/songs/unlike", map[string]string{"songId": liked["songId"]}, nil); code != http.StatusOK {
+			t.Fatalf("unlike: status %d", code)
+		}
+		if s := findSong(c.songs(), liked["songId"]); s != nil {
+			t.Errorf("unliked Jamendo song still listed: %+v", s)
+		}
+	})
+}
+
+func TestUploadSong(t *testing.T) {
+	forEachStore(t, func(t *testing.T, srv *httptest.Server) {
+		c := newTestClient(t, srv)
+		if _, code := c.upload("Anonymous"); code != http.StatusUnauthorized {
+			t.Fatalf("upload as guest: status %d, want 401", code)
+		}
+		c.registerAndLogin("dave")
+
+		song, code := c.upload("My Track")
+		if code != http.StatusCreated {
+			t.Fatalf("upload: status %d", code)
+		}
+		if !song.IsUploaded || !song.CanDelete || song.Title != "My Track" || song.Artist != "Tag Artist" {
+			t.Errorf("unexpected uploaded song: %+v", song)
+		}
+		// Technical details come from the file, not the client.
+		if song.DurationMs != 2576 || song.Duration != 3 || song.Codec != "mp3" || song.SampleRate != 44100 || song.TrackNumber != 3 || song.Year != 2019 {
+			t.Errorf("metadata not extracted: %+v", song)
+		}
+
+		overridden, code := c.uploadFile("other.mp3", testMP3("Tagged"), map[string]string{
+			"title": "Client Title", "year": "2001", "duration": "999",
+		})
+		if code != http.StatusCreated || overridden.Title != "Client Title" || overridden.Year != 2001 || overridden.Album != "Tag Album" || overridden.DurationMs != 2576 {
+			t.Errorf("client overrides: status %d, %+v", code, overridden)
+		}
+		if _, code := c.uploadFile("bad.mp3", testMP3("Bad"), map[string]string{"trackNumber": "three"}); code != http.StatusBadRequest {
+			t.Errorf("non-numeric trackNumber: status %d, want 400", code)
+		}
+		if song.FilePath != "/api/stream/"+song.ID {
+			t.Errorf("upload FilePath %q is not its stream URL", song.FilePath)
+		}
+		if resp, body := c.fetch("GET", song.FilePath, nil); resp.StatusCode != http.StatusOK || !bytes.Equal(body, testMP3("My Track")) {
+			t.Errorf("stream upload: status %d, %d bytes", resp.StatusCode, len(body))
+		}
+
+		listed := findSong(c.songs(), song.ID)
+		if listed == nil || !listed.CanDelete || listed.Genre != "Rock" || listed.DurationMs != 2576 {
+			t.Fatalf("upload not listed as deletable: %+v", listed)
+		}
+		other := newTestClient(t, srv)
+		other.registerAndLogin("erin")
+		if findSong(other.songs(), song.ID) != nil {
+			t.Errorf("dave's upload is visible to erin")
+		}
+	})
+}
+
+func TestUploadStoresCoverArtOnce(t *testing.T) {
+	forEachStore(t, func(t *testing.T, srv *httptest.Server) {
+		c := newTestClient(t, srv)
+		c.registerAndLogin("fay")
+
+		plain, _ := c.upload("No Art")
+		if plain.CoverPath != "/static/images/default-cover.jpg" {
+			t.Errorf("upload without artwork: cover %q", plain.CoverPath)
+		}
+
+		var covers []string
+		for _, title := range []string{"Side A", "Side B"} {
+			song, code := c.uploadFile(title+".mp3", testMP3(title, id3APIC(3, "image/jpeg", testJPEG)), nil)
+			if code != http.StatusCreated {
+				t.Fatalf("upload %s: status %d", title, code)
+			}
+			covers = append(covers, song.CoverPath)
+		}
+		if covers[0] != covers[1] || !strings.HasPrefix(covers[0], "/api/covers/") || !strings.HasSuffix(covers[0], ".jpg") {
+			t.Fatalf("album tracks got covers %v", covers)
+		}
+		entries, err := os.ReadDir(filepath.Join(uploadsDir, strconv.Itoa(*plain.UserID), coversDirName))
+		if err != nil || len(entries) != 1 {
+			t.Errorf("covers dir holds %d files (err %v), want 1", len(entries), err)
+		}
+
+		resp, served := c.fetch("GET", covers[0], nil)
+		if resp.StatusCode != http.StatusOK || !bytes.Equal(served, testJPEG) || resp.Header.Get("Content-Type") != "image/jpeg" {
+			t.Errorf("GET cover: status %d, %d bytes, type %q", resp.StatusCode, len(served), resp.Header.Get("Content-Type"))
+		}
+	})
+}
+
+func TestUploadSniffsContent(t *testing.T) {
+	forEachStore(t, func(t *testing.T, srv *httptest.Server) {
+		c := newTestClient(t, srv)
+		c.registerAndLogin("gus")
+
+		// The name says MP3 but the bytes are WAV: store and label it as WAV.
+		song, code := c.uploadFile("mislabelled.mp3", testWAV(), nil)
+		if code != http.StatusCreated || song.MimeType != "audio/wav" {
+			t.Errorf("mislabelled WAV: status %d, %+v", code, song)
+		}
+		if song, _ := c.upload("Real MP3"); song.MimeType != "audio/mpeg" {
+			t.Errorf("MP3 upload: %+v", song)
+		}
+
+		rejects := map[string][]byte{
+			"notes.mp3":   []byte("just some text, not audio"),
+			"tagonly.mp3": id3v2Tag(3, id3Frame(3, "TIT2", id3Text("No audio"))),
+			"script.flac": []byte("#!/bin/sh\necho hi\n"),
+			"picture.m4a": testJPEG,
+		}
+		for name, content := range rejects {
+			if _, code := c.uploadFile(name, content, nil); code != http.StatusUnsupportedMediaType {
+				t.Errorf("%s: status %d, want 415", name, code)
+			}
+		}
+		var exts []string
+		for _, name := range blobFiles(t) {
+			exts = append(exts, filepath.Ext(name))
+		}
+		sort.Strings(exts)
+		if fmt.Sprint(exts) != "[.mp3 .wav]" {
+			t.Errorf("blob store holds %v, want only the 2 accepted files with canonical extensions", exts)
+		}
+	})
+}
+
+func TestDeleteChecksOwnership(t *testing.T) {
+	forEachStore(t, func(t *testing.T, srv *httptest.Server) {
+		owner := newTestClient(t, srv)
+		owner.registerAndLogin("frank")
+		song, code := owner.upload("Keep Out")
+		if code != http.StatusCreated {
+			t.Fatalf("upload: status %d", code)
+		}
+		// The owner likes their own upload so the delete also has likes to clean up.
+		owner.do("POST", "/api/songs/like", LikeRequest{SongID: song.ID, IsLocal: true}, nil)
+
+		intruder := newTestClient(t, srv)
+		intruder.registerAndLogin("grace")
+		if code := intruder.do("DELETE", "/api/songs/delete?id="+song.ID, nil, nil); code != http.StatusForbidden {
+			t.Fatalf("delete by non-owner: status %d, want 403", code)
+		}
+		if code := owner.do("POST", "/api/songs/delete?id="+song.ID, nil, nil); code != http.StatusMethodNotAllowed {
+			t.Errorf("POST delete: status %d, want 405", code)
+		}
+		if code := owner.do("DELETE", "/api/songs/delete", map[string]string{"songId": song.ID}, nil); code != http.StatusOK {
+			t.Fatalf("delete by owner: status %d", code)
+		}
+		if findSong(owner.songs(), song.ID) != nil {
+			t.Errorf("deleted song still listed")
+		}
+		if code := owner.do("DELETE", "/api/songs/delete?id="+song.ID, nil, nil); code != http.StatusForbidden {
+			t.Errorf("second delete: status %d, want 403", code)
+		}
+	})
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	defaultHistoryPageSize = 50
+	maxHistoryPageSize     = 200
+	// Clients' clocks drift; anything further ahead than this is rejected.
+	maxPlayClockSkew = 5 * time.Minute
+)
+
+// PlaysHandler records a play event sent by the player when a track ends or
+// is skipped. Nothing is stored while the user has paused their history.
+func PlaysHandler(w http.ResponseWriter, r *http.Request) { // Protected by AuthMiddleware
+	if r.Method != http.MethodPost {
+		writeJSONError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	claims := GetClaimsFromContext(r)
+	if claims == nil {
+		writeJSONError(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	var req PlayRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSONError(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if req.SongID == "" {
+		writeJSONError(w, "Song ID is required", http.StatusBadRequest)
+		return
+	}
+	if req.MsListened < 0 {
+		writeJSONError(w, "msListened must not be negative", http.StatusBadRequest)
+		return
+	}
+	if req.Completed && req.Skipped {
+		writeJSONError(w, "A play cannot be both completed and skipped", http.StatusBadRequest)
+		return
+	}
+	now := time.Now()
+	startedAt := now.Add(-time.Duration(req.MsListened) * time.Millisecond)
+	if req.StartedAt != nil {
+		startedAt = *req.StartedAt
+	}
+	if startedAt.After(now.Add(maxPlayClockSkew)) {
+		writeJSONError(w, "startedAt is in the future", http.StatusBadRequest)
+		return
+	}
+
+	paused, err := store.GetHistoryPaused(claims.UserID)
+	if err != nil {
+		writeStoreError(w, err, "Failed to record play")
+		return
+	}
+	if paused {
+		writeJSONResponse(w, map[string]interface{}{"recorded": false, "message": "History is paused"}, http.StatusAccepted)
+		return
+	}
+
+	songID, err := ensureVisibleSong(claims.UserID, req.LikeRequest)
+	if err != nil {
+		writeStoreError(w, err, "Error processing song for play")
+		return
+	}
+	ev, err := store.RecordPlay(claims.UserID, PlayEvent{
+		SongID: songID, StartedAt: startedAt, MsListened: req.MsListened, Completed: req.Completed, Skipped: req.Skipped,
+	})
+	if err != nil {
+		writeStoreError(w, err, "Failed to record play")
+		return
+	}
+	writeJSONResponse(w, map[string]interface{}{"recorded": true, "play": ev}, http.StatusCreated)
+}
+
+// HistoryHandler returns the user's plays, newest first. Query parameters:
+//
+//	after, before  RFC 3339 times bounding startedAt (after inclusive, before exclusive)
+//	beforeId       with before, continues a page that ended on plays sharing one startedAt
+//	limit          page size, default 50, max 200
+//
+// When more plays may follow, the response carries nextBefore/nextBeforeId
+// to pass back for the next page.
+func HistoryHandler(w http.ResponseWriter, r *http.Request) { // Protected by AuthMiddleware
+	if r.Method != http.MethodGet {
+		writeJSONError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	claims := GetClaimsFromContext(r)
+	if claims == nil {
+		writeJSONError(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	params := r.URL.Query()
+	q := HistoryQuery{Limit: defaultHistoryPageSize}
+	var err error
+	if v := params.Get("after"); v != "" {
+		if q.After, err = time.Parse(time.RFC3339, v); err != nil {
+			writeJSONError(w, "after must be an RFC 3339 time", http.StatusBadRequest)
+			return
+		}
+	}
+	if v := params.Get("before"); v != "" {
+		if q.Before, err = time.Parse(time.RFC3339, v); err != nil {
+			writeJSONError(w, "before must be an RFC 3339 time", http.StatusBadRequest)
+			return
+		}
+	}
+	if v := params.Get("beforeId"); v != "" {
+		if q.BeforeID, err = strconv.ParseInt(v, 10, 64); err != nil || q.Before.IsZero() {
+			writeJSONError(w, "beforeId must be a number and needs before", http.StatusBadRequest)
+			return
+		}
+	}
+	if v := params.Get("limit"); v != "" {
+		if q.Limit, err = strconv.Atoi(v); err != nil || q.Limit < 1 {
+			writeJSONError(w, "limit must be a positive number", http.StatusBadRequest)
+			return
+		}
+		if q.Limit > maxHistoryPageSize {
+			q.Limit = maxHistoryPageSize
+		}
+	}
+
+	plays, err := store.ListPlays(claims.UserID, q)
+	if err != nil {
+		writeStoreError(w, err, "Failed to fetch history")
+		return
+	}
+	resp := map[string]interface{}{"plays": plays}
+	if len(plays) == q.Limit {
+		last := plays[len(plays)-1]
+		resp["nextBefore"] = last.StartedAt.UTC().Format(time.RFC3339Nano)
+		resp["nextBeforeId"] = last.ID
+	}
+	writeJSONResponse(w, resp, http.StatusOK)
+}
+
+// GET returns and PUT changes the user's "pause history" switch.
+func HistorySettingsHandler(w http.ResponseWriter, r *http.Request) { // Protected by AuthMiddleware
+	claims := GetClaimsFromContext(r)
+	if claims == nil {
+		writeJSONError(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		var req HistorySettings
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeJSONError(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		if err := store.SetHistoryPaused(claims.UserID, req.Paused); err != nil {
+			writeStoreError(w, err, "Failed to update history settings")
+			return
+		}
+	default:
+		writeJSONError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	paused, err := store.GetHistoryPaused(claims.UserID)
+	if err != nil {
+		writeStoreError(w, err, "Failed to fetch history settings")
+		return
+	}
+	writeJSONResponse(w, HistorySettings{Paused: paused}, http.StatusOK)
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+)
+
+type historyPage struct {
+	Plays        []PlayEvent `json:"plays"`
+	NextBefore   string      `json:"nextBefore"`
+	NextBeforeID int64       `json:"nextBeforeId"`
+}
+
+func TestListeningHistory(t *testing.T) {
+	forEachStore(t, func(t *testing.T, srv *httptest.Server) {
+		c := newTestClient(t, srv)
+		if code := c.do("POST", "/api/plays", PlayRequest{LikeRequest: LikeRequest{SongID: "sample-1"}}, nil); code != http.StatusUnauthorized {
+			t.Fatalf("play as guest: status %d, want 401", code)
+		}
+		c.registerAndLogin("mia")
+
+		base := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+		sample := LikeRequest{SongID: "sample-1", IsLocal: true}
+		jamendo := LikeRequest{SongID: "jamendo-5", JamendoID: "5", Title: "Five"}
+		for i := 0; i < 5; i++ {
+			started := base.Add(time.Duration(i) * time.Minute)
+			song := sample
+			if i%2 == 1 {
+				song = jamendo
+			}
+			req := PlayRequest{LikeRequest: song, StartedAt: &started, MsListened: int64(1000 * (i + 1)), Completed: i%2 == 0, Skipped: i%2 == 1}
+			if code := c.do("POST", "/api/plays", req, nil); code != http.StatusCreated {
+				t.Fatalf("record play %d: status %d", i, code)
+			}
+		}
+		// Two plays at the same instant must both survive pagination.
+		tie := base.Add(10 * time.Minute)
+		c.do("POST", "/api/plays", PlayRequest{LikeRequest: sample, StartedAt: &tie}, nil)
+		c.do("POST", "/api/plays", PlayRequest{LikeRequest: sample, StartedAt: &tie}, nil)
+
+		var all []PlayEvent
+		path := "/api/history?limit=2"
+		for pages := 0; pages < 10; pages++ {
+			var page historyPage
+			if code := c.do("GET", path, nil, &page); code != http.StatusOK {
+				t.Fatalf("GET %s: status %d", path, code)
+			}
+			all = append(all, page.Plays...)
+			if page.NextBefore == "" {
+				break
+			}
+			path = "/api/history?limit=2&before=" + url.QueryEscape(page.NextBefore) + "&beforeId=" + strconv.FormatInt(page.NextBeforeID, 10)
+		}
+		if len(all) != 7 {
+			t.Fatalf("paged through %d plays, want 7", len(all))
+		}
+		for i := 1; i < len(all); i++ {
+			if all[i].StartedAt.After(all[i-1].StartedAt) {
+				t.Errorf("history not newest first at %d", i)
+			}
+		}
+		oldest := all[len(all)-1]
+		if !oldest.StartedAt.Equal(base) || oldest.MsListened != 1000 || !oldest.Completed || oldest.Song == nil || oldest.Song.ID != "sample-1" {
+			t.Errorf("unexpected oldest play: %+v", oldest)
+		}
+
+		var window historyPage
+		after := url.QueryEscape(base.Add(time.Minute).Format(time.RFC3339))
+		before := url.QueryEscape(base.Add(3 * time.Minute).Format(time.RFC3339))
+		c.do("GET", "/api/history?after="+after+"&before="+before, nil, &window)
+		if len(window.Plays) != 2 || window.Plays[1].Song.Title != "Five" {
+			t.Errorf("time window returned %+v", window.Plays)
+		}
+
+		if code := c.do("POST", "/api/plays", PlayRequest{LikeRequest: sample, Completed: true, Skipped: true}, nil); code != http.StatusBadRequest {
+			t.Errorf("completed+skipped: status %d, want 400", code)
+		}
+		future := time.Now().Add(time.Hour)
+		if code := c.do("POST", "/api/plays", PlayRequest{LikeRequest: sample, StartedAt: &future}, nil); code != http.StatusBadRequest {
+			t.Errorf("future play: status %d, want 400", code)
+		}
+
+		var settings HistorySettings
+		if code := c.do("PUT", "/api/history/settings", HistorySettings{Paused: true}, &settings); code != http.StatusOK || !settings.Paused {
+			t.Fatalf("pause history: status %d, %+v", code, settings)
+		}
+		if code := c.do("POST", "/api/plays", PlayRequest{LikeRequest: sample}, nil); code != http.StatusAccepted {
+			t.Errorf("play while paused: status %d, want 202", code)
+		}
+		var latest historyPage
+		c.do("GET", "/api/history", nil, &latest)
+		if len(latest.Plays) != 7 {
+			t.Errorf("play recorded while paused: %d plays", len(latest.Plays))
+		}
+		c.do("PUT", "/api/history/settings", HistorySettings{Paused: false}, &settings)
+		if settings.Paused {
+			t.Errorf("history still paused after resume")
+		}
+
+		other := newTestClient(t, srv)
+		other.registerAndLogin("noah")
+		var empty historyPage
+		other.do("GET", "/api/history", nil, &empty)
+		if len(empty.Plays) != 0 {
+			t.Errorf("history leaked to another user: %+v", empty.Plays)
+		}
+	})
+}
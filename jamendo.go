@@ -0,0 +1,536 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Defaults for JAMENDO_API_URL and JAMENDO_CLIENT_ID. The client ID is the
+// app's public read-only key; deployments should register their own.
+const (
+	defaultJamendoBaseURL  = "https://api.jamendo.com/v3.0"
+	defaultJamendoClientID = "5a074d04"
+	jamendoTimeout         = 15 * time.Second
+)
+
+// Page sizes for /api/jamendo/search. Jamendo returns at most 200 results
+// per call.
+const (
+	defaultJamendoPageSize = 50
+	maxJamendoPageSize     = 200
+)
+
+// jamendoOrders maps the order names /api/jamendo/search accepts to
+// Jamendo's. Relevance, Jamendo's own default for searches, sends none.
+var jamendoOrders = map[string]string{
+	"relevance":        "",
+	"popularity":       "popularity_total",
+	"popularity_month": "popularity_month",
+	"popularity_week":  "popularity_week",
+	"releasedate":      "releasedate_desc", // Newest first
+	"releasedate_asc":  "releasedate_asc",
+}
+
+// jamendoAudioFormats are the stream encodings Jamendo serves: 96 kbps VBR
+// MP3, 320 kbps MP3, Ogg Vorbis and FLAC.
+var jamendoAudioFormats = []string{"mp31", "mp32", "ogg", "flac"}
+
+// JamendoClient calls the Jamendo v3.0 read API
+// (https://developer.jamendo.com/v3.0). Calls are cached, collapsed,
+// rate-limited and guarded by a circuit breaker; see jamendo_cache.go.
+type JamendoClient struct {
+	BaseURL  string // Without a trailing slash
+	ClientID string
+	HTTP     *http.Client
+
+	cache   *responseCache
+	flights *flightGroup
+	limiter *tokenBucket // nil for no limit
+	breaker *circuitBreaker
+	now     func() time.Time
+}
+
+func newJamendoClient(baseURL, clientID string) *JamendoClient {
+	return &JamendoClient{
+		BaseURL:  strings.TrimSuffix(baseURL, "/"),
+		ClientID: clientID,
+		HTTP:     &http.Client{Timeout: jamendoTimeout},
+		cache:    newResponseCache(defaultJamendoCacheSize, defaultJamendoCacheTTL),
+		flights:  &flightGroup{},
+		limiter:  newTokenBucket(defaultJamendoRateLimit, jamendoRateBurst),
+		breaker:  newCircuitBreaker(jamendoBreakerThreshold, jamendoBreakerCooldown),
+		now:      time.Now,
+	}
+}
+
+// jamendo is the client the handlers use. main configures it from the
+// environment.
+var jamendo = newJamendoClient(defaultJamendoBaseURL, defaultJamendoClientID)
+
+// loadJamendoClient reads JAMENDO_API_URL and JAMENDO_CLIENT_ID, and the
+// cache and rate limit settings JAMENDO_CACHE_TTL, JAMENDO_CACHE_SIZE and
+// JAMENDO_RATE_LIMIT.
+func loadJamendoClient() *JamendoClient {
+	baseURL, clientID := defaultJamendoBaseURL, defaultJamendoClientID
+	if v := os.Getenv("JAMENDO_API_URL"); v != "" {
+		if u, err := url.Parse(v); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			log.Fatal().Str("JAMENDO_API_URL", v).Msg("JAMENDO_API_URL must be an http(s) URL")
+		}
+		baseURL = v
+	}
+	if v := os.Getenv("JAMENDO_CLIENT_ID"); v != "" {
+		clientID = v
+	}
+	c := newJamendoClient(baseURL, clientID)
+
+	ttl, size := defaultJamendoCacheTTL, defaultJamendoCacheSize
+	if v := os.Getenv("JAMENDO_CACHE_TTL"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 0 {
+			log.Fatal().Str("JAMENDO_CACHE_TTL", v).Msg("JAMENDO_CACHE_TTL must be a duration such as 10m, or 0 to disable caching")
+		}
+		ttl = d
+	}
+	if v := os.Getenv("JAMENDO_CACHE_SIZE"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			log.Fatal().Str("JAMENDO_CACHE_SIZE", v).Msg("JAMENDO_CACHE_SIZE must be a number of responses, or 0 to disable caching")
+		}
+		size = n
+	}
+	if ttl == 0 {
+		size = 0
+	}
+	c.cache = newResponseCache(size, ttl)
+	if v := os.Getenv("JAMENDO_RATE_LIMIT"); v != "" {
+		rate, err := strconv.ParseFloat(v, 64)
+		if err != nil || rate < 0 {
+			log.Fatal().Str("JAMENDO_RATE_LIMIT", v).Msg("JAMENDO_RATE_LIMIT must be calls per second, or 0 for no limit")
+		}
+		c.limiter = newTokenBucket(rate, jamendoRateBurst)
+	}
+	return c
+}
+
+// JamendoTrack is a track as Jamendo's /tracks returns it.
+type JamendoTrack struct {
+	ID            string `json:"id"`
+	Name          string `json:"name"`
+	Duration      int    `json:"duration"`
+	ArtistID      string `json:"artist_id"`
+	ArtistName    string `json:"artist_name"`
+	AlbumName     string `json:"album_name"`
+	Audio         string `json:"audio"`
+	AudioDownload string `json:"audiodownload"`
+	Image         string `json:"image"`
+	LicenseCCURL  string `json:"license_ccurl"`
+	// AudioDownloadAllowed is false when the artist's license doesn't
+	// allow the track to be downloaded.
+	AudioDownloadAllowed bool `json:"audiodownload_allowed"`
+}
+
+// JamendoHeaders starts every Jamendo response. ResultsFullCount is only
+// sent when asked for with fullcount=true.
+type JamendoHeaders struct {
+	Status           string `json:"status"` // "success" or "failed"
+	Code             int    `json:"code"`
+	ErrorMessage     string `json:"error_message"`
+	ResultsCount     int    `json:"results_count"`
+	ResultsFullCount int    `json:"results_fullcount"`
+}
+
+type JamendoResponse struct {
+	Headers JamendoHeaders `json:"headers"`
+	Results []JamendoTrack `json:"results"`
+}
+
+// JamendoAPIError is a failed Jamendo call: a non-200 response, or a 200
+// whose headers report failure (as Jamendo does for bad parameters and
+// unknown client IDs).
+type JamendoAPIError struct {
+	StatusCode int    // HTTP status
+	Code       int    // Jamendo's error code, 0 for HTTP failures
+	Message    string // Jamendo's error_message, or the start of the body
+}
+
+func (e *JamendoAPIError) Error() string {
+	if e.Code != 0 {
+		return fmt.Sprintf("jamendo: error %d: %s", e.Code, e.Message)
+	}
+	return fmt.Sprintf("jamendo: HTTP %d: %s", e.StatusCode, e.Message)
+}
+
+// get calls resource (e.g. "tracks") with params plus the client ID and
+// decodes the JSON response into out. Responses come from the cache while
+// fresh; stale reports that Jamendo was unreachable and an expired cached
+// response stood in (see fetch).
+func (c *JamendoClient) get(ctx context.Context, resource string, params url.Values, out interface{}) (stale bool, err error) {
+	params = normalizeJamendoParams(params)
+	key := resource + "?" + params.Encode()
+	if body, age, ok := c.cache.get(key, c.now()); ok && age <= c.cache.ttl {
+		jamendoStats.Add("cache_hits", 1)
+		log.Debug().Str("key", key).Dur("age", age).Msg("Jamendo cache hit")
+		return false, json.Unmarshal(body, out)
+	}
+	jamendoStats.Add("cache_misses", 1)
+	body, stale, err := c.flights.do(ctx, key, func() ([]byte, bool, error) {
+		// Shared by every caller waiting on key, so one giving up must not
+		// cancel it for the rest; HTTP.Timeout still bounds it.
+		return c.fetch(context.WithoutCancel(ctx), resource, params, key)
+	})
+	if err != nil {
+		return false, err
+	}
+	return stale, json.Unmarshal(body, out)
+}
+
+// roundTrip makes one HTTP call and returns the body of a successful
+// response.
+func (c *JamendoClient) roundTrip(ctx context.Context, resource string, params url.Values) ([]byte, error) {
+	query := url.Values{"client_id": {c.ClientID}, "format": {"json"}}
+	for k, v := range params {
+		query[k] = v
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.BaseURL+"/"+resource+"/?"+query.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	resp, err := c.HTTP.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("jamendo: %w", err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 8<<20))
+	if err != nil {
+		return nil, fmt.Errorf("jamendo: reading response: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, &JamendoAPIError{StatusCode: resp.StatusCode, Message: truncate(string(body), 200)}
+	}
+	var envelope struct {
+		Headers JamendoHeaders `json:"headers"`
+	}
+	if err := json.Unmarshal(body, &envelope); err != nil {
+		return nil, fmt.Errorf("jamendo: decoding %s response: %w", resource, err)
+	}
+	if h := envelope.Headers; h.Status != "success" {
+		return nil, &JamendoAPIError{StatusCode: resp.StatusCode, Code: h.Code, Message: h.ErrorMessage}
+	}
+	return body, nil
+}
+
+// truncate shortens s to at most n bytes for logs and error messages.
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	return s[:n] + "..."
+}
+
+// JamendoTrackQuery selects tracks. Zero fields are left to Jamendo.
+type JamendoTrackQuery struct {
+	Search      string   // Free text over track, album and artist names and tags
+	Tags        []string // Tags or genres, all of which must match
+	MinDuration int      // Seconds
+	MaxDuration int      // Seconds; 0 for no upper bound
+	Order       string   // A key of jamendoOrders
+	AudioFormat string   // One of jamendoAudioFormats; Jamendo's default is mp31
+	Offset      int
+	Limit       int
+}
+
+// maxJamendoDuration bounds durationbetween when only a minimum is given.
+const maxJamendoDuration = 24 * 60 * 60
+
+func (q JamendoTrackQuery) params() url.Values {
+	p := url.Values{"imagesize": {"300"}, "fullcount": {"true"}}
+	if q.Search != "" {
+		p.Set("search", q.Search)
+	}
+	if len(q.Tags) > 0 {
+		p.Set("tags", strings.Join(q.Tags, " ")) // Encoded as "+", Jamendo's AND
+	}
+	if q.MinDuration > 0 || q.MaxDuration > 0 {
+		maxDuration := q.MaxDuration
+		if maxDuration == 0 {
+			maxDuration = maxJamendoDuration
+		}
+		p.Set("durationbetween", fmt.Sprintf("%d_%d", q.MinDuration, maxDuration))
+	}
+	if order := jamendoOrders[q.Order]; order != "" {
+		p.Set("order", order)
+	}
+	if q.AudioFormat != "" {
+		p.Set("audioformat", q.AudioFormat)
+	}
+	if q.Offset > 0 {
+		p.Set("offset", strconv.Itoa(q.Offset))
+	}
+	if q.Limit > 0 {
+		p.Set("limit", strconv.Itoa(q.Limit))
+	}
+	return p
+}
+
+// JamendoTrackPage is one page of tracks and how many match in all. Stale
+// pages are cached ones served while Jamendo is failing.
+type JamendoTrackPage struct {
+	Tracks []JamendoTrack
+	Total  int
+	Stale  bool
+}
+
+// SearchTracks runs q against Jamendo's /tracks.
+func (c *JamendoClient) SearchTracks(ctx context.Context, q JamendoTrackQuery) (*JamendoTrackPage, error) {
+	var resp JamendoResponse
+	stale, err := c.get(ctx, "tracks", q.params(), &resp)
+	if err != nil {
+		return nil, err
+	}
+	return &JamendoTrackPage{Tracks: resp.Results, Total: resp.Headers.ResultsFullCount, Stale: stale}, nil
+}
+
+// jamendoTrackSong converts a Jamendo track to a Song, or reports false for
+// tracks without a playable URL.
+func jamendoTrackSong(t JamendoTrack) (Song, bool) {
+	filePath := t.Audio
+	if filePath == "" {
+		filePath = t.AudioDownload
+	}
+	if filePath == "" {
+		return Song{}, false
+	}
+	coverPath := t.Image
+	if coverPath == "" {
+		coverPath = "/static/images/default-cover.jpg"
+	}
+	jamendoID := t.ID
+	song := Song{
+		ID: "jamendo-" + t.ID, Title: t.Name, Artist: t.ArtistName, Album: t.AlbumName,
+		FilePath: filePath, CoverPath: coverPath, IsLocal: false, Duration: t.Duration, JamendoID: &jamendoID,
+		Source: jamendoSource,
+	}
+	setLicense(&song, t.LicenseCCURL, jamendoArtistURL(t.ArtistID))
+	return song, true
+}
+
+// jamendoArtistURL is an artist's page on Jamendo.
+func jamendoArtistURL(artistID string) string {
+	if artistID == "" {
+		return ""
+	}
+	return "https://www.jamendo.com/artist/" + artistID
+}
+
+// jamendoDownloadAllowed reports whether t may be downloaded: the artist
+// must allow it and the license must be one we recognize.
+func jamendoDownloadAllowed(t JamendoTrack) bool {
+	kind, _ := parseLicense(t.LicenseCCURL)
+	return t.AudioDownloadAllowed && t.AudioDownload != "" && licenseAllowsCopies(kind)
+}
+
+// jamendoSource is Jamendo's provider name and song ID prefix.
+const jamendoSource = "jamendo"
+
+// Name implements Provider.
+func (c *JamendoClient) Name() string { return jamendoSource }
+
+// Search implements Provider with a plain track search; /api/jamendo/search
+// has the Jamendo-specific filters.
+func (c *JamendoClient) Search(ctx context.Context, q SearchQuery) (*SearchPage, error) {
+	page, err := c.SearchTracks(ctx, JamendoTrackQuery{Search: q.Text, Tags: q.Tags, Offset: q.Offset, Limit: q.Limit})
+	if err != nil {
+		return nil, err
+	}
+	result := &SearchPage{Songs: []Song{}, Total: page.Total, Stale: page.Stale}
+	for _, track := range page.Tracks {
+		if song, ok := jamendoTrackSong(track); ok {
+			result.Songs = append(result.Songs, song)
+		}
+	}
+	return result, nil
+}
+
+// Track implements Provider. Jamendo track IDs are numeric.
+func (c *JamendoClient) Track(ctx context.Context, id string) (*Song, error) {
+	track, err := c.trackByID(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if song, ok := jamendoTrackSong(*track); ok {
+		return &song, nil
+	}
+	return nil, errTrackNotFound
+}
+
+// trackByID looks up one track as Jamendo describes it, or returns
+// errTrackNotFound.
+func (c *JamendoClient) trackByID(ctx context.Context, id string) (*JamendoTrack, error) {
+	if !validJamendoID(id) {
+		return nil, errTrackNotFound
+	}
+	var resp JamendoResponse
+	if _, err := c.get(ctx, "tracks", url.Values{"id": {id}, "imagesize": {"300"}}, &resp); err != nil {
+		return nil, err
+	}
+	for _, track := range resp.Results {
+		if track.ID == id {
+			return &track, nil
+		}
+	}
+	return nil, errTrackNotFound
+}
+
+// StreamURL implements Provider. Jamendo's stream URLs carry the client ID,
+// so they come from a fresh (or cached) lookup rather than being built.
+func (c *JamendoClient) StreamURL(ctx context.Context, id string) (string, error) {
+	song, err := c.Track(ctx, id)
+	if err != nil {
+		return "", err
+	}
+	return song.FilePath, nil
+}
+
+// DownloadURL implements Downloader with the track's audiodownload URL,
+// for tracks whose artist and license allow downloads.
+func (c *JamendoClient) DownloadURL(ctx context.Context, id string) (string, error) {
+	track, err := c.trackByID(ctx, id)
+	if err != nil {
+		return "", err
+	}
+	if !jamendoDownloadAllowed(*track) {
+		return "", errLicenseForbids
+	}
+	return track.AudioDownload, nil
+}
+
+// Attribution implements Provider.
+func (c *JamendoClient) Attribution() Attribution {
+	return Attribution{
+		Name:   "Jamendo",
+		URL:    "https://www.jamendo.com",
+		Notice: "Music from Jamendo, shared by its artists under Creative Commons licenses.",
+	}
+}
+
+// jamendoSearchResponse is a page of /api/jamendo/search. NextOffset is set
+// when more results follow.
+type jamendoSearchResponse struct {
+	Results    []Song `json:"results"`
+	Offset     int    `json:"offset"`
+	Limit      int    `json:"limit"`
+	Total      int    `json:"total"`
+	NextOffset *int   `json:"nextOffset,omitempty"`
+	Stale      bool   `json:"stale,omitempty"` // Cached results served while Jamendo is failing
+}
+
+// parseJamendoTrackQuery reads the /api/jamendo/search parameters:
+//
+//	query                     free text
+//	tags                      comma-separated tags, all required; genre adds one more
+//	minDuration, maxDuration  seconds
+//	order                     relevance (default), popularity, popularity_month,
+//	                          popularity_week, releasedate (newest first) or releasedate_asc
+//	audioformat               mp31 (default), mp32, ogg or flac
+//	offset, limit             paging; limit defaults to 50, at most 200
+//
+// A query or at least one tag is required.
+func parseJamendoTrackQuery(params url.Values) (JamendoTrackQuery, error) {
+	q := JamendoTrackQuery{
+		Search:      strings.TrimSpace(params.Get("query")),
+		Order:       params.Get("order"),
+		AudioFormat: params.Get("audioformat"),
+		Limit:       defaultJamendoPageSize,
+	}
+	for _, tag := range append(strings.Split(params.Get("tags"), ","), params.Get("genre")) {
+		if tag = strings.TrimSpace(tag); tag != "" {
+			q.Tags = append(q.Tags, tag)
+		}
+	}
+	if q.Search == "" && len(q.Tags) == 0 {
+		return q, errors.New("a query or tags are required")
+	}
+	ints := []struct {
+		field string
+		dst   *int
+	}{{"minDuration", &q.MinDuration}, {"maxDuration", &q.MaxDuration}, {"offset", &q.Offset}, {"limit", &q.Limit}}
+	for _, f := range ints {
+		v := params.Get(f.field)
+		if v == "" {
+			continue
+		}
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return q, fmt.Errorf("%s must be a non-negative whole number", f.field)
+		}
+		*f.dst = n
+	}
+	if q.Limit < 1 || q.Limit > maxJamendoPageSize {
+		return q, fmt.Errorf("limit must be between 1 and %d", maxJamendoPageSize)
+	}
+	if q.MaxDuration > 0 && q.MinDuration > q.MaxDuration {
+		return q, errors.New("minDuration must not exceed maxDuration")
+	}
+	if _, ok := jamendoOrders[q.Order]; !ok && q.Order != "" {
+		return q, errors.New("order must be relevance, popularity, popularity_month, popularity_week, releasedate or releasedate_asc")
+	}
+	if q.AudioFormat != "" && !containsString(jamendoAudioFormats, q.AudioFormat) {
+		return q, errors.New("audioformat must be mp31, mp32, ogg or flac")
+	}
+	return q, nil
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// JamendoSearchHandler serves GET /api/jamendo/search; see
+// parseJamendoTrackQuery for the parameters.
+func JamendoSearchHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSONError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	q, err := parseJamendoTrackQuery(r.URL.Query())
+	if err != nil {
+		writeJSONError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	page, err := jamendo.SearchTracks(r.Context(), q)
+	if err != nil {
+		log.Error().Err(err).Str("query", q.Search).Msg("Jamendo search failed")
+		writeJamendoError(w, err)
+		return
+	}
+
+	resp := jamendoSearchResponse{Results: []Song{}, Offset: q.Offset, Limit: q.Limit, Total: page.Total, Stale: page.Stale}
+	for _, track := range page.Tracks {
+		if song, ok := jamendoTrackSong(track); ok {
+			resp.Results = append(resp.Results, song)
+		}
+	}
+	// Tracks are skipped after paging, so count what Jamendo returned. Total
+	// is 0 if Jamendo left out the full count.
+	if next := q.Offset + len(page.Tracks); len(page.Tracks) == q.Limit && (page.Total == 0 || next < page.Total) {
+		resp.NextOffset = &next
+	}
+	log.Info().Int("count", len(resp.Results)).Int("total", page.Total).Str("query", q.Search).Msg("Jamendo search yielded results")
+	writeJSONResponse(w, resp, http.StatusOK)
+}
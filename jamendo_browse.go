@@ -0,0 +1,407 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+)
+
+// How many albums and popular tracks an artist page lists.
+const (
+	jamendoArtistAlbums    = 50
+	jamendoArtistTopTracks = 20
+)
+
+var errJamendoNotFound = errors.New("jamendo: not found")
+
+// jamendoNumber is a number Jamendo sends as a JSON string in some
+// responses (the tracks nested in albums and playlists) and as a number in
+// others.
+type jamendoNumber int
+
+func (n *jamendoNumber) UnmarshalJSON(b []byte) error {
+	s := strings.Trim(string(b), `"`)
+	if s == "" || s == "null" {
+		*n = 0
+		return nil
+	}
+	v, err := strconv.Atoi(s)
+	if err != nil {
+		return fmt.Errorf("jamendo: bad number %s", b)
+	}
+	*n = jamendoNumber(v)
+	return nil
+}
+
+// JamendoArtist is an artist as Jamendo's /artists returns it.
+type JamendoArtist struct {
+	ID       string `json:"id"`
+	Name     string `json:"name"`
+	Website  string `json:"website"`
+	JoinDate string `json:"joindate"`
+	Image    string `json:"image"`
+	ShareURL string `json:"shareurl"`
+}
+
+// JamendoAlbum is an album as Jamendo's /albums returns it; /albums/tracks
+// adds its tracks.
+type JamendoAlbum struct {
+	ID          string               `json:"id"`
+	Name        string               `json:"name"`
+	ReleaseDate string               `json:"releasedate"`
+	ArtistID    string               `json:"artist_id"`
+	ArtistName  string               `json:"artist_name"`
+	Image       string               `json:"image"`
+	ShareURL    string               `json:"shareurl"`
+	Tracks      []JamendoNestedTrack `json:"tracks"`
+}
+
+// JamendoPlaylist is a playlist with its tracks as Jamendo's
+// /playlists/tracks returns it.
+type JamendoPlaylist struct {
+	ID           string               `json:"id"`
+	Name         string               `json:"name"`
+	CreationDate string               `json:"creationdate"`
+	UserName     string               `json:"user_name"`
+	Tracks       []JamendoNestedTrack `json:"tracks"`
+}
+
+// JamendoNestedTrack is a track listed inside an album or playlist. Album
+// tracks leave out the artist, album and image, which come from the album.
+type JamendoNestedTrack struct {
+	ID            string        `json:"id"`
+	Name          string        `json:"name"`
+	Position      jamendoNumber `json:"position"`
+	Duration      jamendoNumber `json:"duration"`
+	ArtistID      string        `json:"artist_id"`
+	ArtistName    string        `json:"artist_name"`
+	AlbumName     string        `json:"album_name"`
+	AlbumImage    string        `json:"album_image"`
+	Image         string        `json:"image"`
+	Audio         string        `json:"audio"`
+	AudioDownload string        `json:"audiodownload"`
+	LicenseCCURL  string        `json:"license_ccurl"`
+}
+
+// jamendoNestedSongs converts tracks to songs in position order, skipping
+// unplayable ones. album fills in what album tracks leave out.
+func jamendoNestedSongs(tracks []JamendoNestedTrack, album *JamendoAlbum) []Song {
+	sorted := append([]JamendoNestedTrack{}, tracks...)
+	sort.SliceStable(sorted, func(i, j int) bool { return sorted[i].Position < sorted[j].Position })
+	songs := []Song{}
+	for _, t := range sorted {
+		track := JamendoTrack{
+			ID: t.ID, Name: t.Name, Duration: int(t.Duration), ArtistID: t.ArtistID, ArtistName: t.ArtistName, AlbumName: t.AlbumName,
+			Audio: t.Audio, AudioDownload: t.AudioDownload, Image: t.Image, LicenseCCURL: t.LicenseCCURL,
+		}
+		if track.Image == "" {
+			track.Image = t.AlbumImage
+		}
+		if album != nil {
+			track.ArtistID, track.ArtistName, track.AlbumName = album.ArtistID, album.ArtistName, album.Name
+			if track.Image == "" {
+				track.Image = album.Image
+			}
+		}
+		if song, ok := jamendoTrackSong(track); ok {
+			songs = append(songs, song)
+		}
+	}
+	return songs
+}
+
+// validJamendoID reports whether id looks like a Jamendo ID, so malformed
+// ones are turned away without a call.
+func validJamendoID(id string) bool {
+	_, err := strconv.ParseUint(id, 10, 64)
+	return err == nil
+}
+
+// lookup fetches the one result of resource for id into out, a pointer to
+// a slice, or returns errJamendoNotFound.
+func (c *JamendoClient) lookup(ctx context.Context, resource, id string, params url.Values, out interface{}) (stale bool, err error) {
+	if !validJamendoID(id) {
+		return false, errJamendoNotFound
+	}
+	params.Set("id", id)
+	var resp struct {
+		Results json.RawMessage `json:"results"`
+	}
+	if stale, err = c.get(ctx, resource, params, &resp); err != nil {
+		return false, err
+	}
+	if err := json.Unmarshal(resp.Results, out); err != nil {
+		return false, fmt.Errorf("jamendo: decoding %s response: %w", resource, err)
+	}
+	return stale, nil
+}
+
+// Artist looks up an artist with their latest albums and most popular
+// tracks.
+func (c *JamendoClient) Artist(ctx context.Context, id string) (*jamendoArtistResponse, error) {
+	var artists []JamendoArtist
+	stale, err := c.lookup(ctx, "artists", id, url.Values{"imagesize": {"300"}}, &artists)
+	if err != nil {
+		return nil, err
+	}
+	if len(artists) == 0 || artists[0].ID != id {
+		return nil, errJamendoNotFound
+	}
+	a := artists[0]
+	resp := &jamendoArtistResponse{
+		ID: a.ID, Name: a.Name, Website: a.Website, Image: a.Image, URL: a.ShareURL,
+		Albums: []jamendoAlbumSummary{}, TopTracks: []Song{}, Stale: stale,
+	}
+
+	var albums struct {
+		Results []JamendoAlbum `json:"results"`
+	}
+	albumParams := url.Values{"artist_id": {id}, "order": {"releasedate_desc"}, "limit": {strconv.Itoa(jamendoArtistAlbums)}, "imagesize": {"300"}}
+	if stale, err = c.get(ctx, "albums", albumParams, &albums); err != nil {
+		return nil, err
+	}
+	resp.Stale = resp.Stale || stale
+	for _, album := range albums.Results {
+		resp.Albums = append(resp.Albums, jamendoAlbumSummary{ID: album.ID, Name: album.Name, ReleaseDate: album.ReleaseDate, Image: album.Image})
+	}
+
+	var tracks JamendoResponse
+	trackParams := url.Values{"artist_id": {id}, "order": {"popularity_total"}, "limit": {strconv.Itoa(jamendoArtistTopTracks)}, "imagesize": {"300"}}
+	if stale, err = c.get(ctx, "tracks", trackParams, &tracks); err != nil {
+		return nil, err
+	}
+	resp.Stale = resp.Stale || stale
+	for _, track := range tracks.Results {
+		if song, ok := jamendoTrackSong(track); ok {
+			resp.TopTracks = append(resp.TopTracks, song)
+		}
+	}
+	return resp, nil
+}
+
+// Album looks up an album with its tracks in album order.
+func (c *JamendoClient) Album(ctx context.Context, id string) (*jamendoAlbumResponse, error) {
+	var albums []JamendoAlbum
+	stale, err := c.lookup(ctx, "albums/tracks", id, url.Values{"imagesize": {"300"}, "audioformat": {"mp31"}}, &albums)
+	if err != nil {
+		return nil, err
+	}
+	if len(albums) == 0 || albums[0].ID != id {
+		return nil, errJamendoNotFound
+	}
+	a := albums[0]
+	return &jamendoAlbumResponse{
+		ID: a.ID, Name: a.Name, ArtistID: a.ArtistID, ArtistName: a.ArtistName, ReleaseDate: a.ReleaseDate,
+		Image: a.Image, URL: a.ShareURL, Tracks: jamendoNestedSongs(a.Tracks, &a), Stale: stale,
+	}, nil
+}
+
+// Playlist looks up a public Jamendo playlist with its tracks in playlist
+// order.
+func (c *JamendoClient) Playlist(ctx context.Context, id string) (*jamendoPlaylistResponse, error) {
+	var playlists []JamendoPlaylist
+	stale, err := c.lookup(ctx, "playlists/tracks", id, url.Values{"audioformat": {"mp31"}}, &playlists)
+	if err != nil {
+		return nil, err
+	}
+	if len(playlists) == 0 || playlists[0].ID != id {
+		return nil, errJamendoNotFound
+	}
+	p := playlists[0]
+	return &jamendoPlaylistResponse{
+		ID: p.ID, Name: p.Name, UserName: p.UserName, CreatedOn: p.CreationDate,
+		Tracks: jamendoNestedSongs(p.Tracks, nil), Stale: stale,
+	}, nil
+}
+
+// jamendoAlbumSummary is an album in an artist's album list.
+type jamendoAlbumSummary struct {
+	ID          string `json:"id"`
+	Name        string `json:"name"`
+	ReleaseDate string `json:"releaseDate"`
+	Image       string `json:"image"`
+}
+
+// jamendoArtistResponse is GET /api/jamendo/artists/{id}.
+type jamendoArtistResponse struct {
+	ID        string                `json:"id"`
+	Name      string                `json:"name"`
+	Website   string                `json:"website,omitempty"`
+	Image     string                `json:"image,omitempty"`
+	URL       string                `json:"url,omitempty"`   // The artist's page on Jamendo
+	Albums    []jamendoAlbumSummary `json:"albums"`          // Newest first
+	TopTracks []Song                `json:"topTracks"`       // Most played first
+	Stale     bool                  `json:"stale,omitempty"` // Cached while Jamendo is failing
+}
+
+// jamendoAlbumResponse is GET /api/jamendo/albums/{id}.
+type jamendoAlbumResponse struct {
+	ID          string `json:"id"`
+	Name        string `json:"name"`
+	ArtistID    string `json:"artistId"`
+	ArtistName  string `json:"artistName"`
+	ReleaseDate string `json:"releaseDate"`
+	Image       string `json:"image,omitempty"`
+	URL         string `json:"url,omitempty"`
+	Tracks      []Song `json:"tracks"` // In album order
+	Stale       bool   `json:"stale,omitempty"`
+}
+
+// jamendoPlaylistResponse is GET /api/jamendo/playlists/{id}.
+type jamendoPlaylistResponse struct {
+	ID        string `json:"id"`
+	Name      string `json:"name"`
+	UserName  string `json:"userName"`  // The Jamendo user who made it
+	CreatedOn string `json:"createdOn"` // YYYY-MM-DD
+	Tracks    []Song `json:"tracks"`    // In playlist order
+	Stale     bool   `json:"stale,omitempty"`
+}
+
+// writeJamendoLookupError answers a failed artist, album or playlist lookup.
+func writeJamendoLookupError(w http.ResponseWriter, kind, id string, err error) {
+	if errors.Is(err, errJamendoNotFound) {
+		writeJSONError(w, "Jamendo "+kind+" not found", http.StatusNotFound)
+		return
+	}
+	log.Error().Err(err).Str(kind+"Id", id).Msg("Jamendo " + kind + " lookup failed")
+	writeJamendoError(w, err)
+}
+
+// JamendoArtistHandler serves GET /api/jamendo/artists/{id}.
+func JamendoArtistHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSONError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	id := r.PathValue("id")
+	artist, err := jamendo.Artist(r.Context(), id)
+	if err != nil {
+		writeJamendoLookupError(w, "artist", id, err)
+		return
+	}
+	writeJSONResponse(w, artist, http.StatusOK)
+}
+
+// JamendoAlbumHandler serves GET /api/jamendo/albums/{id}.
+func JamendoAlbumHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSONError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	id := r.PathValue("id")
+	album, err := jamendo.Album(r.Context(), id)
+	if err != nil {
+		writeJamendoLookupError(w, "album", id, err)
+		return
+	}
+	writeJSONResponse(w, album, http.StatusOK)
+}
+
+// JamendoPlaylistHandler serves GET /api/jamendo/playlists/{id}.
+func JamendoPlaylistHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSONError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	id := r.PathValue("id")
+	playlist, err := jamendo.Playlist(r.Context(), id)
+	if err != nil {
+		writeJamendoLookupError(w, "playlist", id, err)
+		return
+	}
+	writeJSONResponse(w, playlist, http.StatusOK)
+}
+
+// POST imports a Jamendo album as one of the user's playlists.
+func JamendoAlbumImportHandler(w http.ResponseWriter, r *http.Request) { // Protected by AuthMiddleware
+	if r.Method != http.MethodPost {
+		writeJSONError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	id := r.PathValue("id")
+	album, err := jamendo.Album(r.Context(), id)
+	if err != nil {
+		writeJamendoLookupError(w, "album", id, err)
+		return
+	}
+	importPlaylist(w, r, album.ArtistName+" - "+album.Name, album.Tracks)
+}
+
+// POST imports a Jamendo playlist as one of the user's playlists.
+func JamendoPlaylistImportHandler(w http.ResponseWriter, r *http.Request) { // Protected by AuthMiddleware
+	if r.Method != http.MethodPost {
+		writeJSONError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	id := r.PathValue("id")
+	playlist, err := jamendo.Playlist(r.Context(), id)
+	if err != nil {
+		writeJamendoLookupError(w, "playlist", id, err)
+		return
+	}
+	importPlaylist(w, r, playlist.Name, playlist.Tracks)
+}
+
+// importPlaylist creates a playlist of songs for the user, storing each song
+// with EnsureSongExists first. The request body may give {"name"}; the
+// playlist is otherwise named defaultName. A failed import removes the
+// partly filled playlist.
+func importPlaylist(w http.ResponseWriter, r *http.Request, defaultName string, songs []Song) {
+	claims := GetClaimsFromContext(r)
+	if claims == nil {
+		writeJSONError(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	var req PlaylistRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+		writeJSONError(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	name := strings.TrimSpace(req.Name)
+	if name == "" {
+		name = truncate(strings.TrimSpace(defaultName), maxPlaylistNameLength-3)
+	}
+	if len(name) > maxPlaylistNameLength {
+		writeJSONError(w, "Playlist name is too long", http.StatusBadRequest)
+		return
+	}
+	if len(songs) == 0 {
+		writeJSONError(w, "Nothing to import: no playable tracks", http.StatusUnprocessableEntity)
+		return
+	}
+
+	playlist, err := store.CreatePlaylist(claims.UserID, name)
+	if err != nil {
+		writeStoreError(w, err, "Failed to create playlist")
+		return
+	}
+	for _, song := range songs {
+		songID, err := saveProviderSong(song)
+		if err == nil {
+			err = store.AddPlaylistTrack(claims.UserID, playlist.ID, songID, -1)
+		}
+		if err != nil {
+			if delErr := store.DeletePlaylist(claims.UserID, playlist.ID); delErr != nil {
+				log.Error().Err(delErr).Int("playlistID", playlist.ID).Msg("Failed to remove partly imported playlist")
+			}
+			writeStoreError(w, err, "Failed to import playlist")
+			return
+		}
+	}
+	playlist, err = store.GetPlaylist(claims.UserID, playlist.ID)
+	if err != nil {
+		writeStoreError(w, err, "Failed to fetch playlist")
+		return
+	}
+	log.Info().Int("userID", claims.UserID).Int("playlistID", playlist.ID).Int("tracks", len(songs)).Msg("Imported Jamendo playlist")
+	writeJSONResponse(w, playlist, http.StatusCreated)
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// jamendoBrowseRoutes answers every lookup the browse endpoints make.
+var jamendoBrowseRoutes = map[string]string{
+	"artists":          "artists.json",
+	"albums":           "albums.json",
+	"tracks":           "tracks.json",
+	"albums/tracks":    "albums_tracks.json",
+	"playlists/tracks": "playlists_tracks.json",
+}
+
+func TestJamendoBrowse(t *testing.T) {
+	api := newJamendoFixtures(t, jamendoBrowseRoutes)
+	srv := httptest.NewServer(newRouter())
+	defer srv.Close()
+
+	var album jamendoAlbumResponse
+	if code := getJSON(t, srv, "/api/jamendo/albums/370118", &album).StatusCode; code != http.StatusOK {
+		t.Fatalf("album: status %d", code)
+	}
+	// Tracks come in album order, unplayable ones left out, with the album's
+	// artist, name and cover.
+	if album.Name != "Coastline" || album.ArtistID != "511022" || len(album.Tracks) != 2 ||
+		album.Tracks[0].ID != "jamendo-1712430" || album.Tracks[1].Title != "Low Tide" ||
+		album.Tracks[1].Artist != "The Tidewaters" || album.Tracks[1].Album != "Coastline" ||
+		album.Tracks[1].CoverPath != album.Image || album.Tracks[1].Duration != 243 {
+		t.Errorf("album = %+v", album)
+	}
+	if q := api.last().Query(); q.Get("id") != "370118" {
+		t.Errorf("album lookup %s", q.Encode())
+	}
+
+	var playlist jamendoPlaylistResponse
+	if code := getJSON(t, srv, "/api/jamendo/playlists/500089", &playlist).StatusCode; code != http.StatusOK {
+		t.Fatalf("playlist: status %d", code)
+	}
+	if playlist.Name != "Sunday Morning" || playlist.UserName != "quietlistener" || len(playlist.Tracks) != 2 ||
+		playlist.Tracks[0].Title != "Harbour Lights" || playlist.Tracks[1].Artist != "Alanis Rivers" ||
+		playlist.Tracks[0].CoverPath != "https://usercontent.jamendo.com?type=album&id=370118&width=300" {
+		t.Errorf("playlist = %+v", playlist)
+	}
+
+	var artist jamendoArtistResponse
+	if code := getJSON(t, srv, "/api/jamendo/artists/511022", &artist).StatusCode; code != http.StatusOK {
+		t.Fatalf("artist: status %d", code)
+	}
+	if artist.Name != "The Tidewaters" || artist.URL != "https://www.jamendo.com/artist/511022" ||
+		len(artist.Albums) != 2 || artist.Albums[0].Name != "Undertow" || len(artist.TopTracks) != 2 {
+		t.Errorf("artist = %+v", artist)
+	}
+	if q := api.last().Query(); q.Get("artist_id") != "511022" || q.Get("order") != "popularity_total" {
+		t.Errorf("top tracks lookup %s", q.Encode())
+	}
+}
+
+func TestJamendoBrowseErrors(t *testing.T) {
+	api := newJamendoFixtures(t, map[string]string{"albums/tracks": "empty.json", "artists": "error.json"})
+	srv := httptest.NewServer(newRouter())
+	defer srv.Close()
+
+	calls := api.calls()
+	for _, target := range []string{"/api/jamendo/albums/abc", "/api/jamendo/albums/-1"} {
+		if code := getJSON(t, srv, target, nil).StatusCode; code != http.StatusNotFound {
+			t.Errorf("%s: status %d, want 404", target, code)
+		}
+	}
+	if api.calls() != calls {
+		t.Errorf("malformed IDs were looked up")
+	}
+	if code := getJSON(t, srv, "/api/jamendo/albums/999", nil).StatusCode; code != http.StatusNotFound {
+		t.Errorf("unknown album: status %d, want 404", code)
+	}
+	if code := getJSON(t, srv, "/api/jamendo/artists/511022", nil).StatusCode; code != http.StatusBadGateway {
+		t.Errorf("failed lookup: status %d, want 502", code)
+	}
+}
+
+func TestJamendoImport(t *testing.T) {
+	forEachStore(t, func(t *testing.T, srv *httptest.Server) {
+		newJamendoFixtures(t, jamendoBrowseRoutes)
+		c := newTestClient(t, srv)
+		if code := c.do("POST", "/api/jamendo/albums/370118/import", nil, nil); code != http.StatusUnauthorized {
+			t.Errorf("guest import: status %d, want 401", code)
+		}
+		c.registerAndLogin("ida")
+
+		var p Playlist
+		if code := c.do("POST", "/api/jamendo/albums/370118/import", nil, &p); code != http.StatusCreated {
+			t.Fatalf("album import: status %d", code)
+		}
+		if p.Name != "The Tidewaters - Coastline" || p.TrackCount != 2 || len(p.Tracks) != 2 ||
+			p.Tracks[0].Title != "Harbour Lights" || p.Tracks[1].Title != "Low Tide" || p.Tracks[1].Album != "Coastline" {
+			t.Errorf("imported album = %+v", p)
+		}
+
+		// Tracks already stored are reused; a name may be given.
+		if code := c.do("POST", "/api/jamendo/playlists/500089/import", PlaylistRequest{Name: " Sundays "}, &p); code != http.StatusCreated {
+			t.Fatalf("playlist import: status %d", code)
+		}
+		if p.Name != "Sundays" || len(p.Tracks) != 2 || p.Tracks[0].ID != "jamendo-1712430" || p.Tracks[1].ID != "jamendo-1886257" {
+			t.Errorf("imported playlist = %+v", p)
+		}
+		var playlists []Playlist
+		c.do("GET", "/api/playlists", nil, &playlists)
+		if len(playlists) != 2 {
+			t.Errorf("%d playlists, want 2", len(playlists))
+		}
+
+		if code := c.do("POST", "/api/jamendo/playlists/1/import", nil, nil); code != http.StatusNotFound {
+			t.Errorf("unknown playlist: status %d, want 404", code)
+		}
+		if code := c.do("GET", "/api/jamendo/albums/370118/import", nil, nil); code != http.StatusMethodNotAllowed {
+			t.Errorf("GET import: status %d, want 405", code)
+		}
+	})
+}
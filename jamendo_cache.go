@@ -0,0 +1,341 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"expvar"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Defaults for JAMENDO_CACHE_TTL, JAMENDO_CACHE_SIZE and JAMENDO_RATE_LIMIT.
+// Jamendo allows a client ID 35,000 calls a month, so keystroke searches
+// would exhaust it quickly without a cache.
+const (
+	defaultJamendoCacheTTL  = 10 * time.Minute
+	defaultJamendoCacheSize = 500 // Responses
+	defaultJamendoRateLimit = 5   // Calls per second
+	jamendoRateBurst        = 10
+	jamendoMaxRateWait      = time.Second // Longest a call waits for a token before failing
+)
+
+// jamendoStaleTTL is how long past its TTL a cached response may stand in
+// for a failing Jamendo.
+const jamendoStaleTTL = 24 * time.Hour
+
+// The circuit opens after jamendoBreakerThreshold failed calls in a row and
+// lets one call through to test Jamendo every jamendoBreakerCooldown.
+const (
+	jamendoBreakerThreshold = 5
+	jamendoBreakerCooldown  = 30 * time.Second
+)
+
+var (
+	errJamendoRateLimited = errors.New("jamendo: outbound rate limit reached")
+	errJamendoUnavailable = errors.New("jamendo: circuit open after repeated failures")
+)
+
+// jamendoStats counts cache hits and misses, stale responses served, calls
+// collapsed into one already in flight, and upstream calls, errors and
+// rejections. It is published at /debug/vars.
+var jamendoStats = expvar.NewMap("jamendo")
+
+// normalizeJamendoParams returns params with the search text lowercased and
+// its whitespace collapsed, and the tags lowercased and sorted (Jamendo
+// matches both case-insensitively, and all tags must match), so equivalent
+// searches share a cache entry.
+func normalizeJamendoParams(params url.Values) url.Values {
+	out := url.Values{}
+	for k, v := range params {
+		out[k] = v
+	}
+	if v := out.Get("search"); v != "" {
+		out.Set("search", strings.ToLower(strings.Join(strings.Fields(v), " ")))
+	}
+	if v := out.Get("tags"); v != "" {
+		tags := strings.Fields(strings.ToLower(v))
+		sort.Strings(tags)
+		out.Set("tags", strings.Join(tags, " "))
+	}
+	return out
+}
+
+// fetch makes the call for a cache miss and caches the response. When the
+// call is refused or fails with Jamendo at fault (see jamendoUnhealthy), a
+// cached response up to jamendoStaleTTL past its TTL is returned instead,
+// with stale set.
+func (c *JamendoClient) fetch(ctx context.Context, resource string, params url.Values, key string) (body []byte, stale bool, err error) {
+	body, err = c.call(ctx, resource, params)
+	if err == nil {
+		c.cache.put(key, body, c.now())
+		return body, false, nil
+	}
+	if !jamendoUnhealthy(err) {
+		return nil, false, err
+	}
+	if body, age, ok := c.cache.get(key, c.now()); ok {
+		jamendoStats.Add("stale_served", 1)
+		log.Warn().Err(err).Str("key", key).Dur("age", age).Msg("Serving stale Jamendo response")
+		return body, true, nil
+	}
+	return nil, false, err
+}
+
+// call makes one call through the rate limit and circuit breaker.
+func (c *JamendoClient) call(ctx context.Context, resource string, params url.Values) ([]byte, error) {
+	if wait, ok := c.limiter.take(c.now(), jamendoMaxRateWait); !ok {
+		jamendoStats.Add("rate_limited", 1)
+		return nil, errJamendoRateLimited
+	} else if wait > 0 {
+		t := time.NewTimer(wait)
+		defer t.Stop()
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	if !c.breaker.allow(c.now()) {
+		jamendoStats.Add("circuit_rejected", 1)
+		return nil, errJamendoUnavailable
+	}
+
+	jamendoStats.Add("upstream_calls", 1)
+	body, err := c.roundTrip(ctx, resource, params)
+	failed := err != nil && jamendoUnhealthy(err)
+	if failed {
+		jamendoStats.Add("upstream_errors", 1)
+	}
+	if c.breaker.record(c.now(), failed) {
+		jamendoStats.Add("circuit_opened", 1)
+		log.Warn().Err(err).Dur("cooldown", c.breaker.cooldown).Msg("Jamendo failing; circuit open")
+	}
+	return body, err
+}
+
+// jamendoUnhealthy reports whether err means Jamendo itself is failing or
+// unreachable, as opposed to rejecting the request: network errors,
+// timeouts, 5xx and 429 responses, and calls this client refused to make.
+func jamendoUnhealthy(err error) bool {
+	var apiErr *JamendoAPIError
+	if errors.As(err, &apiErr) {
+		return apiErr.StatusCode >= 500 || apiErr.StatusCode == http.StatusTooManyRequests
+	}
+	return err != nil
+}
+
+// writeJamendoError answers a failed Jamendo call: 503 with Retry-After when
+// this server held the call back, 502 when Jamendo failed it.
+func writeJamendoError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, errJamendoRateLimited):
+		w.Header().Set("Retry-After", "1")
+		writeJSONError(w, "Too many Jamendo requests, try again shortly", http.StatusServiceUnavailable)
+	case errors.Is(err, errJamendoUnavailable):
+		w.Header().Set("Retry-After", "30")
+		writeJSONError(w, "Jamendo is unavailable, try again shortly", http.StatusServiceUnavailable)
+	default:
+		writeJSONError(w, "Jamendo API request failed", http.StatusBadGateway)
+	}
+}
+
+// responseCache holds response bodies by key, evicting the least recently
+// used past size. Entries are fresh for ttl and kept for jamendoStaleTTL
+// after that to stand in when Jamendo fails. A size of 0 caches nothing.
+type responseCache struct {
+	mu      sync.Mutex
+	size    int
+	ttl     time.Duration
+	entries map[string]*list.Element
+	lru     *list.List // Of *cacheEntry, most recently used first
+}
+
+type cacheEntry struct {
+	key    string
+	body   []byte
+	stored time.Time
+}
+
+func newResponseCache(size int, ttl time.Duration) *responseCache {
+	return &responseCache{size: size, ttl: ttl, entries: map[string]*list.Element{}, lru: list.New()}
+}
+
+// get returns the body cached under key and its age. Entries too old even
+// to serve stale are dropped.
+func (c *responseCache) get(key string, now time.Time) (body []byte, age time.Duration, ok bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.entries[key]
+	if !ok {
+		return nil, 0, false
+	}
+	e := el.Value.(*cacheEntry)
+	if age = now.Sub(e.stored); age > c.ttl+jamendoStaleTTL {
+		c.lru.Remove(el)
+		delete(c.entries, key)
+		return nil, 0, false
+	}
+	c.lru.MoveToFront(el)
+	return e.body, age, true
+}
+
+func (c *responseCache) put(key string, body []byte, now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.size == 0 {
+		return
+	}
+	if el, ok := c.entries[key]; ok {
+		el.Value = &cacheEntry{key: key, body: body, stored: now}
+		c.lru.MoveToFront(el)
+		return
+	}
+	c.entries[key] = c.lru.PushFront(&cacheEntry{key: key, body: body, stored: now})
+	for c.lru.Len() > c.size {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cacheEntry).key)
+	}
+}
+
+// flightGroup collapses concurrent calls for the same key into one.
+type flightGroup struct {
+	mu      sync.Mutex
+	flights map[string]*flight
+}
+
+type flight struct {
+	done  chan struct{}
+	body  []byte
+	stale bool
+	err   error
+}
+
+// do runs fn for key unless a call for key is already running, and waits
+// for that call's result. fn runs on its own goroutine, so a caller whose
+// ctx ends stops waiting without affecting the others.
+func (g *flightGroup) do(ctx context.Context, key string, fn func() ([]byte, bool, error)) ([]byte, bool, error) {
+	g.mu.Lock()
+	if g.flights == nil {
+		g.flights = map[string]*flight{}
+	}
+	f, ok := g.flights[key]
+	if ok {
+		jamendoStats.Add("shared_calls", 1)
+	} else {
+		f = &flight{done: make(chan struct{})}
+		g.flights[key] = f
+		go func() {
+			f.body, f.stale, f.err = fn()
+			g.mu.Lock()
+			delete(g.flights, key)
+			g.mu.Unlock()
+			close(f.done)
+		}()
+	}
+	g.mu.Unlock()
+
+	select {
+	case <-f.done:
+		return f.body, f.stale, f.err
+	case <-ctx.Done():
+		return nil, false, ctx.Err()
+	}
+}
+
+// tokenBucket allows rate calls per second on average, in bursts of up to
+// burst. A nil *tokenBucket allows everything.
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// newTokenBucket returns a full bucket, or nil for a rate of 0.
+func newTokenBucket(rate float64, burst int) *tokenBucket {
+	if rate == 0 {
+		return nil
+	}
+	return &tokenBucket{rate: rate, burst: float64(burst), tokens: float64(burst)}
+}
+
+// take claims a token and returns how long to wait before using it. If
+// none frees up within maxWait it claims nothing and reports false.
+func (b *tokenBucket) take(now time.Time, maxWait time.Duration) (time.Duration, bool) {
+	if b == nil {
+		return 0, true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !b.last.IsZero() {
+		b.tokens = min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	}
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return 0, true
+	}
+	wait := time.Duration((1 - b.tokens) / b.rate * float64(time.Second))
+	if wait > maxWait {
+		return wait, false
+	}
+	b.tokens-- // Claimed ahead; the balance goes negative until it refills
+	return wait, true
+}
+
+// circuitBreaker stops calls to a failing service. After threshold failures
+// in a row it opens; once cooldown has passed it lets a single probe
+// through, which closes it on success and reopens it on failure.
+type circuitBreaker struct {
+	mu        sync.Mutex
+	threshold int
+	cooldown  time.Duration
+	failures  int
+	openedAt  time.Time
+	probing   bool
+}
+
+func newCircuitBreaker(threshold int, cooldown time.Duration) *circuitBreaker {
+	return &circuitBreaker{threshold: threshold, cooldown: cooldown}
+}
+
+// allow reports whether a call may go ahead.
+func (b *circuitBreaker) allow(now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.failures < b.threshold {
+		return true
+	}
+	if b.probing || now.Sub(b.openedAt) < b.cooldown {
+		return false
+	}
+	b.probing = true
+	return true
+}
+
+// record notes the outcome of an allowed call and reports whether it opened
+// (or reopened) the circuit.
+func (b *circuitBreaker) record(now time.Time, failed bool) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.probing = false
+	if !failed {
+		b.failures = 0
+		return false
+	}
+	b.failures++
+	if b.failures < b.threshold {
+		return false
+	}
+	b.openedAt = now
+	return true
+}
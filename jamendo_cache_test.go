@@ -0,0 +1,204 @@
+package main
+
+import (
+	"expvar"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testClock is a settable clock for the Jamendo client.
+type testClock struct {
+	mu sync.Mutex
+	t  time.Time
+}
+
+func (c *testClock) now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.t
+}
+
+func (c *testClock) advance(d time.Duration) {
+	c.mu.Lock()
+	c.t = c.t.Add(d)
+	c.mu.Unlock()
+}
+
+// useTestClock makes the jamendo client read time from a testClock.
+func useTestClock() *testClock {
+	clock := &testClock{t: time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)}
+	jamendo.now = clock.now
+	return clock
+}
+
+// jamendoStat reads one of the jamendo expvar counters.
+func jamendoStat(name string) int64 {
+	if v, ok := jamendoStats.Get(name).(*expvar.Int); ok {
+		return v.Value()
+	}
+	return 0
+}
+
+// search runs /api/jamendo/search?query and returns the status and page.
+func search(query string) (int, jamendoSearchResponse) {
+	var page jamendoSearchResponse
+	code := serveJSON(JamendoSearchHandler, "/api/jamendo/search?"+query, &page)
+	return code, page
+}
+
+func TestJamendoCache(t *testing.T) {
+	api := newJamendoFixtures(t, map[string]string{"tracks": "tracks.json"})
+	clock := useTestClock()
+	hits, misses := jamendoStat("cache_hits"), jamendoStat("cache_misses")
+
+	// Case, spacing and tag order don't matter.
+	for _, query := range []string{"query=Morning++Light&tags=Piano,chill", "query=morning+light&tags=chill&genre=piano"} {
+		if code, page := search(query); code != http.StatusOK || len(page.Results) != 2 {
+			t.Fatalf("%s: status %d, %d results", query, code, len(page.Results))
+		}
+	}
+	if n := api.calls(); n != 1 {
+		t.Errorf("equivalent searches made %d calls", n)
+	}
+	if h, m := jamendoStat("cache_hits")-hits, jamendoStat("cache_misses")-misses; h != 1 || m != 1 {
+		t.Errorf("%d hits and %d misses, want 1 of each", h, m)
+	}
+	if search("query=morning+light&limit=10"); api.calls() != 2 {
+		t.Errorf("another page was served from the cache")
+	}
+
+	clock.advance(defaultJamendoCacheTTL + time.Second)
+	if search("query=morning+light&tags=chill,piano"); api.calls() != 3 {
+		t.Errorf("expired entry was served")
+	}
+
+	// The least recently used entry goes first.
+	jamendo.cache = newResponseCache(2, time.Hour)
+	for _, q := range []string{"a", "b", "a", "c", "a", "b"} {
+		search("query=" + q)
+	}
+	if n := api.calls(); n != 3+4 {
+		t.Errorf("%d calls for a, b, a, c, a, b with room for two; want 4", n-3)
+	}
+}
+
+func TestJamendoSingleFlight(t *testing.T) {
+	api := newJamendoFixtures(t, map[string]string{"tracks": "tracks.json"})
+	api.gate = make(chan struct{})
+	shared := jamendoStat("shared_calls")
+
+	const callers = 5
+	codes := make([]int, callers)
+	var wg sync.WaitGroup
+	for i := range codes {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			codes[i], _ = search("query=together")
+		}(i)
+	}
+	for deadline := time.Now().Add(5 * time.Second); jamendoStat("shared_calls")-shared < callers-1; {
+		if time.Now().After(deadline) {
+			t.Fatalf("only %d callers joined the call in flight", jamendoStat("shared_calls")-shared)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	close(api.gate)
+	wg.Wait()
+	if n := api.calls(); n != 1 {
+		t.Errorf("%d concurrent identical searches made %d calls", callers, n)
+	}
+	for i, code := range codes {
+		if code != http.StatusOK {
+			t.Errorf("caller %d: status %d", i, code)
+		}
+	}
+}
+
+func TestJamendoRateLimit(t *testing.T) {
+	api := newJamendoFixtures(t, map[string]string{"tracks": "tracks.json"})
+	clock := useTestClock()
+	jamendo.limiter = newTokenBucket(1.0/60, 2) // A burst of two, then one a minute
+
+	for _, q := range []string{"a", "b"} {
+		if code, _ := search("query=" + q); code != http.StatusOK {
+			t.Fatalf("%s: status %d", q, code)
+		}
+	}
+	rec := httptest.NewRecorder()
+	JamendoSearchHandler(rec, httptest.NewRequest(http.MethodGet, "/api/jamendo/search?query=c", nil))
+	if rec.Code != http.StatusServiceUnavailable || rec.Header().Get("Retry-After") == "" {
+		t.Errorf("over the limit: status %d, Retry-After %q", rec.Code, rec.Header().Get("Retry-After"))
+	}
+	if code, _ := search("query=a"); code != http.StatusOK {
+		t.Errorf("cached search over the limit: status %d", code)
+	}
+	if n := api.calls(); n != 2 {
+		t.Errorf("%d calls, want 2", n)
+	}
+
+	clock.advance(time.Minute)
+	if code, _ := search("query=c"); code != http.StatusOK || api.calls() != 3 {
+		t.Errorf("after a minute: status %d", code)
+	}
+}
+
+func TestJamendoCircuitBreaker(t *testing.T) {
+	api := newJamendoFixtures(t, map[string]string{"tracks": "tracks.json"})
+	clock := useTestClock()
+	jamendo.breaker = newCircuitBreaker(2, time.Minute)
+
+	// Requests Jamendo rejects don't count against it.
+	api.fail(http.StatusBadRequest)
+	for _, q := range []string{"x", "y", "z"} {
+		if code, _ := search("query=" + q); code != http.StatusBadGateway {
+			t.Errorf("rejected search: status %d", code)
+		}
+	}
+	if n := api.calls(); n != 3 {
+		t.Fatalf("circuit opened on client errors")
+	}
+
+	api.fail(0)
+	if code, _ := search("query=a"); code != http.StatusOK {
+		t.Fatalf("status %d", code)
+	}
+	clock.advance(defaultJamendoCacheTTL + time.Second)
+	api.fail(http.StatusInternalServerError)
+
+	// An expired entry stands in for a failed call...
+	code, page := search("query=a")
+	if code != http.StatusOK || !page.Stale || len(page.Results) != 2 {
+		t.Errorf("failing with a cached copy: status %d, %+v", code, page)
+	}
+	if code, _ := search("query=b"); code != http.StatusBadGateway {
+		t.Errorf("failing without a cached copy: status %d", code)
+	}
+	// ...and the second failure in a row opens the circuit.
+	calls := api.calls()
+	if code, _ := search("query=c"); code != http.StatusServiceUnavailable {
+		t.Errorf("open circuit: status %d", code)
+	}
+	if code, page := search("query=a"); code != http.StatusOK || !page.Stale {
+		t.Errorf("open circuit with a cached copy: status %d, stale %v", code, page.Stale)
+	}
+	if api.calls() != calls {
+		t.Errorf("calls made through an open circuit")
+	}
+
+	// After the cooldown one call probes Jamendo and closes the circuit.
+	clock.advance(time.Minute)
+	api.fail(0)
+	if code, page := search("query=c"); code != http.StatusOK || page.Stale {
+		t.Errorf("probe: status %d, stale %v", code, page.Stale)
+	}
+	if code, page := search("query=a"); code != http.StatusOK || page.Stale {
+		t.Errorf("closed again: status %d, stale %v", code, page.Stale)
+	}
+	if n := api.calls() - calls; n != 2 {
+		t.Errorf("%d calls after closing, want 2", n)
+	}
+}
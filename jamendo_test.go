@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// newJamendoFixtures stands in for the Jamendo API, answering each resource
+// ("tracks", ...) with a JSON file from testdata/jamendo. It points the
+// jamendo client at itself for the test's duration.
+func newJamendoFixtures(t *testing.T, routes map[string]string) *fixtureServer {
+	f := newFixtureServer(t, "jamendo", "/v3.0", routes)
+	saved := jamendo
+	jamendo = newJamendoClient(f.URL+"/v3.0/", "test-client")
+	t.Cleanup(func() { jamendo = saved })
+	return f
+}
+
+// serveJSON calls handler for a GET of target and decodes the response.
+func serveJSON(handler http.HandlerFunc, target string, out interface{}) int {
+	rec := httptest.NewRecorder()
+	handler(rec, httptest.NewRequest(http.MethodGet, target, nil))
+	if out != nil {
+		json.NewDecoder(rec.Body).Decode(out)
+	}
+	return rec.Code
+}
+
+func TestJamendoSearch(t *testing.T) {
+	api := newJamendoFixtures(t, map[string]string{"tracks": "tracks.json"})
+
+	var page jamendoSearchResponse
+	code := serveJSON(JamendoSearchHandler, "/api/jamendo/search?query=morning&tags=chill,+piano&genre=jazz"+
+		"&minDuration=60&order=popularity&audioformat=flac&offset=3&limit=3", &page)
+	if code != http.StatusOK {
+		t.Fatalf("status %d", code)
+	}
+	want := url.Values{
+		"client_id": {"test-client"}, "format": {"json"}, "imagesize": {"300"}, "fullcount": {"true"},
+		"search": {"morning"}, "tags": {"chill jazz piano"}, "durationbetween": {"60_86400"},
+		"order": {"popularity_total"}, "audioformat": {"flac"}, "offset": {"3"}, "limit": {"3"},
+	}
+	if got := api.last().Query(); got.Encode() != want.Encode() {
+		t.Errorf("Jamendo query\n got %s\nwant %s", got.Encode(), want.Encode())
+	}
+
+	// The track with neither stream nor download URL is left out.
+	if len(page.Results) != 2 || page.Total != 7 || page.Offset != 3 || page.Limit != 3 || page.NextOffset == nil || *page.NextOffset != 6 {
+		t.Fatalf("page = %+v", page)
+	}
+	first, second := page.Results[0], page.Results[1]
+	if first.ID != "jamendo-1886257" || first.JamendoID == nil || *first.JamendoID != "1886257" || first.Title != "Morning Light" ||
+		first.Artist != "Alanis Rivers" || first.Album != "Open Skies" || first.Duration != 214 ||
+		!strings.Contains(first.FilePath, "trackid=1886257") || !strings.HasPrefix(first.CoverPath, "https://") {
+		t.Errorf("first result = %+v", first)
+	}
+	if !strings.Contains(second.FilePath, "/download/track/1712430/") || second.CoverPath != "/static/images/default-cover.jpg" {
+		t.Errorf("second result = %+v", second)
+	}
+
+	// The last page has no next offset; tags alone are enough to search.
+	page = jamendoSearchResponse{}
+	serveJSON(JamendoSearchHandler, "/api/jamendo/search?genre=rock&offset=4&limit=3", &page)
+	if page.NextOffset != nil {
+		t.Errorf("next offset %d past the end", *page.NextOffset)
+	}
+	if got := api.last().Query(); got.Get("tags") != "rock" || got.Has("search") || got.Has("order") || got.Get("limit") != "3" {
+		t.Errorf("tag-only query %s", got.Encode())
+	}
+}
+
+func TestJamendoSearchErrors(t *testing.T) {
+	api := newJamendoFixtures(t, map[string]string{"tracks": "error.json"})
+
+	for _, query := range []string{
+		"", "tags=,", "query=a&limit=0", "query=a&limit=201", "query=a&offset=-1", "query=a&minDuration=x",
+		"query=a&minDuration=300&maxDuration=100", "query=a&order=random", "query=a&audioformat=wav",
+	} {
+		if code := serveJSON(JamendoSearchHandler, "/api/jamendo/search?"+query, nil); code != http.StatusBadRequest {
+			t.Errorf("%q: status %d, want 400", query, code)
+		}
+	}
+	if n := api.calls(); n != 0 {
+		t.Errorf("invalid searches made %d Jamendo calls", n)
+	}
+
+	// Jamendo reports bad credentials in a 200 response.
+	if code := serveJSON(JamendoSearchHandler, "/api/jamendo/search?query=a", nil); code != http.StatusBadGateway {
+		t.Errorf("failed status: %d, want 502", code)
+	}
+	_, err := jamendo.SearchTracks(context.Background(), JamendoTrackQuery{Search: "a"})
+	var apiErr *JamendoAPIError
+	if !errors.As(err, &apiErr) || apiErr.Code != 5 || apiErr.Message != "Your credential is not authorized." {
+		t.Errorf("error = %v", err)
+	}
+
+	delete(api.routes, "tracks")
+	if code := serveJSON(JamendoSearchHandler, "/api/jamendo/search?query=a", nil); code != http.StatusBadGateway {
+		t.Errorf("HTTP 404: status %d, want 502", code)
+	}
+	_, err = jamendo.SearchTracks(context.Background(), JamendoTrackQuery{Search: "a"})
+	if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusNotFound {
+		t.Errorf("error = %v", err)
+	}
+}
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"context"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// librarySource is the local library's provider name and song ID prefix.
+// Its track IDs are slash-separated paths relative to the library root.
+const librarySource = "library"
+
+// libraryRescanInterval is how old the index may get before a search or
+// lookup walks the directory again.
+const libraryRescanInterval = 5 * time.Minute
+
+// libraryExtensions are the file extensions indexed.
+var libraryExtensions = map[string]bool{
+	".mp3": true, ".flac": true, ".ogg": true, ".oga": true, ".opus": true,
+	".wav": true, ".aif": true, ".aiff": true, ".m4a": true,
+}
+
+// LibraryProvider serves a directory of audio files, such as an existing
+// music collection, read-only and without copying it into uploads/.
+type LibraryProvider struct {
+	Root string
+
+	mu       sync.Mutex
+	tracks   []*libraryTrack // In path order
+	byPath   map[string]*libraryTrack
+	scanned  time.Time
+	scanning chan struct{} // Closed when the scan in progress finishes; nil when idle
+}
+
+type libraryTrack struct {
+	path    string // Relative to Root, slash-separated
+	size    int64
+	modTime time.Time
+	song    Song
+}
+
+func newLibraryProvider(root string) *LibraryProvider {
+	return &LibraryProvider{Root: root, byPath: map[string]*libraryTrack{}}
+}
+
+// library is the local library provider, nil unless LIBRARY_DIR is set.
+var library *LibraryProvider
+
+// loadLibrary reads LIBRARY_DIR.
+func loadLibrary() *LibraryProvider {
+	v := os.Getenv("LIBRARY_DIR")
+	if v == "" {
+		return nil
+	}
+	if info, err := os.Stat(v); err != nil || !info.IsDir() {
+		log.Fatal().Str("LIBRARY_DIR", v).Msg("LIBRARY_DIR must be a directory")
+	}
+	return newLibraryProvider(v)
+}
+
+// index returns the indexed tracks, rescanning the directory first if the
+// index is older than libraryRescanInterval. The scan runs without holding
+// l.mu: while one caller rescans, others keep getting the previous index, or
+// wait for the scan if there is none yet.
+func (l *LibraryProvider) index() []*libraryTrack {
+	l.mu.Lock()
+	if !l.scanned.IsZero() && time.Since(l.scanned) < libraryRescanInterval {
+		defer l.mu.Unlock()
+		return l.tracks
+	}
+	if done := l.scanning; done != nil {
+		if !l.scanned.IsZero() {
+			defer l.mu.Unlock()
+			return l.tracks
+		}
+		l.mu.Unlock()
+		<-done
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		return l.tracks
+	}
+	done := make(chan struct{})
+	l.scanning = done
+	previous := l.byPath
+	l.mu.Unlock()
+
+	tracks, byPath := scanLibrary(l.Root, previous)
+
+	l.mu.Lock()
+	l.tracks, l.byPath, l.scanned, l.scanning = tracks, byPath, time.Now(), nil
+	l.mu.Unlock()
+	close(done)
+	return tracks
+}
+
+// scanLibrary walks root and returns its tracks in path order. Files whose
+// size and modification time match their entry in previous keep its
+// metadata; previous itself is not modified.
+func scanLibrary(root string, previous map[string]*libraryTrack) ([]*libraryTrack, map[string]*libraryTrack) {
+	started := time.Now()
+	var tracks []*libraryTrack
+	byPath := map[string]*libraryTrack{}
+	err := filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			log.Warn().Err(err).Str("path", p).Msg("Skipping unreadable library path")
+			return nil
+		}
+		if d.IsDir() || !libraryExtensions[strings.ToLower(filepath.Ext(p))] {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		rel, err := filepath.Rel(root, p)
+		if err != nil {
+			return nil
+		}
+		rel = filepath.ToSlash(rel)
+		t := previous[rel]
+		if t == nil || t.size != info.Size() || !t.modTime.Equal(info.ModTime()) {
+			if t, err = readLibraryTrack(p, rel, info); err != nil {
+				log.Debug().Err(err).Str("path", p).Msg("Skipping library file")
+				return nil
+			}
+		}
+		tracks = append(tracks, t)
+		byPath[rel] = t
+		return nil
+	})
+	if err != nil {
+		log.Error().Err(err).Str("root", root).Msg("Library scan failed")
+	}
+	log.Info().Str("root", root).Int("tracks", len(tracks)).Dur("took", time.Since(started)).Msg("Library scanned")
+	return tracks, byPath
+}
+
+// readLibraryTrack reads the tags of the file at p.
+func readLibraryTrack(p, rel string, info fs.FileInfo) (*libraryTrack, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	md, err := extractMetadata(f, info.Size())
+	if err != nil {
+		return nil, err
+	}
+	title := md.Title
+	if title == "" {
+		title = strings.TrimSuffix(path.Base(rel), path.Ext(rel))
+	}
+	return &libraryTrack{path: rel, size: info.Size(), modTime: info.ModTime(), song: Song{
+		ID: librarySource + "-" + rel, Title: title, Artist: md.Artist, Album: md.Album,
+		FilePath: "/api/library/" + escapePath(rel), CoverPath: "/static/images/default-cover.jpg",
+		IsLocal: true, Duration: int(md.DurationMs / 1000), Genre: md.Genre, Year: md.Year,
+		TrackNumber: md.TrackNumber, DiscNumber: md.DiscNumber, Codec: md.Codec, Bitrate: md.Bitrate,
+		SampleRate: md.SampleRate, Channels: md.Channels, DurationMs: md.DurationMs,
+		MimeType: supportedFormats[md.Format].MIME, FileSize: info.Size(), Source: librarySource,
+	}}, nil
+}
+
+// lookup returns the indexed track at rel.
+func (l *LibraryProvider) lookup(rel string) (*libraryTrack, bool) {
+	l.index()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	t, ok := l.byPath[rel]
+	return t, ok
+}
+
+// Name implements Provider.
+func (l *LibraryProvider) Name() string { return librarySource }
+
+// Search implements Provider: every word of the query must appear in the
+// title, artist, album, genre or path, and every tag in the genre, ignoring
+// case.
+func (l *LibraryProvider) Search(ctx context.Context, q SearchQuery) (*SearchPage, error) {
+	words := strings.Fields(strings.ToLower(q.Text))
+	page := &SearchPage{Songs: []Song{}}
+	for _, t := range l.index() {
+		s := t.song
+		text := strings.ToLower(strings.Join([]string{s.Title, s.Artist, s.Album, s.Genre, t.path}, "\n"))
+		genre := strings.ToLower(s.Genre)
+		if !containsAll(text, words) || !containsAll(genre, lowerAll(q.Tags)) {
+			continue
+		}
+		if page.Total >= q.Offset && (q.Limit == 0 || len(page.Songs) < q.Limit) {
+			page.Songs = append(page.Songs, s)
+		}
+		page.Total++
+	}
+	return page, nil
+}
+
+func containsAll(s string, words []string) bool {
+	for _, w := range words {
+		if !strings.Contains(s, w) {
+			return false
+		}
+	}
+	return true
+}
+
+func lowerAll(list []string) []string {
+	out := make([]string, len(list))
+	for i, s := range list {
+		out[i] = strings.ToLower(s)
+	}
+	return out
+}
+
+// Track implements Provider.
+func (l *LibraryProvider) Track(ctx context.Context, id string) (*Song, error) {
+	t, ok := l.lookup(id)
+	if !ok {
+		return nil, errTrackNotFound
+	}
+	song := t.song
+	return &song, nil
+}
+
+// StreamURL implements Provider.
+func (l *LibraryProvider) StreamURL(ctx context.Context, id string) (string, error) {
+	t, ok := l.lookup(id)
+	if !ok {
+		return "", errTrackNotFound
+	}
+	return t.song.FilePath, nil
+}
+
+// Attribution implements Provider.
+func (l *LibraryProvider) Attribution() Attribution {
+	return Attribution{Name: "Local library"}
+}
+
+// LibraryFileHandler serves GET /api/library/{path...}: the audio of an
+// indexed library file, with Range support. Only indexed files are served,
+// never other files under the root.
+func LibraryFileHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		writeJSONError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if library == nil {
+		writeJSONError(w, "No library configured", http.StatusNotFound)
+		return
+	}
+	t, ok := library.lookup(r.PathValue("path"))
+	if !ok {
+		writeJSONError(w, "File not found", http.StatusNotFound)
+		return
+	}
+	f, err := os.Open(filepath.Join(library.Root, filepath.FromSlash(t.path)))
+	if err != nil {
+		log.Error().Err(err).Str("path", t.path).Msg("Failed to open library file")
+		writeJSONError(w, "File not found", http.StatusNotFound)
+		return
+	}
+	defer f.Close()
+	if t.song.MimeType != "" {
+		w.Header().Set("Content-Type", t.song.MimeType)
+	}
+	http.ServeContent(w, r, path.Base(t.path), t.modTime, f)
+}
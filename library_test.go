@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// newTestLibrary writes files (by slash-separated path) to a temporary
+// directory and makes it the library for the test's duration.
+func newTestLibrary(t *testing.T, files map[string][]byte) *LibraryProvider {
+	root := t.TempDir()
+	for name, content := range files {
+		p := filepath.Join(root, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, content, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	saved := library
+	library = newLibraryProvider(root)
+	t.Cleanup(func() { library = saved })
+	return library
+}
+
+func TestLibraryProvider(t *testing.T) {
+	lib := newTestLibrary(t, map[string][]byte{
+		"Tag Artist/Tag Album/03 Harbour.mp3": testMP3("Harbour Lights"),
+		"Wav Artist/take.wav":                 testWAV(),
+		"Field/untitled take.wav":             sineWAV(8000, sine(8000, 1, 0.5, 440, 0.5, 0)),
+		"Field/notes.txt":                     []byte("not audio"),
+		"Field/broken.mp3":                    []byte("not audio either"),
+	})
+	ctx := context.Background()
+
+	page, err := lib.Search(ctx, SearchQuery{Text: "HARBOUR tag"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if page.Total != 1 || len(page.Songs) != 1 {
+		t.Fatalf("%d of %d results", len(page.Songs), page.Total)
+	}
+	song := page.Songs[0]
+	if song.ID != "library-Tag Artist/Tag Album/03 Harbour.mp3" || song.Title != "Harbour Lights" || song.Artist != "Tag Artist" ||
+		song.Genre != "Rock" || song.Source != "library" || song.MimeType != "audio/mpeg" ||
+		song.FilePath != "/api/library/Tag%20Artist/Tag%20Album/03%20Harbour.mp3" {
+		t.Errorf("result = %+v", song)
+	}
+
+	// Files without tags are named after the file; paths match too.
+	page, _ = lib.Search(ctx, SearchQuery{Text: "field"})
+	if len(page.Songs) != 1 || page.Songs[0].Title != "untitled take" || page.Songs[0].DurationMs != 500 {
+		t.Errorf("field search = %+v", page.Songs)
+	}
+	if page, _ = lib.Search(ctx, SearchQuery{Tags: []string{"rock"}}); len(page.Songs) != 1 {
+		t.Errorf("tag search found %d", len(page.Songs))
+	}
+	if page, _ = lib.Search(ctx, SearchQuery{Text: "wav", Offset: 1, Limit: 1}); page.Total != 2 || len(page.Songs) != 1 {
+		t.Errorf("paged search: %d of %d", len(page.Songs), page.Total)
+	}
+
+	if _, err := lib.Track(ctx, "Field/notes.txt"); !errors.Is(err, errTrackNotFound) {
+		t.Errorf("non-audio file: %v", err)
+	}
+	if song, err := lib.Track(ctx, "Wav Artist/take.wav"); err != nil || song.Title != "Wav Title" || song.Album != "Wav Album" {
+		t.Errorf("track = %+v, %v", song, err)
+	}
+
+	// New files appear once the index is rescanned.
+	os.WriteFile(filepath.Join(lib.Root, "new.mp3"), testMP3("Fresh"), 0o644)
+	if _, err := lib.Track(ctx, "new.mp3"); !errors.Is(err, errTrackNotFound) {
+		t.Errorf("index rescanned early")
+	}
+	lib.mu.Lock()
+	lib.scanned = lib.scanned.Add(-libraryRescanInterval)
+	lib.mu.Unlock()
+	if song, err := lib.Track(ctx, "new.mp3"); err != nil || song.Title != "Fresh" {
+		t.Errorf("after rescan: %+v, %v", song, err)
+	}
+}
+
+// A rescan in progress must not block lookups that can use the old index.
+func TestLibraryIndexDuringRescan(t *testing.T) {
+	lib := newTestLibrary(t, map[string][]byte{"old.mp3": testMP3("Old")})
+	ctx := context.Background()
+	if _, err := lib.Track(ctx, "old.mp3"); err != nil {
+		t.Fatal(err)
+	}
+	os.WriteFile(filepath.Join(lib.Root, "new.mp3"), testMP3("New"), 0o644)
+
+	// Pretend another request is rescanning the expired index.
+	scan := make(chan struct{})
+	lib.mu.Lock()
+	lib.scanned = lib.scanned.Add(-libraryRescanInterval)
+	lib.scanning = scan
+	lib.mu.Unlock()
+	result := make(chan error, 1)
+	go func() {
+		_, err := lib.Track(ctx, "old.mp3")
+		result <- err
+	}()
+	select {
+	case err := <-result:
+		if err != nil {
+			t.Errorf("old index: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("lookup blocked on the rescan")
+	}
+	if _, err := lib.Track(ctx, "new.mp3"); !errors.Is(err, errTrackNotFound) {
+		t.Errorf("new file served before the rescan finished: %v", err)
+	}
+
+	lib.mu.Lock()
+	lib.scanning = nil
+	lib.mu.Unlock()
+	close(scan)
+	if song, err := lib.Track(ctx, "new.mp3"); err != nil || song.Title != "New" {
+		t.Errorf("after rescan: %+v, %v", song, err)
+	}
+
+	// Without an old index, callers wait for the scan in progress.
+	fresh := newLibraryProvider(lib.Root)
+	scan = make(chan struct{})
+	fresh.scanning = scan
+	go func() {
+		_, err := fresh.Track(ctx, "new.mp3")
+		result <- err
+	}()
+	select {
+	case err := <-result:
+		t.Fatalf("lookup returned before the first scan: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	tracks, byPath := scanLibrary(fresh.Root, nil)
+	fresh.mu.Lock()
+	fresh.tracks, fresh.byPath, fresh.scanned, fresh.scanning = tracks, byPath, time.Now(), nil
+	fresh.mu.Unlock()
+	close(scan)
+	if err := <-result; err != nil {
+		t.Errorf("after first scan: %v", err)
+	}
+}
+
+func TestLibraryFileHandler(t *testing.T) {
+	wav := testWAV()
+	newTestLibrary(t, map[string][]byte{"Wav Artist/take one.wav": wav, "secret.txt": []byte("private")})
+	srv := httptest.NewServer(newRouter())
+	defer srv.Close()
+
+	req, _ := http.NewRequest(http.MethodGet, srv.URL+"/api/library/Wav%20Artist/take%20one.wav", nil)
+	req.Header.Set("Range", "bytes=0-11")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusPartialContent || resp.Header.Get("Content-Type") != "audio/wav" || string(body) != string(wav[:12]) {
+		t.Errorf("range request: status %d, type %q, body %q", resp.StatusCode, resp.Header.Get("Content-Type"), body)
+	}
+
+	for _, p := range []string{"/api/library/secret.txt", "/api/library/..%2Fsecret.txt", "/api/library/missing.wav"} {
+		resp, err := http.Get(srv.URL + p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusNotFound {
+			t.Errorf("%s: status %d, want 404", p, resp.StatusCode)
+		}
+	}
+
+	// The track endpoints take library IDs with the slashes escaped.
+	var song Song
+	resp, err = http.Get(srv.URL + "/api/tracks/library-Wav%20Artist%2Ftake%20one.wav")
+	if err != nil {
+		t.Fatal(err)
+	}
+	json.NewDecoder(resp.Body).Decode(&song)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || song.Title != "Wav Title" {
+		t.Errorf("track: status %d, %+v", resp.StatusCode, song)
+	}
+}
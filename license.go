@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+)
+
+// errLicenseForbids is returned when a track's license doesn't allow what
+// was asked of it, such as downloading it.
+var errLicenseForbids = errors.New("license does not allow this use")
+
+// parseLicense recognizes Creative Commons license and public domain URLs,
+// returning the license type ("BY", "BY-NC-SA", "CC0", "PDM", ...) and
+// version. Both are empty for anything else.
+func parseLicense(licenseURL string) (kind, version string) {
+	u, err := url.Parse(strings.TrimSpace(licenseURL))
+	if err != nil || strings.TrimPrefix(strings.ToLower(u.Host), "www.") != "creativecommons.org" {
+		return "", ""
+	}
+	parts := strings.Split(strings.Trim(u.Path, "/"), "/")
+	switch {
+	case len(parts) >= 2 && parts[0] == "licenses":
+		kind = strings.ToUpper(parts[1])
+		for _, term := range strings.Split(kind, "-") {
+			if term != "BY" && term != "SA" && term != "NC" && term != "ND" {
+				return "", ""
+			}
+		}
+	case len(parts) >= 2 && parts[0] == "publicdomain" && parts[1] == "zero":
+		kind = "CC0"
+	case len(parts) >= 2 && parts[0] == "publicdomain" && parts[1] == "mark":
+		kind = "PDM"
+	default:
+		return "", ""
+	}
+	if len(parts) >= 3 {
+		version = parts[2]
+	}
+	return kind, version
+}
+
+// licenseAllowsCopies reports whether a license lets us keep a verbatim
+// copy and pass it on, as every Creative Commons license and public domain
+// dedication does. Tracks under anything else are only ever streamed.
+func licenseAllowsCopies(kind string) bool {
+	return kind != ""
+}
+
+// setLicense fills in s's license fields. s.ID must already be set: the
+// attribution links to the track's page at its provider.
+func setLicense(s *Song, licenseURL, artistURL string) {
+	s.LicenseURL, s.ArtistURL = licenseURL, artistURL
+	s.LicenseType, _ = parseLicense(licenseURL)
+	s.AttributionText = attributionText(s.Title, s.Artist, trackPageURL(s.ID), licenseURL)
+}
+
+// trackPageURL is the public page of a Jamendo or Internet Archive track.
+func trackPageURL(songID string) string {
+	source, id, _ := strings.Cut(songID, "-")
+	switch source {
+	case jamendoSource:
+		return "https://www.jamendo.com/track/" + id
+	case archiveSource:
+		return "https://archive.org/details/" + id
+	}
+	return ""
+}
+
+// attributionText credits a track the way Creative Commons recommends:
+// title, author, source and license. It is empty for unlicensed tracks.
+func attributionText(title, artist, sourceURL, licenseURL string) string {
+	if licenseURL == "" {
+		return ""
+	}
+	credit := fmt.Sprintf("%q", title)
+	if artist != "" {
+		credit += " by " + artist
+	}
+	if sourceURL != "" {
+		credit += " (" + sourceURL + ")"
+	}
+	kind, version := parseLicense(licenseURL)
+	switch kind {
+	case "":
+		return credit + ", licensed under " + licenseURL
+	case "CC0", "PDM":
+		return credit + ", in the public domain (" + licenseURL + ")"
+	}
+	name := "CC " + kind
+	if version != "" {
+		name += " " + version
+	}
+	return credit + ", licensed under " + name + " (" + licenseURL + ")"
+}
+
+// licenseQueue feeds liked and playlisted songs to runLicenseWorker.
+var licenseQueue = make(chan string, 1024)
+
+// queueLicenseRefresh asks the worker to record the license songID's
+// provider reports for it; songs without a provider are ignored. If the
+// queue is full, the license is refreshed the next time the song is liked
+// or added to a playlist.
+func queueLicenseRefresh(songID string) {
+	if _, _, ok := providerFor(songID); !ok {
+		return
+	}
+	select {
+	case licenseQueue <- songID:
+	default:
+		log.Warn().Str("song_id", songID).Msg("License queue is full; the license will be refreshed later")
+	}
+}
+
+// runLicenseWorker records licenses as songs are queued, one lookup at a
+// time. main runs it in its own goroutine.
+func runLicenseWorker() {
+	for songID := range licenseQueue {
+		refreshSongLicense(context.Background(), songID)
+	}
+}
+
+// refreshSongLicense replaces the license recorded for songID with the one
+// its provider reports. If the lookup fails, whatever was recorded before
+// stays until the next refresh.
+func refreshSongLicense(ctx context.Context, songID string) {
+	p, id, ok := providerFor(songID)
+	if !ok {
+		return
+	}
+	track, err := p.Track(ctx, id)
+	if err != nil {
+		log.Warn().Err(err).Str("song_id", songID).Msg("License lookup failed; keeping the recorded license")
+		return
+	}
+	if err := store.SetSongLicense(songID, *track); err != nil {
+		log.Error().Err(err).Str("song_id", songID).Msg("Failed to record song license")
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestParseLicense(t *testing.T) {
+	for _, tc := range []struct{ url, kind, version string }{
+		{"http://creativecommons.org/licenses/by-nc-sa/3.0/", "BY-NC-SA", "3.0"},
+		{"https://creativecommons.org/licenses/by/4.0", "BY", "4.0"},
+		{"https://www.creativecommons.org/licenses/by-nd/2.5/es/", "BY-ND", "2.5"},
+		{"https://creativecommons.org/publicdomain/zero/1.0/", "CC0", "1.0"},
+		{"http://creativecommons.org/publicdomain/mark/1.0/", "PDM", "1.0"},
+		{"https://creativecommons.org/licenses/sampling+/1.0/", "", ""},
+		{"https://example.com/licenses/by/4.0/", "", ""},
+		{"", "", ""},
+	} {
+		if kind, version := parseLicense(tc.url); kind != tc.kind || version != tc.version {
+			t.Errorf("parseLicense(%q) = %q, %q, want %q, %q", tc.url, kind, version, tc.kind, tc.version)
+		}
+	}
+}
+
+func TestJamendoTrackLicense(t *testing.T) {
+	song, _ := jamendoTrackSong(JamendoTrack{
+		ID: "1886257", Name: "Morning Light", ArtistID: "7908", ArtistName: "Alanis Rivers",
+		Audio: "https://prod-1.storage.jamendo.com/?trackid=1886257&format=mp31", LicenseCCURL: "http://creativecommons.org/licenses/by-nc-sa/3.0/",
+	})
+	if song.LicenseType != "BY-NC-SA" || song.LicenseURL != "http://creativecommons.org/licenses/by-nc-sa/3.0/" || song.ArtistURL != "https://www.jamendo.com/artist/7908" ||
+		song.AttributionText != `"Morning Light" by Alanis Rivers (https://www.jamendo.com/track/1886257), licensed under CC BY-NC-SA 3.0 (http://creativecommons.org/licenses/by-nc-sa/3.0/)` {
+		t.Errorf("song = %+v", song)
+	}
+	if got := attributionText("Low Tide", "", "", "https://creativecommons.org/publicdomain/zero/1.0/"); got != `"Low Tide", in the public domain (https://creativecommons.org/publicdomain/zero/1.0/)` {
+		t.Errorf("CC0 attribution %q", got)
+	}
+}
+
+// runLicenseQueue does what runLicenseWorker would for everything queued so
+// far.
+func runLicenseQueue() {
+	for {
+		select {
+		case songID := <-licenseQueue:
+			refreshSongLicense(context.Background(), songID)
+		default:
+			return
+		}
+	}
+}
+
+// Songs get their license from the provider whenever they are liked or added
+// to a playlist, whatever the request says and whatever was recorded before.
+func TestSongLicenseStored(t *testing.T) {
+	api := newJamendoFixtures(t, map[string]string{"tracks": "tracks.json"})
+	const byNCSA = "http://creativecommons.org/licenses/by-nc-sa/3.0/"
+	forEachStore(t, func(t *testing.T, srv *httptest.Server) {
+		runLicenseQueue()
+		c := newTestClient(t, srv)
+		c.registerAndLogin("alice")
+
+		// The like doesn't wait for Jamendo, even when it hangs.
+		gate := make(chan struct{})
+		api.mu.Lock()
+		api.gate = gate
+		api.mu.Unlock()
+		like := map[string]interface{}{
+			"songId": "jamendo-1886257", "jamendoId": "1886257", "title": "Morning Light", "filePath": "https://example.com/a.mp3",
+			"licenseUrl": "https://creativecommons.org/publicdomain/zero/1.0/", "artistUrl": "https://evil.example/",
+		}
+		if code := c.do("POST", "/api/songs/like", like, nil); code != http.StatusOK {
+			t.Fatalf("like: status %d", code)
+		}
+		if s := findSong(c.songs(), "jamendo-1886257"); s == nil || s.LicenseURL != "" || s.ArtistURL != "" {
+			t.Errorf("license taken from the request: %+v", s)
+		}
+		api.mu.Lock()
+		api.gate = nil
+		api.mu.Unlock()
+		close(gate)
+
+		runLicenseQueue()
+		s := findSong(c.songs(), "jamendo-1886257")
+		if s == nil || s.LicenseURL != byNCSA || s.LicenseType != "BY-NC-SA" || s.ArtistURL != "https://www.jamendo.com/artist/7908" ||
+			s.AttributionText != `"Morning Light" by Alanis Rivers (https://www.jamendo.com/track/1886257), licensed under CC BY-NC-SA 3.0 (`+byNCSA+`)` {
+			t.Errorf("liked song = %+v", s)
+		}
+
+		// A stale or spoofed license is replaced the next time the provider is asked.
+		if err := store.SetSongLicense("jamendo-1886257", Song{LicenseURL: "https://creativecommons.org/publicdomain/zero/1.0/", LicenseType: "CC0"}); err != nil {
+			t.Fatal(err)
+		}
+		var p Playlist
+		if code := c.do("POST", "/api/playlists", PlaylistRequest{Name: "Mix"}, &p); code != http.StatusCreated {
+			t.Fatalf("create playlist: status %d", code)
+		}
+		add := PlaylistTrackRequest{LikeRequest: LikeRequest{SongID: "jamendo-1886257", JamendoID: "1886257", Title: "Morning Light"}}
+		if code := c.do("POST", fmt.Sprintf("/api/playlists/%d/tracks", p.ID), add, nil); code != http.StatusOK {
+			t.Fatalf("add to playlist: status %d", code)
+		}
+		runLicenseQueue()
+		if s, err := store.GetSong("jamendo-1886257"); err != nil || s.LicenseURL != byNCSA || s.LicenseType != "BY-NC-SA" {
+			t.Errorf("license not replaced: %+v, %v", s, err)
+		}
+
+		// A failed lookup leaves the recorded license alone.
+		api.fail(http.StatusBadGateway)
+		defer api.fail(0)
+		queueLicenseRefresh("jamendo-1886257")
+		runLicenseQueue()
+		if s, err := store.GetSong("jamendo-1886257"); err != nil || s.LicenseURL != byNCSA || s.AttributionText == "" {
+			t.Errorf("license after failed lookup: %+v, %v", s, err)
+		}
+	})
+}
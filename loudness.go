@@ -0,0 +1,368 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"strings"
+	"sync"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Loudness analysis of uploads follows EBU R128 / ITU-R BS.1770-4: the audio
+// is K-weighted, its mean square taken over 400 ms blocks overlapping by 75%,
+// and blocks below -70 LUFS, then those more than 10 LU below the mean of the
+// rest, are gated out. Gains are ReplayGain 2.0 values, which are relative to
+// -18 LUFS.
+const (
+	replayGainReference = -18.0 // LUFS
+	r128TagReference    = -23.0 // LUFS, the reference of Opus R128_* tags
+	absoluteGate        = -70.0 // LUFS
+	relativeGate        = -10.0 // LU below the absolutely gated loudness
+)
+
+// Values of songs.loudness_status. Uploads start out pending; songs that are
+// not uploads (samples, Jamendo) have no status and are never analysed.
+const (
+	loudnessPending = "pending"
+	loudnessDone    = "done"
+	loudnessFailed  = "failed"
+)
+
+// Values of Loudness.Source.
+const (
+	loudnessSourceAnalysis = "analysis"
+	loudnessSourceTags     = "tags"
+)
+
+// errSilentAudio is returned when no block is loud enough to measure.
+var errSilentAudio = errors.New("audio is silent or too short to measure")
+
+// biquad is a second-order IIR section in transposed direct form II.
+type biquad struct {
+	b0, b1, b2, a1, a2 float64
+	z1, z2             float64
+}
+
+func (f *biquad) process(x float64) float64 {
+	y := f.b0*x + f.z1
+	f.z1 = f.b1*x - f.a1*y + f.z2
+	f.z2 = f.b2*x - f.a2*y
+	return y
+}
+
+// kWeighting returns the two stages of the BS.1770 K-weighting filter, a
+// high shelf modelling the head followed by a high-pass, for any sample
+// rate. The standard only tabulates coefficients for 48 kHz; these are
+// derived from the analogue prototype the same way libebur128 does.
+func kWeighting(sampleRate int) [2]biquad {
+	rate := float64(sampleRate)
+
+	f0, gain, q := 1681.974450955533, 3.999843853973347, 0.7071752369554196
+	k := math.Tan(math.Pi * f0 / rate)
+	vh := math.Pow(10, gain/20)
+	vb := math.Pow(vh, 0.4996667741545416)
+	a0 := 1 + k/q + k*k
+	shelf := biquad{
+		b0: (vh + vb*k/q + k*k) / a0,
+		b1: 2 * (k*k - vh) / a0,
+		b2: (vh - vb*k/q + k*k) / a0,
+		a1: 2 * (k*k - 1) / a0,
+		a2: (1 - k/q + k*k) / a0,
+	}
+
+	f0, q = 38.13547087602444, 0.5003270373238773
+	k = math.Tan(math.Pi * f0 / rate)
+	a0 = 1 + k/q + k*k
+	highPass := biquad{
+		b0: 1, b1: -2, b2: 1,
+		a1: 2 * (k*k - 1) / a0,
+		a2: (1 - k/q + k*k) / a0,
+	}
+	return [2]biquad{shelf, highPass}
+}
+
+// channelWeight is BS.1770's weighting: surround channels count 1.41 and the
+// LFE channel of a 5.1 stream is ignored. WAVE channel order is assumed.
+func channelWeight(ch, channels int) float64 {
+	switch {
+	case channels == 5 && ch >= 3:
+		return 1.41
+	case channels == 6 && ch == 3:
+		return 0
+	case channels == 6 && ch >= 4:
+		return 1.41
+	}
+	return 1
+}
+
+// truePeakMeter estimates the inter-sample peak by oversampling with a
+// polyphase windowed-sinc interpolator (BS.1770 Annex 2): 4x below 96 kHz,
+// 2x below 192 kHz, and the plain sample peak above that.
+type truePeakMeter struct {
+	phases  [][]float64 // phases[p][k] is the tap for input sample n-k
+	history [][]float64 // Per channel ring of the last len(phases[0]) samples
+	pos     []int
+	peak    float64
+}
+
+const truePeakTapsPerPhase = 12
+
+func newTruePeakMeter(sampleRate, channels int) *truePeakMeter {
+	factor := 4
+	switch {
+	case sampleRate >= 192000:
+		factor = 1
+	case sampleRate >= 96000:
+		factor = 2
+	}
+	m := &truePeakMeter{}
+	if factor == 1 {
+		return m
+	}
+	n := truePeakTapsPerPhase * factor
+	center := float64(n-1) / 2
+	m.phases = make([][]float64, factor)
+	for p := range m.phases {
+		m.phases[p] = make([]float64, truePeakTapsPerPhase)
+		for k := range m.phases[p] {
+			i := k*factor + p
+			t := (float64(i) - center) / float64(factor)
+			sinc := 1.0
+			if t != 0 {
+				sinc = math.Sin(math.Pi*t) / (math.Pi * t)
+			}
+			window := 0.5 - 0.5*math.Cos(2*math.Pi*float64(i+1)/float64(n+1)) // Hann
+			m.phases[p][k] = sinc * window
+		}
+	}
+	m.history = make([][]float64, channels)
+	for ch := range m.history {
+		m.history[ch] = make([]float64, truePeakTapsPerPhase)
+	}
+	m.pos = make([]int, channels)
+	return m
+}
+
+func (m *truePeakMeter) add(ch int, x float64) {
+	if a := math.Abs(x); a > m.peak {
+		m.peak = a
+	}
+	if m.phases == nil {
+		return
+	}
+	h := m.history[ch]
+	pos := m.pos[ch]
+	h[pos] = x
+	for _, taps := range m.phases {
+		var y float64
+		j := pos
+		for _, c := range taps {
+			y += c * h[j]
+			if j--; j < 0 {
+				j = len(h) - 1
+			}
+		}
+		if a := math.Abs(y); a > m.peak {
+			m.peak = a
+		}
+	}
+	m.pos[ch] = (pos + 1) % len(h)
+}
+
+// r128Meter accumulates the gating blocks and true peak of one stream.
+type r128Meter struct {
+	channels int
+	weights  []float64
+	filters  [][2]biquad
+	peak     *truePeakMeter
+
+	step       int        // Frames in 100 ms, the spacing of gating blocks
+	stepFrames int        // Frames in the current step so far
+	stepEnergy float64    // Weighted sum of squares in the current step
+	recent     [4]float64 // The last four steps, newest last
+	steps      int
+	blocks     []float64 // Mean square of each 400 ms block
+}
+
+func newR128Meter(sampleRate, channels int) *r128Meter {
+	m := &r128Meter{
+		channels: channels,
+		weights:  make([]float64, channels),
+		filters:  make([][2]biquad, channels),
+		peak:     newTruePeakMeter(sampleRate, channels),
+		step:     sampleRate / 10,
+	}
+	for ch := range m.filters {
+		m.weights[ch] = channelWeight(ch, channels)
+		m.filters[ch] = kWeighting(sampleRate)
+	}
+	return m
+}
+
+// add feeds interleaved samples, a whole number of frames.
+func (m *r128Meter) add(samples []float64) {
+	for i := 0; i+m.channels <= len(samples); i += m.channels {
+		for ch := 0; ch < m.channels; ch++ {
+			x := samples[i+ch]
+			m.peak.add(ch, x)
+			f := &m.filters[ch]
+			y := f[1].process(f[0].process(x))
+			m.stepEnergy += m.weights[ch] * y * y
+		}
+		if m.stepFrames++; m.stepFrames == m.step {
+			copy(m.recent[:], m.recent[1:])
+			m.recent[3] = m.stepEnergy
+			m.stepEnergy, m.stepFrames = 0, 0
+			if m.steps++; m.steps >= 4 {
+				sum := m.recent[0] + m.recent[1] + m.recent[2] + m.recent[3]
+				m.blocks = append(m.blocks, sum/float64(4*m.step))
+			}
+		}
+	}
+}
+
+func blockLoudness(meanSquare float64) float64 {
+	return -0.691 + 10*math.Log10(meanSquare)
+}
+
+// integrated returns the gated loudness in LUFS, or -Inf when every block
+// falls below the absolute gate.
+func (m *r128Meter) integrated() float64 {
+	gatedMean := func(threshold float64) (float64, bool) {
+		var sum float64
+		var n int
+		for _, z := range m.blocks {
+			if z > 0 && blockLoudness(z) > threshold {
+				sum += z
+				n++
+			}
+		}
+		if n == 0 {
+			return 0, false
+		}
+		return sum / float64(n), true
+	}
+	mean, ok := gatedMean(absoluteGate)
+	if !ok {
+		return math.Inf(-1)
+	}
+	mean, ok = gatedMean(math.Max(absoluteGate, blockLoudness(mean)+relativeGate))
+	if !ok {
+		return math.Inf(-1)
+	}
+	return blockLoudness(mean)
+}
+
+// newLoudness turns a measurement into the values stored on a song. The
+// album values start out as the track's; updateAlbumGain refines them.
+func newLoudness(integrated, truePeak float64, source string) *Loudness {
+	l := &Loudness{
+		IntegratedLUFS: roundGain(integrated),
+		TrackGainDB:    roundGain(replayGainReference - integrated),
+		TrackPeak:      roundPeak(truePeak),
+		Source:         source,
+	}
+	if truePeak > 0 {
+		dbtp := roundGain(20 * math.Log10(truePeak))
+		l.TruePeakDBTP = &dbtp
+	}
+	l.AlbumGainDB, l.AlbumPeak = l.TrackGainDB, l.TrackPeak
+	return l
+}
+
+// loudnessFromTags honours ReplayGain (or Opus R128) tags written by the
+// user's own tools, so a file that was tagged is not measured again. It
+// returns nil when the file carries no track gain.
+func loudnessFromTags(rg ReplayGainTags) *Loudness {
+	if rg.TrackGain == nil {
+		return nil
+	}
+	var peak float64
+	if rg.TrackPeak != nil {
+		peak = *rg.TrackPeak
+	}
+	l := newLoudness(replayGainReference-*rg.TrackGain, peak, loudnessSourceTags)
+	if rg.AlbumGain != nil {
+		l.AlbumGainDB = roundGain(*rg.AlbumGain)
+		if rg.AlbumPeak != nil {
+			l.AlbumPeak = roundPeak(*rg.AlbumPeak)
+		}
+		l.AlbumFromTags = true
+	}
+	return l
+}
+
+func roundGain(v float64) float64 { return math.Round(v*100) / 100 }
+func roundPeak(v float64) float64 { return math.Round(v*1e6) / 1e6 }
+
+// albumGainMu serializes album updates, so the worker and a concurrent
+// delete can't store gains computed from different sets of tracks.
+var albumGainMu sync.Mutex
+
+// updateAlbumGain recomputes the album gain of a user's uploads tagged with
+// album. The album loudness is the duration-weighted power mean of its
+// tracks' integrated loudness rather than a measurement gated over the
+// whole album: it stays within a fraction of a dB for real albums and can
+// be updated as tracks arrive without decoding the others again. Tracks
+// that carried an album gain tag keep it.
+func updateAlbumGain(userID int, album string) {
+	if strings.TrimSpace(album) == "" {
+		return
+	}
+	albumGainMu.Lock()
+	defer albumGainMu.Unlock()
+	songs, err := store.ListAlbumUploads(userID, album)
+	if err != nil {
+		log.Error().Err(err).Int("user_id", userID).Str("album", album).Msg("Failed to list album for album gain")
+		return
+	}
+	var energy, weight, peak float64
+	for _, s := range songs {
+		if s.Loudness == nil {
+			continue
+		}
+		w := float64(s.DurationMs)
+		if w <= 0 {
+			w = float64(s.Duration) * 1000
+		}
+		if w <= 0 {
+			w = 1
+		}
+		energy += w * math.Pow(10, s.Loudness.IntegratedLUFS/10)
+		weight += w
+		peak = math.Max(peak, s.Loudness.TrackPeak)
+	}
+	if weight == 0 {
+		return
+	}
+	gain := roundGain(replayGainReference - 10*math.Log10(energy/weight))
+	for _, s := range songs {
+		if s.Loudness == nil || s.Loudness.AlbumFromTags || (s.Loudness.AlbumGainDB == gain && s.Loudness.AlbumPeak == peak) {
+			continue
+		}
+		if err := store.SetAlbumGain(s.ID, gain, peak); err != nil && !errors.Is(err, errNotFound) {
+			log.Error().Err(err).Str("song_id", s.ID).Msg("Failed to store album gain")
+		}
+	}
+}
+
+// storeLoudness records the outcome of measuring an upload, marking the song
+// failed when its audio can't be measured so it isn't retried forever.
+func storeLoudness(s Song, l *Loudness, err error) {
+	status := loudnessDone
+	if l == nil {
+		status = loudnessFailed
+		log.Warn().Err(err).Str("song_id", s.ID).Str("mime_type", s.MimeType).Msg("Loudness analysis failed")
+	}
+	if err := store.SetSongLoudness(s.ID, status, l); err != nil {
+		if !errors.Is(err, errNotFound) {
+			log.Error().Err(err).Str("song_id", s.ID).Msg("Failed to store loudness")
+		}
+		return
+	}
+	if l != nil && s.UserID != nil {
+		log.Info().Str("song_id", s.ID).Float64("lufs", l.IntegratedLUFS).Float64("track_gain_db", l.TrackGainDB).Msg("Loudness analysed")
+		updateAlbumGain(*s.UserID, s.Album)
+	}
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/mewkiz/flac"
+	"github.com/mewkiz/flac/frame"
+	"github.com/mewkiz/flac/meta"
+)
+
+// sine returns seconds of a sine wave as 16-bit samples, the same on every
+// channel, indexed [channel][frame].
+func sine(rate, channels int, seconds, freq, amplitude, phase float64) [][]int32 {
+	n := int(seconds * float64(rate))
+	samples := make([][]int32, channels)
+	for ch := range samples {
+		samples[ch] = make([]int32, n)
+		for i := range samples[ch] {
+			v := amplitude * math.Sin(2*math.Pi*freq*float64(i)/float64(rate)+phase)
+			samples[ch][i] = int32(math.Round(v * 32767))
+		}
+	}
+	return samples
+}
+
+func sineWAV(rate int, samples [][]int32) []byte {
+	channels := len(samples)
+	fmtChunk := make([]byte, 16)
+	binary.LittleEndian.PutUint16(fmtChunk, waveFormatPCM)
+	binary.LittleEndian.PutUint16(fmtChunk[2:], uint16(channels))
+	binary.LittleEndian.PutUint32(fmtChunk[4:], uint32(rate))
+	binary.LittleEndian.PutUint32(fmtChunk[8:], uint32(rate*channels*2))
+	binary.LittleEndian.PutUint16(fmtChunk[12:], uint16(channels*2))
+	binary.LittleEndian.PutUint16(fmtChunk[14:], 16)
+	var data []byte
+	for i := range samples[0] {
+		for ch := range samples {
+			data = binary.LittleEndian.AppendUint16(data, uint16(int16(samples[ch][i])))
+		}
+	}
+	body := bytes.Join([][]byte{[]byte("WAVE"), riffChunk("fmt ", fmtChunk), riffChunk("data", data)}, nil)
+	return append(append([]byte("RIFF"), binary.LittleEndian.AppendUint32(nil, uint32(len(body)))...), body...)
+}
+
+func sineFLAC(t *testing.T, rate int, samples [][]int32) []byte {
+	t.Helper()
+	var b bytes.Buffer
+	info := &meta.StreamInfo{
+		BlockSizeMin: 4096, BlockSizeMax: 4096, SampleRate: uint32(rate),
+		NChannels: uint8(len(samples)), BitsPerSample: 16, NSamples: uint64(len(samples[0])),
+	}
+	enc, err := flac.NewEncoder(&b, info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for start := 0; start < len(samples[0]); start += 4096 {
+		end := min(start+4096, len(samples[0]))
+		f := &frame.Frame{Header: frame.Header{
+			HasFixedBlockSize: true, BlockSize: uint16(end - start), SampleRate: uint32(rate),
+			Channels: frame.ChannelsLR, BitsPerSample: 16, Num: uint64(start / 4096),
+		}}
+		if len(samples) == 1 {
+			f.Channels = frame.ChannelsMono
+		}
+		for ch := range samples {
+			f.Subframes = append(f.Subframes, &frame.Subframe{
+				SubHeader: frame.SubHeader{Pred: frame.PredVerbatim},
+				Samples:   samples[ch][start:end], NSamples: end - start,
+			})
+		}
+		if err := enc.WriteFrame(f); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := enc.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return b.Bytes()
+}
+
+func analyzeBytes(t *testing.T, name string, content []byte, channels int) *Loudness {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, content, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	a, err := analyzeFile(path, channels)
+	if err != nil {
+		t.Fatalf("%s: %v", name, err)
+	}
+	if a.Loudness == nil {
+		t.Fatalf("%s: no loudness: %v", name, a.LoudnessErr)
+	}
+	return a.Loudness
+}
+
+func near(got, want, tolerance float64) bool { return math.Abs(got-want) <= tolerance }
+
+func TestMeasureLoudness(t *testing.T) {
+	// BS.1770 is calibrated so that a 1 kHz sine at 0 dBFS in one channel
+	// reads -3.01 LUFS; a -20 dBFS sine in both channels is then -20 LUFS.
+	stereo := sine(48000, 2, 5, 1000, 0.1, 0)
+	mono := sine(44100, 1, 5, 1000, 0.1, 0)
+	tests := []struct {
+		name     string
+		content  []byte
+		channels int
+		lufs     float64
+	}{
+		{"stereo.wav", sineWAV(48000, stereo), 2, -20},
+		{"stereo.flac", sineFLAC(t, 48000, stereo), 2, -20},
+		{"mono.wav", sineWAV(44100, mono), 1, -23.01},
+		{"mono.flac", sineFLAC(t, 44100, mono), 1, -23.01},
+	}
+	for _, tt := range tests {
+		l := analyzeBytes(t, tt.name, tt.content, tt.channels)
+		if !near(l.IntegratedLUFS, tt.lufs, 0.1) || !near(l.TrackGainDB, replayGainReference-tt.lufs, 0.1) {
+			t.Errorf("%s: %.2f LUFS, gain %.2f dB; want %.2f LUFS", tt.name, l.IntegratedLUFS, l.TrackGainDB, tt.lufs)
+		}
+		if l.TruePeakDBTP == nil || !near(*l.TruePeakDBTP, -20, 0.1) || l.Source != loudnessSourceAnalysis {
+			t.Errorf("%s: true peak %v dBTP, source %q", tt.name, l.TruePeakDBTP, l.Source)
+		}
+	}
+
+	// A sine at a quarter of the sample rate, 45 degrees out of phase with
+	// the samples, peaks 3 dB above every sample it has.
+	l := analyzeBytes(t, "quarter.wav", sineWAV(48000, sine(48000, 1, 2, 12000, 0.5, math.Pi/4)), 1)
+	if l.TruePeakDBTP == nil || !near(*l.TruePeakDBTP, -6.02, 0.5) {
+		t.Errorf("inter-sample peak: %v dBTP, want about -6.02", l.TruePeakDBTP)
+	}
+
+	silent := filepath.Join(t.TempDir(), "silent.wav")
+	os.WriteFile(silent, sineWAV(48000, sine(48000, 2, 2, 1000, 0, 0)), 0o644)
+	if a, err := analyzeFile(silent, 2); err != nil {
+		t.Errorf("silence: %v", err)
+	} else if a.LoudnessErr != errSilentAudio || a.Waveform == nil {
+		t.Errorf("silence: loudness error %v, want errSilentAudio", a.LoudnessErr)
+	}
+}
+
+func TestReplayGainTags(t *testing.T) {
+	md := &AudioMetadata{}
+	parseVorbisComment(vorbisComment("replaygain_track_gain=-7.25 dB", "REPLAYGAIN_TRACK_PEAK=0.988", "R128_ALBUM_GAIN=-1024"), md)
+	rg := md.ReplayGain
+	if rg.TrackGain == nil || *rg.TrackGain != -7.25 || rg.TrackPeak == nil || *rg.TrackPeak != 0.988 {
+		t.Errorf("track tags = %+v", rg)
+	}
+	// -4 dB relative to -23 LUFS is +1 dB relative to -18 LUFS.
+	if rg.AlbumGain == nil || *rg.AlbumGain != 1 || rg.AlbumPeak != nil {
+		t.Errorf("album tags = %+v", rg)
+	}
+}
+
+func replayGainTXXX(key, value string) []byte {
+	return id3Frame(3, "TXXX", id3Text(key+"\x00"+value))
+}
+
+func TestUploadLoudness(t *testing.T) {
+	forEachStore(t, func(t *testing.T, srv *httptest.Server) {
+		c := newTestClient(t, srv)
+		c.registerAndLogin("lou")
+		album := map[string]string{"album": "Dynamics"}
+		quiet, code := c.uploadFile("quiet.wav", sineWAV(48000, sine(48000, 2, 3, 1000, 0.1, 0)), album)
+		if code != http.StatusCreated {
+			t.Fatalf("upload: status %d", code)
+		}
+		if quiet.Loudness != nil {
+			t.Errorf("loudness reported before analysis: %+v", quiet.Loudness)
+		}
+		loud, code := c.uploadFile("loud.wav", sineWAV(48000, sine(48000, 2, 3, 1000, 0.4, 0)), album)
+		if code != http.StatusCreated {
+			t.Fatalf("upload: status %d", code)
+		}
+		tagged, code := c.uploadFile("tagged.mp3", testMP3("Tagged",
+			replayGainTXXX("REPLAYGAIN_TRACK_GAIN", "-7.50 dB"), replayGainTXXX("replaygain_track_peak", "0.5")), nil)
+		if code != http.StatusCreated {
+			t.Fatalf("upload: status %d", code)
+		}
+		if l := tagged.Loudness; l == nil || l.Source != loudnessSourceTags || l.TrackGainDB != -7.5 || l.IntegratedLUFS != -10.5 ||
+			l.TrackPeak != 0.5 || l.AlbumGainDB != -7.5 {
+			t.Errorf("tagged upload loudness = %+v", l)
+		}
+
+		analyzePendingLoudness()
+		songs := c.songs()
+		q, l := findSong(songs, quiet.ID).Loudness, findSong(songs, loud.ID).Loudness
+		if q == nil || l == nil {
+			t.Fatalf("not analysed: quiet %+v, loud %+v", q, l)
+		}
+		if !near(q.TrackGainDB, 2, 0.1) || !near(l.TrackGainDB, -10.04, 0.1) {
+			t.Errorf("track gains %.2f and %.2f, want 2 and -10.04", q.TrackGainDB, l.TrackGainDB)
+		}
+		// Equal lengths: the album is the power mean of -20 and -7.96 LUFS.
+		wantAlbum := replayGainReference - 10*math.Log10((math.Pow(10, -2)+math.Pow(10, -0.796))/2)
+		if !near(q.AlbumGainDB, wantAlbum, 0.1) || q.AlbumGainDB != l.AlbumGainDB || q.AlbumPeak != l.TrackPeak {
+			t.Errorf("album gain %.2f/%.2f (peak %v), want %.2f (peak %v)", q.AlbumGainDB, l.AlbumGainDB, q.AlbumPeak, wantAlbum, l.TrackPeak)
+		}
+
+		// Without the loud track the album is just the quiet one.
+		if code := c.do("DELETE", "/api/songs/delete?id="+loud.ID, nil, nil); code != http.StatusOK {
+			t.Fatalf("delete: status %d", code)
+		}
+		if q := findSong(c.songs(), quiet.ID).Loudness; q.AlbumGainDB != q.TrackGainDB {
+			t.Errorf("album gain after delete %.2f, want the track gain %.2f", q.AlbumGainDB, q.TrackGainDB)
+		}
+	})
+}
+
+// A valid Ogg Vorbis file with a corrupt trailing page used to panic inside
+// the decoder, killing the analysis worker, and again on every restart.
+func TestCorruptUploadAnalysis(t *testing.T) {
+	corrupt := append(testOggVorbis(), append([]byte("OggS"), make([]byte, 24)...)...) // A page header with no segments
+	forEachStore(t, func(t *testing.T, srv *httptest.Server) {
+		c := newTestClient(t, srv)
+		c.registerAndLogin("lou")
+		song, code := c.uploadFile("corrupt.ogg", corrupt, nil)
+		if code != http.StatusCreated {
+			t.Fatalf("upload: status %d", code)
+		}
+
+		analyzePendingLoudness()
+		if s, err := store.GetSong(song.ID); err != nil || s.LoudnessStatus != loudnessFailed || s.Loudness != nil {
+			t.Errorf("after analysis: %+v, %v", s, err)
+		}
+		if pending, err := store.ListPendingLoudness(); err != nil || len(pending) != 0 {
+			t.Errorf("still pending: %d, %v", len(pending), err)
+		}
+	})
+}
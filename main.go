@@ -1,6 +1,8 @@
 package main
 
 import (
+	"expvar"
+	"flag"
 	"html/template"
 	"net/http"
 	"os"
@@ -15,10 +17,15 @@ import (
 
 var tmpl *template.Template
 
+// uploadsDir is where user uploads are stored on disk. They are served by
+// StreamHandler and CoverHandler, never directly.
+var uploadsDir = "uploads"
+
 // Logging middleware from your original main.go
 type loggingResponseWriter struct { http.ResponseWriter; statusCode int }
 func newLoggingResponseWriter(w http.ResponseWriter) *loggingResponseWriter { return &loggingResponseWriter{w, http.StatusOK} }
 func (lrw *loggingResponseWriter) WriteHeader(code int) { lrw.statusCode = code; lrw.ResponseWriter.WriteHeader(code) }
+func (lrw *loggingResponseWriter) Unwrap() http.ResponseWriter { return lrw.ResponseWriter } // For http.ResponseController
 func httpLogger(handler http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		start := time.Now(); lrw := newLoggingResponseWriter(w); handler.ServeHTTP(lrw, r); duration := time.Since(start)
@@ -29,6 +36,10 @@ func httpLogger(handler http.Handler) http.Handler {
 
 
 func main() {
+	migrateDownSteps := flag.Int("migrate-down", 0, "roll back this many database migrations and exit")
+	reconcileOnce := flag.Bool("reconcile", false, "compare uploads/ with the songs table once (honouring RECONCILE_DRY_RUN) and exit")
+	flag.Parse()
+
 	// Logger Setup (from your original main.go)
 	err := godotenv.Load() // Loads .env file by default
     if err != nil {
@@ -41,71 +52,68 @@ func main() {
 
 	
 	// Database Initialization
-	// IMPORTANT: Use environment variables for DSN in production
-	dbUser := os.Getenv("DB_USER")          // e.g., root
-	dbPassword := os.Getenv("DB_PASSWORD")  // e.g., mysecretpassword
-	dbHost := os.Getenv("DB_HOST")          // e.g., 127.0.0.1
-	dbPort := os.Getenv("DB_PORT")          // Default MySQL port
-	dbName := os.Getenv("DB_NAME")          // e.g., harmony_web_db
-	
-
-	// Fallback to defaults if ENV vars not set (for easier local dev)
-	if dbUser == "" { dbUser = "your_db_user" } // REPLACE
-	if dbPassword == "" { dbPassword = "your_db_password" } // REPLACE
-	if dbHost == "" { dbHost = "127.0.0.1" }
-	if dbPort == "" { dbPort = "3306" }
-	if dbName == "" { dbName = "harmony_web_db" }
-
-	dataSourceName := fmt.Sprintf("%s:%s@tcp(%s:%s)/%s?parseTime=true",
-		dbUser, dbPassword, dbHost, dbPort, dbName)
-	InitDB(dataSourceName)
+	// DB_DRIVER selects the backend: "mysql" (default), "sqlite" for a single-binary setup,
+	// or "memory" for throwaway demo/dev instances.
+	dbDriver := os.Getenv("DB_DRIVER")
+	if dbDriver == "" { dbDriver = driverMySQL }
+	var dataSourceName string
+	switch dbDriver {
+	case driverSQLite:
+		dataSourceName = sqliteDSN(os.Getenv("DB_PATH"))
+	case driverMySQL:
+		dataSourceName = mysqlDSN()
+	}
+	if *migrateDownSteps > 0 {
+		if err := RollbackMigrations(dbDriver, dataSourceName, *migrateDownSteps); err != nil {
+			log.Fatal().Err(err).Msg("Error rolling back migrations")
+		}
+		log.Info().Int("steps", *migrateDownSteps).Msg("Migrations rolled back")
+		return
+	}
+	if dbDriver == driverMemory {
+		log.Warn().Msg("Using the in-memory store: all data is lost when the server stops")
+		store = newMemoryStore()
+	} else {
+		store = InitDB(dbDriver, dataSourceName)
+	}
+	uploadQuota = loadUploadQuota()
+	pcmToFLAC = loadPCMToFLAC()
+	jamendo = loadJamendoClient()
+	archive = loadArchiveClient()
+	library = loadLibrary()
+	var exploreRefresh time.Duration
+	explore, exploreRefresh = loadExploreConfig()
+	reconcileInterval, reconcileDryRun := loadReconcileConfig()
+	if *reconcileOnce {
+		if _, err := reconcileUploads(time.Now(), reconcileDryRun); err != nil {
+			log.Fatal().Err(err).Msg("Upload reconciliation failed")
+		}
+		return
+	}
+	go runUploadJanitor(uploadJanitorInterval)
+	analyzeSamples()
+	go runAnalysisWorker()
+	go runOfflineWorker()
+	go runLicenseWorker()
+	if reconcileInterval > 0 {
+		go runReconciler(reconcileInterval, reconcileDryRun)
+	}
+	if exploreRefresh > 0 {
+		go runExploreRefresher(exploreRefresh)
+	}
+	log.Info().Int64("bytes", uploadQuota.MaxBytes).Int("tracks", uploadQuota.MaxTracks).Msg("Per-user upload quota (0 = unlimited)")
 
 	// Templates
 	tmpl, err = template.ParseFiles("templates/index.html")
 	if err != nil { log.Fatal().Err(err).Msg("Error parsing HTML template") }
 
-	// HTTP Router (using standard net/http.ServeMux)
-	mux := http.NewServeMux()
-
-	// Serve index.html
-	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		if r.URL.Path != "/" { http.NotFound(w, r); return }
-		err := tmpl.Execute(w, nil)
-		if err != nil { log.Error().Err(err).Msg("Template execute error"); http.Error(w, "Internal Server Error", 500) }
-	})
-
-	// Static Files (CSS, JS, Images)
-	mux.Handle("/static/", http.StripPrefix("/static/", http.FileServer(http.Dir("static"))))
-	mux.Handle("/assets/audio/", http.StripPrefix("/assets/audio/", http.FileServer(http.Dir("assets/audio"))))
-    mux.Handle("/uploads/", http.StripPrefix("/uploads/", http.FileServer(http.Dir("uploads"))))
-
-
-	// API Endpoints
-    // Auth
-	mux.HandleFunc("/auth/register", RegisterHandler)
-	mux.HandleFunc("/auth/login", LoginHandler)
-	mux.HandleFunc("/auth/logout", LogoutHandler) // No middleware, just clears cookie
-    mux.Handle("/auth/me", AuthMiddleware(http.HandlerFunc(MeHandler))) // Get current user info
-
-
-    // Songs - TryAuth allows guests to see samples, logged-in users see their stuff
-	mux.Handle("/api/songs", TryAuthMiddleware(http.HandlerFunc(SongsAPIHandler)))
-	mux.HandleFunc("/api/jamendo/search", JamendoSearchHandler) // Public search
-
-    // Protected song actions
-    mux.Handle("/api/songs/upload", AuthMiddleware(http.HandlerFunc(UploadSongHandler)))
-    mux.Handle("/api/songs/like", AuthMiddleware(http.HandlerFunc(LikeSongHandler)))
-    mux.Handle("/api/songs/unlike", AuthMiddleware(http.HandlerFunc(UnlikeSongHandler)))
-    mux.Handle("/api/songs/delete", AuthMiddleware(http.HandlerFunc(DeleteSongHandler))) // Or /api/songs/{id} with DELETE method
-
 	// Server Start
-	loggedMux := httpLogger(mux) // Apply logging middleware
+	loggedMux := httpLogger(newRouter()) // Apply logging middleware
 	port := os.Getenv("PORT"); if port == "" { port = "8080" }
 	serverAddr := ":" + port
 	log.Info().Str("address", "http://localhost:"+port).Msg("Server starting")
 
     // Create uploads directory if it doesn't exist
-    uploadsDir := "./uploads"
     if _, err := os.Stat(uploadsDir); os.IsNotExist(err) {
         if err := os.MkdirAll(uploadsDir, 0755); err != nil {
             log.Fatal().Err(err).Msg("Failed to create uploads directory")
@@ -144,4 +152,119 @@ func main() {
 	if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
 		log.Fatal().Err(err).Msg("Server error")
 	}
-}
\ No newline at end of file
+}
+
+// newRouter wires every route onto a fresh ServeMux. Tests drive the same
+// router through httptest.
+func newRouter() http.Handler {
+	// HTTP Router (using standard net/http.ServeMux)
+	mux := http.NewServeMux()
+
+	// Serve index.html
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" { http.NotFound(w, r); return }
+		err := tmpl.Execute(w, nil)
+		if err != nil { log.Error().Err(err).Msg("Template execute error"); http.Error(w, "Internal Server Error", 500) }
+	})
+
+	// Static Files (CSS, JS, Images)
+	mux.Handle("/static/", http.StripPrefix("/static/", http.FileServer(http.Dir("static"))))
+	mux.Handle("/assets/audio/", http.StripPrefix("/assets/audio/", http.FileServer(http.Dir("assets/audio"))))
+
+	// Runtime counters, including the Jamendo cache's ("jamendo")
+	mux.Handle("/debug/vars", expvar.Handler())
+
+
+	// API Endpoints
+    // Auth
+	mux.HandleFunc("/auth/register", RegisterHandler)
+	mux.HandleFunc("/auth/login", LoginHandler)
+	mux.HandleFunc("/auth/logout", LogoutHandler) // No middleware, just clears cookie
+    mux.Handle("/auth/me", AuthMiddleware(http.HandlerFunc(MeHandler))) // Get current user info
+
+
+    // Songs - TryAuth allows guests to see samples, logged-in users see their stuff
+	mux.Handle("/api/songs", TryAuthMiddleware(http.HandlerFunc(SongsAPIHandler)))
+	mux.HandleFunc("/api/jamendo/search", JamendoSearchHandler) // Public search
+	mux.HandleFunc("/api/jamendo/artists/{id}", JamendoArtistHandler)
+	mux.HandleFunc("/api/jamendo/albums/{id}", JamendoAlbumHandler)
+	mux.HandleFunc("/api/jamendo/playlists/{id}", JamendoPlaylistHandler)
+	mux.HandleFunc("/api/explore", ExploreHandler) // Jamendo charts, refreshed in the background
+	mux.Handle("/api/search", TryAuthMiddleware(http.HandlerFunc(SearchHandler)))   // The user's songs and every provider
+	mux.Handle("/api/suggest", TryAuthMiddleware(http.HandlerFunc(SuggestHandler))) // Type-ahead
+	mux.HandleFunc("/api/sources", SourcesHandler)
+	mux.HandleFunc("/api/tracks/{id}", TrackHandler)
+	mux.HandleFunc("/api/tracks/{id}/stream", TrackStreamHandler)
+	mux.HandleFunc("/api/tracks/{id}/download", TrackDownloadHandler) // Only where the license allows
+	mux.HandleFunc("/api/library/{path...}", LibraryFileHandler) // Public, like the samples
+
+    // Protected song actions
+    mux.Handle("/api/songs/upload", AuthMiddleware(http.HandlerFunc(UploadSongHandler)))
+    mux.Handle("/api/uploads", AuthMiddleware(http.HandlerFunc(UploadSessionsHandler))) // Resumable (tus) uploads
+    mux.Handle("/api/uploads/{uploadID}", AuthMiddleware(http.HandlerFunc(UploadSessionHandler)))
+    mux.Handle("/api/songs/like", AuthMiddleware(http.HandlerFunc(LikeSongHandler)))
+    mux.Handle("/api/songs/unlike", AuthMiddleware(http.HandlerFunc(UnlikeSongHandler)))
+    mux.Handle("/api/songs/delete", AuthMiddleware(http.HandlerFunc(DeleteSongHandler))) // Or /api/songs/{id} with DELETE method
+
+    // Uploaded audio and cover art, only ever served to their owner
+    mux.Handle("/api/stream/{songID}", TryAuthMiddleware(http.HandlerFunc(StreamHandler)))
+    mux.Handle("/api/songs/{id}/waveform", TryAuthMiddleware(http.HandlerFunc(SongWaveformHandler)))
+    mux.Handle("/api/covers/{userID}/{name}", AuthMiddleware(http.HandlerFunc(CoverHandler)))
+    mux.Handle("/api/me/storage", AuthMiddleware(http.HandlerFunc(StorageHandler)))
+
+    // Jamendo tracks saved to server storage for offline playback
+    mux.Handle("/api/offline", AuthMiddleware(http.HandlerFunc(OfflineTracksHandler)))
+    mux.Handle("/api/offline/{jamendoID}", AuthMiddleware(http.HandlerFunc(OfflineTrackHandler)))
+
+    // Playlists (all scoped to the logged-in user)
+    mux.Handle("/api/playlists", AuthMiddleware(http.HandlerFunc(PlaylistsHandler)))
+    mux.Handle("/api/playlists/{id}", AuthMiddleware(http.HandlerFunc(PlaylistHandler)))
+    mux.Handle("/api/playlists/{id}/tracks", AuthMiddleware(http.HandlerFunc(PlaylistTracksHandler)))
+    mux.Handle("/api/playlists/{id}/tracks/{position}", AuthMiddleware(http.HandlerFunc(PlaylistTrackHandler)))
+    mux.Handle("/api/playlists/{id}/tracks/move", AuthMiddleware(http.HandlerFunc(PlaylistMoveTrackHandler)))
+    mux.Handle("/api/jamendo/albums/{id}/import", AuthMiddleware(http.HandlerFunc(JamendoAlbumImportHandler)))
+    mux.Handle("/api/jamendo/playlists/{id}/import", AuthMiddleware(http.HandlerFunc(JamendoPlaylistImportHandler)))
+
+    // Play queue, synced across the user's browsers
+    mux.Handle("/api/queue", AuthMiddleware(http.HandlerFunc(QueueHandler)))
+    mux.Handle("/api/queue/{action}", AuthMiddleware(http.HandlerFunc(QueueActionHandler)))
+
+    // Listening history
+    mux.Handle("/api/plays", AuthMiddleware(http.HandlerFunc(PlaysHandler)))
+    mux.Handle("/api/history", AuthMiddleware(http.HandlerFunc(HistoryHandler)))
+    mux.Handle("/api/history/settings", AuthMiddleware(http.HandlerFunc(HistorySettingsHandler)))
+
+	return mux
+}
+
+// mysqlDSN builds the MySQL data source name from the DB_* environment variables.
+func mysqlDSN() string {
+	// IMPORTANT: Use environment variables for DSN in production
+	dbUser := os.Getenv("DB_USER")          // e.g., root
+	dbPassword := os.Getenv("DB_PASSWORD")  // e.g., mysecretpassword
+	dbHost := os.Getenv("DB_HOST")          // e.g., 127.0.0.1
+	dbPort := os.Getenv("DB_PORT")          // Default MySQL port
+	dbName := os.Getenv("DB_NAME")          // e.g., harmony_web_db
+
+	// Fallback to defaults if ENV vars not set (for easier local dev)
+	if dbUser == "" { dbUser = "your_db_user" } // REPLACE
+	if dbPassword == "" { dbPassword = "your_db_password" } // REPLACE
+	if dbHost == "" { dbHost = "127.0.0.1" }
+	if dbPort == "" { dbPort = "3306" }
+	if dbName == "" { dbName = "harmony_web_db" }
+
+	return fmt.Sprintf("%s:%s@tcp(%s:%s)/%s?parseTime=true",
+		dbUser, dbPassword, dbHost, dbPort, dbName)
+}
+
+// sqliteDSN builds the SQLite data source name for the database file at path
+// (default ./data/harmony.db), creating its directory if needed.
+func sqliteDSN(path string) string {
+	if path == "" { path = filepath.Join("data", "harmony.db") }
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		log.Fatal().Err(err).Str("path", path).Msg("Failed to create SQLite database directory")
+	}
+	// Foreign keys are off by default in SQLite; immediate transactions avoid
+	// lock-upgrade failures when two requests write at once.
+	return "file:" + path + "?_pragma=foreign_keys(1)&_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)&_txlock=immediate"
+}
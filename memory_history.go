@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+func (m *memoryStore) RecordPlay(userID int, ev PlayEvent) (*PlayEvent, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.songs[ev.SongID]; !ok {
+		return nil, fmt.Errorf("failed to insert play event: unknown song %q", ev.SongID)
+	}
+	m.nextPlayID++
+	ev.ID = m.nextPlayID
+	ev.StartedAt = ev.StartedAt.UTC().Truncate(time.Millisecond)
+	ev.Song = nil
+	m.plays[userID] = append(m.plays[userID], ev)
+	return &ev, nil
+}
+
+func (m *memoryStore) ListPlays(userID int, q HistoryQuery) ([]PlayEvent, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	plays := []PlayEvent{}
+	for _, ev := range m.plays[userID] {
+		song, ok := m.songs[ev.SongID]
+		if !ok {
+			continue
+		}
+		if !q.After.IsZero() && ev.StartedAt.Before(q.After) {
+			continue
+		}
+		if !q.Before.IsZero() {
+			if ev.StartedAt.After(q.Before) {
+				continue
+			}
+			if ev.StartedAt.Equal(q.Before) && (q.BeforeID <= 0 || ev.ID >= q.BeforeID) {
+				continue
+			}
+		}
+		ev.Song = &song
+		plays = append(plays, ev)
+	}
+	sort.Slice(plays, func(i, j int) bool {
+		if !plays[i].StartedAt.Equal(plays[j].StartedAt) {
+			return plays[i].StartedAt.After(plays[j].StartedAt)
+		}
+		return plays[i].ID > plays[j].ID
+	})
+	if len(plays) > q.Limit {
+		plays = plays[:q.Limit]
+	}
+	return plays, nil
+}
+
+func (m *memoryStore) GetHistoryPaused(userID int) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	user, err := m.userByID(userID)
+	if err != nil {
+		return false, err
+	}
+	return user.historyPaused, nil
+}
+
+func (m *memoryStore) SetHistoryPaused(userID int, paused bool) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	user, err := m.userByID(userID)
+	if err != nil {
+		return err
+	}
+	user.historyPaused = paused
+	return nil
+}
@@ -0,0 +1,59 @@
+package main
+
+import "fmt"
+
+func (m *memoryStore) ListPendingLoudness() ([]Song, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	songs := []Song{}
+	for _, id := range m.songOrder {
+		if s, ok := m.songs[id]; ok && s.IsUploaded && s.LoudnessStatus == loudnessPending {
+			songs = append(songs, s)
+		}
+	}
+	return songs, nil
+}
+
+func (m *memoryStore) SetSongLoudness(songID, status string, l *Loudness) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s, ok := m.songs[songID]
+	if !ok {
+		return fmt.Errorf("song %s: %w", songID, errNotFound)
+	}
+	s.LoudnessStatus, s.Loudness = status, nil
+	if status == loudnessDone && l != nil {
+		stored := *l
+		s.Loudness = &stored
+	}
+	m.songs[songID] = s
+	return nil
+}
+
+func (m *memoryStore) ListAlbumUploads(userID int, album string) ([]Song, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	songs := []Song{}
+	for _, id := range m.songOrder {
+		s, ok := m.songs[id]
+		if ok && s.IsUploaded && s.UserID != nil && *s.UserID == userID && s.Album == album {
+			songs = append(songs, s)
+		}
+	}
+	return songs, nil
+}
+
+func (m *memoryStore) SetAlbumGain(songID string, gainDB, peak float64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s, ok := m.songs[songID]
+	if !ok || s.Loudness == nil {
+		return fmt.Errorf("song %s: %w", songID, errNotFound)
+	}
+	// Songs handed out earlier share the old Loudness; replace, don't modify.
+	l := *s.Loudness
+	l.AlbumGainDB, l.AlbumPeak = gainDB, peak
+	s.Loudness = &l
+	m.songs[songID] = s
+	return nil
+}
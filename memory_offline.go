@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+func (m *memoryStore) AddOfflineTrack(userID int, t OfflineTrack) (*OfflineTrack, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now().UTC().Truncate(time.Millisecond)
+	existing, ok := m.offline[t.JamendoID]
+	switch {
+	case !ok:
+		t.Status, t.StoragePath, t.MimeType, t.Size, t.Attempts, t.Error = offlineQueued, "", "", 0, 0, ""
+		t.CreatedAt, t.UpdatedAt, t.SavedAt = now, now, time.Time{}
+		existing = &t
+		m.offline[t.JamendoID] = existing
+		m.offlineSaves[t.JamendoID] = map[int]time.Time{}
+	case existing.Status == offlineFailed:
+		existing.Status, existing.Attempts, existing.Error, existing.UpdatedAt = offlineQueued, 0, "", now
+	}
+	saves := m.offlineSaves[t.JamendoID]
+	if _, saved := saves[userID]; !saved {
+		saves[userID] = now
+	}
+	copied := *existing
+	copied.SavedAt = saves[userID]
+	return &copied, nil
+}
+
+func (m *memoryStore) GetOfflineTrack(jamendoID string) (*OfflineTrack, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	t, ok := m.offline[jamendoID]
+	if !ok {
+		return nil, fmt.Errorf("offline track %s: %w", jamendoID, errNotFound)
+	}
+	copied := *t
+	return &copied, nil
+}
+
+func (m *memoryStore) ListOfflineTracks(userID int) ([]OfflineTrack, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	tracks := []OfflineTrack{}
+	for id, saves := range m.offlineSaves {
+		if savedAt, ok := saves[userID]; ok {
+			t := *m.offline[id]
+			t.SavedAt = savedAt
+			tracks = append(tracks, t)
+		}
+	}
+	sort.Slice(tracks, func(i, j int) bool {
+		if !tracks[i].SavedAt.Equal(tracks[j].SavedAt) {
+			return tracks[i].SavedAt.After(tracks[j].SavedAt)
+		}
+		return tracks[i].JamendoID < tracks[j].JamendoID
+	})
+	return tracks, nil
+}
+
+func (m *memoryStore) ListPendingOfflineTracks() ([]OfflineTrack, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	tracks := []OfflineTrack{}
+	for _, t := range m.offline {
+		if t.Status == offlineQueued || t.Status == offlineDownloading {
+			tracks = append(tracks, *t)
+		}
+	}
+	sort.Slice(tracks, func(i, j int) bool {
+		if !tracks[i].CreatedAt.Equal(tracks[j].CreatedAt) {
+			return tracks[i].CreatedAt.Before(tracks[j].CreatedAt)
+		}
+		return tracks[i].JamendoID < tracks[j].JamendoID
+	})
+	return tracks, nil
+}
+
+func (m *memoryStore) ListAllOfflineTracks() ([]OfflineTrack, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	tracks := []OfflineTrack{}
+	for _, t := range m.offline {
+		tracks = append(tracks, *t)
+	}
+	sort.Slice(tracks, func(i, j int) bool { return tracks[i].JamendoID < tracks[j].JamendoID })
+	return tracks, nil
+}
+
+func (m *memoryStore) UpdateOfflineTrack(t OfflineTrack) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	existing, ok := m.offline[t.JamendoID]
+	if !ok {
+		return fmt.Errorf("offline track %s: %w", t.JamendoID, errNotFound)
+	}
+	existing.Status, existing.StoragePath, existing.MimeType = t.Status, t.StoragePath, t.MimeType
+	existing.Size, existing.Attempts, existing.Error = t.Size, t.Attempts, t.Error
+	existing.UpdatedAt = time.Now().UTC().Truncate(time.Millisecond)
+	return nil
+}
+
+func (m *memoryStore) RemoveOfflineTrack(userID int, jamendoID string) (*OfflineTrack, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	t, ok := m.offline[jamendoID]
+	if _, saved := m.offlineSaves[jamendoID][userID]; !ok || !saved {
+		return nil, fmt.Errorf("offline track %s: %w", jamendoID, errNotFound)
+	}
+	delete(m.offlineSaves[jamendoID], userID)
+	if len(m.offlineSaves[jamendoID]) > 0 {
+		return nil, nil
+	}
+	delete(m.offline, jamendoID)
+	delete(m.offlineSaves, jamendoID)
+	copied := *t
+	return &copied, nil
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+type memoryPlaylist struct {
+	Playlist
+	tracks []memoryPlaylistTrack
+}
+
+type memoryPlaylistTrack struct {
+	songID  string
+	addedAt time.Time
+}
+
+func (m *memoryStore) CreatePlaylist(userID int, name string) (*Playlist, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+	p := &memoryPlaylist{Playlist: Playlist{ID: m.nextPlaylistID, UserID: userID, Name: name, CreatedAt: now, UpdatedAt: now}}
+	m.nextPlaylistID++
+	m.playlists[p.ID] = p
+	return m.playlistView(p), nil
+}
+
+func (m *memoryStore) ListPlaylists(userID int) ([]Playlist, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	playlists := []Playlist{}
+	for id := 1; id < m.nextPlaylistID; id++ {
+		if p, ok := m.playlists[id]; ok && p.UserID == userID {
+			view := m.playlistView(p)
+			view.Tracks = nil
+			playlists = append(playlists, *view)
+		}
+	}
+	return playlists, nil
+}
+
+func (m *memoryStore) GetPlaylist(userID, playlistID int) (*Playlist, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	p, err := m.ownedPlaylist(userID, playlistID)
+	if err != nil {
+		return nil, err
+	}
+	return m.playlistView(p), nil
+}
+
+func (m *memoryStore) RenamePlaylist(userID, playlistID int, name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	p, err := m.ownedPlaylist(userID, playlistID)
+	if err != nil {
+		return err
+	}
+	p.Name = name
+	p.UpdatedAt = time.Now()
+	return nil
+}
+
+func (m *memoryStore) DeletePlaylist(userID, playlistID int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, err := m.ownedPlaylist(userID, playlistID); err != nil {
+		return err
+	}
+	delete(m.playlists, playlistID)
+	return nil
+}
+
+func (m *memoryStore) AddPlaylistTrack(userID, playlistID int, songID string, position int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	p, err := m.ownedPlaylist(userID, playlistID)
+	if err != nil {
+		return err
+	}
+	if _, ok := m.songs[songID]; !ok {
+		return fmt.Errorf("failed to insert playlist track: unknown song %q", songID)
+	}
+	p.tracks, _ = insertIndex(p.tracks, memoryPlaylistTrack{songID: songID, addedAt: time.Now()}, position)
+	p.UpdatedAt = time.Now()
+	return nil
+}
+
+func (m *memoryStore) RemovePlaylistTrack(userID, playlistID, position int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	p, err := m.ownedPlaylist(userID, playlistID)
+	if err != nil {
+		return err
+	}
+	if position < 0 || position >= len(p.tracks) {
+		return fmt.Errorf("remove %d: %w", position, errOutOfRange)
+	}
+	p.tracks = append(p.tracks[:position], p.tracks[position+1:]...)
+	p.UpdatedAt = time.Now()
+	return nil
+}
+
+func (m *memoryStore) MovePlaylistTrack(userID, playlistID, from, to int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	p, err := m.ownedPlaylist(userID, playlistID)
+	if err != nil {
+		return err
+	}
+	if from < 0 || from >= len(p.tracks) || to < 0 || to >= len(p.tracks) {
+		return fmt.Errorf("move %d to %d: %w", from, to, errOutOfRange)
+	}
+	p.tracks = moveIndex(p.tracks, from, to)
+	p.UpdatedAt = time.Now()
+	return nil
+}
+
+// ownedPlaylist and playlistView expect mu to be held.
+func (m *memoryStore) ownedPlaylist(userID, playlistID int) (*memoryPlaylist, error) {
+	p, ok := m.playlists[playlistID]
+	if !ok || p.UserID != userID {
+		return nil, fmt.Errorf("playlist %d: %w", playlistID, errNotFound)
+	}
+	return p, nil
+}
+
+func (m *memoryStore) playlistView(p *memoryPlaylist) *Playlist {
+	view := p.Playlist
+	view.Tracks = make([]PlaylistTrack, 0, len(p.tracks))
+	for i, t := range p.tracks {
+		view.Tracks = append(view.Tracks, PlaylistTrack{Position: i, AddedAt: t.addedAt, Song: m.songs[t.songID]})
+	}
+	view.TrackCount = len(view.Tracks)
+	return &view
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// memoryQueue is the stored form of a PlayQueue: songs are kept by ID so
+// deleted songs drop out, as with the SQL foreign keys.
+type memoryQueue struct {
+	songIDs      []string
+	currentIndex int
+	positionMs   int64
+	version      int
+	updatedAt    time.Time
+}
+
+func (m *memoryStore) GetQueue(userID int) (*PlayQueue, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	q := &PlayQueue{Songs: []Song{}, CurrentIndex: -1}
+	stored, ok := m.queues[userID]
+	if !ok {
+		return q, nil
+	}
+	for _, id := range stored.songIDs {
+		if s, ok := m.songs[id]; ok {
+			q.Songs = append(q.Songs, s)
+		}
+	}
+	q.CurrentIndex, q.PositionMs, q.Version, q.UpdatedAt = stored.currentIndex, stored.positionMs, stored.version, stored.updatedAt
+	q.normalize()
+	return q, nil
+}
+
+func (m *memoryStore) SaveQueue(userID int, q *PlayQueue) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	version := 0
+	if stored, ok := m.queues[userID]; ok {
+		version = stored.version
+	}
+	if version != q.Version {
+		return fmt.Errorf("play queue: %w", errConflict)
+	}
+	stored := &memoryQueue{currentIndex: q.CurrentIndex, positionMs: q.PositionMs, version: version + 1, updatedAt: time.Now()}
+	for _, s := range q.Songs {
+		if _, ok := m.songs[s.ID]; !ok {
+			return fmt.Errorf("failed to insert play queue song: unknown song %q", s.ID)
+		}
+		stored.songIDs = append(stored.songIDs, s.ID)
+	}
+	m.queues[userID] = stored
+	q.Version, q.UpdatedAt = stored.version, stored.updatedAt
+	return nil
+}
@@ -0,0 +1,349 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// memoryStore is a Store kept entirely in process memory. It backs the
+// handler tests and DB_DRIVER=memory; nothing survives a restart.
+type memoryStore struct {
+	mu         sync.Mutex
+	nextUserID int
+	users      map[string]*memoryUser  // by username
+	songs      map[string]Song         // by song ID
+	songOrder  []string                // insertion order, mirrors a table scan
+	likes      map[int]map[string]bool // userID -> liked song IDs
+
+	nextPlaylistID int
+	playlists      map[int]*memoryPlaylist
+
+	queues map[int]*memoryQueue // by user ID
+
+	nextPlayID int64
+	plays      map[int][]PlayEvent // by user ID, in insertion order
+
+	uploads map[string]*UploadSession // by session ID
+
+	blobRefs map[string]int // blob SHA-256 -> referencing songs
+
+	offline      map[string]*OfflineTrack     // by Jamendo ID
+	offlineSaves map[string]map[int]time.Time // Jamendo ID -> user ID -> saved at
+}
+
+type memoryUser struct {
+	User
+	historyPaused bool
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{
+		nextUserID: 1,
+		users:      make(map[string]*memoryUser),
+		songs:      make(map[string]Song),
+		likes:      make(map[int]map[string]bool),
+
+		nextPlaylistID: 1,
+		playlists:      make(map[int]*memoryPlaylist),
+
+		queues: make(map[int]*memoryQueue),
+		plays:  make(map[int][]PlayEvent),
+
+		uploads: make(map[string]*UploadSession),
+
+		blobRefs: make(map[string]int),
+
+		offline:      make(map[string]*OfflineTrack),
+		offlineSaves: make(map[string]map[int]time.Time),
+	}
+}
+
+func (m *memoryStore) CreateUser(username, password string) (*User, error) {
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return nil, fmt.Errorf("failed to hash password: %w", err)
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, exists := m.users[username]; exists {
+		return nil, fmt.Errorf("failed to execute user insert: duplicate username %q", username)
+	}
+	user := &memoryUser{User: User{ID: m.nextUserID, Username: username, PasswordHash: string(hashedPassword), CreatedAt: time.Now()}}
+	m.nextUserID++
+	m.users[username] = user
+	return &User{ID: user.ID, Username: username}, nil
+}
+
+func (m *memoryStore) GetUserByUsername(username string) (*User, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	user, ok := m.users[username]
+	if !ok {
+		return nil, fmt.Errorf("user not found")
+	}
+	u := user.User
+	return &u, nil
+}
+
+// userByID expects mu to be held.
+func (m *memoryStore) userByID(userID int) (*memoryUser, error) {
+	for _, user := range m.users {
+		if user.ID == userID {
+			return user, nil
+		}
+	}
+	return nil, fmt.Errorf("user %d: %w", userID, errNotFound)
+}
+
+func (m *memoryStore) GetSongsForUser(userID *int) ([]Song, error) {
+	if userID == nil {
+		return buildSongList(nil, nil, nil), nil
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var uploads []Song
+	for _, id := range m.songOrder {
+		s := m.songs[id]
+		if s.IsUploaded && s.UserID != nil && *s.UserID == *userID {
+			s.UserID = userID
+			s.IsLocal = true
+			s.CanDelete = true
+			uploads = append(uploads, s)
+		}
+	}
+
+	var liked []Song
+	for _, id := range m.songOrder {
+		if !m.likes[*userID][id] {
+			continue
+		}
+		s := m.songs[id]
+		s.UserID = userID
+		liked = append(liked, s)
+	}
+	return buildSongList(userID, uploads, liked), nil
+}
+
+func (m *memoryStore) AddUploadedSong(userID int, s Song, quota StorageQuota) (Song, error) {
+	s.ID = "local-" + uuid.New().String()
+	s.FilePath = streamURL(s.ID)
+	s.UserID = &userID
+	s.IsLocal, s.IsUploaded, s.CanDelete = true, true, true
+	s.JamendoID = nil
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	usage := m.storageUsage(userID)
+	if err := quota.check(usage.UsedBytes, usage.Tracks, s.FileSize); err != nil {
+		return Song{}, err
+	}
+	if s.BlobSHA256 != "" {
+		m.blobRefs[s.BlobSHA256]++
+	}
+	m.insertSong(s)
+	return s, nil
+}
+
+func (m *memoryStore) GetStorageUsage(userID int) (*StorageUsage, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.storageUsage(userID), nil
+}
+
+// storageUsage mirrors the SQL GROUP BY mime_type. Callers hold m.mu.
+func (m *memoryStore) storageUsage(userID int) *StorageUsage {
+	byType := map[string]*FormatUsage{}
+	var types []string
+	for _, s := range m.songs {
+		if !s.IsUploaded || s.UserID == nil || *s.UserID != userID {
+			continue
+		}
+		f, ok := byType[s.MimeType]
+		if !ok {
+			f = &FormatUsage{MimeType: s.MimeType}
+			byType[s.MimeType] = f
+			types = append(types, s.MimeType)
+		}
+		f.Tracks++
+		f.Bytes += s.FileSize
+	}
+	sort.Strings(types)
+	usage := &StorageUsage{Formats: []FormatUsage{}}
+	for _, t := range types {
+		usage.add(*byType[t])
+	}
+	return usage
+}
+
+func (m *memoryStore) EnsureSongExists(s Song) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if s.JamendoID != nil && *s.JamendoID != "" {
+		for _, existing := range m.songs {
+			if existing.JamendoID != nil && *existing.JamendoID == *s.JamendoID {
+				return existing.ID, nil
+			}
+		}
+	} else {
+		if s.ID == "" && s.IsLocal {
+			return "", fmt.Errorf("local song must have an ID to be ensured")
+		}
+		if _, ok := m.songs[s.ID]; ok && s.ID != "" {
+			return s.ID, nil
+		}
+	}
+
+	if s.JamendoID != nil && *s.JamendoID == "" {
+		s.JamendoID = nil
+	}
+	if s.ID == "" && s.JamendoID != nil {
+		s.ID = "jamendo-" + *s.JamendoID
+	} else if s.ID == "" {
+		s.ID = "external-" + uuid.New().String()
+	}
+	if _, ok := m.songs[s.ID]; ok {
+		return "", fmt.Errorf("failed to insert new song for EnsureSongExists: duplicate id %q", s.ID)
+	}
+	m.insertSong(Song{
+		ID: s.ID, Title: s.Title, Artist: s.Artist, Album: s.Album, FilePath: streamURL(s.ID),
+		CoverPath: s.CoverPath, IsLocal: s.IsLocal, JamendoID: s.JamendoID, Duration: s.Duration,
+		LicenseURL: s.LicenseURL, LicenseType: s.LicenseType, ArtistURL: s.ArtistURL, AttributionText: s.AttributionText,
+	})
+	return s.ID, nil
+}
+
+func (m *memoryStore) SetSongLicense(songID string, s Song) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	song, ok := m.songs[songID]
+	if !ok {
+		return fmt.Errorf("song %s: %w", songID, errNotFound)
+	}
+	song.LicenseURL, song.LicenseType = s.LicenseURL, s.LicenseType
+	song.ArtistURL, song.AttributionText = s.ArtistURL, s.AttributionText
+	m.songs[songID] = song
+	return nil
+}
+
+func (m *memoryStore) GetSong(songID string) (*Song, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s, ok := m.songs[songID]
+	if !ok {
+		return nil, fmt.Errorf("song %s: %w", songID, errNotFound)
+	}
+	return &s, nil
+}
+
+func (m *memoryStore) LikeSong(userID int, songID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.songs[songID]; !ok {
+		return fmt.Errorf("failed to execute like song: unknown song %q", songID)
+	}
+	if m.likes[userID] == nil {
+		m.likes[userID] = make(map[string]bool)
+	}
+	m.likes[userID][songID] = true
+	return nil
+}
+
+func (m *memoryStore) UnlikeSong(userID int, songID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.likes[userID], songID)
+	return nil
+}
+
+func (m *memoryStore) DeleteUserUploadedSong(userID int, songID string) (*Song, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s, ok := m.songs[songID]
+	if !ok || !s.IsUploaded {
+		return nil, fmt.Errorf("song not found or not an uploaded song")
+	}
+	if s.UserID == nil || *s.UserID != userID {
+		return nil, fmt.Errorf("user does not own this song or invalid owner ID")
+	}
+	m.deleteSong(songID)
+	if s.BlobSHA256 != "" {
+		if m.blobRefs[s.BlobSHA256]--; m.blobRefs[s.BlobSHA256] <= 0 {
+			delete(m.blobRefs, s.BlobSHA256)
+		}
+	}
+	return &s, nil
+}
+
+func (m *memoryStore) BlobInUse(sha256 string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.blobRefs[sha256] > 0, nil
+}
+
+func (m *memoryStore) CoverInUse(coverPath string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, s := range m.songs {
+		if s.CoverPath == coverPath {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (m *memoryStore) ListUploadedSongs() ([]Song, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	songs := []Song{}
+	for _, id := range m.songOrder {
+		if s, ok := m.songs[id]; ok && s.IsUploaded {
+			songs = append(songs, s)
+		}
+	}
+	return songs, nil
+}
+
+// insertSong and deleteSong keep songs and songOrder in step. Callers hold mu.
+func (m *memoryStore) insertSong(s Song) {
+	m.songs[s.ID] = s
+	m.songOrder = append(m.songOrder, s.ID)
+}
+
+// deleteSong also drops the song's likes, playlist entries and plays, like
+// the ON DELETE CASCADE foreign keys do in SQL.
+func (m *memoryStore) deleteSong(songID string) {
+	delete(m.songs, songID)
+	for _, liked := range m.likes {
+		delete(liked, songID)
+	}
+	for userID, plays := range m.plays {
+		kept := plays[:0]
+		for _, ev := range plays {
+			if ev.SongID != songID {
+				kept = append(kept, ev)
+			}
+		}
+		m.plays[userID] = kept
+	}
+	for _, p := range m.playlists {
+		kept := p.tracks[:0]
+		for _, t := range p.tracks {
+			if t.songID != songID {
+				kept = append(kept, t)
+			}
+		}
+		p.tracks = kept
+	}
+	for i, id := range m.songOrder {
+		if id == songID {
+			m.songOrder = append(m.songOrder[:i], m.songOrder[i+1:]...)
+			break
+		}
+	}
+}
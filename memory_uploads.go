@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func (m *memoryStore) CreateUploadSession(userID int, length int64, metadata string, expiresAt time.Time) (*UploadSession, error) {
+	u := UploadSession{
+		ID: uuid.New().String(), UserID: userID, Length: length, Metadata: metadata,
+		CreatedAt: time.Now().UTC().Truncate(time.Millisecond), ExpiresAt: expiresAt.UTC().Truncate(time.Millisecond),
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.uploads[u.ID] = &u
+	copied := u
+	return &copied, nil
+}
+
+// uploadSession expects mu to be held.
+func (m *memoryStore) uploadSession(userID int, sessionID string) (*UploadSession, error) {
+	u, ok := m.uploads[sessionID]
+	if !ok || u.UserID != userID {
+		return nil, fmt.Errorf("upload %s: %w", sessionID, errNotFound)
+	}
+	return u, nil
+}
+
+func (m *memoryStore) GetUploadSession(userID int, sessionID string) (*UploadSession, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	u, err := m.uploadSession(userID, sessionID)
+	if err != nil {
+		return nil, err
+	}
+	copied := *u
+	return &copied, nil
+}
+
+func (m *memoryStore) ListUploadSessions(userID int) ([]UploadSession, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	sessions := []UploadSession{}
+	for _, u := range m.uploads {
+		if u.UserID == userID && u.SongID == nil {
+			sessions = append(sessions, *u)
+		}
+	}
+	sort.Slice(sessions, func(i, j int) bool {
+		if !sessions[i].CreatedAt.Equal(sessions[j].CreatedAt) {
+			return sessions[i].CreatedAt.Before(sessions[j].CreatedAt)
+		}
+		return sessions[i].ID < sessions[j].ID
+	})
+	return sessions, nil
+}
+
+func (m *memoryStore) AdvanceUploadSession(userID int, sessionID string, from, to int64, expiresAt time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	u, err := m.uploadSession(userID, sessionID)
+	if err != nil {
+		return err
+	}
+	if u.Offset != from || u.SongID != nil {
+		return fmt.Errorf("upload %s: %w", sessionID, errConflict)
+	}
+	u.Offset, u.ExpiresAt = to, expiresAt.UTC().Truncate(time.Millisecond)
+	return nil
+}
+
+func (m *memoryStore) CompleteUploadSession(userID int, sessionID, songID string, expiresAt time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	u, err := m.uploadSession(userID, sessionID)
+	if err != nil {
+		return err
+	}
+	u.SongID, u.ExpiresAt = &songID, expiresAt.UTC().Truncate(time.Millisecond)
+	return nil
+}
+
+func (m *memoryStore) DeleteUploadSession(userID int, sessionID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, err := m.uploadSession(userID, sessionID); err != nil {
+		return err
+	}
+	delete(m.uploads, sessionID)
+	return nil
+}
+
+func (m *memoryStore) DeleteExpiredUploadSessions(now time.Time) ([]UploadSession, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var expired []UploadSession
+	for id, u := range m.uploads {
+		if u.ExpiresAt.Before(now) {
+			expired = append(expired, *u)
+			delete(m.uploads, id)
+		}
+	}
+	return expired, nil
+}
@@ -0,0 +1,420 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Container formats recognised by detectAudioFormat.
+const (
+	formatMP3  = "mp3"
+	formatFLAC = "flac"
+	formatOgg  = "ogg"
+	formatWAV  = "wav"
+	formatAIFF = "aiff"
+	formatM4A  = "m4a"
+)
+
+// audioFormat is how an accepted upload format is stored and served.
+type audioFormat struct {
+	Ext  string // Canonical file extension
+	MIME string
+}
+
+// supportedFormats is the upload allow-list, keyed by container.
+var supportedFormats = map[string]audioFormat{
+	formatMP3:  {Ext: ".mp3", MIME: "audio/mpeg"},
+	formatFLAC: {Ext: ".flac", MIME: "audio/flac"},
+	formatOgg:  {Ext: ".ogg", MIME: "audio/ogg"},
+	formatWAV:  {Ext: ".wav", MIME: "audio/wav"},
+	formatAIFF: {Ext: ".aiff", MIME: "audio/aiff"},
+	formatM4A:  {Ext: ".m4a", MIME: "audio/mp4"},
+}
+
+// errUnknownFormat is returned when the content is not a supported container.
+var errUnknownFormat = errors.New("unrecognised audio format")
+
+// Upper bound for any single tag field, comment packet or atom we buffer in
+// memory. Embedded cover art is the largest thing that legitimately gets close.
+const maxMetadataBlock = 16 << 20
+
+// AudioMetadata is what the server learns from an audio file itself: its
+// tags plus the technical details of the stream. Zero values mean unknown.
+type AudioMetadata struct {
+	Format string // Container, one of the format* constants
+	Codec  string // e.g. "mp3", "flac", "vorbis", "opus", "pcm", "aac", "alac"
+
+	Title       string
+	Artist      string
+	Album       string
+	AlbumArtist string
+	Genre       string
+	Year        int
+	TrackNumber int
+	TrackTotal  int
+	DiscNumber  int
+	DiscTotal   int
+
+	DurationMs    int64
+	Bitrate       int // Average bits per second
+	SampleRate    int
+	Channels      int
+	BitsPerSample int // Lossless/PCM only
+
+	Picture *Picture // Embedded cover art, front cover preferred
+
+	ReplayGain ReplayGainTags
+}
+
+// ReplayGainTags are the gains a tagger already wrote into the file. Gains
+// are in dB relative to -18 LUFS, peaks linear; nil means not tagged.
+type ReplayGainTags struct {
+	TrackGain, TrackPeak *float64
+	AlbumGain, AlbumPeak *float64
+}
+
+// Picture is an image embedded in the file's tags.
+type Picture struct {
+	MIMEType string
+	Type     byte // ID3/FLAC picture type; 3 is the front cover
+	Data     []byte
+}
+
+// pictureTypeFrontCover is the ID3v2 APIC / FLAC PICTURE type for the front
+// cover; other types (back cover, artist photo, ...) are used only if no
+// front cover is present.
+const pictureTypeFrontCover = 3
+
+// offerPicture records p as md's cover unless a better one is already set.
+// The MIME type is taken from the image bytes, since taggers often get it
+// wrong, and pictures that are not a recognisable image are dropped.
+func offerPicture(md *AudioMetadata, p Picture) {
+	p.MIMEType = sniffImageType(p.Data)
+	if p.MIMEType == "" {
+		return
+	}
+	if md.Picture == nil || (md.Picture.Type != pictureTypeFrontCover && p.Type == pictureTypeFrontCover) {
+		md.Picture = &p
+	}
+}
+
+// sniffImageType identifies the image formats browsers can show as cover art.
+func sniffImageType(b []byte) string {
+	switch {
+	case len(b) >= 3 && b[0] == 0xFF && b[1] == 0xD8 && b[2] == 0xFF:
+		return "image/jpeg"
+	case len(b) >= 8 && string(b[:8]) == "\x89PNG\r\n\x1a\n":
+		return "image/png"
+	case len(b) >= 6 && (string(b[:6]) == "GIF87a" || string(b[:6]) == "GIF89a"):
+		return "image/gif"
+	case len(b) >= 12 && string(b[:4]) == "RIFF" && string(b[8:12]) == "WEBP":
+		return "image/webp"
+	}
+	return ""
+}
+
+// parseFLACPicture decodes a FLAC PICTURE block, which is also the payload
+// of the base64 METADATA_BLOCK_PICTURE Vorbis comment. All integers are
+// big-endian.
+func parseFLACPicture(data []byte, md *AudioMetadata) {
+	field := func() ([]byte, bool) {
+		if len(data) < 4 {
+			return nil, false
+		}
+		n := int(binary.BigEndian.Uint32(data))
+		if n < 0 || 4+n > len(data) {
+			return nil, false
+		}
+		v := data[4 : 4+n]
+		data = data[4+n:]
+		return v, true
+	}
+	if len(data) < 4 {
+		return
+	}
+	picType := binary.BigEndian.Uint32(data)
+	data = data[4:]
+	mime, ok := field()
+	if !ok {
+		return
+	}
+	if _, ok := field(); !ok { // description
+		return
+	}
+	if len(data) < 16 { // width, height, depth, colours
+		return
+	}
+	data = data[16:]
+	img, ok := field()
+	if !ok {
+		return
+	}
+	offerPicture(md, Picture{MIMEType: string(mime), Type: byte(picType), Data: img})
+}
+
+// extractMetadata identifies the container in r and parses its tags and
+// stream information. size is the total length of r in bytes.
+func extractMetadata(r io.ReadSeeker, size int64) (*AudioMetadata, error) {
+	format, err := detectAudioFormat(r)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	md := &AudioMetadata{Format: format}
+	switch format {
+	case formatMP3:
+		err = parseMP3(r, size, md)
+	case formatFLAC:
+		err = parseFLAC(r, size, md)
+	case formatOgg:
+		err = parseOgg(r, size, md)
+	case formatWAV:
+		err = parseWAV(r, size, md)
+	case formatAIFF:
+		err = parseAIFF(r, size, md)
+	case formatM4A:
+		err = parseMP4(r, size, md)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", format, err)
+	}
+	if md.Bitrate == 0 && md.DurationMs > 0 {
+		md.Bitrate = int(size * 8 * 1000 / md.DurationMs)
+	}
+	return md, nil
+}
+
+// detectAudioFormat identifies the container from its magic bytes, ignoring
+// the file name. A leading ID3v2 tag is skipped, since MP3 and (rarely) FLAC
+// files may both carry one. MPEG audio has no magic number, so MP3 is only
+// reported when consecutive valid frame headers are found.
+func detectAudioFormat(r io.ReadSeeker) (string, error) {
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	header := make([]byte, 12)
+	n, err := io.ReadFull(r, header)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return "", errUnknownFormat
+	}
+	header = header[:n]
+
+	if tagSize, ok := id3v2TagSize(header); ok {
+		if _, err := r.Seek(tagSize, io.SeekStart); err != nil {
+			return "", err
+		}
+		after := make([]byte, 4)
+		if _, err := io.ReadFull(r, after); err != nil {
+			return "", errUnknownFormat
+		}
+		if string(after) == "fLaC" {
+			return formatFLAC, nil
+		}
+		// Some encoders pad after the tag, so look a little further for frames.
+		if hasMPEGFrames(r, tagSize) {
+			return formatMP3, nil
+		}
+		return "", errUnknownFormat
+	}
+
+	switch {
+	case len(header) >= 4 && string(header[:4]) == "fLaC":
+		return formatFLAC, nil
+	case len(header) >= 4 && string(header[:4]) == "OggS":
+		return formatOgg, nil
+	case len(header) >= 12 && string(header[:4]) == "RIFF" && string(header[8:12]) == "WAVE":
+		return formatWAV, nil
+	case len(header) >= 12 && string(header[:4]) == "FORM" && (string(header[8:12]) == "AIFF" || string(header[8:12]) == "AIFC"):
+		return formatAIFF, nil
+	case len(header) >= 8 && string(header[4:8]) == "ftyp":
+		return formatM4A, nil
+	case isMPEGFrameSync(header) && hasMPEGFrames(r, 0):
+		return formatMP3, nil
+	}
+	return "", errUnknownFormat
+}
+
+// parseVorbisComment reads a Vorbis comment block (used by FLAC and Ogg) into
+// md. Multi-byte integers are little-endian.
+func parseVorbisComment(data []byte, md *AudioMetadata) {
+	if len(data) < 4 {
+		return
+	}
+	vendorLen := int(binary.LittleEndian.Uint32(data))
+	pos := 4 + vendorLen
+	if vendorLen < 0 || pos+4 > len(data) {
+		return
+	}
+	count := int(binary.LittleEndian.Uint32(data[pos:]))
+	pos += 4
+	for i := 0; i < count && pos+4 <= len(data); i++ {
+		length := int(binary.LittleEndian.Uint32(data[pos:]))
+		pos += 4
+		if length < 0 || pos+length > len(data) {
+			return
+		}
+		key, value, ok := strings.Cut(string(data[pos:pos+length]), "=")
+		pos += length
+		if ok {
+			applyVorbisField(strings.ToUpper(key), value, md)
+		}
+	}
+}
+
+func applyVorbisField(key, value string, md *AudioMetadata) {
+	value = strings.TrimSpace(value)
+	switch key {
+	case "TITLE":
+		setIfEmpty(&md.Title, value)
+	case "ARTIST":
+		setIfEmpty(&md.Artist, value)
+	case "ALBUM":
+		setIfEmpty(&md.Album, value)
+	case "ALBUMARTIST", "ALBUM ARTIST":
+		setIfEmpty(&md.AlbumArtist, value)
+	case "GENRE":
+		setIfEmpty(&md.Genre, value)
+	case "DATE", "YEAR":
+		if md.Year == 0 {
+			md.Year = parseYear(value)
+		}
+	case "TRACKNUMBER":
+		parseNumberPair(value, &md.TrackNumber, &md.TrackTotal)
+	case "TRACKTOTAL", "TOTALTRACKS":
+		if md.TrackTotal == 0 {
+			md.TrackTotal, _ = strconv.Atoi(value)
+		}
+	case "DISCNUMBER":
+		parseNumberPair(value, &md.DiscNumber, &md.DiscTotal)
+	case "DISCTOTAL", "TOTALDISCS":
+		if md.DiscTotal == 0 {
+			md.DiscTotal, _ = strconv.Atoi(value)
+		}
+	case "METADATA_BLOCK_PICTURE":
+		if data, err := base64.StdEncoding.DecodeString(value); err == nil {
+			parseFLACPicture(data, md)
+		}
+	default:
+		applyReplayGainField(key, value, md)
+	}
+}
+
+// applyReplayGainField reads the REPLAYGAIN_* fields used by Vorbis comments
+// and ID3 TXXX frames, and the R128_* gains of Opus files. key is upper case.
+func applyReplayGainField(key, value string, md *AudioMetadata) {
+	rg := &md.ReplayGain
+	switch key {
+	case "REPLAYGAIN_TRACK_GAIN":
+		setGain(&rg.TrackGain, value, parseGainDB)
+	case "REPLAYGAIN_ALBUM_GAIN":
+		setGain(&rg.AlbumGain, value, parseGainDB)
+	case "REPLAYGAIN_TRACK_PEAK":
+		setGain(&rg.TrackPeak, value, parsePeak)
+	case "REPLAYGAIN_ALBUM_PEAK":
+		setGain(&rg.AlbumPeak, value, parsePeak)
+	case "R128_TRACK_GAIN":
+		setGain(&rg.TrackGain, value, parseR128Gain)
+	case "R128_ALBUM_GAIN":
+		setGain(&rg.AlbumGain, value, parseR128Gain)
+	}
+}
+
+// setGain keeps the first value of a field that parses.
+func setGain(dst **float64, value string, parse func(string) (float64, bool)) {
+	if v, ok := parse(value); ok && *dst == nil {
+		*dst = &v
+	}
+}
+
+// parseGainDB parses "-6.48 dB"; gains beyond what any tagger writes are
+// rejected as garbage.
+func parseGainDB(value string) (float64, bool) {
+	value = strings.TrimSpace(value)
+	if len(value) >= 2 && strings.EqualFold(value[len(value)-2:], "dB") {
+		value = strings.TrimSpace(value[:len(value)-2])
+	}
+	v, err := strconv.ParseFloat(value, 64)
+	if err != nil || math.IsNaN(v) || math.Abs(v) > 64 {
+		return 0, false
+	}
+	return v, true
+}
+
+func parsePeak(value string) (float64, bool) {
+	v, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+	if err != nil || !(v > 0 && v < 100) {
+		return 0, false
+	}
+	return v, true
+}
+
+// parseR128Gain converts an Opus R128 gain, a Q7.8 fixed-point number of dB
+// relative to -23 LUFS, to a ReplayGain gain relative to -18 LUFS.
+func parseR128Gain(value string) (float64, bool) {
+	q, err := strconv.ParseInt(strings.TrimSpace(value), 10, 16)
+	if err != nil {
+		return 0, false
+	}
+	return float64(q)/256 + replayGainReference - r128TagReference, true
+}
+
+func setIfEmpty(dst *string, value string) {
+	if *dst == "" {
+		*dst = value
+	}
+}
+
+// parseNumberPair parses "3" or "3/12" into number and total, leaving
+// fields that are already set alone.
+func parseNumberPair(value string, number, total *int) {
+	n, t, _ := strings.Cut(strings.TrimSpace(value), "/")
+	if v, err := strconv.Atoi(strings.TrimSpace(n)); err == nil && *number == 0 {
+		*number = v
+	}
+	if v, err := strconv.Atoi(strings.TrimSpace(t)); err == nil && *total == 0 {
+		*total = v
+	}
+}
+
+// parseYear takes the year from dates such as "2010", "2010-05-01" or
+// "2010-05-01T10:00:00".
+func parseYear(value string) int {
+	value = strings.TrimSpace(value)
+	if len(value) < 4 {
+		return 0
+	}
+	year, err := strconv.Atoi(value[:4])
+	if err != nil || year < 1000 {
+		return 0
+	}
+	return year
+}
+
+// readBlock reads exactly n bytes, refusing implausibly large blocks.
+func readBlock(r io.Reader, n int64) ([]byte, error) {
+	if n < 0 || n > maxMetadataBlock {
+		return nil, fmt.Errorf("metadata block of %d bytes is out of bounds", n)
+	}
+	buf := make([]byte, n)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
+
+// trimNulls strips trailing NULs and whitespace from fixed-width text fields.
+func trimNulls(b []byte) string {
+	if i := bytes.IndexByte(b, 0); i >= 0 {
+		b = b[:i]
+	}
+	return strings.TrimSpace(string(b))
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+	"strings"
+)
+
+// aiffCommon is the COMM chunk of an AIFF or AIFF-C file.
+type aiffCommon struct {
+	Channels      int
+	Frames        int64
+	BitsPerSample int
+	SampleRate    int
+	Compression   string // "NONE" for plain AIFF
+}
+
+func parseAIFFCommon(data []byte) (*aiffCommon, error) {
+	if len(data) < 18 {
+		return nil, errors.New("short COMM chunk")
+	}
+	c := &aiffCommon{
+		Channels:      int(binary.BigEndian.Uint16(data)),
+		Frames:        int64(binary.BigEndian.Uint32(data[2:])),
+		BitsPerSample: int(binary.BigEndian.Uint16(data[6:])),
+		SampleRate:    int(math.Round(extendedToFloat(data[8:18]))),
+		Compression:   "NONE",
+	}
+	if len(data) >= 22 {
+		c.Compression = string(data[18:22]) // AIFF-C only
+	}
+	return c, nil
+}
+
+// extendedToFloat converts the 80-bit IEEE 754 extended precision number
+// AIFF stores the sample rate as.
+func extendedToFloat(b []byte) float64 {
+	exponent := int(binary.BigEndian.Uint16(b) & 0x7FFF)
+	mantissa := binary.BigEndian.Uint64(b[2:])
+	v := math.Ldexp(float64(mantissa), exponent-16383-63)
+	if b[0]&0x80 != 0 {
+		v = -v
+	}
+	return v
+}
+
+// parseAIFF walks the big-endian IFF chunks of an AIFF or AIFF-C file for
+// the format, the NAME and AUTH text chunks and an embedded ID3 tag.
+func parseAIFF(r io.ReadSeeker, size int64, md *AudioMetadata) error {
+	if _, err := r.Seek(12, io.SeekStart); err != nil {
+		return err
+	}
+	var comm *aiffCommon
+	haveSound := false
+	for offset := int64(12); offset+8 <= size; {
+		header := make([]byte, 8)
+		if _, err := io.ReadFull(r, header); err != nil {
+			break
+		}
+		id := string(header[:4])
+		length := int64(binary.BigEndian.Uint32(header[4:]))
+		offset += 8
+		if offset+length > size {
+			length = size - offset // Truncated, or written by a streaming encoder
+		}
+
+		switch id {
+		case "COMM":
+			data, err := readBlock(r, length)
+			if err != nil {
+				return err
+			}
+			if comm, err = parseAIFFCommon(data); err != nil {
+				return err
+			}
+		case "NAME", "AUTH":
+			data, err := readBlock(r, length)
+			if err != nil {
+				return err
+			}
+			if id == "NAME" {
+				setIfEmpty(&md.Title, strings.TrimSpace(trimNulls(data)))
+			} else {
+				setIfEmpty(&md.Artist, strings.TrimSpace(trimNulls(data)))
+			}
+		case "ID3 ", "id3 ":
+			data, err := readBlock(r, length)
+			if err != nil {
+				return err
+			}
+			if tagSize, ok := id3v2TagSize(data); ok && tagSize <= int64(len(data)) {
+				parseID3v2(data[:10], data[10:tagSize], md)
+			}
+		case "SSND":
+			haveSound = true
+			if _, err := r.Seek(length, io.SeekCurrent); err != nil {
+				return err
+			}
+		default:
+			if _, err := r.Seek(length, io.SeekCurrent); err != nil {
+				return err
+			}
+		}
+		offset += length
+		if length%2 == 1 {
+			// Chunks are word aligned.
+			if _, err := r.Seek(1, io.SeekCurrent); err != nil {
+				return err
+			}
+			offset++
+		}
+	}
+
+	if comm == nil || comm.SampleRate <= 0 || !haveSound {
+		return errors.New("missing COMM or SSND chunk")
+	}
+	md.Channels, md.SampleRate = comm.Channels, comm.SampleRate
+	md.Codec = aiffCodecName(comm.Compression)
+	md.DurationMs = comm.Frames * 1000 / int64(comm.SampleRate)
+	switch md.Codec {
+	case "pcm":
+		md.BitsPerSample = comm.BitsPerSample
+		md.Bitrate = comm.SampleRate * comm.Channels * 8 * ((comm.BitsPerSample + 7) / 8)
+	case "pcm_float":
+		md.BitsPerSample = 32
+		if comm.Compression[2] == '6' {
+			md.BitsPerSample = 64
+		}
+		md.Bitrate = comm.SampleRate * comm.Channels * md.BitsPerSample
+	}
+	return nil
+}
+
+// aiffCodecName maps an AIFF-C compression type to a codec name, using the
+// names parseWAV gives the same encodings.
+func aiffCodecName(compression string) string {
+	switch compression {
+	case "NONE", "twos", "sowt":
+		return "pcm"
+	case "fl32", "FL32", "fl64", "FL64":
+		return "pcm_float"
+	case "alaw", "ALAW":
+		return "alaw"
+	case "ulaw", "ULAW":
+		return "mulaw"
+	}
+	return "aiff"
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// FLAC metadata block types.
+const (
+	flacStreamInfo    = 0
+	flacVorbisComment = 4
+	flacPicture       = 6
+)
+
+// parseFLAC reads the STREAMINFO, VORBIS_COMMENT and PICTURE metadata blocks.
+func parseFLAC(r io.ReadSeeker, size int64, md *AudioMetadata) error {
+	md.Codec = "flac"
+	start := int64(0)
+	header := make([]byte, 10)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return err
+	}
+	if tagSize, ok := id3v2TagSize(header); ok {
+		start = tagSize
+	}
+	if _, err := r.Seek(start, io.SeekStart); err != nil {
+		return err
+	}
+	magic := make([]byte, 4)
+	if _, err := io.ReadFull(r, magic); err != nil || string(magic) != "fLaC" {
+		return errors.New("missing fLaC marker")
+	}
+
+	var sawStreamInfo bool
+	for {
+		blockHeader := make([]byte, 4)
+		if _, err := io.ReadFull(r, blockHeader); err != nil {
+			return err
+		}
+		last := blockHeader[0]&0x80 != 0
+		blockType := blockHeader[0] & 0x7F
+		length := int64(blockHeader[1])<<16 | int64(blockHeader[2])<<8 | int64(blockHeader[3])
+
+		switch blockType {
+		case flacStreamInfo, flacVorbisComment, flacPicture:
+			data, err := readBlock(r, length)
+			if err != nil {
+				return err
+			}
+			if blockType == flacStreamInfo {
+				if err := parseFLACStreamInfo(data, md); err != nil {
+					return err
+				}
+				sawStreamInfo = true
+			} else if blockType == flacVorbisComment {
+				parseVorbisComment(data, md)
+			} else {
+				parseFLACPicture(data, md)
+			}
+		default:
+			if _, err := r.Seek(length, io.SeekCurrent); err != nil {
+				return err
+			}
+		}
+		if last {
+			break
+		}
+	}
+	if !sawStreamInfo {
+		return errors.New("missing STREAMINFO block")
+	}
+
+	audioStart, err := r.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	if md.DurationMs > 0 {
+		md.Bitrate = int((size - audioStart) * 8 * 1000 / md.DurationMs)
+	}
+	return nil
+}
+
+// parseFLACStreamInfo decodes the fixed 34-byte STREAMINFO block. Sample
+// rate, channels, bit depth and total samples are packed into bytes 10-17.
+func parseFLACStreamInfo(data []byte, md *AudioMetadata) error {
+	if len(data) < 18 {
+		return errors.New("short STREAMINFO block")
+	}
+	packed := binary.BigEndian.Uint64(data[10:18])
+	md.SampleRate = int(packed >> 44)
+	md.Channels = int((packed>>41)&0x7) + 1
+	md.BitsPerSample = int((packed>>36)&0x1F) + 1
+	totalSamples := int64(packed & 0xFFFFFFFFF)
+	if md.SampleRate == 0 {
+		return errors.New("invalid sample rate in STREAMINFO")
+	}
+	md.DurationMs = totalSamples * 1000 / int64(md.SampleRate)
+	return nil
+}
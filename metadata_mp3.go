@@ -0,0 +1,680 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"io"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+)
+
+// id3v2TagSize reports the full size of an ID3v2 tag (header, body and
+// optional footer) starting at header[0].
+func id3v2TagSize(header []byte) (int64, bool) {
+	if len(header) < 10 || string(header[:3]) != "ID3" || header[3] == 0xFF || header[4] == 0xFF {
+		return 0, false
+	}
+	for _, b := range header[6:10] {
+		if b&0x80 != 0 {
+			return 0, false
+		}
+	}
+	size := int64(syncsafe(header[6:10])) + 10
+	if header[5]&0x10 != 0 {
+		size += 10
+	}
+	return size, true
+}
+
+func syncsafe(b []byte) uint32 {
+	var v uint32
+	for _, c := range b {
+		v = v<<7 | uint32(c&0x7F)
+	}
+	return v
+}
+
+// removeUnsync undoes ID3 unsynchronisation, which inserts a zero after every
+// 0xFF byte so tag data cannot be mistaken for an MPEG frame sync.
+func removeUnsync(b []byte) []byte {
+	out := make([]byte, 0, len(b))
+	for i := 0; i < len(b); i++ {
+		out = append(out, b[i])
+		if b[i] == 0xFF && i+1 < len(b) && b[i+1] == 0 {
+			i++
+		}
+	}
+	return out
+}
+
+// parseMP3 reads ID3v2 and ID3v1 tags and works out the stream details from
+// the MPEG frames in between.
+func parseMP3(r io.ReadSeeker, size int64, md *AudioMetadata) error {
+	md.Codec = "mp3"
+	audioStart := int64(0)
+	var tagLengthMs int64
+	// Files occasionally carry more than one ID3v2 tag back to back.
+	for {
+		if _, err := r.Seek(audioStart, io.SeekStart); err != nil {
+			return err
+		}
+		header := make([]byte, 10)
+		if _, err := io.ReadFull(r, header); err != nil {
+			break
+		}
+		tagSize, ok := id3v2TagSize(header)
+		if !ok {
+			break
+		}
+		body, err := readBlock(r, tagSize-10)
+		if err != nil {
+			return err
+		}
+		if ms := parseID3v2(header, body, md); ms > 0 && tagLengthMs == 0 {
+			tagLengthMs = ms
+		}
+		audioStart += tagSize
+	}
+
+	audioEnd := size
+	if size >= 128 {
+		trailer := make([]byte, 128)
+		if _, err := r.Seek(size-128, io.SeekStart); err == nil {
+			if _, err := io.ReadFull(r, trailer); err == nil && string(trailer[:3]) == "TAG" {
+				parseID3v1(trailer, md)
+				audioEnd -= 128
+			}
+		}
+	}
+
+	if err := scanMPEGFrames(r, audioStart, audioEnd, md); err != nil {
+		if tagLengthMs == 0 {
+			return err
+		}
+	}
+	if md.DurationMs == 0 {
+		md.DurationMs = tagLengthMs
+	}
+	return nil
+}
+
+// parseID3v2 applies the frames of one ID3v2 tag to md. It returns the
+// length the tag claims for the track (TLEN), which is only used when the
+// audio cannot be measured.
+func parseID3v2(header, body []byte, md *AudioMetadata) int64 {
+	version := header[3]
+	flags := header[5]
+	if version < 2 || version > 4 {
+		return 0
+	}
+	if flags&0x80 != 0 && version < 4 {
+		body = removeUnsync(body)
+	}
+	if flags&0x10 != 0 && len(body) >= 10 {
+		body = body[:len(body)-10] // footer
+	}
+	if flags&0x40 != 0 && version > 2 && len(body) >= 4 {
+		var extSize int
+		if version == 3 {
+			extSize = int(binary.BigEndian.Uint32(body)) + 4
+		} else {
+			extSize = int(syncsafe(body[:4]))
+		}
+		if extSize > len(body) {
+			return 0
+		}
+		body = body[extSize:]
+	}
+
+	var lengthMs int64
+	for pos := 0; ; {
+		var id string
+		var frameSize, headerSize int
+		var frameFlags uint16
+		if version == 2 {
+			if pos+6 > len(body) {
+				break
+			}
+			id = string(body[pos : pos+3])
+			frameSize = int(body[pos+3])<<16 | int(body[pos+4])<<8 | int(body[pos+5])
+			headerSize = 6
+		} else {
+			if pos+10 > len(body) {
+				break
+			}
+			id = string(body[pos : pos+4])
+			if version == 4 {
+				frameSize = int(syncsafe(body[pos+4 : pos+8]))
+			} else {
+				frameSize = int(binary.BigEndian.Uint32(body[pos+4:]))
+			}
+			frameFlags = binary.BigEndian.Uint16(body[pos+8:])
+			headerSize = 10
+		}
+		if id[0] == 0 || frameSize <= 0 || pos+headerSize+frameSize > len(body) {
+			break
+		}
+		data := body[pos+headerSize : pos+headerSize+frameSize]
+		pos += headerSize + frameSize
+
+		data, ok := decodeID3FrameData(version, flags, frameFlags, data)
+		if !ok {
+			continue
+		}
+		if id == "TLEN" || id == "TLE" {
+			lengthMs, _ = strconv.ParseInt(decodeID3Text(data), 10, 64)
+			continue
+		}
+		applyID3Frame(id, data, md)
+	}
+	return lengthMs
+}
+
+// decodeID3FrameData strips per-frame grouping, compression and
+// unsynchronisation. Encrypted frames are reported as unusable.
+func decodeID3FrameData(version, tagFlags byte, frameFlags uint16, data []byte) ([]byte, bool) {
+	var compressed, encrypted, grouped, unsynced, hasLength bool
+	switch version {
+	case 3:
+		compressed = frameFlags&0x0080 != 0
+		encrypted = frameFlags&0x0040 != 0
+		grouped = frameFlags&0x0020 != 0
+	case 4:
+		grouped = frameFlags&0x0040 != 0
+		compressed = frameFlags&0x0008 != 0
+		encrypted = frameFlags&0x0004 != 0
+		unsynced = frameFlags&0x0002 != 0 || tagFlags&0x80 != 0
+		hasLength = frameFlags&0x0001 != 0
+	}
+	if encrypted {
+		return nil, false
+	}
+	if grouped {
+		if len(data) < 1 {
+			return nil, false
+		}
+		data = data[1:]
+	}
+	if hasLength || (version == 3 && compressed) {
+		if len(data) < 4 {
+			return nil, false
+		}
+		data = data[4:]
+	}
+	if unsynced {
+		data = removeUnsync(data)
+	}
+	if compressed {
+		zr, err := zlib.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, false
+		}
+		inflated, err := io.ReadAll(io.LimitReader(zr, maxMetadataBlock))
+		if err != nil {
+			return nil, false
+		}
+		data = inflated
+	}
+	return data, true
+}
+
+func applyID3Frame(id string, data []byte, md *AudioMetadata) {
+	switch id {
+	case "TIT2", "TT2":
+		setIfEmpty(&md.Title, decodeID3Text(data))
+	case "TPE1", "TP1":
+		setIfEmpty(&md.Artist, decodeID3Text(data))
+	case "TALB", "TAL":
+		setIfEmpty(&md.Album, decodeID3Text(data))
+	case "TPE2", "TP2":
+		setIfEmpty(&md.AlbumArtist, decodeID3Text(data))
+	case "TCON", "TCO":
+		setIfEmpty(&md.Genre, resolveID3Genre(decodeID3Text(data)))
+	case "TYER", "TYE", "TDRC", "TORY", "TDOR":
+		if md.Year == 0 {
+			md.Year = parseYear(decodeID3Text(data))
+		}
+	case "TRCK", "TRK":
+		parseNumberPair(decodeID3Text(data), &md.TrackNumber, &md.TrackTotal)
+	case "TPOS", "TPA":
+		parseNumberPair(decodeID3Text(data), &md.DiscNumber, &md.DiscTotal)
+	case "APIC", "PIC":
+		parseID3Picture(id == "PIC", data, md)
+	case "TXXX", "TXX":
+		// User-defined text: encoding, description, NUL, value.
+		if len(data) < 1 {
+			return
+		}
+		desc, value, ok := strings.Cut(decodeID3String(data[0], data[1:]), "\x00")
+		if ok {
+			value, _, _ = strings.Cut(strings.TrimPrefix(value, "\ufeff"), "\x00")
+			applyReplayGainField(strings.ToUpper(strings.TrimSpace(desc)), strings.TrimSpace(value), md)
+		}
+	}
+}
+
+// parseID3Picture decodes an APIC frame (encoding, NUL-terminated MIME type,
+// picture type, description, image) or its ID3v2.2 form PIC, which has a
+// fixed three-letter image format in place of the MIME type.
+func parseID3Picture(v22 bool, data []byte, md *AudioMetadata) {
+	if len(data) < 2 {
+		return
+	}
+	encoding := data[0]
+	data = data[1:]
+	var mime string
+	if v22 {
+		if len(data) < 3 {
+			return
+		}
+		mime = "image/" + strings.ToLower(string(data[:3]))
+		data = data[3:]
+	} else {
+		end := bytes.IndexByte(data, 0)
+		if end < 0 {
+			return
+		}
+		mime = string(data[:end])
+		data = data[end+1:]
+	}
+	if len(data) < 1 {
+		return
+	}
+	picType := data[0]
+	data = data[1:]
+
+	// Skip the description, whose terminator is two bytes wide in UTF-16.
+	if encoding == 1 || encoding == 2 {
+		end := -1
+		for i := 0; i+1 < len(data); i += 2 {
+			if data[i] == 0 && data[i+1] == 0 {
+				end = i
+				break
+			}
+		}
+		if end < 0 {
+			return
+		}
+		data = data[end+2:]
+	} else {
+		end := bytes.IndexByte(data, 0)
+		if end < 0 {
+			return
+		}
+		data = data[end+1:]
+	}
+	offerPicture(md, Picture{MIMEType: mime, Type: picType, Data: data})
+}
+
+// decodeID3Text decodes a text frame: one encoding byte followed by the
+// text. ID3v2.4 separates multiple values with NULs; only the first is kept.
+func decodeID3Text(data []byte) string {
+	if len(data) < 1 {
+		return ""
+	}
+	s := decodeID3String(data[0], data[1:])
+	if i := strings.IndexByte(s, 0); i >= 0 {
+		s = s[:i]
+	}
+	return strings.TrimSpace(s)
+}
+
+func decodeID3String(encoding byte, b []byte) string {
+	switch encoding {
+	case 1, 2: // UTF-16 with BOM, UTF-16BE
+		bigEndian := encoding == 2
+		if len(b) >= 2 {
+			switch {
+			case b[0] == 0xFF && b[1] == 0xFE:
+				bigEndian, b = false, b[2:]
+			case b[0] == 0xFE && b[1] == 0xFF:
+				bigEndian, b = true, b[2:]
+			}
+		}
+		units := make([]uint16, 0, len(b)/2)
+		for i := 0; i+1 < len(b); i += 2 {
+			if bigEndian {
+				units = append(units, binary.BigEndian.Uint16(b[i:]))
+			} else {
+				units = append(units, binary.LittleEndian.Uint16(b[i:]))
+			}
+		}
+		return string(utf16.Decode(units))
+	case 3: // UTF-8
+		return string(b)
+	default: // ISO-8859-1
+		return latin1(b)
+	}
+}
+
+func latin1(b []byte) string {
+	runes := make([]rune, len(b))
+	for i, c := range b {
+		runes[i] = rune(c)
+	}
+	return string(runes)
+}
+
+// resolveID3Genre turns the numeric forms "(17)", "17" and "(17)Rock" into
+// genre names. RX and CR are the ID3 shorthands for Remix and Cover.
+func resolveID3Genre(s string) string {
+	s = strings.TrimSpace(s)
+	if strings.HasPrefix(s, "(") {
+		if end := strings.IndexByte(s, ')'); end > 0 {
+			if rest := strings.TrimSpace(s[end+1:]); rest != "" {
+				return rest
+			}
+			s = s[1:end]
+		}
+	}
+	switch s {
+	case "RX":
+		return "Remix"
+	case "CR":
+		return "Cover"
+	}
+	if n, err := strconv.Atoi(s); err == nil {
+		if n >= 0 && n < len(id3v1Genres) {
+			return id3v1Genres[n]
+		}
+		return ""
+	}
+	return s
+}
+
+func parseID3v1(tag []byte, md *AudioMetadata) {
+	setIfEmpty(&md.Title, latin1Trimmed(tag[3:33]))
+	setIfEmpty(&md.Artist, latin1Trimmed(tag[33:63]))
+	setIfEmpty(&md.Album, latin1Trimmed(tag[63:93]))
+	if md.Year == 0 {
+		md.Year = parseYear(trimNulls(tag[93:97]))
+	}
+	// ID3v1.1 stores the track number in the last byte of the comment.
+	if tag[125] == 0 && tag[126] != 0 && md.TrackNumber == 0 {
+		md.TrackNumber = int(tag[126])
+	}
+	if md.Genre == "" && int(tag[127]) < len(id3v1Genres) {
+		md.Genre = id3v1Genres[tag[127]]
+	}
+}
+
+func latin1Trimmed(b []byte) string {
+	if i := bytes.IndexByte(b, 0); i >= 0 {
+		b = b[:i]
+	}
+	return strings.TrimSpace(latin1(b))
+}
+
+// mpegFrame is a decoded MPEG audio frame header.
+type mpegFrame struct {
+	version         int // 1, 2 or 25 (MPEG 2.5)
+	layer           int
+	bitrate         int // kbit/s
+	sampleRate      int
+	channels        int
+	samplesPerFrame int
+	length          int // Bytes, including the header
+	sideInfoLength  int // Layer III only
+}
+
+var mpegBitrates = map[[2]int][16]int{
+	{1, 1}: {0, 32, 64, 96, 128, 160, 192, 224, 256, 288, 320, 352, 384, 416, 448},
+	{1, 2}: {0, 32, 48, 56, 64, 80, 96, 112, 128, 160, 192, 224, 256, 320, 384},
+	{1, 3}: {0, 32, 40, 48, 56, 64, 80, 96, 112, 128, 160, 192, 224, 256, 320},
+	{2, 1}: {0, 32, 48, 56, 64, 80, 96, 112, 128, 144, 160, 176, 192, 224, 256},
+	{2, 2}: {0, 8, 16, 24, 32, 40, 48, 56, 64, 80, 96, 112, 128, 144, 160},
+	{2, 3}: {0, 8, 16, 24, 32, 40, 48, 56, 64, 80, 96, 112, 128, 144, 160},
+}
+
+var mpegSampleRates = map[int][3]int{
+	1:  {44100, 48000, 32000},
+	2:  {22050, 24000, 16000},
+	25: {11025, 12000, 8000},
+}
+
+func isMPEGFrameSync(b []byte) bool {
+	_, ok := parseMPEGFrameHeader(b)
+	return ok
+}
+
+// parseMPEGFrameHeader decodes a 4-byte frame header. Free-format and
+// reserved values are rejected, which also keeps false syncs rare.
+func parseMPEGFrameHeader(b []byte) (mpegFrame, bool) {
+	if len(b) < 4 || b[0] != 0xFF || b[1]&0xE0 != 0xE0 {
+		return mpegFrame{}, false
+	}
+	var f mpegFrame
+	switch (b[1] >> 3) & 3 {
+	case 0:
+		f.version = 25
+	case 2:
+		f.version = 2
+	case 3:
+		f.version = 1
+	default:
+		return mpegFrame{}, false
+	}
+	f.layer = 4 - int((b[1]>>1)&3)
+	bitrateIndex := int(b[2] >> 4)
+	rateIndex := int((b[2] >> 2) & 3)
+	if f.layer == 4 || bitrateIndex == 0 || bitrateIndex == 15 || rateIndex == 3 {
+		return mpegFrame{}, false
+	}
+	tableVersion := f.version
+	if tableVersion == 25 {
+		tableVersion = 2
+	}
+	f.bitrate = mpegBitrates[[2]int{tableVersion, f.layer}][bitrateIndex]
+	f.sampleRate = mpegSampleRates[f.version][rateIndex]
+	padding := int((b[2] >> 1) & 1)
+	f.channels = 2
+	if b[3]>>6 == 3 {
+		f.channels = 1
+	}
+
+	switch {
+	case f.layer == 1:
+		f.samplesPerFrame = 384
+		f.length = (12*f.bitrate*1000/f.sampleRate + padding) * 4
+	case f.layer == 3 && f.version != 1:
+		f.samplesPerFrame = 576
+		f.length = 72*f.bitrate*1000/f.sampleRate + padding
+	default:
+		f.samplesPerFrame = 1152
+		f.length = 144*f.bitrate*1000/f.sampleRate + padding
+	}
+	if f.layer == 3 {
+		switch {
+		case f.version == 1 && f.channels == 1:
+			f.sideInfoLength = 17
+		case f.version == 1:
+			f.sideInfoLength = 32
+		case f.channels == 1:
+			f.sideInfoLength = 9
+		default:
+			f.sideInfoLength = 17
+		}
+	}
+	return f, true
+}
+
+var errNoMPEGFrames = errors.New("no MPEG audio frames found")
+
+// Longest possible frame: MPEG-1 Layer II at 384 kbit/s, 32 kHz, padded.
+const maxMPEGFrameLength = 1729
+
+// hasMPEGFrames reports whether two back-to-back MPEG frames start within
+// the first 64 KiB after offset.
+func hasMPEGFrames(r io.ReadSeeker, offset int64) bool {
+	if _, err := r.Seek(offset, io.SeekStart); err != nil {
+		return false
+	}
+	buf := make([]byte, 64<<10+2*maxMPEGFrameLength)
+	n, _ := io.ReadFull(r, buf)
+	buf = buf[:n]
+	for i := 0; i+4 <= len(buf) && i < 64<<10; i++ {
+		f, ok := parseMPEGFrameHeader(buf[i:])
+		if ok && i+f.length+4 <= len(buf) && isMPEGFrameSync(buf[i+f.length:]) {
+			return true
+		}
+	}
+	return false
+}
+
+// scanMPEGFrames finds the first frame between start and end. If it carries
+// a Xing/Info or VBRI header the totals come from there (minus the LAME
+// encoder delay and padding, for a sample-exact length); otherwise every
+// frame is walked and counted.
+func scanMPEGFrames(r io.ReadSeeker, start, end int64, md *AudioMetadata) error {
+	if _, err := r.Seek(start, io.SeekStart); err != nil {
+		return err
+	}
+	br := bufio.NewReaderSize(io.LimitReader(r, end-start), 64<<10)
+	offset := start
+
+	// Find the first frame whose successor is also a valid frame header.
+	var first mpegFrame
+	for {
+		peek, err := br.Peek(4)
+		if err != nil {
+			return errNoMPEGFrames
+		}
+		if f, ok := parseMPEGFrameHeader(peek); ok {
+			if next, err := br.Peek(f.length + 4); err != nil || isMPEGFrameSync(next[f.length:]) {
+				first = f
+				break
+			}
+		}
+		br.Discard(1)
+		offset++
+		if offset-start > 1<<20 {
+			return errNoMPEGFrames
+		}
+	}
+	md.SampleRate = first.sampleRate
+	md.Channels = first.channels
+	if first.layer != 3 {
+		md.Codec = "mp" + strconv.Itoa(first.layer)
+	}
+
+	frameData, _ := br.Peek(first.length)
+	if frames, audioBytes, delay, padding, ok := parseVBRHeader(first, frameData); ok && frames > 0 {
+		samples := frames*int64(first.samplesPerFrame) - delay - padding
+		if samples < 0 {
+			samples = 0
+		}
+		md.DurationMs = samples * 1000 / int64(first.sampleRate)
+		if audioBytes == 0 {
+			audioBytes = end - offset - int64(first.length)
+		}
+		if md.DurationMs > 0 {
+			md.Bitrate = int(audioBytes * 8 * 1000 / md.DurationMs)
+		}
+		return nil
+	}
+
+	// No VBR header: count every frame.
+	var samples, audioBytes int64
+	for {
+		header, err := br.Peek(4)
+		if err != nil {
+			break
+		}
+		f, ok := parseMPEGFrameHeader(header)
+		if !ok || f.sampleRate != first.sampleRate {
+			// Junk between frames; resynchronise byte by byte.
+			if _, err := br.Discard(1); err != nil {
+				break
+			}
+			continue
+		}
+		n, err := br.Discard(f.length)
+		if n < f.length {
+			// A truncated last frame still holds a partial frame of audio.
+			samples += int64(f.samplesPerFrame) * int64(n) / int64(f.length)
+			audioBytes += int64(n)
+			break
+		}
+		samples += int64(f.samplesPerFrame)
+		audioBytes += int64(f.length)
+		if err != nil {
+			break
+		}
+	}
+	md.DurationMs = samples * 1000 / int64(first.sampleRate)
+	if md.DurationMs > 0 {
+		md.Bitrate = int(audioBytes * 8 * 1000 / md.DurationMs)
+	}
+	return nil
+}
+
+// parseVBRHeader reads the Xing/Info (with optional LAME extension) or VBRI
+// header stored in the first frame of VBR and most LAME-encoded files.
+func parseVBRHeader(f mpegFrame, frame []byte) (frames, audioBytes, delay, padding int64, ok bool) {
+	if f.layer != 3 {
+		return
+	}
+	pos := 4 + f.sideInfoLength
+	if pos+8 <= len(frame) && (string(frame[pos:pos+4]) == "Xing" || string(frame[pos:pos+4]) == "Info") {
+		flags := binary.BigEndian.Uint32(frame[pos+4:])
+		pos += 8
+		if flags&1 != 0 && pos+4 <= len(frame) {
+			frames = int64(binary.BigEndian.Uint32(frame[pos:]))
+			pos += 4
+		}
+		if flags&2 != 0 && pos+4 <= len(frame) {
+			audioBytes = int64(binary.BigEndian.Uint32(frame[pos:]))
+			pos += 4
+		}
+		if flags&4 != 0 {
+			pos += 100 // seek table
+		}
+		if flags&8 != 0 {
+			pos += 4 // quality
+		}
+		// LAME extension: 9-byte encoder string, then the delay/padding
+		// pair 21 bytes in as two 12-bit values.
+		if pos+24 <= len(frame) && (string(frame[pos:pos+4]) == "LAME" || string(frame[pos:pos+4]) == "Lavf" || string(frame[pos:pos+4]) == "Lavc") {
+			dp := frame[pos+21:]
+			delay = int64(dp[0])<<4 | int64(dp[1]>>4)
+			padding = int64(dp[1]&0x0F)<<8 | int64(dp[2])
+		}
+		return frames, audioBytes, delay, padding, true
+	}
+	// VBRI (Fraunhofer) always sits 32 bytes after the header.
+	pos = 4 + 32
+	if pos+18 <= len(frame) && string(frame[pos:pos+4]) == "VBRI" {
+		delay = int64(binary.BigEndian.Uint16(frame[pos+6:]))
+		audioBytes = int64(binary.BigEndian.Uint32(frame[pos+10:]))
+		frames = int64(binary.BigEndian.Uint32(frame[pos+14:]))
+		return frames, audioBytes, delay, 0, true
+	}
+	return
+}
+
+// id3v1Genres is the ID3v1 genre list including the Winamp extensions.
+var id3v1Genres = []string{
+	"Blues", "Classic Rock", "Country", "Dance", "Disco", "Funk", "Grunge", "Hip-Hop",
+	"Jazz", "Metal", "New Age", "Oldies", "Other", "Pop", "R&B", "Rap",
+	"Reggae", "Rock", "Techno", "Industrial", "Alternative", "Ska", "Death Metal", "Pranks",
+	"Soundtrack", "Euro-Techno", "Ambient", "Trip-Hop", "Vocal", "Jazz+Funk", "Fusion", "Trance",
+	"Classical", "Instrumental", "Acid", "House", "Game", "Sound Clip", "Gospel", "Noise",
+	"AlternRock", "Bass", "Soul", "Punk", "Space", "Meditative", "Instrumental Pop", "Instrumental Rock",
+	"Ethnic", "Gothic", "Darkwave", "Techno-Industrial", "Electronic", "Pop-Folk", "Eurodance", "Dream",
+	"Southern Rock", "Comedy", "Cult", "Gangsta", "Top 40", "Christian Rap", "Pop/Funk", "Jungle",
+	"Native American", "Cabaret", "New Wave", "Psychadelic", "Rave", "Showtunes", "Trailer", "Lo-Fi",
+	"Tribal", "Acid Punk", "Acid Jazz", "Polka", "Retro", "Musical", "Rock & Roll", "Hard Rock",
+	"Folk", "Folk-Rock", "National Folk", "Swing", "Fast Fusion", "Bebob", "Latin", "Revival",
+	"Celtic", "Bluegrass", "Avantgarde", "Gothic Rock", "Progressive Rock", "Psychedelic Rock", "Symphonic Rock", "Slow Rock",
+	"Big Band", "Chorus", "Easy Listening", "Acoustic", "Humour", "Speech", "Chanson", "Opera",
+	"Chamber Music", "Sonata", "Symphony", "Booty Bass", "Primus", "Porn Groove", "Satire", "Slow Jam",
+	"Club", "Tango", "Samba", "Folklore", "Ballad", "Power Ballad", "Rhythmic Soul", "Freestyle",
+	"Duet", "Punk Rock", "Drum Solo", "A capella", "Euro-House", "Dance Hall", "Goa", "Drum & Bass",
+	"Club-House", "Hardcore", "Terror", "Indie", "BritPop", "Negerpunk", "Polsk Punk", "Beat",
+	"Christian Gangsta Rap", "Heavy Metal", "Black Metal", "Crossover", "Contemporary Christian", "Christian Rock", "Merengue", "Salsa",
+	"Thrash Metal", "Anime", "JPop", "Synthpop",
+}
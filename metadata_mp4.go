@@ -0,0 +1,333 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"strings"
+)
+
+// mp4Parser walks the atom tree of an MP4/M4A file, reading only the leaf
+// atoms it needs and seeking over everything else (notably mdat).
+type mp4Parser struct {
+	r  io.ReadSeeker
+	md *AudioMetadata
+
+	// Per-track state while inside a trak atom.
+	inAudioTrack    bool
+	trackTimescale  int64
+	trackDuration   int64
+	movieTimescale  int64
+	movieDuration   int64
+	audioTimescale  int64
+	audioDuration   int64
+	foundAudioTrack bool
+}
+
+// Atoms that only contain other atoms.
+var mp4Containers = map[string]bool{
+	"moov": true, "trak": true, "mdia": true, "minf": true, "stbl": true, "udta": true, "ilst": true,
+}
+
+func parseMP4(r io.ReadSeeker, size int64, md *AudioMetadata) error {
+	p := &mp4Parser{r: r, md: md}
+	if err := p.walk(0, size, ""); err != nil {
+		return err
+	}
+	switch {
+	case p.foundAudioTrack && p.audioTimescale > 0:
+		md.DurationMs = p.audioDuration * 1000 / p.audioTimescale
+	case p.movieTimescale > 0:
+		md.DurationMs = p.movieDuration * 1000 / p.movieTimescale
+	}
+	if md.Codec == "" {
+		return errors.New("no audio track found")
+	}
+	return nil
+}
+
+// walk visits the atoms between start and end. parent is the type of the
+// enclosing atom, which decides how ilst items are read.
+func (p *mp4Parser) walk(start, end int64, parent string) error {
+	for offset := start; offset+8 <= end; {
+		if _, err := p.r.Seek(offset, io.SeekStart); err != nil {
+			return err
+		}
+		header := make([]byte, 8)
+		if _, err := io.ReadFull(p.r, header); err != nil {
+			return err
+		}
+		atomSize := int64(binary.BigEndian.Uint32(header))
+		atomType := string(header[4:8])
+		headerSize := int64(8)
+		switch atomSize {
+		case 0:
+			atomSize = end - offset
+		case 1:
+			ext := make([]byte, 8)
+			if _, err := io.ReadFull(p.r, ext); err != nil {
+				return err
+			}
+			atomSize = int64(binary.BigEndian.Uint64(ext))
+			headerSize = 16
+		}
+		if atomSize < headerSize || offset+atomSize > end {
+			return errors.New("malformed MP4 atom " + atomType)
+		}
+		bodyStart, bodyEnd := offset+headerSize, offset+atomSize
+
+		if err := p.visit(atomType, parent, bodyStart, bodyEnd); err != nil {
+			return err
+		}
+		offset = bodyEnd
+	}
+	return nil
+}
+
+func (p *mp4Parser) visit(atomType, parent string, start, end int64) error {
+	switch {
+	case parent == "ilst":
+		data, err := p.read(start, end)
+		if err != nil {
+			return err
+		}
+		p.applyItem(atomType, data)
+		return nil
+	case atomType == "trak":
+		p.inAudioTrack, p.trackTimescale, p.trackDuration = false, 0, 0
+		if err := p.walk(start, end, atomType); err != nil {
+			return err
+		}
+		if p.inAudioTrack && !p.foundAudioTrack {
+			p.foundAudioTrack = true
+			p.audioTimescale, p.audioDuration = p.trackTimescale, p.trackDuration
+		}
+		return nil
+	case mp4Containers[atomType]:
+		return p.walk(start, end, atomType)
+	case atomType == "meta":
+		// meta is a full box: version and flags precede its children.
+		return p.walk(start+4, end, atomType)
+	case atomType == "mvhd" || atomType == "mdhd":
+		data, err := p.read(start, min(end, start+32))
+		if err != nil {
+			return err
+		}
+		timescale, duration := parseMP4TimeHeader(data)
+		if atomType == "mvhd" {
+			p.movieTimescale, p.movieDuration = timescale, duration
+		} else {
+			p.trackTimescale, p.trackDuration = timescale, duration
+		}
+		return nil
+	case atomType == "hdlr" && parent == "mdia":
+		data, err := p.read(start, min(end, start+12))
+		if err != nil {
+			return err
+		}
+		if len(data) >= 12 && string(data[8:12]) == "soun" {
+			p.inAudioTrack = true
+		}
+		return nil
+	case atomType == "stsd" && p.inAudioTrack && !p.foundAudioTrack:
+		data, err := p.read(start, end)
+		if err != nil {
+			return err
+		}
+		p.parseSampleDescription(data)
+		return nil
+	}
+	return nil
+}
+
+func (p *mp4Parser) read(start, end int64) ([]byte, error) {
+	if _, err := p.r.Seek(start, io.SeekStart); err != nil {
+		return nil, err
+	}
+	return readBlock(p.r, end-start)
+}
+
+// parseMP4TimeHeader returns the timescale and duration of an mvhd or mdhd
+// atom, whose field widths depend on the version byte.
+func parseMP4TimeHeader(data []byte) (timescale, duration int64) {
+	if len(data) < 20 {
+		return 0, 0
+	}
+	if data[0] == 1 {
+		if len(data) < 32 {
+			return 0, 0
+		}
+		return int64(binary.BigEndian.Uint32(data[20:])), int64(binary.BigEndian.Uint64(data[24:]))
+	}
+	return int64(binary.BigEndian.Uint32(data[12:])), int64(binary.BigEndian.Uint32(data[16:]))
+}
+
+// parseSampleDescription reads the first audio sample entry of an stsd atom.
+func (p *mp4Parser) parseSampleDescription(data []byte) {
+	// version/flags(4) entry count(4), then the entry: size(4) format(4)
+	// reserved(6) data ref(2) version(2) revision(2) vendor(4) channels(2)
+	// sample size(2) compression(2) packet size(2) rate(16.16).
+	if len(data) < 8+36 {
+		return
+	}
+	entry := data[8:]
+	entrySize := int(binary.BigEndian.Uint32(entry))
+	if entrySize > len(entry) || entrySize < 36 {
+		entrySize = len(entry)
+	}
+	format := string(entry[4:8])
+	p.md.Channels = int(binary.BigEndian.Uint16(entry[24:]))
+	p.md.BitsPerSample = int(binary.BigEndian.Uint16(entry[26:]))
+	p.md.SampleRate = int(binary.BigEndian.Uint32(entry[32:]) >> 16)
+
+	switch format {
+	case "mp4a":
+		p.md.Codec = "aac"
+		p.md.BitsPerSample = 0
+	case "alac":
+		p.md.Codec = "alac"
+	case "fLaC":
+		p.md.Codec = "flac"
+	case "Opus":
+		p.md.Codec = "opus"
+		p.md.BitsPerSample = 0
+	default:
+		p.md.Codec = strings.TrimSpace(strings.ToLower(format))
+	}
+
+	// Child boxes of the sample entry (after the 36-byte fixed part).
+	for pos := 36; pos+8 <= entrySize; {
+		boxSize := int(binary.BigEndian.Uint32(entry[pos:]))
+		if boxSize < 8 || pos+boxSize > entrySize {
+			break
+		}
+		box := entry[pos+8 : pos+boxSize]
+		switch string(entry[pos+4 : pos+8]) {
+		case "esds":
+			parseESDS(box, p.md)
+		case "alac":
+			// version/flags(4) frame length(4) compatible version(1) bit
+			// depth(1) pb mb kb(3) channels(1) max run(2) max frame
+			// bytes(4) average bitrate(4) sample rate(4).
+			if len(box) >= 28 {
+				p.md.BitsPerSample = int(box[9])
+				p.md.Channels = int(box[13])
+				p.md.Bitrate = int(binary.BigEndian.Uint32(box[20:]))
+				p.md.SampleRate = int(binary.BigEndian.Uint32(box[24:]))
+			}
+		}
+		pos += boxSize
+	}
+}
+
+// parseESDS digs the object type and average bitrate out of an MPEG-4
+// elementary stream descriptor.
+func parseESDS(box []byte, md *AudioMetadata) {
+	if len(box) < 4 {
+		return
+	}
+	data := box[4:] // version/flags
+	for len(data) > 2 {
+		tag := data[0]
+		length, n := 0, 1
+		for ; n < 5 && n < len(data); n++ {
+			length = length<<7 | int(data[n]&0x7F)
+			if data[n]&0x80 == 0 {
+				n++
+				break
+			}
+		}
+		body := data[n:]
+		if length < len(body) {
+			body = body[:length]
+		}
+		switch tag {
+		case 0x03: // ES_Descriptor: ES_ID(2) flags(1), optional fields
+			if len(body) < 3 {
+				return
+			}
+			flags := body[2]
+			skip := 3
+			if flags&0x80 != 0 {
+				skip += 2
+			}
+			if flags&0x40 != 0 && len(body) > skip {
+				skip += 1 + int(body[skip])
+			}
+			if flags&0x20 != 0 {
+				skip += 2
+			}
+			if skip > len(body) {
+				return
+			}
+			data = body[skip:]
+			continue
+		case 0x04: // DecoderConfigDescriptor
+			if len(body) >= 13 {
+				if body[0] == 0x6B || body[0] == 0x69 {
+					md.Codec = "mp3"
+				}
+				if avg := int(binary.BigEndian.Uint32(body[9:])); avg > 0 {
+					md.Bitrate = avg
+				}
+			}
+			return
+		}
+		if n+length > len(data) {
+			return
+		}
+		data = data[n+length:]
+	}
+}
+
+// applyItem handles one iTunes-style metadata item from ilst. The value
+// lives in a "data" child: size(4) "data" type(4) locale(4) payload.
+func (p *mp4Parser) applyItem(itemType string, item []byte) {
+	if len(item) < 16 || string(item[4:8]) != "data" {
+		return
+	}
+	dataSize := int(binary.BigEndian.Uint32(item))
+	if dataSize < 16 || dataSize > len(item) {
+		dataSize = len(item)
+	}
+	payload := item[16:dataSize]
+	text := strings.TrimSpace(string(payload))
+	md := p.md
+	switch itemType {
+	case "\xa9nam":
+		setIfEmpty(&md.Title, text)
+	case "\xa9ART":
+		setIfEmpty(&md.Artist, text)
+	case "\xa9alb":
+		setIfEmpty(&md.Album, text)
+	case "aART":
+		setIfEmpty(&md.AlbumArtist, text)
+	case "\xa9gen":
+		setIfEmpty(&md.Genre, text)
+	case "gnre":
+		// ID3v1 genre index plus one.
+		if len(payload) >= 2 {
+			if n := int(binary.BigEndian.Uint16(payload)) - 1; n >= 0 && n < len(id3v1Genres) {
+				setIfEmpty(&md.Genre, id3v1Genres[n])
+			}
+		}
+	case "\xa9day":
+		if md.Year == 0 {
+			md.Year = parseYear(text)
+		}
+	case "covr":
+		// Several pictures may follow one another; the first is the cover.
+		offerPicture(md, Picture{Type: pictureTypeFrontCover, Data: payload})
+	case "trkn", "disk":
+		// reserved(2) number(2) total(2)
+		if len(payload) >= 6 {
+			number := int(binary.BigEndian.Uint16(payload[2:]))
+			total := int(binary.BigEndian.Uint16(payload[4:]))
+			if itemType == "trkn" {
+				md.TrackNumber, md.TrackTotal = number, total
+			} else {
+				md.DiscNumber, md.DiscTotal = number, total
+			}
+		}
+	}
+}
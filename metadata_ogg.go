@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// oggPage is the part of an Ogg page header we need.
+type oggPage struct {
+	headerType byte
+	granule    int64
+	serial     uint32
+	segments   []byte // Lacing values
+}
+
+func readOggPage(r io.Reader) (oggPage, []byte, error) {
+	header := make([]byte, 27)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return oggPage{}, nil, err
+	}
+	if string(header[:4]) != "OggS" {
+		return oggPage{}, nil, errors.New("lost Ogg page sync")
+	}
+	p := oggPage{
+		headerType: header[5],
+		granule:    int64(binary.LittleEndian.Uint64(header[6:])),
+		serial:     binary.LittleEndian.Uint32(header[14:]),
+		segments:   make([]byte, header[26]),
+	}
+	if _, err := io.ReadFull(r, p.segments); err != nil {
+		return oggPage{}, nil, err
+	}
+	var bodySize int
+	for _, l := range p.segments {
+		bodySize += int(l)
+	}
+	body := make([]byte, bodySize)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return oggPage{}, nil, err
+	}
+	return p, body, nil
+}
+
+// parseOgg reads the identification and comment headers of the first
+// logical stream (Vorbis or Opus) and takes the duration from the granule
+// position of its last page.
+func parseOgg(r io.ReadSeeker, size int64, md *AudioMetadata) error {
+	br := bufio.NewReader(r)
+
+	// Collect the first two packets of the first stream; headers may span pages.
+	var serial uint32
+	var packets [][]byte
+	var current []byte
+	for pageNo := 0; len(packets) < 2; pageNo++ {
+		page, body, err := readOggPage(br)
+		if err != nil {
+			return err
+		}
+		if pageNo == 0 {
+			serial = page.serial
+		} else if page.serial != serial {
+			continue
+		}
+		pos := 0
+		for _, l := range page.segments {
+			current = append(current, body[pos:pos+int(l)]...)
+			pos += int(l)
+			if len(current) > maxMetadataBlock {
+				return errors.New("Ogg header packet too large")
+			}
+			if l < 255 {
+				packets = append(packets, current)
+				current = nil
+				if len(packets) == 2 {
+					break
+				}
+			}
+		}
+	}
+
+	id, comments := packets[0], packets[1]
+	var granuleRate, preSkip int64
+	switch {
+	case len(id) >= 30 && bytes.HasPrefix(id, []byte("\x01vorbis")):
+		md.Codec = "vorbis"
+		md.Channels = int(id[11])
+		md.SampleRate = int(binary.LittleEndian.Uint32(id[12:]))
+		if nominal := int32(binary.LittleEndian.Uint32(id[20:])); nominal > 0 {
+			md.Bitrate = int(nominal)
+		}
+		granuleRate = int64(md.SampleRate)
+		if bytes.HasPrefix(comments, []byte("\x03vorbis")) {
+			parseVorbisComment(comments[7:], md)
+		}
+	case len(id) >= 19 && bytes.HasPrefix(id, []byte("OpusHead")):
+		md.Codec = "opus"
+		md.Channels = int(id[9])
+		preSkip = int64(binary.LittleEndian.Uint16(id[10:]))
+		// Opus always runs at 48 kHz; the header records the input rate.
+		md.SampleRate = int(binary.LittleEndian.Uint32(id[12:]))
+		if md.SampleRate == 0 {
+			md.SampleRate = 48000
+		}
+		granuleRate = 48000
+		if bytes.HasPrefix(comments, []byte("OpusTags")) {
+			parseVorbisComment(comments[8:], md)
+		}
+	default:
+		return errors.New("unsupported Ogg codec")
+	}
+	if granuleRate == 0 {
+		return errors.New("invalid sample rate in Ogg header")
+	}
+
+	granule, err := lastOggGranule(r, size, serial)
+	if err != nil {
+		return err
+	}
+	if samples := granule - preSkip; samples > 0 {
+		md.DurationMs = samples * 1000 / granuleRate
+	}
+	if md.Bitrate == 0 && md.DurationMs > 0 {
+		md.Bitrate = int(size * 8 * 1000 / md.DurationMs)
+	}
+	return nil
+}
+
+// lastOggGranule scans backwards from the end of the file for the last page
+// of the given stream, widening the window until one is found.
+func lastOggGranule(r io.ReadSeeker, size int64, serial uint32) (int64, error) {
+	for window := int64(64 << 10); ; window *= 4 {
+		start := size - window
+		if start < 0 {
+			start = 0
+		}
+		if _, err := r.Seek(start, io.SeekStart); err != nil {
+			return 0, err
+		}
+		buf, err := io.ReadAll(io.LimitReader(r, size-start))
+		if err != nil {
+			return 0, err
+		}
+		for i := bytes.LastIndex(buf, []byte("OggS")); i >= 0; i = bytes.LastIndex(buf[:i], []byte("OggS")) {
+			if i+27 > len(buf) {
+				continue
+			}
+			granule := int64(binary.LittleEndian.Uint64(buf[i+6:]))
+			if binary.LittleEndian.Uint32(buf[i+14:]) == serial && granule != -1 {
+				return granule, nil
+			}
+		}
+		if start == 0 {
+			return 0, errors.New("no Ogg page with a granule position")
+		}
+	}
+}
@@ -0,0 +1,431 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"math/bits"
+	"reflect"
+	"testing"
+	"unicode/utf16"
+)
+
+// The builders below assemble just enough of each container for the
+// parsers; the "audio" payloads are zeros.
+
+func id3Frame(version byte, id string, data []byte) []byte {
+	var b bytes.Buffer
+	b.WriteString(id)
+	size := make([]byte, 4)
+	if version == 4 {
+		putSyncsafe(size, len(data))
+	} else {
+		binary.BigEndian.PutUint32(size, uint32(len(data)))
+	}
+	b.Write(size)
+	b.Write([]byte{0, 0})
+	b.Write(data)
+	return b.Bytes()
+}
+
+func id3Text(s string) []byte { return append([]byte{3}, s...) }
+
+func id3UTF16(s string) []byte {
+	b := []byte{1, 0xFF, 0xFE}
+	for _, u := range utf16.Encode([]rune(s)) {
+		b = binary.LittleEndian.AppendUint16(b, u)
+	}
+	return b
+}
+
+func putSyncsafe(b []byte, n int) {
+	for i := 3; i >= 0; i-- {
+		b[i] = byte(n & 0x7F)
+		n >>= 7
+	}
+}
+
+func id3v2Tag(version byte, frames ...[]byte) []byte {
+	body := bytes.Join(frames, nil)
+	body = append(body, make([]byte, 16)...) // padding
+	header := []byte{'I', 'D', '3', version, 0, 0, 0, 0, 0, 0}
+	putSyncsafe(header[6:], len(body))
+	return append(header, body...)
+}
+
+// mpegFrames returns n MPEG-1 Layer III frames at 128 kbit/s, 44.1 kHz
+// stereo (417 bytes each, 1152 samples).
+func mpegFrames(n int) []byte {
+	frame := make([]byte, 417)
+	copy(frame, []byte{0xFF, 0xFB, 0x90, 0x00})
+	return bytes.Repeat(frame, n)
+}
+
+// lameInfoFrame is an "Info" frame announcing frames audio frames with the
+// given encoder delay and padding.
+func lameInfoFrame(frames, delay, padding int) []byte {
+	frame := mpegFrames(1)
+	pos := 4 + 32
+	copy(frame[pos:], "Info")
+	binary.BigEndian.PutUint32(frame[pos+4:], 3)
+	binary.BigEndian.PutUint32(frame[pos+8:], uint32(frames))
+	binary.BigEndian.PutUint32(frame[pos+12:], uint32(frames*417))
+	lame := frame[pos+16:]
+	copy(lame, "LAME3.100")
+	lame[21] = byte(delay >> 4)
+	lame[22] = byte(delay&0xF)<<4 | byte(padding>>8)
+	lame[23] = byte(padding)
+	return frame
+}
+
+func id3v1Tag(title, artist, album, year string, track, genre byte) []byte {
+	tag := make([]byte, 128)
+	copy(tag, "TAG")
+	copy(tag[3:], title)
+	copy(tag[33:], artist)
+	copy(tag[63:], album)
+	copy(tag[93:], year)
+	tag[126] = track
+	tag[127] = genre
+	return tag
+}
+
+// testMP3 is a tagged 2.576 s LAME-style MP3. extra frames (such as APIC)
+// are added to its ID3v2.3 tag.
+func testMP3(title string, extra ...[]byte) []byte {
+	frames := append([][]byte{
+		id3Frame(3, "TIT2", id3UTF16(title)),
+		id3Frame(3, "TPE1", id3Text("Tag Artist")),
+		id3Frame(3, "TALB", id3Text("Tag Album")),
+		id3Frame(3, "TCON", id3Text("(17)")),
+		id3Frame(3, "TYER", id3Text("2019")),
+		id3Frame(3, "TRCK", id3Text("3/12")),
+		id3Frame(3, "TPOS", id3Text("1/2")),
+	}, extra...)
+	tag := id3v2Tag(3, frames...)
+	return bytes.Join([][]byte{tag, lameInfoFrame(100, 576, 1000), mpegFrames(100)}, nil)
+}
+
+func vorbisComment(fields ...string) []byte {
+	b := binary.LittleEndian.AppendUint32(nil, 4)
+	b = append(b, "test"...)
+	b = binary.LittleEndian.AppendUint32(b, uint32(len(fields)))
+	for _, f := range fields {
+		b = binary.LittleEndian.AppendUint32(b, uint32(len(f)))
+		b = append(b, f...)
+	}
+	return b
+}
+
+func flacPictureBlock(picType uint32, mime string, img []byte) []byte {
+	b := binary.BigEndian.AppendUint32(nil, picType)
+	b = binary.BigEndian.AppendUint32(b, uint32(len(mime)))
+	b = append(b, mime...)
+	b = binary.BigEndian.AppendUint32(b, 0) // description
+	b = append(b, make([]byte, 16)...)
+	b = binary.BigEndian.AppendUint32(b, uint32(len(img)))
+	return append(b, img...)
+}
+
+func testFLAC(extraBlocks ...[]byte) []byte {
+	info := make([]byte, 34)
+	const rate, channels, bits, samples = 48000, 2, 24, 48000*7 + 24000
+	binary.BigEndian.PutUint64(info[10:], uint64(rate)<<44|uint64(channels-1)<<41|uint64(bits-1)<<36|samples)
+	comment := vorbisComment("TITLE=Flac Title", "artist=Flac Artist", "ALBUM=Flac Album", "DATE=2001-02-03", "TRACKNUMBER=7", "TRACKTOTAL=9", "DISCNUMBER=2", "GENRE=Jazz")
+
+	var b bytes.Buffer
+	b.WriteString("fLaC")
+	b.Write([]byte{flacStreamInfo, 0, 0, 34})
+	b.Write(info)
+	b.Write([]byte{flacVorbisComment, byte(len(comment) >> 16), byte(len(comment) >> 8), byte(len(comment))})
+	b.Write(comment)
+	for _, block := range extraBlocks {
+		b.Write(block)
+	}
+	b.Write([]byte{0x80 | 1, 0, 0, 8}) // PADDING, last block
+	b.Write(make([]byte, 8))
+	b.Write(make([]byte, 1000))
+	return b.Bytes()
+}
+
+func oggPageBytes(serial uint32, granule int64, packets ...[]byte) []byte {
+	var lacing, body []byte
+	for _, p := range packets {
+		n := len(p)
+		for ; n >= 255; n -= 255 {
+			lacing = append(lacing, 255)
+		}
+		lacing = append(lacing, byte(n))
+		body = append(body, p...)
+	}
+	header := make([]byte, 27)
+	copy(header, "OggS")
+	binary.LittleEndian.PutUint64(header[6:], uint64(granule))
+	binary.LittleEndian.PutUint32(header[14:], serial)
+	header[26] = byte(len(lacing))
+	return bytes.Join([][]byte{header, lacing, body}, nil)
+}
+
+func testOggVorbis(extraComments ...string) []byte {
+	id := make([]byte, 30)
+	copy(id, "\x01vorbis")
+	id[11] = 2
+	binary.LittleEndian.PutUint32(id[12:], 44100)
+	binary.LittleEndian.PutUint32(id[20:], 160000)
+	comments := append([]byte("\x03vorbis"), vorbisComment(append([]string{"TITLE=Ogg Title", "ARTIST=Ogg Artist", "TRACKNUMBER=4/10", "GENRE=Ambient", "DATE=1999"}, extraComments...)...)...)
+	comments = append(comments, 1)
+	return bytes.Join([][]byte{
+		oggPageBytes(7, 0, id),
+		oggPageBytes(7, 0, comments, []byte("\x05vorbis setup")),
+		oggPageBytes(7, 44100*3, make([]byte, 500)),
+		oggPageBytes(7, 44100*3+22050, make([]byte, 500)),
+	}, nil)
+}
+
+func riffChunk(id string, data []byte) []byte {
+	b := append([]byte(id), binary.LittleEndian.AppendUint32(nil, uint32(len(data)))...)
+	b = append(b, data...)
+	if len(data)%2 == 1 {
+		b = append(b, 0)
+	}
+	return b
+}
+
+func testWAV() []byte {
+	fmtChunk := make([]byte, 16)
+	binary.LittleEndian.PutUint16(fmtChunk, waveFormatPCM)
+	binary.LittleEndian.PutUint16(fmtChunk[2:], 2)
+	binary.LittleEndian.PutUint32(fmtChunk[4:], 44100)
+	binary.LittleEndian.PutUint32(fmtChunk[8:], 44100*4)
+	binary.LittleEndian.PutUint16(fmtChunk[12:], 4)
+	binary.LittleEndian.PutUint16(fmtChunk[14:], 16)
+	info := append([]byte("INFO"), bytes.Join([][]byte{
+		riffChunk("INAM", []byte("Wav Title\x00")),
+		riffChunk("IART", []byte("Wav Artist\x00")),
+		riffChunk("IPRD", []byte("Wav Album\x00")),
+		riffChunk("ICRD", []byte("2020-01-01\x00")),
+		riffChunk("ITRK", []byte("5\x00")),
+	}, nil)...)
+	body := bytes.Join([][]byte{
+		[]byte("WAVE"),
+		riffChunk("fmt ", fmtChunk),
+		riffChunk("LIST", info),
+		riffChunk("data", make([]byte, 44100*4*3/2)),
+	}, nil)
+	return append(append([]byte("RIFF"), binary.LittleEndian.AppendUint32(nil, uint32(len(body)))...), body...)
+}
+
+func iffChunk(id string, data []byte) []byte {
+	b := append([]byte(id), binary.BigEndian.AppendUint32(nil, uint32(len(data)))...)
+	b = append(b, data...)
+	if len(data)%2 == 1 {
+		b = append(b, 0)
+	}
+	return b
+}
+
+// extended encodes a whole number as the 80-bit float AIFF uses for rates.
+func extended(n int) []byte {
+	exponent := bits.Len64(uint64(n)) - 1
+	b := binary.BigEndian.AppendUint16(nil, uint16(16383+exponent))
+	return binary.BigEndian.AppendUint64(b, uint64(n)<<(63-exponent))
+}
+
+func aiffCOMM(channels, frames, bitsPerSample, rate int) []byte {
+	comm := binary.BigEndian.AppendUint16(nil, uint16(channels))
+	comm = binary.BigEndian.AppendUint32(comm, uint32(frames))
+	comm = binary.BigEndian.AppendUint16(comm, uint16(bitsPerSample))
+	return iffChunk("COMM", append(comm, extended(rate)...))
+}
+
+func aiffFile(chunks ...[]byte) []byte {
+	body := bytes.Join(append([][]byte{[]byte("AIFF")}, chunks...), nil)
+	return append(append([]byte("FORM"), binary.BigEndian.AppendUint32(nil, uint32(len(body)))...), body...)
+}
+
+func testAIFF() []byte {
+	return aiffFile(
+		iffChunk("NAME", []byte("Aiff Title")),
+		iffChunk("AUTH", []byte("Aiff Artist")),
+		iffChunk("SSND", make([]byte, 8+48000*2*3*2)),
+		aiffCOMM(2, 48000*2, 24, 48000), // After the samples, as some writers do
+		iffChunk("ID3 ", id3v2Tag(3, id3Frame(3, "TALB", id3Text("Aiff Album")), id3Frame(3, "TIT2", id3Text("Ignored")))),
+	)
+}
+
+func atom(typ string, children ...[]byte) []byte {
+	body := bytes.Join(children, nil)
+	return append(append(binary.BigEndian.AppendUint32(nil, uint32(8+len(body))), typ...), body...)
+}
+
+func ilstItem(typ string, dataType uint32, payload []byte) []byte {
+	data := binary.BigEndian.AppendUint32(nil, dataType)
+	data = append(data, 0, 0, 0, 0)
+	return atom(typ, atom("data", data, payload))
+}
+
+func testM4A(extraItems ...[]byte) []byte {
+	mdhd := make([]byte, 24)
+	binary.BigEndian.PutUint32(mdhd[12:], 44100)
+	binary.BigEndian.PutUint32(mdhd[16:], 44100*5+441)
+	mvhd := make([]byte, 100)
+	binary.BigEndian.PutUint32(mvhd[12:], 1000)
+	binary.BigEndian.PutUint32(mvhd[16:], 5000)
+	hdlr := make([]byte, 25)
+	copy(hdlr[8:], "soun")
+
+	entry := make([]byte, 28)
+	binary.BigEndian.PutUint16(entry[6:], 1)
+	binary.BigEndian.PutUint16(entry[16:], 2)
+	binary.BigEndian.PutUint16(entry[18:], 16)
+	binary.BigEndian.PutUint32(entry[24:], 44100<<16)
+	decoderConfig := []byte{0x40, 0x15, 0, 0, 0, 0, 0x03, 0x0D, 0x40, 0, 0x02, 0xEE, 0x00} // max 200000, avg 192000
+	esds := append([]byte{0, 0, 0, 0, 0x03, byte(3 + 2 + len(decoderConfig)), 0, 1, 0, 0x04, byte(len(decoderConfig))}, decoderConfig...)
+	stsd := append([]byte{0, 0, 0, 0, 0, 0, 0, 1}, atom("mp4a", entry, atom("esds", esds))...)
+
+	trkn := []byte{0, 0, 0, 2, 0, 11, 0, 0}
+	disk := []byte{0, 0, 0, 1, 0, 1}
+	ilst := atom("ilst",
+		ilstItem("\xa9nam", 1, []byte("M4A Title")),
+		ilstItem("\xa9ART", 1, []byte("M4A Artist")),
+		ilstItem("\xa9alb", 1, []byte("M4A Album")),
+		ilstItem("\xa9day", 1, []byte("2015-06-01T00:00:00Z")),
+		ilstItem("gnre", 0, []byte{0, 18}),
+		ilstItem("trkn", 0, trkn),
+		ilstItem("disk", 0, disk),
+		bytes.Join(extraItems, nil),
+	)
+	return bytes.Join([][]byte{
+		atom("ftyp", []byte("M4A \x00\x00\x00\x00isomM4A ")),
+		atom("moov",
+			atom("mvhd", mvhd),
+			atom("trak", atom("mdia",
+				atom("mdhd", mdhd),
+				atom("hdlr", hdlr),
+				atom("minf", atom("stbl", atom("stsd", stsd))),
+			)),
+			atom("udta", atom("meta", []byte{0, 0, 0, 0}, ilst)),
+		),
+		atom("mdat", make([]byte, 2000)),
+	}, nil)
+}
+
+func TestExtractMetadata(t *testing.T) {
+	cbrMP3 := bytes.Join([][]byte{
+		id3v2Tag(4, id3Frame(4, "TIT2", id3Text("Only In v2"))),
+		mpegFrames(50),
+		id3v1Tag("Ignored", "V1 Artist", "V1 Album", "1987", 9, 13),
+	}, nil)
+
+	tests := []struct {
+		name string
+		data []byte
+		want AudioMetadata
+	}{
+		{"mp3 with LAME header", testMP3("Café"), AudioMetadata{
+			Format: formatMP3, Codec: "mp3", Title: "Café", Artist: "Tag Artist", Album: "Tag Album", Genre: "Rock",
+			Year: 2019, TrackNumber: 3, TrackTotal: 12, DiscNumber: 1, DiscTotal: 2,
+			DurationMs: 2576, Bitrate: 129503, SampleRate: 44100, Channels: 2,
+		}},
+		{"cbr mp3 with id3v1", cbrMP3, AudioMetadata{
+			Format: formatMP3, Codec: "mp3", Title: "Only In v2", Artist: "V1 Artist", Album: "V1 Album", Genre: "Pop",
+			Year: 1987, TrackNumber: 9, DurationMs: 1306, Bitrate: 127718, SampleRate: 44100, Channels: 2,
+		}},
+		{"flac", testFLAC(), AudioMetadata{
+			Format: formatFLAC, Codec: "flac", Title: "Flac Title", Artist: "Flac Artist", Album: "Flac Album", Genre: "Jazz",
+			Year: 2001, TrackNumber: 7, TrackTotal: 9, DiscNumber: 2,
+			DurationMs: 7500, Bitrate: 1066, SampleRate: 48000, Channels: 2, BitsPerSample: 24,
+		}},
+		{"ogg vorbis", testOggVorbis(), AudioMetadata{
+			Format: formatOgg, Codec: "vorbis", Title: "Ogg Title", Artist: "Ogg Artist", Genre: "Ambient",
+			Year: 1999, TrackNumber: 4, TrackTotal: 10, DurationMs: 3500, Bitrate: 160000, SampleRate: 44100, Channels: 2,
+		}},
+		{"wav", testWAV(), AudioMetadata{
+			Format: formatWAV, Codec: "pcm", Title: "Wav Title", Artist: "Wav Artist", Album: "Wav Album",
+			Year: 2020, TrackNumber: 5, DurationMs: 1500, Bitrate: 1411200, SampleRate: 44100, Channels: 2, BitsPerSample: 16,
+		}},
+		{"aiff", testAIFF(), AudioMetadata{
+			Format: formatAIFF, Codec: "pcm", Title: "Aiff Title", Artist: "Aiff Artist", Album: "Aiff Album",
+			DurationMs: 2000, Bitrate: 2304000, SampleRate: 48000, Channels: 2, BitsPerSample: 24,
+		}},
+		{"m4a", testM4A(), AudioMetadata{
+			Format: formatM4A, Codec: "aac", Title: "M4A Title", Artist: "M4A Artist", Album: "M4A Album", Genre: "Rock",
+			Year: 2015, TrackNumber: 2, TrackTotal: 11, DiscNumber: 1, DiscTotal: 1,
+			DurationMs: 5010, Bitrate: 192000, SampleRate: 44100, Channels: 2,
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			md, err := extractMetadata(bytes.NewReader(tt.data), int64(len(tt.data)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if *md != tt.want {
+				t.Errorf("got  %+v\nwant %+v", *md, tt.want)
+			}
+		})
+	}
+
+	if _, err := extractMetadata(bytes.NewReader([]byte("not audio at all")), 16); err != errUnknownFormat {
+		t.Errorf("plain text: err %v, want errUnknownFormat", err)
+	}
+}
+
+func TestResolveID3Genre(t *testing.T) {
+	for in, want := range map[string]string{
+		"(17)": "Rock", "17": "Rock", "(17)Hard Rock": "Hard Rock", "Synthwave": "Synthwave", "RX": "Remix", "(999)": "",
+	} {
+		if got := resolveID3Genre(in); got != want {
+			t.Errorf("resolveID3Genre(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+var (
+	testJPEG = []byte("\xFF\xD8\xFF\xE0\x00\x10JFIF fake jpeg")
+	testPNG  = []byte("\x89PNG\r\n\x1a\n fake png")
+)
+
+func id3APIC(picType byte, mime string, img []byte) []byte {
+	// UTF-16 description, so the two-byte terminator is exercised.
+	data := append([]byte{1}, mime...)
+	data = append(data, 0, picType)
+	data = append(data, id3UTF16("cover")[1:]...)
+	data = append(data, 0, 0)
+	return id3Frame(3, "APIC", append(data, img...))
+}
+
+func TestExtractCoverArt(t *testing.T) {
+	flacBlock := func(blockType byte, data []byte) []byte {
+		return append([]byte{blockType, byte(len(data) >> 16), byte(len(data) >> 8), byte(len(data))}, data...)
+	}
+	tests := []struct {
+		name string
+		data []byte
+		want *Picture
+	}{
+		{"mp3 prefers the front cover", testMP3("Art", id3APIC(4, "image/jpeg", testJPEG), id3APIC(3, "image/png", testPNG)),
+			&Picture{MIMEType: "image/png", Type: 3, Data: testPNG}},
+		{"mp3 wrong MIME type", testMP3("Art", id3APIC(3, "image/png", testJPEG)),
+			&Picture{MIMEType: "image/jpeg", Type: 3, Data: testJPEG}},
+		{"mp3 not an image", testMP3("Art", id3APIC(3, "image/jpeg", []byte("nope"))), nil},
+		{"flac picture block", testFLAC(flacBlock(flacPicture, flacPictureBlock(3, "image/jpeg", testJPEG))),
+			&Picture{MIMEType: "image/jpeg", Type: 3, Data: testJPEG}},
+		{"ogg METADATA_BLOCK_PICTURE", testOggVorbis("METADATA_BLOCK_PICTURE=" + base64.StdEncoding.EncodeToString(flacPictureBlock(3, "image/png", testPNG))),
+			&Picture{MIMEType: "image/png", Type: 3, Data: testPNG}},
+		{"m4a covr", testM4A(ilstItem("covr", 13, testJPEG)),
+			&Picture{MIMEType: "image/jpeg", Type: 3, Data: testJPEG}},
+		{"no artwork", testWAV(), nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			md, err := extractMetadata(bytes.NewReader(tt.data), int64(len(tt.data)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(md.Picture, tt.want) {
+				t.Errorf("got %+v, want %+v", md.Picture, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// WAVE format tags from the fmt chunk.
+const (
+	waveFormatPCM        = 0x0001
+	waveFormatIEEEFloat  = 0x0003
+	waveFormatALaw       = 0x0006
+	waveFormatMuLaw      = 0x0007
+	waveFormatExtensible = 0xFFFE
+)
+
+// parseWAV walks the RIFF chunks for the format, the length of the sample
+// data, a LIST/INFO tag and an embedded ID3 tag.
+func parseWAV(r io.ReadSeeker, size int64, md *AudioMetadata) error {
+	if _, err := r.Seek(12, io.SeekStart); err != nil {
+		return err
+	}
+	var byteRate, blockAlign int
+	var dataSize int64 = -1
+	for offset := int64(12); offset+8 <= size; {
+		header := make([]byte, 8)
+		if _, err := io.ReadFull(r, header); err != nil {
+			break
+		}
+		id := string(header[:4])
+		length := int64(binary.LittleEndian.Uint32(header[4:]))
+		offset += 8
+
+		switch id {
+		case "fmt ":
+			data, err := readBlock(r, length)
+			if err != nil {
+				return err
+			}
+			if len(data) < 16 {
+				return errors.New("short fmt chunk")
+			}
+			formatTag := binary.LittleEndian.Uint16(data)
+			if formatTag == waveFormatExtensible && len(data) >= 26 {
+				formatTag = binary.LittleEndian.Uint16(data[24:]) // first two bytes of the sub-format GUID
+			}
+			md.Codec = waveCodecName(formatTag)
+			md.Channels = int(binary.LittleEndian.Uint16(data[2:]))
+			md.SampleRate = int(binary.LittleEndian.Uint32(data[4:]))
+			byteRate = int(binary.LittleEndian.Uint32(data[8:]))
+			blockAlign = int(binary.LittleEndian.Uint16(data[12:]))
+			md.BitsPerSample = int(binary.LittleEndian.Uint16(data[14:]))
+		case "data":
+			dataSize = length
+			// Streaming writers leave the size at its maximum; use what is there.
+			if length == 0xFFFFFFFF || offset+length > size {
+				dataSize = size - offset
+			}
+			if _, err := r.Seek(dataSize, io.SeekCurrent); err != nil {
+				return err
+			}
+			length = dataSize
+		case "LIST":
+			data, err := readBlock(r, length)
+			if err != nil {
+				return err
+			}
+			if len(data) >= 4 && string(data[:4]) == "INFO" {
+				parseRIFFInfo(data[4:], md)
+			}
+		case "id3 ", "ID3 ":
+			data, err := readBlock(r, length)
+			if err != nil {
+				return err
+			}
+			if tagSize, ok := id3v2TagSize(data); ok && tagSize <= int64(len(data)) {
+				parseID3v2(data[:10], data[10:tagSize], md)
+			}
+		default:
+			if _, err := r.Seek(length, io.SeekCurrent); err != nil {
+				return err
+			}
+		}
+		offset += length
+		if length%2 == 1 {
+			// Chunks are word aligned.
+			if _, err := r.Seek(1, io.SeekCurrent); err != nil {
+				return err
+			}
+			offset++
+		}
+	}
+
+	if md.SampleRate == 0 || dataSize < 0 {
+		return errors.New("missing fmt or data chunk")
+	}
+	if md.Codec == "pcm" || md.Codec == "pcm_float" {
+		if blockAlign > 0 {
+			frames := dataSize / int64(blockAlign)
+			md.DurationMs = frames * 1000 / int64(md.SampleRate)
+		}
+	} else {
+		md.BitsPerSample = 0
+		if byteRate > 0 {
+			md.DurationMs = dataSize * 1000 / int64(byteRate)
+		}
+	}
+	md.Bitrate = byteRate * 8
+	return nil
+}
+
+func waveCodecName(formatTag uint16) string {
+	switch formatTag {
+	case waveFormatPCM:
+		return "pcm"
+	case waveFormatIEEEFloat:
+		return "pcm_float"
+	case waveFormatALaw:
+		return "alaw"
+	case waveFormatMuLaw:
+		return "mulaw"
+	}
+	return "wav"
+}
+
+// parseRIFFInfo reads the sub-chunks of a LIST/INFO chunk.
+func parseRIFFInfo(data []byte, md *AudioMetadata) {
+	for pos := 0; pos+8 <= len(data); {
+		id := string(data[pos : pos+4])
+		length := int(binary.LittleEndian.Uint32(data[pos+4:]))
+		pos += 8
+		if length < 0 || pos+length > len(data) {
+			return
+		}
+		value := trimNulls(data[pos : pos+length])
+		pos += length + length%2
+		switch id {
+		case "INAM":
+			setIfEmpty(&md.Title, value)
+		case "IART":
+			setIfEmpty(&md.Artist, value)
+		case "IPRD":
+			setIfEmpty(&md.Album, value)
+		case "IGNR":
+			setIfEmpty(&md.Genre, value)
+		case "ICRD":
+			if md.Year == 0 {
+				md.Year = parseYear(value)
+			}
+		case "ITRK", "IPRT", "TRCK":
+			parseNumberPair(value, &md.TrackNumber, &md.TrackTotal)
+		}
+	}
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"database/sql"
+	"embed"
+	"fmt"
+	"io/fs"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Migrations live in migrations/<dialect>/NNNN_name.up.sql with a matching
+// NNNN_name.down.sql. They are embedded so the binary always carries the
+// schema it was built against.
+//
+//go:embed migrations
+var migrationFiles embed.FS
+
+type migration struct {
+	Version int
+	Name    string
+	Up      string
+	Down    string
+}
+
+const createSchemaMigrationsTable = `CREATE TABLE IF NOT EXISTS schema_migrations (
+	version    INT          NOT NULL PRIMARY KEY,
+	name       VARCHAR(255) NOT NULL,
+	applied_at TIMESTAMP    NOT NULL DEFAULT CURRENT_TIMESTAMP
+)`
+
+// loadMigrations reads and orders every migration for the given dialect.
+func loadMigrations(fsys fs.FS, dialect string) ([]migration, error) {
+	dir := path.Join("migrations", dialect)
+	entries, err := fs.ReadDir(fsys, dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read migrations for %s: %w", dialect, err)
+	}
+
+	byVersion := make(map[int]*migration)
+	for _, entry := range entries {
+		fileName := entry.Name()
+		if entry.IsDir() || !strings.HasSuffix(fileName, ".sql") {
+			continue
+		}
+		base := strings.TrimSuffix(fileName, ".sql")
+		var direction string
+		switch {
+		case strings.HasSuffix(base, ".up"):
+			direction, base = "up", strings.TrimSuffix(base, ".up")
+		case strings.HasSuffix(base, ".down"):
+			direction, base = "down", strings.TrimSuffix(base, ".down")
+		default:
+			return nil, fmt.Errorf("migration %s must end in .up.sql or .down.sql", fileName)
+		}
+		versionStr, name, ok := strings.Cut(base, "_")
+		if !ok {
+			return nil, fmt.Errorf("migration %s must be named NNNN_name", fileName)
+		}
+		version, err := strconv.Atoi(versionStr)
+		if err != nil || version <= 0 {
+			return nil, fmt.Errorf("migration %s has an invalid version", fileName)
+		}
+
+		contents, err := fs.ReadFile(fsys, path.Join(dir, fileName))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read migration %s: %w", fileName, err)
+		}
+		m, exists := byVersion[version]
+		if !exists {
+			m = &migration{Version: version, Name: name}
+			byVersion[version] = m
+		} else if m.Name != name {
+			return nil, fmt.Errorf("migration version %d is used by both %s and %s", version, m.Name, name)
+		}
+		if direction == "up" {
+			m.Up = string(contents)
+		} else {
+			m.Down = string(contents)
+		}
+	}
+
+	migrations := make([]migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		if m.Up == "" {
+			return nil, fmt.Errorf("migration %04d_%s has no up script", m.Version, m.Name)
+		}
+		migrations = append(migrations, *m)
+	}
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+	return migrations, nil
+}
+
+// appliedMigrationVersions returns the versions recorded in schema_migrations,
+// creating the table on first run.
+func appliedMigrationVersions(db *sql.DB) (map[int]bool, error) {
+	if _, err := db.Exec(createSchemaMigrationsTable); err != nil {
+		return nil, fmt.Errorf("failed to create schema_migrations table: %w", err)
+	}
+	rows, err := db.Query("SELECT version FROM schema_migrations")
+	if err != nil {
+		return nil, fmt.Errorf("failed to query schema_migrations: %w", err)
+	}
+	defer rows.Close()
+	applied := make(map[int]bool)
+	for rows.Next() {
+		var version int
+		if err := rows.Scan(&version); err != nil {
+			return nil, fmt.Errorf("failed to scan schema_migrations row: %w", err)
+		}
+		applied[version] = true
+	}
+	return applied, rows.Err()
+}
+
+// migrateUp applies every pending migration in order. It refuses to touch a
+// database that has migrations this binary does not know about, since that
+// means a newer build has already changed the schema.
+func migrateUp(db *sql.DB, migrations []migration) error {
+	applied, err := appliedMigrationVersions(db)
+	if err != nil {
+		return err
+	}
+	known := make(map[int]bool, len(migrations))
+	latest := 0
+	for _, m := range migrations {
+		known[m.Version] = true
+		latest = m.Version
+	}
+	for version := range applied {
+		if !known[version] {
+			return fmt.Errorf("database schema version %d is ahead of this binary (latest known migration is %d)", version, latest)
+		}
+	}
+
+	for _, m := range migrations {
+		if applied[m.Version] {
+			continue
+		}
+		log.Info().Int("version", m.Version).Str("name", m.Name).Msg("Applying migration")
+		if err := runMigration(db, m.Up, func(tx *sql.Tx) error {
+			_, err := tx.Exec("INSERT INTO schema_migrations(version, name) VALUES(?, ?)", m.Version, m.Name)
+			return err
+		}); err != nil {
+			return fmt.Errorf("migration %04d_%s failed: %w", m.Version, m.Name, err)
+		}
+	}
+	return nil
+}
+
+// migrateDown rolls back the most recently applied migrations, newest first.
+func migrateDown(db *sql.DB, migrations []migration, steps int) error {
+	applied, err := appliedMigrationVersions(db)
+	if err != nil {
+		return err
+	}
+	for i := len(migrations) - 1; i >= 0 && steps > 0; i-- {
+		m := migrations[i]
+		if !applied[m.Version] {
+			continue
+		}
+		if m.Down == "" {
+			return fmt.Errorf("migration %04d_%s has no down script", m.Version, m.Name)
+		}
+		log.Info().Int("version", m.Version).Str("name", m.Name).Msg("Rolling back migration")
+		if err := runMigration(db, m.Down, func(tx *sql.Tx) error {
+			_, err := tx.Exec("DELETE FROM schema_migrations WHERE version = ?", m.Version)
+			return err
+		}); err != nil {
+			return fmt.Errorf("rollback of %04d_%s failed: %w", m.Version, m.Name, err)
+		}
+		steps--
+	}
+	return nil
+}
+
+// runMigration executes a script statement by statement inside a transaction
+// and records the result with bookkeeping. Note that MySQL commits DDL
+// implicitly, so a failed MySQL migration may need manual cleanup.
+func runMigration(db *sql.DB, script string, bookkeeping func(tx *sql.Tx) error) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	for _, stmt := range splitSQLStatements(script) {
+		if _, err := tx.Exec(stmt); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	if err := bookkeeping(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// splitSQLStatements splits a script on semicolons that end a line, dropping
+// blank lines and full-line "--" comments. Drivers generally refuse to run
+// several statements in one Exec call.
+func splitSQLStatements(script string) []string {
+	var statements []string
+	var current strings.Builder
+	for _, line := range strings.Split(script, "\n") {
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" || strings.HasPrefix(trimmed, "--") {
+			continue
+		}
+		current.WriteString(line)
+		current.WriteString("\n")
+		if strings.HasSuffix(trimmed, ";") {
+			stmt := strings.TrimSpace(current.String())
+			statements = append(statements, strings.TrimSuffix(stmt, ";"))
+			current.Reset()
+		}
+	}
+	if stmt := strings.TrimSpace(current.String()); stmt != "" {
+		statements = append(statements, stmt)
+	}
+	return statements
+}
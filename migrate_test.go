@@ -0,0 +1,305 @@
+package main
+
+import (
+	"database/sql"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+func openMigrateTestDB(t *testing.T) *sql.DB {
+	t.Helper()
+	st := openDB(driverSQLite, sqliteDSN(filepath.Join(t.TempDir(), "migrate.db")))
+	t.Cleanup(func() { st.db.Close() })
+	return st.db
+}
+
+func testMigrationFS(files map[string]string) fstest.MapFS {
+	fsys := fstest.MapFS{}
+	for name, body := range files {
+		fsys["migrations/sqlite/"+name] = &fstest.MapFile{Data: []byte(body)}
+	}
+	return fsys
+}
+
+func appliedVersions(t *testing.T, db *sql.DB) []int {
+	t.Helper()
+	rows, err := db.Query("SELECT version FROM schema_migrations ORDER BY version")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	versions := []int{}
+	for rows.Next() {
+		var v int
+		if err := rows.Scan(&v); err != nil {
+			t.Fatal(err)
+		}
+		versions = append(versions, v)
+	}
+	return versions
+}
+
+func tableExists(t *testing.T, db *sql.DB, name string) bool {
+	t.Helper()
+	var n int
+	if err := db.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = ?", name).Scan(&n); err != nil {
+		t.Fatal(err)
+	}
+	return n > 0
+}
+
+func TestLoadMigrations(t *testing.T) {
+	migrations, err := loadMigrations(testMigrationFS(map[string]string{
+		"0010_third.up.sql":    "CREATE TABLE c (id INT);",
+		"0002_second.up.sql":   "CREATE TABLE b (id INT);",
+		"0002_second.down.sql": "DROP TABLE b;",
+		"0001_first.up.sql":    "CREATE TABLE a (id INT);",
+		"README.md":            "not a migration",
+	}), "sqlite")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, m := range migrations {
+		got = append(got, m.Name)
+	}
+	if want := []string{"first", "second", "third"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("order %v, want %v", got, want)
+	}
+	if migrations[1].Down != "DROP TABLE b;" || migrations[0].Down != "" {
+		t.Errorf("down scripts not paired: %+v", migrations)
+	}
+
+	bad := map[string]map[string]string{
+		"no direction":      {"0001_first.sql": "SELECT 1;"},
+		"no name":           {"0001.up.sql": "SELECT 1;"},
+		"bad version":       {"abc_first.up.sql": "SELECT 1;"},
+		"zero version":      {"0000_first.up.sql": "SELECT 1;"},
+		"duplicate version": {"0001_first.up.sql": "SELECT 1;", "0001_other.up.sql": "SELECT 1;"},
+		"down only":         {"0001_first.down.sql": "SELECT 1;"},
+	}
+	for name, files := range bad {
+		if _, err := loadMigrations(testMigrationFS(files), "sqlite"); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+	if _, err := loadMigrations(testMigrationFS(nil), "mysql"); err == nil {
+		t.Error("expected an error for a dialect without migrations")
+	}
+}
+
+func TestMigrateUpAndDown(t *testing.T) {
+	db := openMigrateTestDB(t)
+	migrations, err := loadMigrations(testMigrationFS(map[string]string{
+		"0001_a.up.sql":   "CREATE TABLE a (id INT);",
+		"0001_a.down.sql": "DROP TABLE a;",
+		// b depends on a, so applying out of order would fail.
+		"0002_b.up.sql":   "CREATE TABLE b (id INT);\nINSERT INTO b (id) SELECT id FROM a;",
+		"0002_b.down.sql": "DROP TABLE b;",
+		"0003_c.up.sql":   "CREATE TABLE c (id INT);",
+		"0003_c.down.sql": "DROP TABLE c;",
+	}), "sqlite")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := migrateUp(db, migrations[:2]); err != nil {
+		t.Fatal(err)
+	}
+	if got := appliedVersions(t, db); !reflect.DeepEqual(got, []int{1, 2}) {
+		t.Fatalf("applied %v, want [1 2]", got)
+	}
+	// Running again only applies what is pending.
+	if err := migrateUp(db, migrations); err != nil {
+		t.Fatal(err)
+	}
+	if err := migrateUp(db, migrations); err != nil {
+		t.Fatalf("second run: %v", err)
+	}
+	if got := appliedVersions(t, db); !reflect.DeepEqual(got, []int{1, 2, 3}) {
+		t.Fatalf("applied %v, want [1 2 3]", got)
+	}
+
+	// An older binary must not touch a schema it doesn't know.
+	err = migrateUp(db, migrations[:2])
+	if err == nil || !strings.Contains(err.Error(), "ahead of this binary") {
+		t.Errorf("older binary: %v", err)
+	}
+
+	if err := migrateDown(db, migrations, 2); err != nil {
+		t.Fatal(err)
+	}
+	if got := appliedVersions(t, db); !reflect.DeepEqual(got, []int{1}) {
+		t.Errorf("after two steps down: %v, want [1]", got)
+	}
+	if !tableExists(t, db, "a") || tableExists(t, db, "b") || tableExists(t, db, "c") {
+		t.Error("rollback dropped the wrong tables")
+	}
+	// Asking for more steps than are applied stops at an empty schema.
+	if err := migrateDown(db, migrations, 5); err != nil {
+		t.Fatal(err)
+	}
+	if got := appliedVersions(t, db); len(got) != 0 || tableExists(t, db, "a") {
+		t.Errorf("after rolling back everything: %v", got)
+	}
+}
+
+func TestMigrateDownWithoutScript(t *testing.T) {
+	db := openMigrateTestDB(t)
+	migrations, err := loadMigrations(testMigrationFS(map[string]string{
+		"0001_a.up.sql":   "CREATE TABLE a (id INT);",
+		"0001_a.down.sql": "DROP TABLE a;",
+		"0002_b.up.sql":   "CREATE TABLE b (id INT);",
+	}), "sqlite")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := migrateUp(db, migrations); err != nil {
+		t.Fatal(err)
+	}
+	if err := migrateDown(db, migrations, 1); err == nil || !strings.Contains(err.Error(), "no down script") {
+		t.Errorf("rollback without a down script: %v", err)
+	}
+	if got := appliedVersions(t, db); !reflect.DeepEqual(got, []int{1, 2}) {
+		t.Errorf("applied %v after refused rollback", got)
+	}
+}
+
+func TestMigrateUpFailureRollsBack(t *testing.T) {
+	db := openMigrateTestDB(t)
+	migrations, err := loadMigrations(testMigrationFS(map[string]string{
+		"0001_a.up.sql": "CREATE TABLE a (id INT);",
+		"0002_b.up.sql": "CREATE TABLE b (id INT);\nINSERT INTO missing (id) VALUES (1);",
+	}), "sqlite")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := migrateUp(db, migrations); err == nil || !strings.Contains(err.Error(), "0002_b failed") {
+		t.Fatalf("expected 0002_b to fail, got %v", err)
+	}
+	if got := appliedVersions(t, db); !reflect.DeepEqual(got, []int{1}) {
+		t.Errorf("applied %v, want [1]", got)
+	}
+	if tableExists(t, db, "b") {
+		t.Error("statements from the failed migration were kept")
+	}
+}
+
+// Every shipped sqlite migration must apply, roll back completely and
+// apply again.
+func TestEmbeddedMigrationsRoundTrip(t *testing.T) {
+	for _, dialect := range []string{driverMySQL, driverSQLite} {
+		if _, err := loadMigrations(migrationFiles, dialect); err != nil {
+			t.Errorf("%s: %v", dialect, err)
+		}
+	}
+	db := openMigrateTestDB(t)
+	migrations, err := loadMigrations(migrationFiles, driverSQLite)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := migrateUp(db, migrations); err != nil {
+		t.Fatal(err)
+	}
+	if err := migrateDown(db, migrations, len(migrations)); err != nil {
+		t.Fatal(err)
+	}
+	if got := appliedVersions(t, db); len(got) != 0 {
+		t.Fatalf("still applied after full rollback: %v", got)
+	}
+	if err := migrateUp(db, migrations); err != nil {
+		t.Fatalf("reapplying: %v", err)
+	}
+}
+
+func TestSplitSQLStatements(t *testing.T) {
+	tests := []struct {
+		name   string
+		script string
+		want   []string
+	}{
+		{"empty", "", nil},
+		{"comments only", "-- nothing here\n\n  -- indented\n", nil},
+		{"single", "DROP TABLE a;", []string{"DROP TABLE a"}},
+		{
+			"multi-line with comments",
+			"-- create\nCREATE TABLE a (\n  id INT\n);\n\n-- fill\nINSERT INTO a VALUES (1);\n",
+			[]string{"CREATE TABLE a (\n  id INT\n)", "INSERT INTO a VALUES (1)"},
+		},
+		{"semicolon mid-line", "UPDATE a SET note = 'x;y' WHERE id = 1;", []string{"UPDATE a SET note = 'x;y' WHERE id = 1"}},
+		{"trailing statement without semicolon", "DELETE FROM a;\nDELETE FROM b", []string{"DELETE FROM a", "DELETE FROM b"}},
+	}
+	for _, tt := range tests {
+		if got := splitSQLStatements(tt.script); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestRollbackMigrationsRejectsMemoryStore(t *testing.T) {
+	if err := RollbackMigrations(driverMemory, "", 1); err == nil {
+		t.Error("expected an error rolling back the in-memory store")
+	}
+}
+
+func TestStreamURLMigrationRewritesUploads(t *testing.T) {
+	st := openDB(driverSQLite, sqliteDSN(filepath.Join(t.TempDir(), "migrate.db")))
+	defer st.db.Close()
+	migrations, err := loadMigrations(migrationFiles, st.dialect)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var before []migration
+	for _, m := range migrations {
+		if m.Version < 7 {
+			before = append(before, m)
+		}
+	}
+	if err := migrateUp(st.db, before); err != nil {
+		t.Fatal(err)
+	}
+	mustExec := func(query string, args ...interface{}) {
+		t.Helper()
+		if _, err := st.db.Exec(query, args...); err != nil {
+			t.Fatal(err)
+		}
+	}
+	mustExec("INSERT INTO users (id, username, password_hash) VALUES (1, 'old', 'x')")
+	mustExec(`INSERT INTO songs (id, user_id, title, file_path, cover_path, is_local, is_uploaded)
+		VALUES ('local-1', 1, 'Old Upload', '/uploads/1/abc.mp3', '/uploads/1/covers/f00.jpg', TRUE, TRUE)`)
+	mustExec(`INSERT INTO songs (id, title, file_path, cover_path, is_local, is_uploaded)
+		VALUES ('sample-1', 'Sample', '/assets/audio/sample1.mp3', '/static/images/cover1.jpg', TRUE, FALSE)`)
+	mustExec(`INSERT INTO songs (id, title, file_path, cover_path, is_local, is_uploaded)
+		VALUES ('jamendo-5', 'Liked', 'https://evil.example/5.mp3', '', FALSE, FALSE)`)
+
+	check := func(id, wantFile, wantCover string) {
+		t.Helper()
+		var file, cover string
+		if err := st.db.QueryRow("SELECT file_path, cover_path FROM songs WHERE id = ?", id).Scan(&file, &cover); err != nil {
+			t.Fatal(err)
+		}
+		if file != wantFile || cover != wantCover {
+			t.Errorf("%s: file %q cover %q, want %q %q", id, file, cover, wantFile, wantCover)
+		}
+	}
+
+	if err := migrateUp(st.db, migrations); err != nil {
+		t.Fatal(err)
+	}
+	check("local-1", "/api/stream/local-1", "/api/covers/1/f00.jpg")
+	// 0015 sends every song that isn't an upload through the stream URL too.
+	check("sample-1", "/api/stream/sample-1", "/static/images/cover1.jpg")
+	check("jamendo-5", "/api/stream/jamendo-5", "")
+	song, err := (&sqlStore{db: st.db, dialect: st.dialect}).GetSong("local-1")
+	if err != nil || song.StoragePath != "1/abc.mp3" {
+		t.Errorf("storage path after migration: %+v, %v", song, err)
+	}
+
+	if err := migrateDown(st.db, migrations, len(migrations)-len(before)); err != nil {
+		t.Fatal(err)
+	}
+	check("local-1", "/uploads/1/abc.mp3", "/uploads/1/covers/f00.jpg")
+}
@@ -0,0 +1,40 @@
+-- Baseline schema. Uses IF NOT EXISTS so databases created by hand before
+-- migrations existed are adopted rather than rejected.
+
+CREATE TABLE IF NOT EXISTS users (
+    id            INT          NOT NULL AUTO_INCREMENT,
+    username      VARCHAR(64)  NOT NULL,
+    password_hash VARCHAR(255) NOT NULL,
+    created_at    TIMESTAMP    NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (id),
+    UNIQUE KEY uq_users_username (username)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+CREATE TABLE IF NOT EXISTS songs (
+    id          VARCHAR(64)   NOT NULL,
+    user_id     INT           NULL,
+    title       VARCHAR(255)  NOT NULL DEFAULT '',
+    artist      VARCHAR(255)  NOT NULL DEFAULT '',
+    album       VARCHAR(255)  NOT NULL DEFAULT '',
+    file_path   VARCHAR(1024) NOT NULL,
+    cover_path  VARCHAR(1024) NOT NULL DEFAULT '',
+    is_local    BOOLEAN       NOT NULL DEFAULT FALSE,
+    is_uploaded BOOLEAN       NOT NULL DEFAULT FALSE,
+    jamendo_id  VARCHAR(64)   NULL,
+    duration    INT           NOT NULL DEFAULT 0,
+    created_at  TIMESTAMP     NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (id),
+    UNIQUE KEY uq_songs_jamendo_id (jamendo_id),
+    KEY idx_songs_user_uploaded (user_id, is_uploaded),
+    CONSTRAINT fk_songs_user FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+CREATE TABLE IF NOT EXISTS user_liked_songs (
+    user_id  INT         NOT NULL,
+    song_id  VARCHAR(64) NOT NULL,
+    liked_at TIMESTAMP   NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (user_id, song_id),
+    KEY idx_user_liked_songs_song (song_id),
+    CONSTRAINT fk_liked_user FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE,
+    CONSTRAINT fk_liked_song FOREIGN KEY (song_id) REFERENCES songs (id) ON DELETE CASCADE
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
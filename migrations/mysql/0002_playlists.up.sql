@@ -0,0 +1,25 @@
+CREATE TABLE playlists (
+    id         INT          NOT NULL AUTO_INCREMENT,
+    user_id    INT          NOT NULL,
+    name       VARCHAR(255) NOT NULL,
+    created_at TIMESTAMP    NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP    NOT NULL DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
+    PRIMARY KEY (id),
+    KEY idx_playlists_user (user_id),
+    CONSTRAINT fk_playlists_user FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+-- position is the 0-based index within the playlist; the store keeps it
+-- contiguous. id breaks ties so ordering is stable even mid-update.
+CREATE TABLE playlist_songs (
+    id          INT         NOT NULL AUTO_INCREMENT,
+    playlist_id INT         NOT NULL,
+    song_id     VARCHAR(64) NOT NULL,
+    position    INT         NOT NULL,
+    added_at    TIMESTAMP   NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (id),
+    KEY idx_playlist_songs_order (playlist_id, position),
+    KEY idx_playlist_songs_song (song_id),
+    CONSTRAINT fk_playlist_songs_playlist FOREIGN KEY (playlist_id) REFERENCES playlists (id) ON DELETE CASCADE,
+    CONSTRAINT fk_playlist_songs_song FOREIGN KEY (song_id) REFERENCES songs (id) ON DELETE CASCADE
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS play_queue_songs;
+DROP TABLE IF EXISTS play_queues;
@@ -0,0 +1,21 @@
+-- One queue per user. version is bumped on every save so clients on
+-- different browsers can detect that their copy is stale.
+CREATE TABLE play_queues (
+    user_id       INT       NOT NULL,
+    current_index INT       NOT NULL DEFAULT -1,
+    position_ms   BIGINT    NOT NULL DEFAULT 0,
+    version       INT       NOT NULL DEFAULT 0,
+    updated_at    TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
+    PRIMARY KEY (user_id),
+    CONSTRAINT fk_play_queues_user FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+CREATE TABLE play_queue_songs (
+    user_id  INT         NOT NULL,
+    position INT         NOT NULL,
+    song_id  VARCHAR(64) NOT NULL,
+    PRIMARY KEY (user_id, position),
+    KEY idx_play_queue_songs_song (song_id),
+    CONSTRAINT fk_play_queue_songs_queue FOREIGN KEY (user_id) REFERENCES play_queues (user_id) ON DELETE CASCADE,
+    CONSTRAINT fk_play_queue_songs_song FOREIGN KEY (song_id) REFERENCES songs (id) ON DELETE CASCADE
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
@@ -0,0 +1,18 @@
+ALTER TABLE users ADD COLUMN history_paused BOOLEAN NOT NULL DEFAULT FALSE;
+
+-- started_at is stored in UTC with millisecond precision. DATETIME rather
+-- than TIMESTAMP so history is not capped at 2038.
+CREATE TABLE play_events (
+    id          BIGINT      NOT NULL AUTO_INCREMENT,
+    user_id     INT         NOT NULL,
+    song_id     VARCHAR(64) NOT NULL,
+    started_at  DATETIME(3) NOT NULL,
+    ms_listened BIGINT      NOT NULL DEFAULT 0,
+    completed   BOOLEAN     NOT NULL DEFAULT FALSE,
+    skipped     BOOLEAN     NOT NULL DEFAULT FALSE,
+    PRIMARY KEY (id),
+    KEY idx_play_events_user_started (user_id, started_at, id),
+    KEY idx_play_events_song (song_id),
+    CONSTRAINT fk_play_events_user FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE,
+    CONSTRAINT fk_play_events_song FOREIGN KEY (song_id) REFERENCES songs (id) ON DELETE CASCADE
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
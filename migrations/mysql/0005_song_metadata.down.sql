@@ -0,0 +1,10 @@
+ALTER TABLE songs
+    DROP COLUMN genre,
+    DROP COLUMN release_year,
+    DROP COLUMN track_number,
+    DROP COLUMN disc_number,
+    DROP COLUMN codec,
+    DROP COLUMN bitrate,
+    DROP COLUMN sample_rate,
+    DROP COLUMN channels,
+    DROP COLUMN duration_ms;
@@ -0,0 +1,12 @@
+-- Tag and stream details read from the uploaded file itself. duration (whole
+-- seconds) is kept for existing clients; duration_ms is the exact length.
+ALTER TABLE songs
+    ADD COLUMN genre        VARCHAR(255) NOT NULL DEFAULT '',
+    ADD COLUMN release_year INT          NOT NULL DEFAULT 0,
+    ADD COLUMN track_number INT          NOT NULL DEFAULT 0,
+    ADD COLUMN disc_number  INT          NOT NULL DEFAULT 0,
+    ADD COLUMN codec        VARCHAR(32)  NOT NULL DEFAULT '',
+    ADD COLUMN bitrate      INT          NOT NULL DEFAULT 0,
+    ADD COLUMN sample_rate  INT          NOT NULL DEFAULT 0,
+    ADD COLUMN channels     INT          NOT NULL DEFAULT 0,
+    ADD COLUMN duration_ms  BIGINT       NOT NULL DEFAULT 0;
@@ -0,0 +1,10 @@
+UPDATE songs
+SET cover_path = CONCAT('/uploads/', SUBSTRING_INDEX(SUBSTRING(cover_path, CHAR_LENGTH('/api/covers/') + 1), '/', 1),
+                        '/covers/', SUBSTRING_INDEX(cover_path, '/', -1))
+WHERE cover_path LIKE '/api/covers/%';
+
+UPDATE songs
+SET file_path = CONCAT('/uploads/', storage_path)
+WHERE is_uploaded = TRUE AND storage_path <> '';
+
+ALTER TABLE songs DROP COLUMN storage_path;
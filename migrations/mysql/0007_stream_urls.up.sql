@@ -0,0 +1,14 @@
+-- Uploads are no longer served straight from disk. storage_path is where
+-- the file lives under the uploads directory; file_path becomes the
+-- authenticated stream URL handed to the player, and embedded covers move
+-- from /uploads/<user>/covers/<name> to /api/covers/<user>/<name>.
+ALTER TABLE songs ADD COLUMN storage_path VARCHAR(1024) NOT NULL DEFAULT '';
+
+UPDATE songs
+SET storage_path = SUBSTRING(file_path, CHAR_LENGTH('/uploads/') + 1),
+    file_path = CONCAT('/api/stream/', id)
+WHERE is_uploaded = TRUE AND file_path LIKE '/uploads/%';
+
+UPDATE songs
+SET cover_path = REPLACE(REPLACE(cover_path, '/covers/', '/'), '/uploads/', '/api/covers/')
+WHERE cover_path LIKE '/uploads/%/covers/%';
@@ -0,0 +1,2 @@
+-- Bytes on disk for uploads, summed for per-user storage quotas.
+ALTER TABLE songs ADD COLUMN file_size BIGINT NOT NULL DEFAULT 0;
@@ -0,0 +1,17 @@
+-- Resumable uploads in progress. upload_offset is how many bytes of the
+-- file have been received; song_id is set once the upload became a song.
+-- Timestamps are stored in UTC.
+CREATE TABLE upload_sessions (
+    id            VARCHAR(36)  NOT NULL,
+    user_id       INT          NOT NULL,
+    upload_length BIGINT       NOT NULL,
+    upload_offset BIGINT       NOT NULL DEFAULT 0,
+    metadata      TEXT         NOT NULL,
+    song_id       VARCHAR(64)  NULL,
+    created_at    DATETIME(3)  NOT NULL,
+    expires_at    DATETIME(3)  NOT NULL,
+    PRIMARY KEY (id),
+    KEY idx_upload_sessions_user (user_id),
+    KEY idx_upload_sessions_expires (expires_at),
+    CONSTRAINT fk_upload_sessions_user FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
@@ -0,0 +1,14 @@
+-- Uploaded audio is stored once per distinct content, named by its SHA-256.
+-- ref_count is the number of songs whose blob_sha256 points at the blob; the
+-- row (and then the file) goes away when it drops to zero. Uploads from
+-- before this migration keep their own file and an empty blob_sha256.
+CREATE TABLE blobs (
+    sha256       CHAR(64)     NOT NULL,
+    storage_path VARCHAR(255) NOT NULL,
+    size         BIGINT       NOT NULL,
+    ref_count    INT          NOT NULL DEFAULT 0,
+    created_at   TIMESTAMP    NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (sha256)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+ALTER TABLE songs ADD COLUMN blob_sha256 VARCHAR(64) NOT NULL DEFAULT '';
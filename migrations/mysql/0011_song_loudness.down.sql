@@ -0,0 +1,10 @@
+ALTER TABLE songs
+    DROP COLUMN album_gain_tagged,
+    DROP COLUMN album_peak,
+    DROP COLUMN album_gain_db,
+    DROP COLUMN track_peak,
+    DROP COLUMN track_gain_db,
+    DROP COLUMN true_peak_dbtp,
+    DROP COLUMN loudness_lufs,
+    DROP COLUMN loudness_source,
+    DROP COLUMN loudness_status;
@@ -0,0 +1,14 @@
+-- EBU R128 loudness and ReplayGain 2.0 gains of uploads. Existing uploads
+-- are queued for analysis; songs that are not uploads keep an empty status.
+-- true_peak_dbtp is NULL when the gains came from tags without a peak.
+ALTER TABLE songs
+    ADD COLUMN loudness_status   VARCHAR(16) NOT NULL DEFAULT '',
+    ADD COLUMN loudness_source   VARCHAR(16) NOT NULL DEFAULT '',
+    ADD COLUMN loudness_lufs     DOUBLE      NOT NULL DEFAULT 0,
+    ADD COLUMN true_peak_dbtp    DOUBLE      NULL,
+    ADD COLUMN track_gain_db     DOUBLE      NOT NULL DEFAULT 0,
+    ADD COLUMN track_peak        DOUBLE      NOT NULL DEFAULT 0,
+    ADD COLUMN album_gain_db     DOUBLE      NOT NULL DEFAULT 0,
+    ADD COLUMN album_peak        DOUBLE      NOT NULL DEFAULT 0,
+    ADD COLUMN album_gain_tagged BOOLEAN     NOT NULL DEFAULT FALSE;
+UPDATE songs SET loudness_status = 'pending' WHERE is_uploaded = TRUE;
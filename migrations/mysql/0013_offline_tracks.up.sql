@@ -0,0 +1,31 @@
+-- Jamendo tracks saved to server storage for offline playback, downloaded
+-- once per Jamendo ID. remote_url is the song's file_path before the copy
+-- was made, restored when the last user forgets it. Timestamps are stored
+-- in UTC.
+CREATE TABLE offline_tracks (
+    jamendo_id   VARCHAR(64)   NOT NULL,
+    song_id      VARCHAR(64)   NOT NULL,
+    status       VARCHAR(16)   NOT NULL DEFAULT 'queued',
+    download_url VARCHAR(1024) NOT NULL,
+    remote_url   VARCHAR(1024) NOT NULL,
+    storage_path VARCHAR(255)  NOT NULL DEFAULT '',
+    mime_type    VARCHAR(64)   NOT NULL DEFAULT '',
+    size         BIGINT        NOT NULL DEFAULT 0,
+    attempts     INT           NOT NULL DEFAULT 0,
+    error        VARCHAR(255)  NOT NULL DEFAULT '',
+    created_at   DATETIME(3)   NOT NULL,
+    updated_at   DATETIME(3)   NOT NULL,
+    PRIMARY KEY (jamendo_id),
+    KEY idx_offline_tracks_status (status),
+    CONSTRAINT fk_offline_tracks_song FOREIGN KEY (song_id) REFERENCES songs (id) ON DELETE CASCADE
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+CREATE TABLE user_offline_tracks (
+    user_id    INT         NOT NULL,
+    jamendo_id VARCHAR(64) NOT NULL,
+    saved_at   DATETIME(3) NOT NULL,
+    PRIMARY KEY (user_id, jamendo_id),
+    KEY idx_user_offline_tracks_track (jamendo_id),
+    CONSTRAINT fk_user_offline_user FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE,
+    CONSTRAINT fk_user_offline_track FOREIGN KEY (jamendo_id) REFERENCES offline_tracks (jamendo_id) ON DELETE CASCADE
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
@@ -0,0 +1,7 @@
+-- Creative Commons license and attribution of external (Jamendo, Internet
+-- Archive) tracks. license_type is derived from license_url ("BY-NC-SA",
+-- "CC0"...); empty when the license is unknown.
+ALTER TABLE songs ADD COLUMN license_url VARCHAR(1024) NOT NULL DEFAULT '';
+ALTER TABLE songs ADD COLUMN license_type VARCHAR(16) NOT NULL DEFAULT '';
+ALTER TABLE songs ADD COLUMN artist_url VARCHAR(1024) NOT NULL DEFAULT '';
+ALTER TABLE songs ADD COLUMN attribution VARCHAR(2048) NOT NULL DEFAULT '';
@@ -0,0 +1,3 @@
+DROP TABLE IF EXISTS user_liked_songs;
+DROP TABLE IF EXISTS songs;
+DROP TABLE IF EXISTS users;
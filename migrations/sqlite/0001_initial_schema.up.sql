@@ -0,0 +1,32 @@
+CREATE TABLE IF NOT EXISTS users (
+    id            INTEGER   NOT NULL PRIMARY KEY AUTOINCREMENT,
+    username      TEXT      NOT NULL UNIQUE,
+    password_hash TEXT      NOT NULL,
+    created_at    TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE IF NOT EXISTS songs (
+    id          TEXT      NOT NULL PRIMARY KEY,
+    user_id     INTEGER   NULL REFERENCES users (id) ON DELETE CASCADE,
+    title       TEXT      NOT NULL DEFAULT '',
+    artist      TEXT      NOT NULL DEFAULT '',
+    album       TEXT      NOT NULL DEFAULT '',
+    file_path   TEXT      NOT NULL,
+    cover_path  TEXT      NOT NULL DEFAULT '',
+    is_local    BOOLEAN   NOT NULL DEFAULT FALSE,
+    is_uploaded BOOLEAN   NOT NULL DEFAULT FALSE,
+    jamendo_id  TEXT      NULL UNIQUE,
+    duration    INTEGER   NOT NULL DEFAULT 0,
+    created_at  TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_songs_user_uploaded ON songs (user_id, is_uploaded);
+
+CREATE TABLE IF NOT EXISTS user_liked_songs (
+    user_id  INTEGER   NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    song_id  TEXT      NOT NULL REFERENCES songs (id) ON DELETE CASCADE,
+    liked_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (user_id, song_id)
+);
+
+CREATE INDEX IF NOT EXISTS idx_user_liked_songs_song ON user_liked_songs (song_id);
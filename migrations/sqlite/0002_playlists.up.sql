@@ -0,0 +1,22 @@
+CREATE TABLE playlists (
+    id         INTEGER   NOT NULL PRIMARY KEY AUTOINCREMENT,
+    user_id    INTEGER   NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    name       TEXT      NOT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX idx_playlists_user ON playlists (user_id);
+
+-- position is the 0-based index within the playlist; the store keeps it
+-- contiguous. id breaks ties so ordering is stable even mid-update.
+CREATE TABLE playlist_songs (
+    id          INTEGER   NOT NULL PRIMARY KEY AUTOINCREMENT,
+    playlist_id INTEGER   NOT NULL REFERENCES playlists (id) ON DELETE CASCADE,
+    song_id     TEXT      NOT NULL REFERENCES songs (id) ON DELETE CASCADE,
+    position    INTEGER   NOT NULL,
+    added_at    TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX idx_playlist_songs_order ON playlist_songs (playlist_id, position);
+CREATE INDEX idx_playlist_songs_song ON playlist_songs (song_id);
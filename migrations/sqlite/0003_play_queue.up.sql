@@ -0,0 +1,18 @@
+-- One queue per user. version is bumped on every save so clients on
+-- different browsers can detect that their copy is stale.
+CREATE TABLE play_queues (
+    user_id       INTEGER   NOT NULL PRIMARY KEY REFERENCES users (id) ON DELETE CASCADE,
+    current_index INTEGER   NOT NULL DEFAULT -1,
+    position_ms   INTEGER   NOT NULL DEFAULT 0,
+    version       INTEGER   NOT NULL DEFAULT 0,
+    updated_at    TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE play_queue_songs (
+    user_id  INTEGER NOT NULL REFERENCES play_queues (user_id) ON DELETE CASCADE,
+    position INTEGER NOT NULL,
+    song_id  TEXT    NOT NULL REFERENCES songs (id) ON DELETE CASCADE,
+    PRIMARY KEY (user_id, position)
+);
+
+CREATE INDEX idx_play_queue_songs_song ON play_queue_songs (song_id);
@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS play_events;
+ALTER TABLE users DROP COLUMN history_paused;
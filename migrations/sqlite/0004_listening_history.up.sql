@@ -0,0 +1,16 @@
+ALTER TABLE users ADD COLUMN history_paused BOOLEAN NOT NULL DEFAULT FALSE;
+
+-- started_at is always written as a UTC time.Time so the stored text sorts
+-- chronologically.
+CREATE TABLE play_events (
+    id          INTEGER   NOT NULL PRIMARY KEY AUTOINCREMENT,
+    user_id     INTEGER   NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    song_id     TEXT      NOT NULL REFERENCES songs (id) ON DELETE CASCADE,
+    started_at  TIMESTAMP NOT NULL,
+    ms_listened INTEGER   NOT NULL DEFAULT 0,
+    completed   BOOLEAN   NOT NULL DEFAULT FALSE,
+    skipped     BOOLEAN   NOT NULL DEFAULT FALSE
+);
+
+CREATE INDEX idx_play_events_user_started ON play_events (user_id, started_at, id);
+CREATE INDEX idx_play_events_song ON play_events (song_id);
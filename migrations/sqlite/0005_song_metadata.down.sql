@@ -0,0 +1,9 @@
+ALTER TABLE songs DROP COLUMN genre;
+ALTER TABLE songs DROP COLUMN release_year;
+ALTER TABLE songs DROP COLUMN track_number;
+ALTER TABLE songs DROP COLUMN disc_number;
+ALTER TABLE songs DROP COLUMN codec;
+ALTER TABLE songs DROP COLUMN bitrate;
+ALTER TABLE songs DROP COLUMN sample_rate;
+ALTER TABLE songs DROP COLUMN channels;
+ALTER TABLE songs DROP COLUMN duration_ms;
@@ -0,0 +1,11 @@
+-- Tag and stream details read from the uploaded file itself. duration (whole
+-- seconds) is kept for existing clients; duration_ms is the exact length.
+ALTER TABLE songs ADD COLUMN genre TEXT NOT NULL DEFAULT '';
+ALTER TABLE songs ADD COLUMN release_year INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE songs ADD COLUMN track_number INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE songs ADD COLUMN disc_number INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE songs ADD COLUMN codec TEXT NOT NULL DEFAULT '';
+ALTER TABLE songs ADD COLUMN bitrate INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE songs ADD COLUMN sample_rate INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE songs ADD COLUMN channels INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE songs ADD COLUMN duration_ms INTEGER NOT NULL DEFAULT 0;
@@ -0,0 +1,2 @@
+-- Content type detected from the uploaded bytes, sent when streaming.
+ALTER TABLE songs ADD COLUMN mime_type TEXT NOT NULL DEFAULT '';
@@ -0,0 +1,13 @@
+-- /api/covers/<user>/<name> back to /uploads/<user>/covers/<name>.
+UPDATE songs
+SET cover_path = '/uploads/' ||
+    SUBSTR(cover_path, 13, INSTR(SUBSTR(cover_path, 13), '/') - 1) ||
+    '/covers/' ||
+    SUBSTR(cover_path, 13 + INSTR(SUBSTR(cover_path, 13), '/'))
+WHERE cover_path LIKE '/api/covers/%';
+
+UPDATE songs
+SET file_path = '/uploads/' || storage_path
+WHERE is_uploaded = TRUE AND storage_path <> '';
+
+ALTER TABLE songs DROP COLUMN storage_path;
@@ -0,0 +1,2 @@
+-- Bytes on disk for uploads, summed for per-user storage quotas.
+ALTER TABLE songs ADD COLUMN file_size INTEGER NOT NULL DEFAULT 0;
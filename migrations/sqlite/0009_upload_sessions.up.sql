@@ -0,0 +1,16 @@
+-- Resumable uploads in progress. upload_offset is how many bytes of the
+-- file have been received; song_id is set once the upload became a song.
+-- Timestamps are written as UTC time.Time values.
+CREATE TABLE upload_sessions (
+    id            TEXT      NOT NULL PRIMARY KEY,
+    user_id       INTEGER   NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    upload_length INTEGER   NOT NULL,
+    upload_offset INTEGER   NOT NULL DEFAULT 0,
+    metadata      TEXT      NOT NULL DEFAULT '',
+    song_id       TEXT,
+    created_at    TIMESTAMP NOT NULL,
+    expires_at    TIMESTAMP NOT NULL
+);
+
+CREATE INDEX idx_upload_sessions_user ON upload_sessions (user_id);
+CREATE INDEX idx_upload_sessions_expires ON upload_sessions (expires_at);
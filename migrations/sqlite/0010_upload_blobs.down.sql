@@ -0,0 +1,2 @@
+ALTER TABLE songs DROP COLUMN blob_sha256;
+DROP TABLE IF EXISTS blobs;
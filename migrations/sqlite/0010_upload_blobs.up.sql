@@ -0,0 +1,13 @@
+-- Uploaded audio is stored once per distinct content, named by its SHA-256.
+-- ref_count is the number of songs whose blob_sha256 points at the blob; the
+-- row (and then the file) goes away when it drops to zero. Uploads from
+-- before this migration keep their own file and an empty blob_sha256.
+CREATE TABLE blobs (
+    sha256       TEXT      NOT NULL PRIMARY KEY,
+    storage_path TEXT      NOT NULL,
+    size         INTEGER   NOT NULL,
+    ref_count    INTEGER   NOT NULL DEFAULT 0,
+    created_at   TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+ALTER TABLE songs ADD COLUMN blob_sha256 TEXT NOT NULL DEFAULT '';
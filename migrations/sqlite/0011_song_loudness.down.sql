@@ -0,0 +1,9 @@
+ALTER TABLE songs DROP COLUMN album_gain_tagged;
+ALTER TABLE songs DROP COLUMN album_peak;
+ALTER TABLE songs DROP COLUMN album_gain_db;
+ALTER TABLE songs DROP COLUMN track_peak;
+ALTER TABLE songs DROP COLUMN track_gain_db;
+ALTER TABLE songs DROP COLUMN true_peak_dbtp;
+ALTER TABLE songs DROP COLUMN loudness_lufs;
+ALTER TABLE songs DROP COLUMN loudness_source;
+ALTER TABLE songs DROP COLUMN loudness_status;
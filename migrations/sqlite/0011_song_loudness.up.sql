@@ -0,0 +1,13 @@
+-- EBU R128 loudness and ReplayGain 2.0 gains of uploads. Existing uploads
+-- are queued for analysis; songs that are not uploads keep an empty status.
+-- true_peak_dbtp is NULL when the gains came from tags without a peak.
+ALTER TABLE songs ADD COLUMN loudness_status TEXT NOT NULL DEFAULT '';
+ALTER TABLE songs ADD COLUMN loudness_source TEXT NOT NULL DEFAULT '';
+ALTER TABLE songs ADD COLUMN loudness_lufs REAL NOT NULL DEFAULT 0;
+ALTER TABLE songs ADD COLUMN true_peak_dbtp REAL;
+ALTER TABLE songs ADD COLUMN track_gain_db REAL NOT NULL DEFAULT 0;
+ALTER TABLE songs ADD COLUMN track_peak REAL NOT NULL DEFAULT 0;
+ALTER TABLE songs ADD COLUMN album_gain_db REAL NOT NULL DEFAULT 0;
+ALTER TABLE songs ADD COLUMN album_peak REAL NOT NULL DEFAULT 0;
+ALTER TABLE songs ADD COLUMN album_gain_tagged BOOLEAN NOT NULL DEFAULT FALSE;
+UPDATE songs SET loudness_status = 'pending' WHERE is_uploaded = TRUE;
@@ -0,0 +1 @@
+ALTER TABLE songs DROP COLUMN original_mime_type;
@@ -0,0 +1,3 @@
+-- Content type of the upload as sent, before any conversion (e.g. WAV stored as FLAC).
+ALTER TABLE songs ADD COLUMN original_mime_type TEXT NOT NULL DEFAULT '';
+UPDATE songs SET original_mime_type = mime_type WHERE is_uploaded = TRUE;
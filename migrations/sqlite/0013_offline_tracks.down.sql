@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS user_offline_tracks;
+DROP TABLE IF EXISTS offline_tracks;
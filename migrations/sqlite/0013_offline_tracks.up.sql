@@ -0,0 +1,29 @@
+-- Jamendo tracks saved to server storage for offline playback, downloaded
+-- once per Jamendo ID. remote_url is the song's file_path before the copy
+-- was made, restored when the last user forgets it. Timestamps are written
+-- as UTC time.Time values.
+CREATE TABLE offline_tracks (
+    jamendo_id   TEXT      NOT NULL PRIMARY KEY,
+    song_id      TEXT      NOT NULL REFERENCES songs (id) ON DELETE CASCADE,
+    status       TEXT      NOT NULL DEFAULT 'queued',
+    download_url TEXT      NOT NULL,
+    remote_url   TEXT      NOT NULL,
+    storage_path TEXT      NOT NULL DEFAULT '',
+    mime_type    TEXT      NOT NULL DEFAULT '',
+    size         INTEGER   NOT NULL DEFAULT 0,
+    attempts     INTEGER   NOT NULL DEFAULT 0,
+    error        TEXT      NOT NULL DEFAULT '',
+    created_at   TIMESTAMP NOT NULL,
+    updated_at   TIMESTAMP NOT NULL
+);
+
+CREATE INDEX idx_offline_tracks_status ON offline_tracks (status);
+
+CREATE TABLE user_offline_tracks (
+    user_id    INTEGER   NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    jamendo_id TEXT      NOT NULL REFERENCES offline_tracks (jamendo_id) ON DELETE CASCADE,
+    saved_at   TIMESTAMP NOT NULL,
+    PRIMARY KEY (user_id, jamendo_id)
+);
+
+CREATE INDEX idx_user_offline_tracks_track ON user_offline_tracks (jamendo_id);
@@ -0,0 +1,4 @@
+ALTER TABLE songs DROP COLUMN attribution;
+ALTER TABLE songs DROP COLUMN artist_url;
+ALTER TABLE songs DROP COLUMN license_type;
+ALTER TABLE songs DROP COLUMN license_url;
@@ -0,0 +1,3 @@
+-- The URLs songs were liked with are gone for good; they keep their stream
+-- URLs.
+ALTER TABLE offline_tracks ADD COLUMN remote_url TEXT NOT NULL DEFAULT '';
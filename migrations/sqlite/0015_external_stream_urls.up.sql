@@ -0,0 +1,9 @@
+-- Songs that aren't uploads play through /api/stream/<id> as well, which
+-- redirects to their provider. The URLs clients liked them with are
+-- dropped, and with them offline_tracks.remote_url, which kept one to put
+-- back when an offline copy went away.
+UPDATE songs
+SET file_path = '/api/stream/' || id
+WHERE is_uploaded = FALSE;
+
+ALTER TABLE offline_tracks DROP COLUMN remote_url;
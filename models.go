@@ -22,29 +22,47 @@ type Song struct {
 	IsLocal     bool   `json:"isLocal"`     // True for initial samples or user uploads
 	IsUploaded  bool   `json:"isUploaded"`  // True only for user uploads
 	JamendoID   *string `json:"jamendoId,omitempty"` // If it's a Jamendo track
+	Source      string `json:"source,omitempty"` // Provider of search results: "jamendo", "archive", "library"
+	// External tracks only: the Creative Commons license they are published
+	// under (LicenseType is "BY", "BY-NC-SA", "CC0"...; see parseLicense) and
+	// the credit their license asks for.
+	LicenseURL      string `json:"licenseUrl,omitempty"`
+	LicenseType     string `json:"licenseType,omitempty"`
+	ArtistURL       string `json:"artistUrl,omitempty"`
+	AttributionText string `json:"attribution,omitempty"`
 	Duration    int    `json:"duration"`
+	// Read from the file on upload; zero/empty when unknown.
+	Genre       string `json:"genre,omitempty"`
+	Year        int    `json:"year,omitempty"`
+	TrackNumber int    `json:"trackNumber,omitempty"`
+	DiscNumber  int    `json:"discNumber,omitempty"`
+	Codec       string `json:"codec,omitempty"`
+	Bitrate     int    `json:"bitrate,omitempty"`    // bits per second
+	SampleRate  int    `json:"sampleRate,omitempty"` // Hz
+	Channels    int    `json:"channels,omitempty"`
+	DurationMs  int64  `json:"durationMs,omitempty"`
+	MimeType    string `json:"mimeType,omitempty"` // Detected from the content of uploads
+	OriginalMimeType string `json:"originalMimeType,omitempty"` // Uploads only: as sent; differs from MimeType once stored as FLAC
+	StoragePath string `json:"-"` // Uploads only: file location relative to uploadsDir; FilePath is the stream URL
+	FileSize    int64  `json:"fileSize,omitempty"` // Uploads only: bytes on disk
+	BlobSHA256  string `json:"-"` // Uploads only: content hash of the shared blob StoragePath points at
+	Loudness    *Loudness `json:"loudness,omitempty"` // Set once analysed; the player normalizes volume with it
+	LoudnessStatus string `json:"-"`                   // Uploads only: pending, done or failed
 	IsLiked     bool   `json:"isLiked,omitempty"` // Dynamically set per user
 	CanDelete   bool   `json:"canDelete,omitempty"` // Dynamically set if user owns uploaded song
 }
 
-// For Jamendo API responses (from your main.go)
-type JamendoTrack struct {
-	ID            string `json:"id"`
-	Name          string `json:"name"`
-	Duration      int    `json:"duration"`
-	ArtistName    string `json:"artist_name"`
-	AlbumName     string `json:"album_name"`
-	Audio         string `json:"audio"`
-	AudioDownload string `json:"audiodownload"`
-	Image         string `json:"image"`
-}
-
-type JamendoResponse struct {
-	Headers struct {
-		Status string `json:"status"`
-		Code   int    `json:"code"`
-	} `json:"headers"`
-	Results []JamendoTrack `json:"results"`
+// Loudness is a song's EBU R128 measurement and the ReplayGain 2.0 gains
+// derived from it, or taken from the file's own ReplayGain tags.
+type Loudness struct {
+	IntegratedLUFS float64  `json:"integratedLufs"`
+	TruePeakDBTP   *float64 `json:"truePeakDbtp,omitempty"` // Unknown when tags gave no peak
+	TrackGainDB    float64  `json:"trackGainDb"`            // Gain to reach -18 LUFS
+	TrackPeak      float64  `json:"trackPeak"`              // Linear, 1.0 is full scale; 0 if unknown
+	AlbumGainDB    float64  `json:"albumGainDb"`            // The track gain for songs without an album
+	AlbumPeak      float64  `json:"albumPeak"`
+	Source         string   `json:"source"` // "analysis" or "tags"
+	AlbumFromTags  bool     `json:"-"`      // Album gain was tagged, not computed from the album's tracks
 }
 
 // For login/register request bodies
@@ -59,9 +77,184 @@ type LikeRequest struct {
     Title       string `json:"title"`       // Needed if song doesn't exist in DB yet
     Artist      string `json:"artist"`
     Album       string `json:"album"`
-    FilePath    string `json:"filePath"`    // Playable URL for Jamendo
     CoverPath   string `json:"coverPath"`
     Duration    int    `json:"duration"`
     IsLocal     bool   `json:"isLocal"`     // False for Jamendo
     JamendoID   string `json:"jamendoId,omitempty"` // Original Jamendo ID if it's a Jamendo song
-}
\ No newline at end of file
+}
+
+// Song converts the request into the Song handed to EnsureSongExists. It
+// never carries a license: that is only taken from the song's provider.
+func (req LikeRequest) Song() Song {
+    return Song{
+        ID: req.SongID, Title: req.Title, Artist: req.Artist, Album: req.Album,
+        CoverPath: req.CoverPath, IsLocal: req.IsLocal, JamendoID: &req.JamendoID, Duration: req.Duration,
+    }
+}
+// Playlist is a user-owned, ordered list of songs. Tracks is only filled in
+// when a single playlist is fetched.
+type Playlist struct {
+	ID         int             `json:"id"`
+	UserID     int             `json:"userId"`
+	Name       string          `json:"name"`
+	TrackCount int             `json:"trackCount"`
+	CreatedAt  time.Time       `json:"createdAt"`
+	UpdatedAt  time.Time       `json:"updatedAt"`
+	Tracks     []PlaylistTrack `json:"tracks,omitempty"`
+}
+
+// PlaylistTrack is a song at a 0-based position within a playlist. The same
+// song may appear more than once, so tracks are addressed by position.
+type PlaylistTrack struct {
+	Position int       `json:"position"`
+	AddedAt  time.Time `json:"addedAt"`
+	Song
+}
+
+// For create/rename playlist requests
+type PlaylistRequest struct {
+	Name string `json:"name"`
+}
+
+// For adding a track to a playlist. The song fields are the same as a like
+// request so Jamendo tracks can be stored on first use.
+type PlaylistTrackRequest struct {
+	LikeRequest
+	Position *int `json:"position,omitempty"` // Insert position; appended when omitted
+}
+
+// For moving a track within a playlist or queue
+type MoveTrackRequest struct {
+	From int `json:"from"`
+	To   int `json:"to"`
+}
+
+// PlayQueue is a user's server-side play queue. CurrentIndex is -1 when the
+// queue is empty; PositionMs is the playback offset within the current song.
+// Version increases on every save and lets clients detect stale copies.
+type PlayQueue struct {
+	Songs        []Song    `json:"songs"`
+	CurrentIndex int       `json:"currentIndex"`
+	PositionMs   int64     `json:"positionMs"`
+	Version      int       `json:"version"`
+	UpdatedAt    time.Time `json:"updatedAt"`
+}
+
+// For replacing the whole queue (PUT /api/queue). Version is optional; when
+// set, the write is rejected if the queue changed since it was read.
+type QueueRequest struct {
+	Songs        []LikeRequest `json:"songs"`
+	CurrentIndex int           `json:"currentIndex"`
+	PositionMs   int64         `json:"positionMs"`
+	Version      *int          `json:"version,omitempty"`
+}
+
+// For updating the playback position only (PUT /api/queue/position)
+type QueuePositionRequest struct {
+	CurrentIndex int   `json:"currentIndex"`
+	PositionMs   int64 `json:"positionMs"`
+}
+
+// For removing a queue entry (POST /api/queue/remove)
+type QueueIndexRequest struct {
+	Index int `json:"index"`
+}
+
+// PlayEvent is one listen recorded through POST /api/plays.
+type PlayEvent struct {
+	ID         int64     `json:"id"`
+	SongID     string    `json:"songId"`
+	StartedAt  time.Time `json:"startedAt"`
+	MsListened int64     `json:"msListened"`
+	Completed  bool      `json:"completed"` // Played through to the end
+	Skipped    bool      `json:"skipped"`   // User moved on before the end
+	Song       *Song     `json:"song,omitempty"`
+}
+
+// For recording a play. The song fields are the same as a like request so
+// Jamendo tracks can be stored on first play. StartedAt defaults to now
+// minus MsListened.
+type PlayRequest struct {
+	LikeRequest
+	StartedAt  *time.Time `json:"startedAt,omitempty"`
+	MsListened int64      `json:"msListened"`
+	Completed  bool       `json:"completed"`
+	Skipped    bool       `json:"skipped"`
+}
+
+// HistoryQuery selects a page of plays, newest first. Zero times mean
+// unbounded. BeforeID breaks ties between plays with the same StartedAt.
+type HistoryQuery struct {
+	After    time.Time
+	Before   time.Time
+	BeforeID int64
+	Limit    int
+}
+
+// For GET/PUT /api/history/settings
+type HistorySettings struct {
+	Paused bool `json:"paused"`
+}
+
+// StorageQuota limits what a user may upload. Zero means no limit.
+type StorageQuota struct {
+	MaxBytes  int64
+	MaxTracks int
+}
+
+// StorageUsage totals a user's uploads.
+type StorageUsage struct {
+	UsedBytes int64         `json:"usedBytes"`
+	Tracks    int           `json:"tracks"`
+	Formats   []FormatUsage `json:"formats"`
+}
+
+// FormatUsage is the share of a user's storage taken by one format.
+type FormatUsage struct {
+	Format   string `json:"format"`
+	MimeType string `json:"mimeType"`
+	Tracks   int    `json:"tracks"`
+	Bytes    int64  `json:"bytes"`
+}
+
+// StorageReport is the response of GET /api/me/storage. Limits and
+// availability are null when unlimited.
+type StorageReport struct {
+	StorageUsage
+	QuotaBytes      *int64 `json:"quotaBytes"`
+	AvailableBytes  *int64 `json:"availableBytes"`
+	TrackLimit      *int   `json:"trackLimit"`
+	AvailableTracks *int   `json:"availableTracks"`
+}
+
+// UploadSession is a resumable upload in progress. Offset bytes of Length
+// have been received so far; SongID is set once the file became a song.
+type UploadSession struct {
+	ID        string    `json:"id"`
+	UserID    int       `json:"-"`
+	Length    int64     `json:"length"`
+	Offset    int64     `json:"offset"`
+	Metadata  string    `json:"-"` // Raw tus Upload-Metadata header
+	SongID    *string   `json:"songId,omitempty"`
+	CreatedAt time.Time `json:"createdAt"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+// OfflineTrack is a Jamendo track saved to server storage so it keeps
+// playing when Jamendo can't be reached. It is downloaded once however many
+// users save it; SavedAt is when the listing user did. Size counts the
+// bytes received so far until Status is offlineDone.
+type OfflineTrack struct {
+	JamendoID   string    `json:"jamendoId"`
+	SongID      string    `json:"songId"`
+	Status      string    `json:"status"` // queued, downloading, done or failed
+	DownloadURL string    `json:"-"`      // Jamendo's audiodownload URL
+	StoragePath string    `json:"-"`      // Relative to uploadsDir once done
+	MimeType    string    `json:"mimeType,omitempty"`
+	Size        int64     `json:"size"`
+	Attempts    int       `json:"attempts"`
+	Error       string    `json:"error,omitempty"`
+	CreatedAt   time.Time `json:"createdAt"`
+	UpdatedAt   time.Time `json:"updatedAt"`
+	SavedAt     time.Time `json:"savedAt,omitempty"`
+}
@@ -0,0 +1,405 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Jamendo tracks saved for offline playback are downloaded into
+// uploadsDir/offline/<Jamendo ID><ext>, once however many users save them.
+// A download in progress is kept as <Jamendo ID>.part and resumed with a
+// Range request after a failure or restart.
+const offlineDirName = "offline"
+
+// OfflineTrack statuses.
+const (
+	offlineQueued      = "queued"
+	offlineDownloading = "downloading"
+	offlineDone        = "done"
+	offlineFailed      = "failed"
+)
+
+const (
+	offlineMaxBytes        = 500 << 20 // Larger downloads are refused
+	offlineMaxAttempts     = 3
+	offlineRetryDelay      = time.Minute
+	offlineDownloadTimeout = 30 * time.Minute
+)
+
+// errOfflineRejected marks download failures that retrying won't fix.
+var errOfflineRejected = errors.New("download rejected")
+
+// offlineHTTP fetches the audio. Downloads are long, so it gets its own
+// timeout rather than the Jamendo client's.
+var offlineHTTP = &http.Client{Timeout: offlineDownloadTimeout}
+
+// offlineQueue feeds saved tracks to runOfflineWorker.
+var offlineQueue = make(chan string, 1024)
+
+// queueOfflineDownload asks the worker to download a queued track. If the
+// queue is full, the download is picked up on the next start.
+func queueOfflineDownload(jamendoID string) {
+	select {
+	case offlineQueue <- jamendoID:
+	default:
+		log.Warn().Str("jamendo_id", jamendoID).Msg("Offline download queue is full; the track will be downloaded later")
+	}
+}
+
+// runOfflineWorker resumes the downloads a restart interrupted, then
+// downloads tracks as they are queued, one at a time so saving an album
+// doesn't starve playback of bandwidth. main runs it in its own goroutine.
+func runOfflineWorker() {
+	pending, err := store.ListPendingOfflineTracks()
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to list pending offline downloads")
+	}
+	for _, t := range pending {
+		downloadOfflineTrack(t.JamendoID)
+	}
+	for jamendoID := range offlineQueue {
+		downloadOfflineTrack(jamendoID)
+	}
+}
+
+// downloadOfflineTrack downloads a queued or interrupted track and records
+// the outcome. Failures are retried offlineMaxAttempts times unless they are
+// errOfflineRejected.
+func downloadOfflineTrack(jamendoID string) {
+	t, err := store.GetOfflineTrack(jamendoID)
+	if err != nil || t.Status == offlineDone || t.Status == offlineFailed {
+		return // Removed, or a duplicate queue entry
+	}
+	t.Status, t.Error = offlineDownloading, ""
+	t.Attempts++
+	if err := store.UpdateOfflineTrack(*t); err != nil {
+		log.Error().Err(err).Str("jamendo_id", jamendoID).Msg("Failed to start offline download")
+		return
+	}
+
+	err = fetchOfflineFile(t)
+	if err != nil {
+		t.Error = truncate(err.Error(), 200)
+		t.Status = offlineFailed
+		if t.Attempts < offlineMaxAttempts && !errors.Is(err, errOfflineRejected) {
+			t.Status = offlineQueued
+			time.AfterFunc(offlineRetryDelay, func() { queueOfflineDownload(jamendoID) })
+		}
+		log.Warn().Err(err).Str("jamendo_id", jamendoID).Int("attempt", t.Attempts).Str("status", t.Status).Msg("Offline download failed")
+	} else {
+		t.Status = offlineDone
+		log.Info().Str("jamendo_id", jamendoID).Int64("bytes", t.Size).Msg("Saved track for offline playback")
+	}
+	if err := store.UpdateOfflineTrack(*t); err != nil {
+		if errors.Is(err, errNotFound) {
+			removeOfflineFiles(jamendoID) // Everyone unsaved it while it downloaded
+			return
+		}
+		log.Error().Err(err).Str("jamendo_id", jamendoID).Msg("Failed to record offline download")
+	}
+}
+
+// offlinePartPath is where t's download in progress is kept.
+func offlinePartPath(jamendoID string) string {
+	return filepath.Join(uploadsDir, offlineDirName, jamendoID+".part")
+}
+
+// fetchOfflineFile downloads t.DownloadURL, continuing a partial download
+// where it stopped, and moves the finished file into place, setting
+// t.StoragePath, t.MimeType and t.Size.
+func fetchOfflineFile(t *OfflineTrack) error {
+	part := offlinePartPath(t.JamendoID)
+	if err := os.MkdirAll(filepath.Dir(part), os.ModePerm); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(part, os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	offset, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), offlineDownloadTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, t.DownloadURL, nil)
+	if err != nil {
+		return fmt.Errorf("%w: %v", errOfflineRejected, err)
+	}
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+	resp, err := offlineHTTP.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusPartialContent && offset > 0 &&
+		strings.HasPrefix(resp.Header.Get("Content-Range"), fmt.Sprintf("bytes %d-", offset)):
+		// Resuming
+	case resp.StatusCode == http.StatusOK:
+		// Range not supported, or a fresh download: start over.
+		if err := f.Truncate(0); err != nil {
+			return err
+		}
+		if offset, err = f.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+	case resp.StatusCode == http.StatusRequestedRangeNotSatisfiable || resp.StatusCode == http.StatusPartialContent:
+		// The partial file doesn't match what the server has; retry from scratch.
+		f.Truncate(0)
+		return fmt.Errorf("download: HTTP %d resuming at byte %d", resp.StatusCode, offset)
+	case resp.StatusCode >= 400 && resp.StatusCode < 500 && resp.StatusCode != http.StatusTooManyRequests:
+		return fmt.Errorf("%w: HTTP %d", errOfflineRejected, resp.StatusCode)
+	default:
+		return fmt.Errorf("download: HTTP %d", resp.StatusCode)
+	}
+
+	n, err := io.Copy(f, io.LimitReader(resp.Body, offlineMaxBytes-offset+1))
+	t.Size = offset + n
+	if err != nil {
+		return err // The partial file is kept for the next attempt
+	}
+	if t.Size > offlineMaxBytes {
+		f.Truncate(0)
+		return fmt.Errorf("%w: larger than %d bytes", errOfflineRejected, offlineMaxBytes)
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	format, err := detectOfflineFormat(part)
+	if err != nil {
+		os.Remove(part)
+		return err
+	}
+	relative := offlineDirName + "/" + t.JamendoID + format.Ext
+	target, err := uploadFilePath(relative)
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(part, target); err != nil {
+		return err
+	}
+	t.StoragePath, t.MimeType = relative, format.MIME
+	return nil
+}
+
+// detectOfflineFormat checks that a finished download is audio we can serve.
+func detectOfflineFormat(path string) (audioFormat, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return audioFormat{}, err
+	}
+	defer f.Close()
+	container, err := detectAudioFormat(f)
+	format, ok := supportedFormats[container]
+	if err != nil || !ok {
+		return audioFormat{}, fmt.Errorf("%w: not a supported audio file", errOfflineRejected)
+	}
+	return format, nil
+}
+
+// removeOfflineFiles deletes a track's saved copy and any partial download,
+// whatever the store last knew about them: a download may still have been
+// writing when the track was removed.
+func removeOfflineFiles(jamendoID string) {
+	matches, err := filepath.Glob(filepath.Join(uploadsDir, offlineDirName, jamendoID+".*"))
+	if err != nil {
+		log.Warn().Err(err).Str("jamendo_id", jamendoID).Msg("Failed to list offline files")
+		return
+	}
+	for _, fullPath := range matches {
+		removeUploadFile(fullPath, "Failed to remove offline file")
+	}
+}
+
+// serveOfflineCopy serves the saved copy of a Jamendo song, reporting false
+// if it has none. Songs whose copy went missing are streamed from Jamendo.
+func serveOfflineCopy(w http.ResponseWriter, r *http.Request, song *Song) bool {
+	if song.JamendoID == nil || *song.JamendoID == "" {
+		return false
+	}
+	t, err := store.GetOfflineTrack(*song.JamendoID)
+	if errors.Is(err, errNotFound) || err == nil && t.Status != offlineDone {
+		return false
+	}
+	if err != nil {
+		writeStoreError(w, err, "Failed to fetch offline track")
+		return true
+	}
+	fullPath, err := uploadFilePath(t.StoragePath)
+	if err == nil {
+		_, err = os.Stat(fullPath)
+	}
+	if err != nil {
+		log.Warn().Err(err).Str("jamendo_id", t.JamendoID).Msg("Offline copy is missing; streaming from Jamendo")
+		return false
+	}
+	// Copies are handed out under the track's license, which goes with them.
+	if song.LicenseURL != "" {
+		w.Header().Set("Link", "<"+song.LicenseURL+`>; rel="license"`)
+	}
+	serveUploadFile(w, r, t.StoragePath, t.MimeType)
+	return true
+}
+
+// withProgress fills in the bytes received so far for a download in
+// progress, which the store only learns when it ends.
+func withProgress(t OfflineTrack) OfflineTrack {
+	if t.Status == offlineDownloading {
+		if info, err := os.Stat(offlinePartPath(t.JamendoID)); err == nil {
+			t.Size = info.Size()
+		}
+	}
+	return t
+}
+
+// GET lists the user's offline tracks, POST {"jamendoId"} (or {"songId":
+// "jamendo-<id>"}) saves one.
+func OfflineTracksHandler(w http.ResponseWriter, r *http.Request) { // Protected by AuthMiddleware
+	claims := GetClaimsFromContext(r)
+	if claims == nil {
+		writeJSONError(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		tracks, err := store.ListOfflineTracks(claims.UserID)
+		if err != nil {
+			writeStoreError(w, err, "Failed to fetch offline tracks")
+			return
+		}
+		for i := range tracks {
+			tracks[i] = withProgress(tracks[i])
+		}
+		writeJSONResponse(w, tracks, http.StatusOK)
+	case http.MethodPost:
+		var req struct {
+			JamendoID string `json:"jamendoId"`
+			SongID    string `json:"songId"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeJSONError(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		if req.JamendoID == "" {
+			req.JamendoID = strings.TrimPrefix(req.SongID, jamendoSource+"-")
+		}
+		if !validJamendoID(req.JamendoID) {
+			writeJSONError(w, "A Jamendo track ID is required", http.StatusBadRequest)
+			return
+		}
+		saveOfflineTrack(w, r, claims.UserID, req.JamendoID)
+	default:
+		writeJSONError(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// saveOfflineTrack records the user's save, looking the track up on Jamendo
+// the first time anyone saves it, and queues its download. It answers 200
+// when the copy is ready and 202 while it downloads.
+func saveOfflineTrack(w http.ResponseWriter, r *http.Request, userID int, jamendoID string) {
+	t, err := store.GetOfflineTrack(jamendoID)
+	if errors.Is(err, errNotFound) {
+		if t = newOfflineTrack(w, r, jamendoID); t == nil {
+			return
+		}
+		err = nil
+	}
+	if err != nil {
+		writeStoreError(w, err, "Failed to fetch offline track")
+		return
+	}
+	t, err = store.AddOfflineTrack(userID, *t)
+	if err != nil {
+		writeStoreError(w, err, "Failed to save track")
+		return
+	}
+	status := http.StatusAccepted
+	switch t.Status {
+	case offlineQueued:
+		queueOfflineDownload(jamendoID)
+	case offlineDone:
+		status = http.StatusOK
+	}
+	writeJSONResponse(w, withProgress(*t), status)
+}
+
+// newOfflineTrack looks up a track nobody has saved yet and adds it to the
+// songs table. It writes the error response itself and returns a nil track
+// when the track can't be saved.
+func newOfflineTrack(w http.ResponseWriter, r *http.Request, jamendoID string) *OfflineTrack {
+	track, err := jamendo.trackByID(r.Context(), jamendoID)
+	if err != nil {
+		if errors.Is(err, errTrackNotFound) {
+			writeJSONError(w, "Track not found", http.StatusNotFound)
+			return nil
+		}
+		log.Error().Err(err).Str("jamendo_id", jamendoID).Msg("Jamendo lookup for offline save failed")
+		writeJamendoError(w, err)
+		return nil
+	}
+	if !jamendoDownloadAllowed(*track) {
+		writeJSONError(w, "This track's license doesn't allow downloads", http.StatusForbidden)
+		return nil
+	}
+	song, _ := jamendoTrackSong(*track)
+	songID, err := saveProviderSong(song)
+	if err != nil {
+		writeStoreError(w, err, "Failed to save track")
+		return nil
+	}
+	return &OfflineTrack{JamendoID: jamendoID, SongID: songID, DownloadURL: track.AudioDownload}
+}
+
+// GET returns one of the user's offline tracks, DELETE unsaves it. The copy
+// is deleted once nobody has it saved.
+func OfflineTrackHandler(w http.ResponseWriter, r *http.Request) { // Protected by AuthMiddleware
+	claims := GetClaimsFromContext(r)
+	if claims == nil {
+		writeJSONError(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	jamendoID := r.PathValue("jamendoID")
+	switch r.Method {
+	case http.MethodGet:
+		tracks, err := store.ListOfflineTracks(claims.UserID)
+		if err != nil {
+			writeStoreError(w, err, "Failed to fetch offline tracks")
+			return
+		}
+		for _, t := range tracks {
+			if t.JamendoID == jamendoID {
+				writeJSONResponse(w, withProgress(t), http.StatusOK)
+				return
+			}
+		}
+		writeJSONError(w, "Not found", http.StatusNotFound)
+	case http.MethodDelete:
+		removed, err := store.RemoveOfflineTrack(claims.UserID, jamendoID)
+		if err != nil {
+			writeStoreError(w, err, "Failed to remove offline track")
+			return
+		}
+		if removed != nil {
+			removeOfflineFiles(removed.JamendoID)
+		}
+		writeJSONResponse(w, map[string]string{"message": "Offline copy removed", "jamendoId": jamendoID}, http.StatusOK)
+	default:
+		writeJSONError(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,376 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// offlineAudio stands in for Jamendo's download servers: offlineHTTP is
+// pointed at it whatever host a download URL names.
+type offlineAudio struct {
+	mu      sync.Mutex
+	content []byte
+	ranges  []string // Range header of each request
+	cutAt   int      // When set, the next full download stops after this many bytes
+	during  func()   // When set, runs before each request is answered
+}
+
+type rewriteTransport struct{ target *url.URL }
+
+func (t rewriteTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	req.URL.Scheme, req.URL.Host = t.target.Scheme, t.target.Host
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+func newOfflineAudio(t *testing.T, content []byte) *offlineAudio {
+	a := &offlineAudio{content: content}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		a.mu.Lock()
+		a.ranges = append(a.ranges, r.Header.Get("Range"))
+		cutAt, during := a.cutAt, a.during
+		a.cutAt = 0
+		a.mu.Unlock()
+		if during != nil {
+			during()
+		}
+		if cutAt > 0 && r.Header.Get("Range") == "" {
+			w.Header().Set("Content-Length", strconv.Itoa(len(a.content)))
+			w.Write(a.content[:cutAt])
+			panic(http.ErrAbortHandler) // The connection drops mid-download
+		}
+		http.ServeContent(w, r, "track.mp3", time.Time{}, bytes.NewReader(a.content))
+	}))
+	t.Cleanup(srv.Close)
+	target, _ := url.Parse(srv.URL)
+	saved := offlineHTTP
+	offlineHTTP = &http.Client{Transport: rewriteTransport{target}}
+	t.Cleanup(func() { offlineHTTP = saved })
+	return a
+}
+
+func (a *offlineAudio) requests() []string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return append([]string(nil), a.ranges...)
+}
+
+// runOfflineQueue does what runOfflineWorker would for everything queued so
+// far, and reports the Jamendo IDs it downloaded.
+func runOfflineQueue() []string {
+	var ids []string
+	for {
+		select {
+		case id := <-offlineQueue:
+			downloadOfflineTrack(id)
+			ids = append(ids, id)
+		default:
+			return ids
+		}
+	}
+}
+
+func TestOfflineSave(t *testing.T) {
+	newJamendoFixtures(t, map[string]string{"tracks": "tracks.json"})
+	audio := testMP3("Morning Light")
+	forEachStore(t, func(t *testing.T, srv *httptest.Server) {
+		server := newOfflineAudio(t, audio)
+		alice, bob := newTestClient(t, srv), newTestClient(t, srv)
+		alice.registerAndLogin("alice")
+		bob.registerAndLogin("bob")
+
+		var saved OfflineTrack
+		if code := alice.do("POST", "/api/offline", map[string]string{"jamendoId": "1886257"}, &saved); code != http.StatusAccepted {
+			t.Fatalf("save: status %d", code)
+		}
+		if saved.Status != offlineQueued || saved.SongID != "jamendo-1886257" {
+			t.Errorf("saved = %+v", saved)
+		}
+		// Bob saving the same track while it is queued shares the download.
+		if code := bob.do("POST", "/api/offline", map[string]string{"songId": "jamendo-1886257"}, &saved); code != http.StatusAccepted {
+			t.Fatalf("second save: status %d", code)
+		}
+		if ids := runOfflineQueue(); len(ids) != 2 || len(server.requests()) != 1 {
+			t.Errorf("downloaded %v with %d requests, want one download", ids, len(server.requests()))
+		}
+
+		var tracks []OfflineTrack
+		if code := alice.do("GET", "/api/offline", nil, &tracks); code != http.StatusOK || len(tracks) != 1 {
+			t.Fatalf("list: status %d, %+v", code, tracks)
+		}
+		if got := tracks[0]; got.Status != offlineDone || got.MimeType != "audio/mpeg" || got.Size != int64(len(audio)) || got.Attempts != 1 || got.SavedAt.IsZero() {
+			t.Errorf("track = %+v", got)
+		}
+		if song, err := store.GetSong("jamendo-1886257"); err != nil || song.FilePath != streamURL("jamendo-1886257") {
+			t.Errorf("song file path = %v, %v", song, err)
+		}
+
+		// Playback now comes from server storage, for anyone.
+		resp, err := http.Get(srv.URL + streamURL("jamendo-1886257"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK || !bytes.Equal(body, audio) {
+			t.Errorf("stream: status %d, %d bytes", resp.StatusCode, len(body))
+		}
+		if link := resp.Header.Get("Link"); link != `<http://creativecommons.org/licenses/by-nc-sa/3.0/>; rel="license"` {
+			t.Errorf("stream Link %q", link)
+		}
+
+		// Saving a track that is already downloaded is answered at once.
+		carol := newTestClient(t, srv)
+		carol.registerAndLogin("carol")
+		if code := carol.do("POST", "/api/offline", map[string]string{"jamendoId": "1886257"}, &saved); code != http.StatusOK || saved.Status != offlineDone {
+			t.Errorf("save of a downloaded track: status %d, %+v", code, saved)
+		}
+		if code := carol.do("GET", "/api/offline/1886257", nil, &saved); code != http.StatusOK {
+			t.Errorf("get: status %d", code)
+		}
+	})
+}
+
+func TestOfflineRemove(t *testing.T) {
+	newJamendoFixtures(t, map[string]string{"tracks": "tracks.json"})
+	forEachStore(t, func(t *testing.T, srv *httptest.Server) {
+		newOfflineAudio(t, testMP3("Morning Light"))
+		alice, bob := newTestClient(t, srv), newTestClient(t, srv)
+		alice.registerAndLogin("alice")
+		bob.registerAndLogin("bob")
+		// A like names whatever file path the client wants; it must not end up
+		// as the song's path once the copy is gone.
+		evil := map[string]string{"songId": "jamendo-1886257", "jamendoId": "1886257", "title": "Morning Light", "filePath": "https://evil.example/phish"}
+		if code := bob.do("POST", "/api/songs/like", evil, nil); code != http.StatusOK {
+			t.Fatalf("like: status %d", code)
+		}
+		for _, c := range []*testClient{alice, bob} {
+			if code := c.do("POST", "/api/offline", map[string]string{"jamendoId": "1886257"}, nil); code != http.StatusAccepted {
+				t.Fatalf("save: status %d", code)
+			}
+		}
+		runOfflineQueue()
+		file := filepath.Join(uploadsDir, offlineDirName, "1886257.mp3")
+
+		noRedirect := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+
+		// A copy that went missing on disk is streamed from Jamendo instead.
+		if err := os.Rename(file, file+".bak"); err != nil {
+			t.Fatal(err)
+		}
+		resp, err := noRedirect.Get(srv.URL + streamURL("jamendo-1886257"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusFound || resp.Header.Get("Location") != "/api/tracks/jamendo-1886257/stream" {
+			t.Errorf("stream of a missing copy: status %d, Location %q", resp.StatusCode, resp.Header.Get("Location"))
+		}
+		if err := os.Rename(file+".bak", file); err != nil {
+			t.Fatal(err)
+		}
+
+		if code := bob.do("DELETE", "/api/offline/1886257", nil, nil); code != http.StatusOK {
+			t.Fatalf("delete: status %d", code)
+		}
+		if code := bob.do("GET", "/api/offline/1886257", nil, nil); code != http.StatusNotFound {
+			t.Errorf("get after delete: status %d", code)
+		}
+		if _, err := os.Stat(file); err != nil {
+			t.Errorf("the copy Alice still has saved is gone: %v", err)
+		}
+
+		if code := alice.do("DELETE", "/api/offline/1886257", nil, nil); code != http.StatusOK {
+			t.Fatalf("last delete: status %d", code)
+		}
+		if _, err := os.Stat(file); !os.IsNotExist(err) {
+			t.Errorf("copy kept after the last save was removed: %v", err)
+		}
+		resp, err = noRedirect.Get(srv.URL + streamURL("jamendo-1886257"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusFound || resp.Header.Get("Location") != "/api/tracks/jamendo-1886257/stream" {
+			t.Errorf("stream: status %d, Location %q", resp.StatusCode, resp.Header.Get("Location"))
+		}
+		if code := alice.do("DELETE", "/api/offline/1886257", nil, nil); code != http.StatusNotFound {
+			t.Errorf("second delete: status %d", code)
+		}
+	})
+}
+
+// Removing the last save deletes whatever is on disk for the track, even
+// while its download is queued or still running.
+func TestOfflineRemoveCleansUp(t *testing.T) {
+	newJamendoFixtures(t, map[string]string{"tracks": "tracks.json"})
+	audio := testMP3("Morning Light")
+	forEachStore(t, func(t *testing.T, srv *httptest.Server) {
+		server := newOfflineAudio(t, audio)
+		c := newTestClient(t, srv)
+		c.registerAndLogin("alice")
+		save := func(id string) {
+			t.Helper()
+			if code := c.do("POST", "/api/offline", map[string]string{"jamendoId": id}, nil); code != http.StatusAccepted {
+				t.Fatalf("save %s: status %d", id, code)
+			}
+		}
+
+		// An interrupted download leaves a partial file and goes back in the queue.
+		server.cutAt = len(audio) / 2
+		save("1886257")
+		runOfflineQueue()
+		if files := userFiles(t, offlineDirName); len(files) != 1 || files[0] != "1886257.part" {
+			t.Fatalf("after the dropped connection: %v", files)
+		}
+		if code := c.do("DELETE", "/api/offline/1886257", nil, nil); code != http.StatusOK {
+			t.Fatalf("delete: status %d", code)
+		}
+		if files := userFiles(t, offlineDirName); len(files) != 0 {
+			t.Errorf("files left after removing a queued track: %v", files)
+		}
+
+		// A download that finishes after the track was removed is thrown away.
+		save("1712430")
+		server.during = func() {
+			if code := c.do("DELETE", "/api/offline/1712430", nil, nil); code != http.StatusOK {
+				t.Errorf("delete during download: status %d", code)
+			}
+		}
+		runOfflineQueue()
+		if files := userFiles(t, offlineDirName); len(files) != 0 {
+			t.Errorf("files left after a download outlived its track: %v", files)
+		}
+		// So is the partial file of one that fails after it.
+		save("1886257")
+		server.cutAt = len(audio) / 2
+		server.during = func() { c.do("DELETE", "/api/offline/1886257", nil, nil) }
+		runOfflineQueue()
+		if files := userFiles(t, offlineDirName); len(files) != 0 {
+			t.Errorf("files left after a failed download outlived its track: %v", files)
+		}
+	})
+}
+
+// The reconciler keeps offline copies and partial downloads of saved tracks
+// and sweeps up any other file in the offline directory.
+func TestReconcileOfflineFiles(t *testing.T) {
+	newJamendoFixtures(t, map[string]string{"tracks": "tracks.json"})
+	audio := testMP3("Morning Light")
+	forEachStore(t, func(t *testing.T, srv *httptest.Server) {
+		server := newOfflineAudio(t, audio)
+		c := newTestClient(t, srv)
+		c.registerAndLogin("alice")
+		for _, id := range []string{"1886257", "1712430"} {
+			if id == "1712430" {
+				server.cutAt = len(audio) / 2 // Stays queued with a partial file
+			}
+			if code := c.do("POST", "/api/offline", map[string]string{"jamendoId": id}, nil); code != http.StatusAccepted {
+				t.Fatalf("save %s: status %d", id, code)
+			}
+			runOfflineQueue()
+		}
+		old := time.Now().Add(-2 * reconcileGrace)
+		for _, name := range []string{"1886257.mp3", "1712430.part"} {
+			os.Chtimes(filepath.Join(uploadsDir, offlineDirName, name), old, old)
+		}
+		stray := filepath.Join(uploadsDir, offlineDirName, "999.mp3")
+		if err := os.WriteFile(stray, audio, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		os.Chtimes(stray, old, old)
+
+		report, err := reconcileUploads(time.Now(), false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(report.OrphanFiles) != 1 || report.OrphanFiles[0] != offlineDirName+"/999.mp3" || report.Removed != 1 {
+			t.Errorf("report = %+v", report)
+		}
+		if files := userFiles(t, offlineDirName); len(files) != 2 {
+			t.Errorf("offline files after reconciling: %v", files)
+		}
+	})
+}
+
+func TestOfflineResume(t *testing.T) {
+	newJamendoFixtures(t, map[string]string{"tracks": "tracks.json"})
+	audio := testMP3("Morning Light")
+	forEachStore(t, func(t *testing.T, srv *httptest.Server) {
+		server := newOfflineAudio(t, audio)
+		server.cutAt = len(audio) / 2
+		c := newTestClient(t, srv)
+		c.registerAndLogin("alice")
+		if code := c.do("POST", "/api/offline", map[string]string{"jamendoId": "1712430"}, nil); code != http.StatusAccepted {
+			t.Fatalf("save: status %d", code)
+		}
+		runOfflineQueue()
+		t1, err := store.GetOfflineTrack("1712430")
+		if err != nil || t1.Status != offlineQueued || t1.Attempts != 1 || t1.Error == "" {
+			t.Fatalf("after the dropped connection: %+v, %v", t1, err)
+		}
+
+		// The retry (normally offlineRetryDelay later) picks up where it stopped.
+		downloadOfflineTrack("1712430")
+		ranges := server.requests()
+		if want := "bytes=" + strconv.Itoa(len(audio)/2) + "-"; len(ranges) != 2 || ranges[1] != want {
+			t.Errorf("Range headers %q, want the second to be %q", ranges, want)
+		}
+		got, err := os.ReadFile(filepath.Join(uploadsDir, offlineDirName, "1712430.mp3"))
+		if err != nil || !bytes.Equal(got, audio) {
+			t.Errorf("resumed file: %d bytes, %v", len(got), err)
+		}
+	})
+}
+
+func TestOfflineRejected(t *testing.T) {
+	newJamendoFixtures(t, map[string]string{"tracks": "tracks.json"})
+	forEachStore(t, func(t *testing.T, srv *httptest.Server) {
+		newOfflineAudio(t, []byte("<html>not audio</html>"))
+		c := newTestClient(t, srv)
+		if code := c.do("POST", "/api/offline", map[string]string{"jamendoId": "1886257"}, nil); code != http.StatusUnauthorized {
+			t.Errorf("guest save: status %d", code)
+		}
+		c.registerAndLogin("alice")
+		// 1650001's license doesn't allow downloads.
+		if code := c.do("POST", "/api/offline", map[string]string{"jamendoId": "1650001"}, nil); code != http.StatusForbidden {
+			t.Errorf("save of a non-downloadable track: status %d", code)
+		}
+		if code := c.do("POST", "/api/offline", map[string]string{"jamendoId": "abc"}, nil); code != http.StatusBadRequest {
+			t.Errorf("invalid ID: status %d", code)
+		}
+
+		// A download that isn't audio fails for good, without retries.
+		if code := c.do("POST", "/api/offline", map[string]string{"jamendoId": "1886257"}, nil); code != http.StatusAccepted {
+			t.Fatalf("save: status %d", code)
+		}
+		runOfflineQueue()
+		tr, err := store.GetOfflineTrack("1886257")
+		if err != nil || tr.Status != offlineFailed || tr.Attempts != 1 {
+			t.Errorf("track = %+v, %v", tr, err)
+		}
+		resp, err := (&http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}).Get(srv.URL + streamURL("jamendo-1886257"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusFound || resp.Header.Get("Location") != "/api/tracks/jamendo-1886257/stream" {
+			t.Errorf("stream of a failed download: status %d, Location %q", resp.StatusCode, resp.Header.Get("Location"))
+		}
+		// Saving it again queues another try.
+		var saved OfflineTrack
+		if code := c.do("POST", "/api/offline", map[string]string{"jamendoId": "1886257"}, &saved); code != http.StatusAccepted || saved.Status != offlineQueued || saved.Attempts != 0 {
+			t.Errorf("save after failure: status %d, %+v", code, saved)
+		}
+		runOfflineQueue()
+	})
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const maxPlaylistNameLength = 255
+
+// playlistIDFromPath reads the {id} path segment, answering 404 itself when
+// it is not a number.
+func playlistIDFromPath(w http.ResponseWriter, r *http.Request) (int, bool) {
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		writeJSONError(w, "Not found", http.StatusNotFound)
+		return 0, false
+	}
+	return id, true
+}
+
+// decodePlaylistName reads and validates a PlaylistRequest body.
+func decodePlaylistName(w http.ResponseWriter, r *http.Request) (string, bool) {
+	var req PlaylistRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSONError(w, "Invalid request body", http.StatusBadRequest)
+		return "", false
+	}
+	name := strings.TrimSpace(req.Name)
+	if name == "" {
+		writeJSONError(w, "Playlist name is required", http.StatusBadRequest)
+		return "", false
+	}
+	if len(name) > maxPlaylistNameLength {
+		writeJSONError(w, "Playlist name is too long", http.StatusBadRequest)
+		return "", false
+	}
+	return name, true
+}
+
+// GET lists the user's playlists, POST creates one.
+func PlaylistsHandler(w http.ResponseWriter, r *http.Request) { // Protected by AuthMiddleware
+	claims := GetClaimsFromContext(r)
+	if claims == nil {
+		writeJSONError(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		playlists, err := store.ListPlaylists(claims.UserID)
+		if err != nil {
+			writeStoreError(w, err, "Failed to fetch playlists")
+			return
+		}
+		writeJSONResponse(w, playlists, http.StatusOK)
+	case http.MethodPost:
+		name, ok := decodePlaylistName(w, r)
+		if !ok {
+			return
+		}
+		playlist, err := store.CreatePlaylist(claims.UserID, name)
+		if err != nil {
+			writeStoreError(w, err, "Failed to create playlist")
+			return
+		}
+		writeJSONResponse(w, playlist, http.StatusCreated)
+	default:
+		writeJSONError(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// GET returns a playlist with its tracks, PUT/PATCH renames it, DELETE removes it.
+func PlaylistHandler(w http.ResponseWriter, r *http.Request) { // Protected by AuthMiddleware
+	claims := GetClaimsFromContext(r)
+	if claims == nil {
+		writeJSONError(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	playlistID, ok := playlistIDFromPath(w, r)
+	if !ok {
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		playlist, err := store.GetPlaylist(claims.UserID, playlistID)
+		if err != nil {
+			writeStoreError(w, err, "Failed to fetch playlist")
+			return
+		}
+		writeJSONResponse(w, playlist, http.StatusOK)
+	case http.MethodPut, http.MethodPatch:
+		name, ok := decodePlaylistName(w, r)
+		if !ok {
+			return
+		}
+		if err := store.RenamePlaylist(claims.UserID, playlistID, name); err != nil {
+			writeStoreError(w, err, "Failed to rename playlist")
+			return
+		}
+		writePlaylist(w, claims.UserID, playlistID)
+	case http.MethodDelete:
+		if err := store.DeletePlaylist(claims.UserID, playlistID); err != nil {
+			writeStoreError(w, err, "Failed to delete playlist")
+			return
+		}
+		writeJSONResponse(w, map[string]interface{}{"message": "Playlist deleted successfully", "playlistId": playlistID}, http.StatusOK)
+	default:
+		writeJSONError(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// POST adds a song (upload, sample or Jamendo track) to a playlist.
+func PlaylistTracksHandler(w http.ResponseWriter, r *http.Request) { // Protected by AuthMiddleware
+	if r.Method != http.MethodPost {
+		writeJSONError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	claims := GetClaimsFromContext(r)
+	if claims == nil {
+		writeJSONError(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	playlistID, ok := playlistIDFromPath(w, r)
+	if !ok {
+		return
+	}
+	var req PlaylistTrackRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSONError(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if req.SongID == "" {
+		writeJSONError(w, "Song ID is required", http.StatusBadRequest)
+		return
+	}
+	// Check the playlist first so a bad playlist ID doesn't store the song as a side effect.
+	if _, err := store.GetPlaylist(claims.UserID, playlistID); err != nil {
+		writeStoreError(w, err, "Failed to fetch playlist")
+		return
+	}
+	songID, err := ensureRequestedSong(req.LikeRequest)
+	if err == nil {
+		err = checkSongVisible(claims.UserID, songID)
+	}
+	if err != nil {
+		writeStoreError(w, err, "Error processing song for playlist")
+		return
+	}
+	position := -1
+	if req.Position != nil {
+		position = *req.Position
+	}
+	if err := store.AddPlaylistTrack(claims.UserID, playlistID, songID, position); err != nil {
+		writeStoreError(w, err, "Failed to add track to playlist")
+		return
+	}
+	writePlaylist(w, claims.UserID, playlistID)
+}
+
+// DELETE removes the track at {position} from a playlist.
+func PlaylistTrackHandler(w http.ResponseWriter, r *http.Request) { // Protected by AuthMiddleware
+	if r.Method != http.MethodDelete {
+		writeJSONError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	claims := GetClaimsFromContext(r)
+	if claims == nil {
+		writeJSONError(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	playlistID, ok := playlistIDFromPath(w, r)
+	if !ok {
+		return
+	}
+	position, err := strconv.Atoi(r.PathValue("position"))
+	if err != nil {
+		writeJSONError(w, "Track position must be a number", http.StatusBadRequest)
+		return
+	}
+	if err := store.RemovePlaylistTrack(claims.UserID, playlistID, position); err != nil {
+		writeStoreError(w, err, "Failed to remove track from playlist")
+		return
+	}
+	writePlaylist(w, claims.UserID, playlistID)
+}
+
+// POST {"from": i, "to": j} moves a track within a playlist.
+func PlaylistMoveTrackHandler(w http.ResponseWriter, r *http.Request) { // Protected by AuthMiddleware
+	if r.Method != http.MethodPost {
+		writeJSONError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	claims := GetClaimsFromContext(r)
+	if claims == nil {
+		writeJSONError(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	playlistID, ok := playlistIDFromPath(w, r)
+	if !ok {
+		return
+	}
+	var req MoveTrackRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSONError(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if err := store.MovePlaylistTrack(claims.UserID, playlistID, req.From, req.To); err != nil {
+		writeStoreError(w, err, "Failed to move playlist track")
+		return
+	}
+	writePlaylist(w, claims.UserID, playlistID)
+}
+
+// writePlaylist answers a successful change with the playlist's new state.
+func writePlaylist(w http.ResponseWriter, userID, playlistID int) {
+	playlist, err := store.GetPlaylist(userID, playlistID)
+	if err != nil {
+		writeStoreError(w, err, "Failed to fetch playlist")
+		return
+	}
+	writeJSONResponse(w, playlist, http.StatusOK)
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func playlistTitles(p Playlist) []string {
+	var titles []string
+	for _, t := range p.Tracks {
+		titles = append(titles, t.Title)
+	}
+	return titles
+}
+
+func TestPlaylistLifecycle(t *testing.T) {
+	forEachStore(t, func(t *testing.T, srv *httptest.Server) {
+		c := newTestClient(t, srv)
+		c.registerAndLogin("henry")
+
+		var p Playlist
+		if code := c.do("POST", "/api/playlists", PlaylistRequest{Name: "  Road Trip "}, &p); code != http.StatusCreated {
+			t.Fatalf("create: status %d", code)
+		}
+		if p.Name != "Road Trip" || p.TrackCount != 0 {
+			t.Fatalf("unexpected new playlist: %+v", p)
+		}
+		if code := c.do("POST", "/api/playlists", PlaylistRequest{Name: " "}, nil); code != http.StatusBadRequest {
+			t.Errorf("blank name: status %d, want 400", code)
+		}
+		base := fmt.Sprintf("/api/playlists/%d", p.ID)
+
+		upload, code := c.upload("Uploaded")
+		if code != http.StatusCreated {
+			t.Fatalf("upload: status %d", code)
+		}
+		sample := initialSampleSongs[0]
+		adds := []LikeRequest{
+			{SongID: "jamendo-77", JamendoID: "77", Title: "Jamendo"},
+			{SongID: sample.ID, Title: sample.Title, IsLocal: true},
+			{SongID: upload.ID, IsLocal: true},
+		}
+		for _, add := range adds {
+			if code := c.do("POST", base+"/tracks", PlaylistTrackRequest{LikeRequest: add}, &p); code != http.StatusOK {
+				t.Fatalf("add %s: status %d", add.SongID, code)
+			}
+		}
+		first := 0
+		if code := c.do("POST", base+"/tracks", PlaylistTrackRequest{LikeRequest: adds[0], Position: &first}, &p); code != http.StatusOK {
+			t.Fatalf("insert at 0: status %d", code)
+		}
+		want := fmt.Sprint([]string{"Jamendo", "Jamendo", sample.Title, "Uploaded"})
+		if got := fmt.Sprint(playlistTitles(p)); got != want {
+			t.Fatalf("tracks = %s, want %s", got, want)
+		}
+
+		if code := c.do("POST", base+"/tracks/move", MoveTrackRequest{From: 3, To: 0}, &p); code != http.StatusOK {
+			t.Fatalf("move: status %d", code)
+		}
+		if code := c.do("DELETE", base+"/tracks/1", nil, &p); code != http.StatusOK {
+			t.Fatalf("remove: status %d", code)
+		}
+		want = fmt.Sprint([]string{"Uploaded", "Jamendo", sample.Title})
+		if got := fmt.Sprint(playlistTitles(p)); got != want {
+			t.Fatalf("after move+remove tracks = %s, want %s", got, want)
+		}
+		for i, track := range p.Tracks {
+			if track.Position != i {
+				t.Errorf("track %d has position %d", i, track.Position)
+			}
+		}
+		if code := c.do("POST", base+"/tracks/move", MoveTrackRequest{From: 0, To: 9}, nil); code != http.StatusBadRequest {
+			t.Errorf("move out of range: status %d, want 400", code)
+		}
+
+		// Deleting the upload drops it from the playlist and keeps positions contiguous.
+		if code := c.do("DELETE", "/api/songs/delete?id="+upload.ID, nil, nil); code != http.StatusOK {
+			t.Fatalf("delete upload: status %d", code)
+		}
+		if code := c.do("DELETE", base+"/tracks/1", nil, &p); code != http.StatusOK {
+			t.Fatalf("remove after song delete: status %d", code)
+		}
+		if got := fmt.Sprint(playlistTitles(p)); got != fmt.Sprint([]string{"Jamendo"}) {
+			t.Fatalf("tracks = %s, want [Jamendo]", got)
+		}
+
+		if code := c.do("PATCH", base, PlaylistRequest{Name: "Renamed"}, &p); code != http.StatusOK || p.Name != "Renamed" {
+			t.Fatalf("rename: status %d, name %q", code, p.Name)
+		}
+		var list []Playlist
+		c.do("GET", "/api/playlists", nil, &list)
+		if len(list) != 1 || list[0].TrackCount != 1 || list[0].Name != "Renamed" {
+			t.Fatalf("unexpected playlist list: %+v", list)
+		}
+
+		if code := c.do("DELETE", base, nil, nil); code != http.StatusOK {
+			t.Fatalf("delete playlist: status %d", code)
+		}
+		if code := c.do("GET", base, nil, nil); code != http.StatusNotFound {
+			t.Errorf("deleted playlist: status %d, want 404", code)
+		}
+	})
+}
+
+func TestPlaylistsAreScopedToOwner(t *testing.T) {
+	forEachStore(t, func(t *testing.T, srv *httptest.Server) {
+		owner := newTestClient(t, srv)
+		owner.registerAndLogin("ivy")
+		var p Playlist
+		owner.do("POST", "/api/playlists", PlaylistRequest{Name: "Private"}, &p)
+		ownerUpload, _ := owner.upload("Ivy's Track")
+
+		other := newTestClient(t, srv)
+		other.registerAndLogin("jack")
+		base := fmt.Sprintf("/api/playlists/%d", p.ID)
+		if code := other.do("GET", base, nil, nil); code != http.StatusNotFound {
+			t.Errorf("GET other's playlist: status %d, want 404", code)
+		}
+		if code := other.do("DELETE", base, nil, nil); code != http.StatusNotFound {
+			t.Errorf("DELETE other's playlist: status %d, want 404", code)
+		}
+		if code := other.do("POST", base+"/tracks", PlaylistTrackRequest{LikeRequest: LikeRequest{SongID: "sample-1", IsLocal: true}}, nil); code != http.StatusNotFound {
+			t.Errorf("add to other's playlist: status %d, want 404", code)
+		}
+
+		var mine Playlist
+		other.do("POST", "/api/playlists", PlaylistRequest{Name: "Mine"}, &mine)
+		path := fmt.Sprintf("/api/playlists/%d/tracks", mine.ID)
+		if code := other.do("POST", path, PlaylistTrackRequest{LikeRequest: LikeRequest{SongID: ownerUpload.ID, IsLocal: true}}, nil); code != http.StatusNotFound {
+			t.Errorf("add someone else's upload: status %d, want 404", code)
+		}
+	})
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Provider is a source of music besides uploads. Its songs have IDs of the
+// form "<name>-<track ID>", where the track ID is the provider's own.
+type Provider interface {
+	// Name identifies the provider in ?sources= and song IDs. It must not
+	// contain "-", or be "local" or "sample" (uploads and samples).
+	Name() string
+	// Search returns one page of matching tracks as songs.
+	Search(ctx context.Context, q SearchQuery) (*SearchPage, error)
+	// Track looks up one track by its track ID, or returns errTrackNotFound.
+	Track(ctx context.Context, id string) (*Song, error)
+	// StreamURL returns where the player can fetch the track's audio.
+	StreamURL(ctx context.Context, id string) (string, error)
+	// Attribution credits the provider wherever its results are shown.
+	Attribution() Attribution
+}
+
+// Downloader is implemented by providers whose tracks can be downloaded
+// as files to keep, where their licenses allow it.
+type Downloader interface {
+	// DownloadURL returns where to fetch the track's file, or
+	// errLicenseForbids when its license doesn't allow downloads.
+	DownloadURL(ctx context.Context, id string) (string, error)
+}
+
+// SearchQuery is a search any provider can run.
+type SearchQuery struct {
+	Text   string
+	Tags   []string // Tags or genres, all of which must match
+	Offset int
+	Limit  int
+}
+
+// SearchPage is one page of a provider's results and how many match in all
+// (0 if the provider can't tell). Stale pages are cached ones served while
+// the provider is failing.
+type SearchPage struct {
+	Songs []Song
+	Total int
+	Stale bool
+}
+
+// Attribution is how a provider asks to be credited.
+type Attribution struct {
+	Name   string `json:"name"`
+	URL    string `json:"url,omitempty"`
+	Notice string `json:"notice,omitempty"`
+}
+
+var errTrackNotFound = errors.New("track not found")
+
+// providers returns the enabled providers in the order their results are
+// merged. Jamendo and the Internet Archive are always on; the local library
+// only when LIBRARY_DIR is set.
+func providers() []Provider {
+	list := []Provider{jamendo, archive}
+	if library != nil {
+		list = append(list, library)
+	}
+	return list
+}
+
+// providerFor splits a song ID into its provider and track ID.
+func providerFor(songID string) (Provider, string, bool) {
+	name, id, ok := strings.Cut(songID, "-")
+	if !ok || id == "" {
+		return nil, "", false
+	}
+	for _, p := range providers() {
+		if p.Name() == name {
+			return p, id, true
+		}
+	}
+	return nil, "", false
+}
+
+// saveProviderSong stores a song as its provider described it. Its license
+// replaces whatever was recorded for it before.
+func saveProviderSong(s Song) (string, error) {
+	songID, err := store.EnsureSongExists(s)
+	if err != nil {
+		return "", err
+	}
+	if err := store.SetSongLicense(songID, s); err != nil {
+		return "", err
+	}
+	return songID, nil
+}
+
+// providerErrorMessage describes a provider failure for API clients without
+// exposing upstream URLs or bodies.
+func providerErrorMessage(err error) string {
+	switch {
+	case errors.Is(err, errJamendoRateLimited):
+		return "rate limited"
+	case errors.Is(err, errJamendoUnavailable):
+		return "temporarily unavailable"
+	case errors.Is(err, context.DeadlineExceeded):
+		return "timed out"
+	default:
+		return "request failed"
+	}
+}
+
+// writeProviderError answers a failed provider lookup.
+func writeProviderError(w http.ResponseWriter, p Provider, err error) {
+	switch {
+	case errors.Is(err, errTrackNotFound):
+		writeJSONError(w, "Track not found", http.StatusNotFound)
+	case errors.Is(err, errLicenseForbids):
+		writeJSONError(w, "This track's license doesn't allow downloads", http.StatusForbidden)
+	case p.Name() == jamendoSource:
+		writeJamendoError(w, err)
+	default:
+		writeJSONError(w, p.Attribution().Name+" request failed", http.StatusBadGateway)
+	}
+}
+
+// SourcesHandler serves GET /api/sources: the enabled providers and their
+// attributions.
+func SourcesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSONError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	type source struct {
+		Name        string      `json:"name"`
+		Attribution Attribution `json:"attribution"`
+	}
+	list := []source{}
+	for _, p := range providers() {
+		list = append(list, source{Name: p.Name(), Attribution: p.Attribution()})
+	}
+	writeJSONResponse(w, list, http.StatusOK)
+}
+
+// TrackHandler serves GET /api/tracks/{id}: a provider's track as a song.
+// IDs containing "/" (library paths) must be sent with it escaped as %2F.
+func TrackHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSONError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	p, id, ok := providerFor(r.PathValue("id"))
+	if !ok {
+		writeJSONError(w, "Track not found", http.StatusNotFound)
+		return
+	}
+	song, err := p.Track(r.Context(), id)
+	if err != nil {
+		if !errors.Is(err, errTrackNotFound) {
+			log.Error().Err(err).Str("source", p.Name()).Str("trackId", id).Msg("Track lookup failed")
+		}
+		writeProviderError(w, p, err)
+		return
+	}
+	writeJSONResponse(w, song, http.StatusOK)
+}
+
+// TrackStreamHandler serves GET /api/tracks/{id}/stream by redirecting to
+// the provider's stream URL, for songs whose URL is resolved on demand.
+func TrackStreamHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		writeJSONError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	p, id, ok := providerFor(r.PathValue("id"))
+	if !ok {
+		writeJSONError(w, "Track not found", http.StatusNotFound)
+		return
+	}
+	target, err := p.StreamURL(r.Context(), id)
+	if err != nil {
+		if !errors.Is(err, errTrackNotFound) {
+			log.Error().Err(err).Str("source", p.Name()).Str("trackId", id).Msg("Stream lookup failed")
+		}
+		writeProviderError(w, p, err)
+		return
+	}
+	http.Redirect(w, r, target, http.StatusFound)
+}
+
+// TrackDownloadHandler serves GET /api/tracks/{id}/download by redirecting
+// to the provider's download URL, if the track's license allows downloads.
+func TrackDownloadHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		writeJSONError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	p, id, ok := providerFor(r.PathValue("id"))
+	if !ok {
+		writeJSONError(w, "Track not found", http.StatusNotFound)
+		return
+	}
+	d, ok := p.(Downloader)
+	if !ok {
+		writeJSONError(w, p.Attribution().Name+" tracks can't be downloaded", http.StatusForbidden)
+		return
+	}
+	target, err := d.DownloadURL(r.Context(), id)
+	if err != nil {
+		if !errors.Is(err, errTrackNotFound) && !errors.Is(err, errLicenseForbids) {
+			log.Error().Err(err).Str("source", p.Name()).Str("trackId", id).Msg("Download lookup failed")
+		}
+		writeProviderError(w, p, err)
+		return
+	}
+	http.Redirect(w, r, target, http.StatusFound)
+}
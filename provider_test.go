@@ -0,0 +1,167 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fixtureServer stands in for a provider's API, answering each route with a
+// JSON file from testdata/<dir> and anything else with 404. Routes are
+// request paths with the API's prefix and surrounding slashes trimmed.
+type fixtureServer struct {
+	URL      string
+	mu       sync.Mutex
+	routes   map[string]string
+	requests []*url.URL
+	status   int           // When set, every request fails with it
+	gate     chan struct{} // When set, requests wait for it to close
+}
+
+func newFixtureServer(t *testing.T, dir, prefix string, routes map[string]string) *fixtureServer {
+	f := &fixtureServer{routes: routes}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		f.mu.Lock()
+		f.requests = append(f.requests, r.URL)
+		name, ok := f.routes[strings.Trim(strings.TrimPrefix(r.URL.Path, prefix), "/")]
+		status, gate := f.status, f.gate
+		f.mu.Unlock()
+		if gate != nil {
+			<-gate
+		}
+		if status != 0 {
+			http.Error(w, http.StatusText(status), status)
+			return
+		}
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		http.ServeFile(w, r, filepath.Join("testdata", dir, name))
+	}))
+	t.Cleanup(srv.Close)
+	f.URL = srv.URL
+	return f
+}
+
+// fail makes every request answer status, or serve fixtures again for 0.
+func (f *fixtureServer) fail(status int) {
+	f.mu.Lock()
+	f.status = status
+	f.mu.Unlock()
+}
+
+// calls returns how many requests reached the stand-in.
+func (f *fixtureServer) calls() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.requests)
+}
+
+// last returns the latest request's URL.
+func (f *fixtureServer) last() *url.URL {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.requests[len(f.requests)-1]
+}
+
+// newProviderServer serves the router with every provider backed by a
+// stand-in: Jamendo and the Archive by fixtures, the library by a
+// temporary directory.
+func newProviderServer(t *testing.T) (*httptest.Server, *fixtureServer, *fixtureServer) {
+	jamendoAPI := newJamendoFixtures(t, map[string]string{"tracks": "tracks.json"})
+	archiveAPI := newArchiveFixtures(t)
+	newTestLibrary(t, map[string][]byte{"Tag Artist/03 Harbour.mp3": testMP3("Harbour Lights"), "other.wav": testWAV()})
+	srv := httptest.NewServer(newRouter())
+	t.Cleanup(srv.Close)
+	return srv, jamendoAPI, archiveAPI
+}
+
+// getJSON fetches path from srv without following redirects and decodes
+// the response into out.
+func getJSON(t *testing.T, srv *httptest.Server, path string, out interface{}) *http.Response {
+	t.Helper()
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	resp, err := client.Get(srv.URL + path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if out != nil {
+		json.NewDecoder(resp.Body).Decode(out)
+	}
+	return resp
+}
+
+func TestTrackEndpoints(t *testing.T) {
+	srv, jamendoAPI, archiveAPI := newProviderServer(t)
+
+	var song Song
+	if resp := getJSON(t, srv, "/api/tracks/jamendo-1886257", &song); resp.StatusCode != http.StatusOK || song.Title != "Morning Light" {
+		t.Errorf("jamendo track: status %d, %+v", resp.StatusCode, song)
+	}
+	if q := jamendoAPI.last().Query(); q.Get("id") != "1886257" {
+		t.Errorf("jamendo lookup %s", q.Encode())
+	}
+	calls := jamendoAPI.calls()
+	for _, id := range []string{"jamendo-1650001", "jamendo-abc", "spotify-1", "nodash"} {
+		if resp := getJSON(t, srv, "/api/tracks/"+id, nil); resp.StatusCode != http.StatusNotFound {
+			t.Errorf("%s: status %d, want 404", id, resp.StatusCode)
+		}
+	}
+	if jamendoAPI.calls() != calls+1 {
+		t.Errorf("invalid Jamendo IDs were looked up")
+	}
+
+	resp := getJSON(t, srv, "/api/tracks/archive-harbour-sessions-2019/stream", nil)
+	if want := archiveAPI.URL + "/download/harbour-sessions-2019/01%20Low%20Tide.mp3"; resp.StatusCode != http.StatusFound || resp.Header.Get("Location") != want {
+		t.Errorf("archive stream: status %d, Location %q", resp.StatusCode, resp.Header.Get("Location"))
+	}
+	resp = getJSON(t, srv, "/api/tracks/library-Tag%20Artist%2F03%20Harbour.mp3/stream", nil)
+	if resp.StatusCode != http.StatusFound || resp.Header.Get("Location") != "/api/library/Tag%20Artist/03%20Harbour.mp3" {
+		t.Errorf("library stream: status %d, Location %q", resp.StatusCode, resp.Header.Get("Location"))
+	}
+	archiveAPI.fail(http.StatusBadGateway)
+	if resp := getJSON(t, srv, "/api/tracks/archive-harbour-sessions-2019", nil); resp.StatusCode != http.StatusBadGateway {
+		t.Errorf("failing archive: status %d", resp.StatusCode)
+	}
+
+	var sources []struct {
+		Name        string      `json:"name"`
+		Attribution Attribution `json:"attribution"`
+	}
+	getJSON(t, srv, "/api/sources", &sources)
+	if len(sources) != 3 || sources[0].Name != "jamendo" || sources[1].Name != "archive" || sources[2].Name != "library" ||
+		sources[1].Attribution.URL != "https://archive.org" {
+		t.Errorf("sources = %+v", sources)
+	}
+}
+
+func TestTrackDownload(t *testing.T) {
+	srv, _, archiveAPI := newProviderServer(t)
+
+	resp := getJSON(t, srv, "/api/tracks/jamendo-1886257/download", nil)
+	if want := "https://prod-1.storage.jamendo.com/download/track/1886257/mp32/"; resp.StatusCode != http.StatusFound || resp.Header.Get("Location") != want {
+		t.Errorf("jamendo download: status %d, Location %q", resp.StatusCode, resp.Header.Get("Location"))
+	}
+	resp = getJSON(t, srv, "/api/tracks/archive-harbour-sessions-2019/download", nil)
+	if want := archiveAPI.URL + "/download/harbour-sessions-2019/01%20Low%20Tide.mp3"; resp.StatusCode != http.StatusFound || resp.Header.Get("Location") != want {
+		t.Errorf("archive download: status %d, Location %q", resp.StatusCode, resp.Header.Get("Location"))
+	}
+
+	// 1650001's artist doesn't allow downloads, the field recording has no
+	// license and library files have no license information at all.
+	for _, id := range []string{"jamendo-1650001", "archive-untitled-field-recording", "library-other.wav"} {
+		if resp := getJSON(t, srv, "/api/tracks/"+id+"/download", nil); resp.StatusCode != http.StatusForbidden {
+			t.Errorf("%s: status %d, want 403", id, resp.StatusCode)
+		}
+	}
+	if resp := getJSON(t, srv, "/api/tracks/jamendo-999/download", nil); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("unknown track: status %d", resp.StatusCode)
+	}
+}
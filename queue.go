@@ -0,0 +1,239 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// How often a queue edit is retried when another request saved in between.
+const maxQueueSaveAttempts = 3
+
+// normalize keeps CurrentIndex pointing at a real entry, e.g. after songs
+// were deleted out from under a stored queue.
+func (q *PlayQueue) normalize() {
+	switch {
+	case len(q.Songs) == 0:
+		q.CurrentIndex, q.PositionMs = -1, 0
+	case q.CurrentIndex < 0:
+		q.CurrentIndex, q.PositionMs = 0, 0
+	case q.CurrentIndex >= len(q.Songs):
+		q.CurrentIndex, q.PositionMs = len(q.Songs)-1, 0
+	}
+}
+
+// insert puts s at index, appending when index is past the end.
+func (q *PlayQueue) insert(s Song, index int) {
+	var at int
+	q.Songs, at = insertIndex(q.Songs, s, index)
+	if q.CurrentIndex < 0 {
+		q.CurrentIndex, q.PositionMs = 0, 0
+	} else if at <= q.CurrentIndex {
+		q.CurrentIndex++
+	}
+}
+
+// remove drops the entry at index. Removing the current song makes the next
+// one current and restarts it.
+func (q *PlayQueue) remove(index int) error {
+	if index < 0 || index >= len(q.Songs) {
+		return fmt.Errorf("remove %d: %w", index, errOutOfRange)
+	}
+	q.Songs = append(q.Songs[:index], q.Songs[index+1:]...)
+	switch {
+	case index < q.CurrentIndex:
+		q.CurrentIndex--
+	case index == q.CurrentIndex:
+		q.PositionMs = 0
+	}
+	q.normalize()
+	return nil
+}
+
+// move reorders an entry; the current song stays current wherever it ends up.
+func (q *PlayQueue) move(from, to int) error {
+	if from < 0 || from >= len(q.Songs) || to < 0 || to >= len(q.Songs) {
+		return fmt.Errorf("move %d to %d: %w", from, to, errOutOfRange)
+	}
+	q.Songs = moveIndex(q.Songs, from, to)
+	switch {
+	case from == q.CurrentIndex:
+		q.CurrentIndex = to
+	case from < q.CurrentIndex && to >= q.CurrentIndex:
+		q.CurrentIndex--
+	case from > q.CurrentIndex && to <= q.CurrentIndex:
+		q.CurrentIndex++
+	}
+	return nil
+}
+
+// setPosition points the queue at index, playing from positionMs.
+func (q *PlayQueue) setPosition(index int, positionMs int64) error {
+	if len(q.Songs) == 0 && index == -1 {
+		return nil
+	}
+	if index < 0 || index >= len(q.Songs) {
+		return fmt.Errorf("current index %d: %w", index, errOutOfRange)
+	}
+	if positionMs < 0 {
+		positionMs = 0
+	}
+	q.CurrentIndex, q.PositionMs = index, positionMs
+	return nil
+}
+
+// updateQueue loads the user's queue, applies edit and saves the result,
+// retrying from a fresh copy when a concurrent save wins the race. Errors
+// returned by edit itself are not retried.
+func updateQueue(userID int, edit func(q *PlayQueue) error) error {
+	for attempt := 1; ; attempt++ {
+		q, err := store.GetQueue(userID)
+		if err != nil {
+			return err
+		}
+		if err := edit(q); err != nil {
+			return err
+		}
+		err = store.SaveQueue(userID, q)
+		if errors.Is(err, errConflict) && attempt < maxQueueSaveAttempts {
+			continue
+		}
+		return err
+	}
+}
+
+// GET returns the user's queue, PUT replaces it.
+func QueueHandler(w http.ResponseWriter, r *http.Request) { // Protected by AuthMiddleware
+	claims := GetClaimsFromContext(r)
+	if claims == nil {
+		writeJSONError(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		writeQueue(w, claims.UserID)
+	case http.MethodPut:
+		var req QueueRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeJSONError(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		songs := make([]Song, 0, len(req.Songs))
+		for _, songReq := range req.Songs {
+			songID, err := ensureVisibleSong(claims.UserID, songReq)
+			if err != nil {
+				writeStoreError(w, err, "Error processing song for queue")
+				return
+			}
+			songs = append(songs, Song{ID: songID})
+		}
+		err := updateQueue(claims.UserID, func(q *PlayQueue) error {
+			if req.Version != nil && *req.Version != q.Version {
+				return fmt.Errorf("play queue: %w", errConflict)
+			}
+			q.Songs = songs
+			return q.setPosition(req.CurrentIndex, req.PositionMs)
+		})
+		if err != nil {
+			writeStoreError(w, err, "Failed to save queue")
+			return
+		}
+		writeQueue(w, claims.UserID)
+	default:
+		writeJSONError(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// QueueActionHandler serves the single-step edits under /api/queue/{action}:
+//
+//	POST next     body: song (as for like)   play the song after the current one
+//	POST append   body: song (as for like)   add the song to the end
+//	POST remove   {"index": i}
+//	POST move     {"from": i, "to": j}
+//	POST clear
+//	PUT  position {"currentIndex": i, "positionMs": n}
+func QueueActionHandler(w http.ResponseWriter, r *http.Request) { // Protected by AuthMiddleware
+	claims := GetClaimsFromContext(r)
+	if claims == nil {
+		writeJSONError(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	action := r.PathValue("action")
+	wantMethod := http.MethodPost
+	if action == "position" {
+		wantMethod = http.MethodPut
+	}
+	if r.Method != wantMethod {
+		writeJSONError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var edit func(q *PlayQueue) error
+	switch action {
+	case "next", "append":
+		var req LikeRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.SongID == "" {
+			writeJSONError(w, "A song with an ID is required", http.StatusBadRequest)
+			return
+		}
+		songID, err := ensureVisibleSong(claims.UserID, req)
+		if err != nil {
+			writeStoreError(w, err, "Error processing song for queue")
+			return
+		}
+		edit = func(q *PlayQueue) error {
+			index := len(q.Songs)
+			if action == "next" {
+				index = q.CurrentIndex + 1
+			}
+			q.insert(Song{ID: songID}, index)
+			return nil
+		}
+	case "remove":
+		var req QueueIndexRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeJSONError(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		edit = func(q *PlayQueue) error { return q.remove(req.Index) }
+	case "move":
+		var req MoveTrackRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeJSONError(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		edit = func(q *PlayQueue) error { return q.move(req.From, req.To) }
+	case "clear":
+		edit = func(q *PlayQueue) error {
+			q.Songs = nil
+			q.normalize()
+			return nil
+		}
+	case "position":
+		var req QueuePositionRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeJSONError(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		edit = func(q *PlayQueue) error { return q.setPosition(req.CurrentIndex, req.PositionMs) }
+	default:
+		writeJSONError(w, "Unknown queue action", http.StatusNotFound)
+		return
+	}
+
+	if err := updateQueue(claims.UserID, edit); err != nil {
+		writeStoreError(w, err, "Failed to update queue")
+		return
+	}
+	writeQueue(w, claims.UserID)
+}
+
+func writeQueue(w http.ResponseWriter, userID int) {
+	q, err := store.GetQueue(userID)
+	if err != nil {
+		writeStoreError(w, err, "Failed to fetch queue")
+		return
+	}
+	writeJSONResponse(w, q, http.StatusOK)
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func queueIDs(q PlayQueue) string {
+	var ids []string
+	for _, s := range q.Songs {
+		ids = append(ids, s.ID)
+	}
+	return fmt.Sprint(ids)
+}
+
+func TestPlayQueueEditsFollowCurrentSong(t *testing.T) {
+	newQueue := func() *PlayQueue {
+		return &PlayQueue{Songs: []Song{{ID: "a"}, {ID: "b"}, {ID: "c"}, {ID: "d"}}, CurrentIndex: 2, PositionMs: 5000}
+	}
+	tests := []struct {
+		name      string
+		edit      func(q *PlayQueue) error
+		wantIDs   string
+		wantIndex int
+		wantPos   int64
+	}{
+		{"insert before current", func(q *PlayQueue) error { q.insert(Song{ID: "x"}, 0); return nil }, "[x a b c d]", 3, 5000},
+		{"insert after current", func(q *PlayQueue) error { q.insert(Song{ID: "x"}, 3); return nil }, "[a b c x d]", 2, 5000},
+		{"remove before current", func(q *PlayQueue) error { return q.remove(0) }, "[b c d]", 1, 5000},
+		{"remove current", func(q *PlayQueue) error { return q.remove(2) }, "[a b d]", 2, 0},
+		{"remove current at end", func(q *PlayQueue) error { q.CurrentIndex = 3; return q.remove(3) }, "[a b c]", 2, 0},
+		{"move current", func(q *PlayQueue) error { return q.move(2, 0) }, "[c a b d]", 0, 5000},
+		{"move across current forwards", func(q *PlayQueue) error { return q.move(0, 3) }, "[b c d a]", 1, 5000},
+		{"move across current backwards", func(q *PlayQueue) error { return q.move(3, 1) }, "[a d b c]", 3, 5000},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := newQueue()
+			if err := tt.edit(q); err != nil {
+				t.Fatal(err)
+			}
+			if got := queueIDs(*q); got != tt.wantIDs || q.CurrentIndex != tt.wantIndex || q.PositionMs != tt.wantPos {
+				t.Errorf("got %s index %d pos %d, want %s index %d pos %d", got, q.CurrentIndex, q.PositionMs, tt.wantIDs, tt.wantIndex, tt.wantPos)
+			}
+		})
+	}
+
+	q := &PlayQueue{CurrentIndex: -1}
+	q.insert(Song{ID: "first"}, 0)
+	if q.CurrentIndex != 0 {
+		t.Errorf("first insert into empty queue: index %d, want 0", q.CurrentIndex)
+	}
+	if err := q.remove(0); err != nil || q.CurrentIndex != -1 {
+		t.Errorf("emptied queue: index %d err %v, want -1", q.CurrentIndex, err)
+	}
+}
+
+func TestQueueSyncsAcrossBrowsers(t *testing.T) {
+	forEachStore(t, func(t *testing.T, srv *httptest.Server) {
+		laptop := newTestClient(t, srv)
+		laptop.registerAndLogin("kim")
+		phone := newTestClient(t, srv)
+		if code := phone.do("POST", "/auth/login", AuthRequest{Username: "kim", Password: "password123"}, nil); code != http.StatusOK {
+			t.Fatalf("second login: status %d", code)
+		}
+
+		var q PlayQueue
+		if code := laptop.do("GET", "/api/queue", nil, &q); code != http.StatusOK || q.CurrentIndex != -1 || len(q.Songs) != 0 {
+			t.Fatalf("initial queue: status %d, %+v", code, q)
+		}
+
+		put := QueueRequest{
+			Songs: []LikeRequest{
+				{SongID: "sample-1", IsLocal: true},
+				{SongID: "jamendo-9", JamendoID: "9", Title: "Nine"},
+			},
+			CurrentIndex: 1, PositionMs: 42000,
+		}
+		if code := laptop.do("PUT", "/api/queue", put, &q); code != http.StatusOK {
+			t.Fatalf("PUT queue: status %d", code)
+		}
+		laptop.do("POST", "/api/queue/append", LikeRequest{SongID: "sample-2", IsLocal: true}, &q)
+		laptop.do("POST", "/api/queue/next", LikeRequest{SongID: "sample-2", IsLocal: true}, &q)
+		staleVersion := q.Version
+
+		if code := phone.do("GET", "/api/queue", nil, &q); code != http.StatusOK {
+			t.Fatalf("GET queue from phone: status %d", code)
+		}
+		if got := queueIDs(q); got != "[sample-1 jamendo-9 sample-2 sample-2]" || q.CurrentIndex != 1 || q.PositionMs != 42000 {
+			t.Fatalf("phone sees %s index %d pos %d", got, q.CurrentIndex, q.PositionMs)
+		}
+		if q.Songs[1].Title != "Nine" {
+			t.Errorf("queue songs are not fully populated: %+v", q.Songs[1])
+		}
+
+		phone.do("PUT", "/api/queue/position", QueuePositionRequest{CurrentIndex: 2, PositionMs: 1000}, &q)
+		phone.do("POST", "/api/queue/move", MoveTrackRequest{From: 0, To: 3}, &q)
+		phone.do("POST", "/api/queue/remove", QueueIndexRequest{Index: 0}, &q)
+		if got := queueIDs(q); got != "[sample-2 sample-2 sample-1]" || q.CurrentIndex != 0 || q.PositionMs != 1000 {
+			t.Fatalf("after phone edits %s index %d pos %d", got, q.CurrentIndex, q.PositionMs)
+		}
+
+		put.Version = &staleVersion
+		if code := laptop.do("PUT", "/api/queue", put, nil); code != http.StatusConflict {
+			t.Errorf("PUT with stale version: status %d, want 409", code)
+		}
+		if code := laptop.do("POST", "/api/queue/remove", QueueIndexRequest{Index: 7}, nil); code != http.StatusBadRequest {
+			t.Errorf("remove out of range: status %d, want 400", code)
+		}
+		if code := laptop.do("POST", "/api/queue/clear", nil, &q); code != http.StatusOK || len(q.Songs) != 0 || q.CurrentIndex != -1 {
+			t.Errorf("clear: status %d, %+v", code, q)
+		}
+
+		other := newTestClient(t, srv)
+		other.registerAndLogin("lee")
+		other.do("GET", "/api/queue", nil, &q)
+		if len(q.Songs) != 0 {
+			t.Errorf("queue leaked to another user: %+v", q)
+		}
+	})
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Defaults for UPLOAD_QUOTA_BYTES and UPLOAD_QUOTA_TRACKS; 0 in the
+// environment turns a limit off.
+const (
+	defaultQuotaBytes  = 1 << 30 // 1 GiB
+	defaultQuotaTracks = 0
+)
+
+// uploadQuota applies to every user. main loads it from the environment.
+var uploadQuota = StorageQuota{MaxBytes: defaultQuotaBytes, MaxTracks: defaultQuotaTracks}
+
+// loadUploadQuota reads UPLOAD_QUOTA_BYTES and UPLOAD_QUOTA_TRACKS.
+func loadUploadQuota() StorageQuota {
+	q := StorageQuota{MaxBytes: defaultQuotaBytes, MaxTracks: defaultQuotaTracks}
+	if v := os.Getenv("UPLOAD_QUOTA_BYTES"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n < 0 {
+			log.Fatal().Str("UPLOAD_QUOTA_BYTES", v).Msg("UPLOAD_QUOTA_BYTES must be a non-negative number of bytes")
+		}
+		q.MaxBytes = n
+	}
+	if v := os.Getenv("UPLOAD_QUOTA_TRACKS"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			log.Fatal().Str("UPLOAD_QUOTA_TRACKS", v).Msg("UPLOAD_QUOTA_TRACKS must be a non-negative number")
+		}
+		q.MaxTracks = n
+	}
+	return q
+}
+
+// check reports whether one more file of size bytes fits next to what the
+// user already stores.
+func (q StorageQuota) check(usedBytes int64, tracks int, size int64) error {
+	if q.MaxTracks > 0 && tracks+1 > q.MaxTracks {
+		return fmt.Errorf("%w: track limit of %d reached", errQuotaExceeded, q.MaxTracks)
+	}
+	if q.MaxBytes > 0 && usedBytes+size > q.MaxBytes {
+		return fmt.Errorf("%w: %d of %d bytes used, file needs %d", errQuotaExceeded, usedBytes, q.MaxBytes, size)
+	}
+	return nil
+}
+
+// remainingBytes is how much more the user may store, or -1 when unlimited.
+func (q StorageQuota) remainingBytes(usedBytes int64) int64 {
+	if q.MaxBytes <= 0 {
+		return -1
+	}
+	if usedBytes >= q.MaxBytes {
+		return 0
+	}
+	return q.MaxBytes - usedBytes
+}
+
+// add folds one format's totals into u. Formats are named after the upload
+// allow-list; rows from before content sniffing have no MIME type.
+func (u *StorageUsage) add(f FormatUsage) {
+	f.Format = "unknown"
+	for name, format := range supportedFormats {
+		if format.MIME == f.MimeType {
+			f.Format = name
+		}
+	}
+	u.UsedBytes += f.Bytes
+	u.Tracks += f.Tracks
+	u.Formats = append(u.Formats, f)
+}
+
+// StorageHandler reports the user's storage use against their quota.
+func StorageHandler(w http.ResponseWriter, r *http.Request) { // Protected by AuthMiddleware
+	if r.Method != http.MethodGet {
+		writeJSONError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	claims := GetClaimsFromContext(r)
+	if claims == nil {
+		writeJSONError(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	usage, err := store.GetStorageUsage(claims.UserID)
+	if err != nil {
+		writeStoreError(w, err, "Failed to fetch storage usage")
+		return
+	}
+	report := StorageReport{StorageUsage: *usage}
+	if uploadQuota.MaxBytes > 0 {
+		quota, available := uploadQuota.MaxBytes, uploadQuota.remainingBytes(usage.UsedBytes)
+		report.QuotaBytes, report.AvailableBytes = &quota, &available
+	}
+	if uploadQuota.MaxTracks > 0 {
+		limit, available := uploadQuota.MaxTracks, uploadQuota.MaxTracks-usage.Tracks
+		if available < 0 {
+			available = 0
+		}
+		report.TrackLimit, report.AvailableTracks = &limit, &available
+	}
+	writeJSONResponse(w, report, http.StatusOK)
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+)
+
+func TestStorageQuota(t *testing.T) {
+	mp3 := int64(len(testMP3("One")))
+	wav := int64(len(testWAV()))
+	saved := uploadQuota
+	t.Cleanup(func() { uploadQuota = saved })
+	// Room for one MP3 and the WAV, but not a second MP3 on top.
+	uploadQuota = StorageQuota{MaxBytes: mp3 + wav + mp3/2, MaxTracks: 3}
+
+	forEachStore(t, func(t *testing.T, srv *httptest.Server) {
+		c := newTestClient(t, srv)
+		if code := c.do("GET", "/api/me/storage", nil, nil); code != http.StatusUnauthorized {
+			t.Fatalf("storage as guest: status %d, want 401", code)
+		}
+		c.registerAndLogin("quinn")
+
+		var report StorageReport
+		if code := c.do("GET", "/api/me/storage", nil, &report); code != http.StatusOK {
+			t.Fatalf("GET /api/me/storage: status %d", code)
+		}
+		if report.UsedBytes != 0 || report.Tracks != 0 || len(report.Formats) != 0 || report.AvailableBytes == nil || *report.AvailableBytes != uploadQuota.MaxBytes {
+			t.Errorf("empty report: %+v", report)
+		}
+
+		first, code := c.upload("One")
+		if code != http.StatusCreated || first.FileSize != mp3 {
+			t.Fatalf("first upload: status %d, size %d want %d", code, first.FileSize, mp3)
+		}
+		if _, code := c.uploadFile("take.wav", testWAV(), nil); code != http.StatusCreated {
+			t.Fatalf("wav upload: status %d", code)
+		}
+		if _, code := c.upload("Two"); code != http.StatusRequestEntityTooLarge {
+			t.Fatalf("upload over byte quota: status %d, want 413", code)
+		}
+		// The rejected file must not linger on disk.
+		if files := blobFiles(t); len(files) != 2 {
+			t.Errorf("blob store holds %v, want 2 files", files)
+		}
+
+		c.do("GET", "/api/me/storage", nil, &report)
+		if report.UsedBytes != mp3+wav || report.Tracks != 2 || *report.AvailableBytes != mp3/2 || *report.AvailableTracks != 1 {
+			t.Errorf("report after uploads: %+v", report)
+		}
+		want := []FormatUsage{
+			{Format: formatMP3, MimeType: "audio/mpeg", Tracks: 1, Bytes: mp3},
+			{Format: formatWAV, MimeType: "audio/wav", Tracks: 1, Bytes: wav},
+		}
+		if len(report.Formats) != len(want) || report.Formats[0] != want[0] || report.Formats[1] != want[1] {
+			t.Errorf("per-format breakdown = %+v, want %+v", report.Formats, want)
+		}
+
+		// Deleting frees the space again.
+		if code := c.do("DELETE", "/api/songs/delete?id="+first.ID, nil, nil); code != http.StatusOK {
+			t.Fatalf("delete: status %d", code)
+		}
+		if _, code := c.upload("Two"); code != http.StatusCreated {
+			t.Fatalf("upload after delete: status %d", code)
+		}
+
+		// Other users have a quota of their own.
+		other := newTestClient(t, srv)
+		other.registerAndLogin("rosa")
+		other.do("GET", "/api/me/storage", nil, &report)
+		if report.UsedBytes != 0 || report.Tracks != 0 {
+			t.Errorf("rosa sees quinn's usage: %+v", report)
+		}
+	})
+}
+
+func TestStorageQuotaTrackLimit(t *testing.T) {
+	saved := uploadQuota
+	t.Cleanup(func() { uploadQuota = saved })
+	uploadQuota = StorageQuota{MaxTracks: 1}
+
+	forEachStore(t, func(t *testing.T, srv *httptest.Server) {
+		c := newTestClient(t, srv)
+		c.registerAndLogin("sam")
+		if _, code := c.upload("One"); code != http.StatusCreated {
+			t.Fatalf("first upload: status %d", code)
+		}
+		if _, code := c.upload("Two"); code != http.StatusRequestEntityTooLarge {
+			t.Errorf("upload over track limit: status %d, want 413", code)
+		}
+		var report StorageReport
+		c.do("GET", "/api/me/storage", nil, &report)
+		if report.QuotaBytes != nil || report.AvailableBytes != nil || *report.TrackLimit != 1 || *report.AvailableTracks != 0 {
+			t.Errorf("report with track limit only: %+v", report)
+		}
+	})
+}
+
+// The multipart body is cut off once it outgrows the quota, whatever the
+// request claims, and broken forms are refused rather than half read.
+func TestUploadBodyLimit(t *testing.T) {
+	saved := uploadQuota
+	t.Cleanup(func() { uploadQuota = saved })
+	uploadQuota = StorageQuota{MaxBytes: 64 << 10}
+
+	forEachStore(t, func(t *testing.T, srv *httptest.Server) {
+		c := newTestClient(t, srv)
+		c.registerAndLogin("tess")
+		var big bytes.Buffer
+		mw := multipart.NewWriter(&big)
+		fw, _ := mw.CreateFormFile("audioFile", "big.mp3")
+		fw.Write(append(testMP3("Big"), make([]byte, 64<<20)...))
+		mw.Close()
+		size := big.Len()
+		sent := &countingReader{r: &big}
+		req, _ := http.NewRequest("POST", srv.URL+"/api/songs/upload", sent)
+		req.Header.Set("Content-Type", mw.FormDataContentType())
+		if code := c.send(req, nil); code != http.StatusRequestEntityTooLarge {
+			t.Errorf("upload over the remaining quota: status %d, want 413", code)
+		}
+		if n := atomic.LoadInt64(&sent.n); n > int64(size)/2 {
+			t.Errorf("server read %d of %d bytes before refusing the upload", n, size)
+		}
+
+		var body bytes.Buffer
+		mw = multipart.NewWriter(&body)
+		fw, _ = mw.CreateFormFile("audioFile", "track.mp3")
+		fw.Write(testMP3("Cut"))
+		// No closing boundary: the form ends mid-part.
+		req, _ = http.NewRequest("POST", srv.URL+"/api/songs/upload", &body)
+		req.Header.Set("Content-Type", mw.FormDataContentType())
+		if code := c.send(req, nil); code != http.StatusBadRequest {
+			t.Errorf("truncated form: status %d, want 400", code)
+		}
+		if code := c.do("POST", "/api/songs/upload", map[string]string{"title": "x"}, nil); code != http.StatusBadRequest {
+			t.Errorf("JSON body: status %d, want 400", code)
+		}
+		if files := blobFiles(t); len(files) != 0 {
+			t.Errorf("blob store holds %v after rejected uploads", files)
+		}
+
+		// What fits still goes through.
+		if _, code := c.upload("Small"); code != http.StatusCreated {
+			t.Errorf("upload within quota: status %d", code)
+		}
+	})
+}
+
+// countingReader counts the bytes read through it.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	atomic.AddInt64(&c.n, int64(n))
+	return n, err
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Defaults for RECONCILE_INTERVAL and RECONCILE_DRY_RUN. Until an operator
+// opts in, the reconciler only reports what it would remove.
+const (
+	defaultReconcileInterval = 6 * time.Hour
+	defaultReconcileDryRun   = true
+)
+
+// reconcileGrace protects files younger than this: an upload writes its file
+// before the song row exists, and a delete drops the row before the file.
+const reconcileGrace = time.Hour
+
+// removeUploadFiles deletes the audio of an upload, unless its blob is still
+// referenced by another song, and likewise its cover. Call it only after the
+// song's row is gone (or was never written).
+func removeUploadFiles(s Song) {
+	if s.BlobSHA256 != "" {
+		releaseBlob(s)
+	} else if s.StoragePath != "" {
+		// Uploaded before the blob store; the file is the song's own.
+		if fullPath, err := uploadFilePath(s.StoragePath); err == nil {
+			removeUploadFile(fullPath, "Failed to remove upload")
+		}
+		removeWaveform(s.ID)
+	}
+	removeCoverIfUnused(s.CoverPath)
+}
+
+// removeCoverIfUnused deletes a cover stored by saveCoverArt once no song
+// shows it any more.
+func removeCoverIfUnused(coverPath string) {
+	relative, ok := coverStoragePath(coverPath)
+	if !ok {
+		return
+	}
+	inUse, err := store.CoverInUse(coverPath)
+	if err != nil {
+		log.Warn().Err(err).Str("cover", coverPath).Msg("Failed to check cover references; keeping the file")
+		return
+	}
+	if !inUse {
+		if fullPath, err := uploadFilePath(relative); err == nil {
+			removeUploadFile(fullPath, "Failed to remove cover")
+		}
+	}
+}
+
+func removeUploadFile(fullPath, message string) bool {
+	if err := os.Remove(fullPath); err != nil && !os.IsNotExist(err) {
+		log.Warn().Err(err).Str("path", fullPath).Msg(message)
+		return false
+	}
+	return true
+}
+
+// loadReconcileConfig reads RECONCILE_INTERVAL (a Go duration, 0 disables
+// the background sweep) and RECONCILE_DRY_RUN.
+func loadReconcileConfig() (interval time.Duration, dryRun bool) {
+	interval, dryRun = defaultReconcileInterval, defaultReconcileDryRun
+	if v := os.Getenv("RECONCILE_INTERVAL"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 0 {
+			log.Fatal().Str("RECONCILE_INTERVAL", v).Msg("RECONCILE_INTERVAL must be a duration such as 6h, or 0 to disable")
+		}
+		interval = d
+	}
+	if v := os.Getenv("RECONCILE_DRY_RUN"); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			log.Fatal().Str("RECONCILE_DRY_RUN", v).Msg("RECONCILE_DRY_RUN must be true or false")
+		}
+		dryRun = b
+	}
+	return interval, dryRun
+}
+
+// reconcileReport is what one reconciliation pass found. Paths are relative
+// to uploadsDir.
+type reconcileReport struct {
+	OrphanFiles  []string // Files no song or offline track refers to
+	MissingFiles []string // IDs of songs whose file is gone
+	Removed      int      // Files and rows actually deleted
+}
+
+// reconcileUploads compares uploadsDir with the songs and offline tracks.
+// Files nothing refers to and songs whose audio file is missing are logged; unless dryRun
+// is set the files are deleted and the songs removed.
+func reconcileUploads(now time.Time, dryRun bool) (*reconcileReport, error) {
+	started := time.Now()
+	songs, err := store.ListUploadedSongs()
+	if err != nil {
+		return nil, err
+	}
+	offline, err := store.ListAllOfflineTracks()
+	if err != nil {
+		return nil, err
+	}
+	referenced := map[string]bool{}
+	for _, t := range offline {
+		// A partial download is kept for resuming as long as the track is.
+		referenced[offlineDirName+"/"+t.JamendoID+".part"] = true
+		if t.StoragePath != "" {
+			referenced[t.StoragePath] = true
+		}
+	}
+	for _, s := range initialSampleSongs {
+		referenced[waveformStoragePath(waveformKey(s))] = true
+	}
+	for _, s := range songs {
+		if s.StoragePath != "" {
+			referenced[s.StoragePath] = true
+		}
+		referenced[waveformStoragePath(waveformKey(s))] = true
+		if cover, ok := coverStoragePath(s.CoverPath); ok {
+			referenced[cover] = true
+		}
+	}
+
+	report := &reconcileReport{}
+	err = filepath.WalkDir(uploadsDir, func(fullPath string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		relative, err := filepath.Rel(uploadsDir, fullPath)
+		if err != nil {
+			return err
+		}
+		relative = filepath.ToSlash(relative)
+		// Only the blob store, the waveform cache, offline copies and
+		// per-user directories hold uploads; leave anything else alone.
+		if !strings.Contains(relative, "/") {
+			if d.IsDir() && relative != "." && relative != blobsDirName && relative != waveformsDirName && relative != offlineDirName {
+				if _, err := strconv.Atoi(relative); err != nil {
+					return fs.SkipDir
+				}
+			}
+			return nil
+		}
+		if d.IsDir() || referenced[relative] {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return nil // Deleted while we were walking
+		}
+		grace := reconcileGrace
+		if strings.Contains(relative, "/"+incomingDirName+"/") {
+			// Partial resumable uploads are owned by their session until it expires.
+			grace += uploadSessionTTL
+		}
+		if now.Sub(info.ModTime()) < grace {
+			return nil
+		}
+		report.OrphanFiles = append(report.OrphanFiles, relative)
+		log.Warn().Str("path", relative).Int64("bytes", info.Size()).Time("modified", info.ModTime()).Bool("dry_run", dryRun).Msg("Upload file has no song")
+		if !dryRun && removeUploadFile(fullPath, "Failed to remove orphaned upload") {
+			report.Removed++
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, s := range songs {
+		if s.StoragePath == "" || s.UserID == nil {
+			continue
+		}
+		fullPath, err := uploadFilePath(s.StoragePath)
+		if err != nil {
+			continue
+		}
+		if _, err := os.Stat(fullPath); !os.IsNotExist(err) {
+			continue
+		}
+		report.MissingFiles = append(report.MissingFiles, s.ID)
+		log.Warn().Str("song_id", s.ID).Int("user_id", *s.UserID).Str("path", s.StoragePath).Bool("dry_run", dryRun).Msg("Song has no upload file")
+		if dryRun {
+			continue
+		}
+		deleted, err := store.DeleteUserUploadedSong(*s.UserID, s.ID)
+		if err != nil {
+			log.Warn().Err(err).Str("song_id", s.ID).Msg("Failed to remove song with missing file")
+			continue
+		}
+		removeUploadFiles(*deleted)
+		report.Removed++
+	}
+
+	log.Info().Int("songs", len(songs)).Int("orphan_files", len(report.OrphanFiles)).Int("missing_files", len(report.MissingFiles)).
+		Int("removed", report.Removed).Bool("dry_run", dryRun).Dur("took", time.Since(started)).Msg("Upload reconciliation finished")
+	return report, nil
+}
+
+// runReconciler reconciles uploads every interval. main runs it in its own
+// goroutine.
+func runReconciler(interval time.Duration, dryRun bool) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		if _, err := reconcileUploads(now, dryRun); err != nil {
+			log.Error().Err(err).Msg("Upload reconciliation failed")
+		}
+	}
+}
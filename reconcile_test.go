@@ -0,0 +1,136 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+)
+
+// userFiles lists the files directly in dir, which is relative to uploadsDir.
+func userFiles(t *testing.T, dir string) []string {
+	t.Helper()
+	entries, err := os.ReadDir(filepath.Join(uploadsDir, dir))
+	if err != nil && !os.IsNotExist(err) {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, e := range entries {
+		if !e.IsDir() {
+			names = append(names, e.Name())
+		}
+	}
+	return names
+}
+
+func TestDeleteRemovesFiles(t *testing.T) {
+	forEachStore(t, func(t *testing.T, srv *httptest.Server) {
+		c := newTestClient(t, srv)
+		c.registerAndLogin("zoe")
+		art := id3APIC(3, "image/jpeg", testJPEG)
+		first, code := c.uploadFile("a.mp3", testMP3("Side A", art), nil)
+		if code != http.StatusCreated {
+			t.Fatalf("upload: status %d", code)
+		}
+		second, code := c.uploadFile("b.mp3", testMP3("Side B", art), nil)
+		if code != http.StatusCreated {
+			t.Fatalf("upload: status %d", code)
+		}
+
+		if code := c.do("DELETE", "/api/songs/delete?id="+first.ID, nil, nil); code != http.StatusOK {
+			t.Fatalf("delete: status %d", code)
+		}
+		if files := blobFiles(t); len(files) != 1 {
+			t.Errorf("after first delete: audio files %v, want 1", files)
+		}
+		// The cover is still shown by the other track.
+		if covers := userFiles(t, "1/covers"); len(covers) != 1 {
+			t.Errorf("shared cover removed too early: %v", covers)
+		}
+
+		if code := c.do("DELETE", "/api/songs/delete?id="+second.ID, nil, nil); code != http.StatusOK {
+			t.Fatalf("delete: status %d", code)
+		}
+		if files, covers := blobFiles(t), userFiles(t, "1/covers"); len(files) != 0 || len(covers) != 0 {
+			t.Errorf("files left after deleting every upload: %v, covers %v", files, covers)
+		}
+	})
+}
+
+func TestReconcileUploads(t *testing.T) {
+	forEachStore(t, func(t *testing.T, srv *httptest.Server) {
+		c := newTestClient(t, srv)
+		c.registerAndLogin("abe")
+		lost, code := c.upload("Lost")
+		if code != http.StatusCreated {
+			t.Fatalf("upload: status %d", code)
+		}
+		// Delete the first upload's file behind the server's back.
+		lostFiles := blobFiles(t)
+		if len(lostFiles) != 1 {
+			t.Fatalf("files after one upload: %v", lostFiles)
+		}
+		os.Remove(filepath.Join(uploadsDir, lostFiles[0]))
+		kept, code := c.upload("Kept")
+		if code != http.StatusCreated {
+			t.Fatalf("upload: status %d", code)
+		}
+
+		old := time.Now().Add(-2 * reconcileGrace)
+		write := func(relative string, modified time.Time) {
+			path := filepath.Join(uploadsDir, filepath.FromSlash(relative))
+			os.MkdirAll(filepath.Dir(path), os.ModePerm)
+			if err := os.WriteFile(path, []byte("stray"), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			os.Chtimes(path, modified, modified)
+		}
+		write("1/stray.mp3", old)
+		write("1/covers/stray.jpg", old)
+		write("1/fresh.mp3", time.Now())     // May belong to an upload in progress
+		write("1/incoming/active.part", old) // Its session has not expired yet
+		write("notes.txt", old)              // Not in a user directory
+		write("offline/404.part", old)       // Left by a removed offline track
+
+		report, err := reconcileUploads(time.Now(), true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sort.Strings(report.OrphanFiles)
+		if len(report.OrphanFiles) != 3 || report.OrphanFiles[0] != "1/covers/stray.jpg" || report.OrphanFiles[1] != "1/stray.mp3" || report.OrphanFiles[2] != "offline/404.part" {
+			t.Errorf("orphans = %v", report.OrphanFiles)
+		}
+		if len(report.MissingFiles) != 1 || report.MissingFiles[0] != lost.ID || report.Removed != 0 {
+			t.Errorf("dry run report = %+v", report)
+		}
+		if findSong(c.songs(), lost.ID) == nil || len(userFiles(t, "1")) != 2 || len(blobFiles(t)) != 1 {
+			t.Fatalf("dry run changed something")
+		}
+
+		report, err = reconcileUploads(time.Now(), false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if report.Removed != 4 {
+			t.Errorf("removed %d, want 4: %+v", report.Removed, report)
+		}
+		songs := c.songs()
+		if findSong(songs, lost.ID) != nil || findSong(songs, kept.ID) == nil {
+			t.Errorf("after reconciling: lost listed %v, kept listed %v", findSong(songs, lost.ID) != nil, findSong(songs, kept.ID) != nil)
+		}
+		if files, blobs := userFiles(t, "1"), blobFiles(t); len(files) != 1 || len(blobs) != 1 {
+			t.Errorf("files after reconciling: %v and blobs %v, want fresh.mp3 and the kept upload", files, blobs)
+		}
+		for _, relative := range []string{"1/incoming/active.part", "notes.txt"} {
+			if _, err := os.Stat(filepath.Join(uploadsDir, relative)); err != nil {
+				t.Errorf("%s should have been left alone: %v", relative, err)
+			}
+		}
+		if resp, _ := c.fetch("GET", kept.FilePath, nil); resp.StatusCode != http.StatusOK {
+			t.Errorf("kept upload no longer streams: status %d", resp.StatusCode)
+		}
+	})
+}
@@ -0,0 +1,683 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Page sizes and the time allowed to each provider for /api/search.
+const (
+	defaultSearchPageSize = 20
+	maxSearchPageSize     = 50
+	providerSearchTimeout = 10 * time.Second
+)
+
+// The sections of the user's own songs, searched from the store before any
+// provider. Samples include nothing the user owns or liked.
+const (
+	sectionUploads = "uploads"
+	sectionLiked   = "liked"
+	sectionSamples = "samples"
+)
+
+var localSections = []string{sectionUploads, sectionLiked, sectionSamples}
+
+var sectionTitles = map[string]string{sectionUploads: "Your uploads", sectionLiked: "Liked songs", sectionSamples: "Samples"}
+
+// sourceAliases lets source: terms use singular names.
+var sourceAliases = map[string]string{"upload": sectionUploads, "like": sectionLiked, "likes": sectionLiked, "sample": sectionSamples}
+
+// Relevance scores. A song gets the highest that applies, plus a boost for
+// the user's own and liked songs so they win ties with the catalog.
+const (
+	scoreExactTitle    = 100
+	scoreExactArtist   = 80
+	scoreTitlePrefix   = 60
+	scoreArtistPrefix  = 50
+	scoreExactAlbum    = 40
+	scoreWordPrefix    = 30 // Every query word starts a word of the title, artist or album
+	scoreContains      = 20 // Every query word appears somewhere in them
+	scoreFuzzy         = 10 // Every query word is a typo or two away from one of their words
+	scoreProviderMatch = 5  // Providers match on more than is shown (tags, descriptions)
+	scoreFilterOnly    = 1  // Queries made only of year: and source: terms
+	boostUpload        = 3
+	boostLiked         = 2
+)
+
+// searchQuery is a parsed /api/search query: free text plus field terms.
+//
+//	artist:x album:x title:x genre:x  substring filters; quote values with spaces
+//	year:2019 year:>2010 year:<=2000 year:2010..2015
+//	source:uploads,liked,samples,jamendo,archive,library  (repeatable)
+//
+// Text may also contain "quoted phrases", which are searched as written.
+type searchQuery struct {
+	Text                 string
+	Title, Artist, Album string
+	Tags                 []string // genre: terms and the tags/genre parameters; all must match
+	YearMin, YearMax     int      // 0 for no bound
+	Sources              []string // Sections to search; empty for all
+}
+
+var searchFields = map[string]bool{"artist": true, "album": true, "title": true, "genre": true, "year": true, "source": true}
+
+// queryToken is a word or quoted phrase, with the field it was given for.
+type queryToken struct {
+	field, value string
+}
+
+// tokenizeQuery splits s into words and quoted phrases, each optionally
+// prefixed by field: for one of searchFields. An unclosed quote runs to the
+// end; other colons are just text.
+func tokenizeQuery(s string) []queryToken {
+	var tokens []queryToken
+	for i := 0; i < len(s); {
+		if s[i] == ' ' || s[i] == '\t' {
+			i++
+			continue
+		}
+		var tok queryToken
+		j := i
+		for j < len(s) && ('a' <= s[j] && s[j] <= 'z' || 'A' <= s[j] && s[j] <= 'Z') {
+			j++
+		}
+		if j < len(s) && s[j] == ':' && searchFields[strings.ToLower(s[i:j])] {
+			tok.field, i = strings.ToLower(s[i:j]), j+1
+		}
+		if i < len(s) && s[i] == '"' {
+			end := strings.IndexByte(s[i+1:], '"')
+			if end < 0 {
+				end = len(s) - i - 1
+			}
+			tok.value = s[i+1 : i+1+end]
+			i += end + 2
+		} else {
+			end := strings.IndexAny(s[i:], " \t")
+			if end < 0 {
+				end = len(s) - i
+			}
+			tok.value = s[i : i+end]
+			i += end
+		}
+		tokens = append(tokens, tok)
+	}
+	return tokens
+}
+
+// parseSearchQuery parses s; see searchQuery for the syntax.
+func parseSearchQuery(s string) (searchQuery, error) {
+	var q searchQuery
+	var text []string
+	for _, tok := range tokenizeQuery(s) {
+		value := strings.TrimSpace(tok.value)
+		if value == "" {
+			continue
+		}
+		switch tok.field {
+		case "":
+			text = append(text, value)
+		case "title":
+			q.Title = value
+		case "artist":
+			q.Artist = value
+		case "album":
+			q.Album = value
+		case "genre":
+			q.Tags = append(q.Tags, value)
+		case "year":
+			if err := q.parseYear(value); err != nil {
+				return q, err
+			}
+		case "source":
+			if err := q.addSources(value); err != nil {
+				return q, err
+			}
+		}
+	}
+	q.Text = strings.Join(text, " ")
+	return q, nil
+}
+
+// parseYear reads a year: term.
+func (q *searchQuery) parseYear(v string) error {
+	errYear := errors.New("year must be like 2019, >2010, <=2000 or 2010..2015")
+	year := func(s string) (int, error) {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 || n > 9999 {
+			return 0, errYear
+		}
+		return n, nil
+	}
+	var err error
+	switch {
+	case strings.Contains(v, ".."):
+		from, to, _ := strings.Cut(v, "..")
+		if q.YearMin, err = year(from); err == nil {
+			q.YearMax, err = year(to)
+		}
+		if err == nil && q.YearMin > q.YearMax {
+			err = errYear
+		}
+	case strings.HasPrefix(v, ">="):
+		q.YearMin, err = year(v[2:])
+	case strings.HasPrefix(v, ">"):
+		q.YearMin, err = year(v[1:])
+		q.YearMin++
+	case strings.HasPrefix(v, "<="):
+		q.YearMax, err = year(v[2:])
+	case strings.HasPrefix(v, "<"):
+		q.YearMax, err = year(v[1:])
+		q.YearMax--
+	default:
+		q.YearMin, err = year(strings.TrimPrefix(v, "="))
+		q.YearMax = q.YearMin
+	}
+	return err
+}
+
+// addSources reads a comma-separated list of sections for source: terms and
+// the sources parameter.
+func (q *searchQuery) addSources(v string) error {
+	available := append([]string{}, localSections...)
+	for _, p := range providers() {
+		available = append(available, p.Name())
+	}
+	for _, name := range strings.Split(v, ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if alias, ok := sourceAliases[name]; ok {
+			name = alias
+		}
+		if name == "" || containsString(q.Sources, name) {
+			continue
+		}
+		if !containsString(available, name) {
+			return fmt.Errorf("unknown source %q; available: %s", name, strings.Join(available, ", "))
+		}
+		q.Sources = append(q.Sources, name)
+	}
+	return nil
+}
+
+func (q searchQuery) empty() bool {
+	return q.Text == "" && q.Title == "" && q.Artist == "" && q.Album == "" && len(q.Tags) == 0 &&
+		q.YearMin == 0 && q.YearMax == 0 && len(q.Sources) == 0
+}
+
+// wants reports whether section is searched.
+func (q searchQuery) wants(section string) bool {
+	return len(q.Sources) == 0 || containsString(q.Sources, section)
+}
+
+// matches reports whether s passes the field filters. Songs of unknown
+// year never pass a year filter.
+func (q searchQuery) matches(s Song) bool {
+	if !containsFold(s.Title, q.Title) || !containsFold(s.Artist, q.Artist) || !containsFold(s.Album, q.Album) {
+		return false
+	}
+	for _, tag := range q.Tags {
+		if !containsFold(s.Genre, tag) {
+			return false
+		}
+	}
+	if q.YearMin > 0 && s.Year < q.YearMin || q.YearMax > 0 && (s.Year == 0 || s.Year > q.YearMax) {
+		return false
+	}
+	return true
+}
+
+// scoringText is what results are ranked against: the free text, or the
+// title, artist and album terms when there is none.
+func (q searchQuery) scoringText() string {
+	if q.Text != "" {
+		return q.Text
+	}
+	return strings.TrimSpace(strings.Join([]string{q.Title, q.Artist, q.Album}, " "))
+}
+
+// providerQuery is the search sent to providers, which know nothing of
+// field terms: the text and the title, artist and album terms as words.
+// Results are filtered by the terms afterwards.
+func (q searchQuery) providerQuery(offset, limit int) SearchQuery {
+	var words []string
+	for _, v := range []string{q.Text, q.Title, q.Artist, q.Album} {
+		if v != "" {
+			words = append(words, v)
+		}
+	}
+	return SearchQuery{Text: strings.Join(words, " "), Tags: q.Tags, Offset: offset, Limit: limit}
+}
+
+func containsFold(s, sub string) bool {
+	return strings.Contains(strings.ToLower(s), strings.ToLower(sub))
+}
+
+// normalizeText lowercases s and collapses its whitespace.
+func normalizeText(s string) string {
+	return strings.ToLower(strings.Join(strings.Fields(s), " "))
+}
+
+// relevance scores s against text (see the score constants); 0 means no
+// match.
+func relevance(s Song, text string) int {
+	q := normalizeText(text)
+	if q == "" {
+		return scoreFilterOnly
+	}
+	title, artist, album := normalizeText(s.Title), normalizeText(s.Artist), normalizeText(s.Album)
+	switch {
+	case title == q:
+		return scoreExactTitle
+	case artist == q:
+		return scoreExactArtist
+	case strings.HasPrefix(title, q):
+		return scoreTitlePrefix
+	case strings.HasPrefix(artist, q):
+		return scoreArtistPrefix
+	case album == q:
+		return scoreExactAlbum
+	}
+	words := strings.Fields(q)
+	songWords := strings.Fields(title + " " + artist + " " + album)
+	all := func(match func(w, sw string) bool) bool {
+		for _, w := range words {
+			found := false
+			for _, sw := range songWords {
+				if match(w, sw) {
+					found = true
+					break
+				}
+			}
+			if !found {
+				return false
+			}
+		}
+		return true
+	}
+	switch {
+	case all(func(w, sw string) bool { return strings.HasPrefix(sw, w) }):
+		return scoreWordPrefix
+	case all(func(w, sw string) bool { return strings.Contains(sw, w) }):
+		return scoreContains
+	case all(fuzzyMatch):
+		return scoreFuzzy
+	}
+	return 0
+}
+
+// fuzzyMatch reports whether w is within one edit of word (two for words
+// longer than five letters), or of its start. Words under three letters
+// never match fuzzily.
+func fuzzyMatch(w, word string) bool {
+	n := len([]rune(w))
+	if n < 3 {
+		return false
+	}
+	maxDist := 1
+	if n > 5 {
+		maxDist = 2
+	}
+	if r := []rune(word); len(r) > n+maxDist {
+		word = string(r[:n]) // Typed the start of a longer word
+	}
+	return editDistance(w, word) <= maxDist
+}
+
+// editDistance is the Levenshtein distance between a and b.
+func editDistance(a, b string) int {
+	ra, rb := []rune(a), []rune(b)
+	prev := make([]int, len(rb)+1)
+	cur := make([]int, len(rb)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(ra); i++ {
+		cur[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(rb)]
+}
+
+// searchHit is a song in /api/search results with its score and section.
+type searchHit struct {
+	Song
+	Score   int    `json:"score"`
+	Section string `json:"section"`
+}
+
+type searchSection struct {
+	Name    string      `json:"name"` // uploads, liked, samples or a provider name
+	Title   string      `json:"title"`
+	Total   int         `json:"total"`
+	Results []searchHit `json:"results"`
+}
+
+// sourceResult is one provider's part of a /api/search response.
+type sourceResult struct {
+	Count       int         `json:"count"` // Results on this page, before filtering
+	Total       int         `json:"total"`
+	Stale       bool        `json:"stale,omitempty"`
+	Error       string      `json:"error,omitempty"`
+	Attribution Attribution `json:"attribution"`
+}
+
+type searchResponse struct {
+	Results  []searchHit              `json:"results"` // Every section's results, best first
+	Sections []searchSection          `json:"sections"`
+	Sources  map[string]*sourceResult `json:"sources"` // Providers only
+	Offset   int                      `json:"offset"`
+	Limit    int                      `json:"limit"`
+}
+
+// parseSearchRequest reads the /api/search parameters: query (see
+// searchQuery), tags (comma-separated) and genre, sources (a
+// comma-separated source: list), and offset and limit, which apply to each
+// section.
+func parseSearchRequest(params url.Values) (q searchQuery, offset, limit int, err error) {
+	if q, err = parseSearchQuery(params.Get("query")); err != nil {
+		return q, 0, 0, err
+	}
+	for _, tag := range append(strings.Split(params.Get("tags"), ","), params.Get("genre")) {
+		if tag = strings.TrimSpace(tag); tag != "" {
+			q.Tags = append(q.Tags, tag)
+		}
+	}
+	if err = q.addSources(params.Get("sources")); err != nil {
+		return q, 0, 0, err
+	}
+	if q.empty() {
+		return q, 0, 0, errors.New("a query is required")
+	}
+	limit = defaultSearchPageSize
+	for field, dst := range map[string]*int{"offset": &offset, "limit": &limit} {
+		if v := params.Get(field); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 0 {
+				return q, 0, 0, fmt.Errorf("%s must be a non-negative whole number", field)
+			}
+			*dst = n
+		}
+	}
+	if limit < 1 || limit > maxSearchPageSize {
+		return q, 0, 0, fmt.Errorf("limit must be between 1 and %d", maxSearchPageSize)
+	}
+	return q, offset, limit, nil
+}
+
+// localSection returns the section one of the user's songs belongs in.
+func localSection(s Song) string {
+	switch {
+	case s.IsUploaded:
+		return sectionUploads
+	case s.IsLiked:
+		return sectionLiked
+	default:
+		return sectionSamples
+	}
+}
+
+// rankHits sorts hits best first, keeping the given order for equal scores.
+func rankHits(hits []searchHit) {
+	sort.SliceStable(hits, func(i, j int) bool { return hits[i].Score > hits[j].Score })
+}
+
+// pageHits returns hits[offset:offset+limit], clamped.
+func pageHits(hits []searchHit, offset, limit int) []searchHit {
+	if offset >= len(hits) {
+		return []searchHit{}
+	}
+	return hits[offset:min(len(hits), offset+limit)]
+}
+
+// SearchHandler serves GET /api/search. It searches the user's uploads,
+// liked songs and the samples (for guests, just the samples) and every
+// provider at once, ranks every result by relevance and answers them both
+// merged, best first, and grouped into sections. A failing provider is
+// reported under sources without failing the search.
+func SearchHandler(w http.ResponseWriter, r *http.Request) { // Protected by TryAuthMiddleware
+	if r.Method != http.MethodGet {
+		writeJSONError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	q, offset, limit, err := parseSearchRequest(r.URL.Query())
+	if err != nil {
+		writeJSONError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var userID *int
+	if claims := GetClaimsFromContext(r); claims != nil {
+		userID = &claims.UserID
+	}
+
+	var selected []Provider
+	pq := q.providerQuery(offset, limit)
+	for _, p := range providers() {
+		// Providers need something to search for.
+		if q.wants(p.Name()) && (pq.Text != "" || len(pq.Tags) > 0) {
+			selected = append(selected, p)
+		}
+	}
+	searchLocal := false
+	for _, section := range localSections {
+		searchLocal = searchLocal || q.wants(section)
+	}
+
+	var wg sync.WaitGroup
+	var local []Song
+	var localErr error
+	if searchLocal {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			local, localErr = store.GetSongsForUser(userID)
+		}()
+	}
+	pages := make([]*SearchPage, len(selected))
+	errs := make([]error, len(selected))
+	for i, p := range selected {
+		wg.Add(1)
+		go func(i int, p Provider) {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(r.Context(), providerSearchTimeout)
+			defer cancel()
+			pages[i], errs[i] = p.Search(ctx, pq)
+		}(i, p)
+	}
+	wg.Wait()
+	if localErr != nil {
+		log.Error().Err(localErr).Msg("Error fetching songs to search")
+		writeJSONError(w, "Search failed", http.StatusInternalServerError)
+		return
+	}
+
+	resp := searchResponse{Results: []searchHit{}, Sections: []searchSection{}, Sources: map[string]*sourceResult{}, Offset: offset, Limit: limit}
+	addSection := func(name, title string, hits []searchHit, total int) {
+		rankHits(hits)
+		if total < 0 {
+			total, hits = len(hits), pageHits(hits, offset, limit)
+		}
+		if len(hits) > 0 {
+			resp.Sections = append(resp.Sections, searchSection{Name: name, Title: title, Total: total, Results: hits})
+			resp.Results = append(resp.Results, hits...)
+		}
+	}
+
+	text := q.scoringText()
+	found := map[string]bool{} // Local songs matched, left out of provider sections
+	bySection := map[string][]searchHit{}
+	for _, s := range local {
+		section := localSection(s)
+		if !q.wants(section) || !q.matches(s) {
+			continue
+		}
+		score := relevance(s, text)
+		if score == 0 {
+			continue
+		}
+		switch section {
+		case sectionUploads:
+			score += boostUpload
+		case sectionLiked:
+			score += boostLiked
+		}
+		found[s.ID] = true
+		bySection[section] = append(bySection[section], searchHit{Song: s, Score: score, Section: section})
+	}
+	for _, section := range localSections {
+		addSection(section, sectionTitles[section], bySection[section], -1)
+	}
+
+	failed := 0
+	for i, p := range selected {
+		result := &sourceResult{Attribution: p.Attribution()}
+		resp.Sources[p.Name()] = result
+		if errs[i] != nil {
+			failed++
+			result.Error = providerErrorMessage(errs[i])
+			log.Error().Err(errs[i]).Str("source", p.Name()).Str("query", pq.Text).Msg("Provider search failed")
+			continue
+		}
+		page := pages[i]
+		result.Count, result.Total, result.Stale = len(page.Songs), page.Total, page.Stale
+		var hits []searchHit
+		for _, s := range page.Songs {
+			if found[s.ID] || !q.matches(s) {
+				continue
+			}
+			found[s.ID] = true
+			hits = append(hits, searchHit{Song: s, Score: max(relevance(s, text), scoreProviderMatch), Section: p.Name()})
+		}
+		addSection(p.Name(), p.Attribution().Name, hits, page.Total)
+	}
+	if len(selected) > 0 && failed == len(selected) && !searchLocal {
+		writeJSONError(w, "Search failed on every source", http.StatusBadGateway)
+		return
+	}
+	rankHits(resp.Results)
+	log.Info().Str("query", r.URL.Query().Get("query")).Int("count", len(resp.Results)).Int("sections", len(resp.Sections)).Msg("Search ranked")
+	writeJSONResponse(w, resp, http.StatusOK)
+}
+
+// Type-ahead suggestion limits.
+const (
+	defaultSuggestLimit = 8
+	maxSuggestLimit     = 20
+)
+
+// suggestion is one /api/suggest completion. Query is what to search for
+// to find it: the title itself, or an artist: or album: term.
+type suggestion struct {
+	Text  string `json:"text"`
+	Kind  string `json:"kind"` // title, artist or album
+	Query string `json:"query"`
+	rank  int
+}
+
+// SuggestHandler serves GET /api/suggest?q=&limit=: titles, artists and
+// albums starting with q (or with a word starting with it) among the
+// user's songs, the samples and the local library. It makes no provider
+// calls, so it is cheap enough for every keystroke. A q of artist:, album:
+// or title: followed by a prefix suggests only that kind.
+func SuggestHandler(w http.ResponseWriter, r *http.Request) { // Protected by TryAuthMiddleware
+	if r.Method != http.MethodGet {
+		writeJSONError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	limit := defaultSuggestLimit
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxSuggestLimit {
+			writeJSONError(w, fmt.Sprintf("limit must be between 1 and %d", maxSuggestLimit), http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+	prefix, kind := strings.TrimLeft(r.URL.Query().Get("q"), " "), ""
+	if field, value, ok := strings.Cut(prefix, ":"); ok && (field == "artist" || field == "album" || field == "title") {
+		prefix, kind = strings.TrimPrefix(value, `"`), field
+	}
+	prefix = normalizeText(prefix)
+	resp := struct {
+		Suggestions []suggestion `json:"suggestions"`
+	}{Suggestions: []suggestion{}}
+	if prefix == "" {
+		writeJSONResponse(w, resp, http.StatusOK)
+		return
+	}
+
+	var userID *int
+	if claims := GetClaimsFromContext(r); claims != nil {
+		userID = &claims.UserID
+	}
+	songs, err := store.GetSongsForUser(userID)
+	if err != nil {
+		log.Error().Err(err).Msg("Error fetching songs for suggestions")
+		writeJSONError(w, "Failed to fetch suggestions", http.StatusInternalServerError)
+		return
+	}
+	if library != nil {
+		for _, t := range library.index() {
+			songs = append(songs, t.song)
+		}
+	}
+
+	seen := map[string]bool{}
+	var found []suggestion
+	for _, s := range songs {
+		for _, c := range []suggestion{{Text: s.Title, Kind: "title"}, {Text: s.Artist, Kind: "artist"}, {Text: s.Album, Kind: "album"}} {
+			text := normalizeText(c.Text)
+			if text == "" || (kind != "" && c.Kind != kind) || seen[c.Kind+"\n"+text] {
+				continue
+			}
+			switch {
+			case strings.HasPrefix(text, prefix):
+				c.rank = 0
+			case strings.Contains(" "+text, " "+prefix):
+				c.rank = 1
+			default:
+				continue
+			}
+			seen[c.Kind+"\n"+text] = true
+			c.Query = c.Text
+			if c.Kind != "title" {
+				c.Query = c.Kind + `:"` + c.Text + `"`
+			}
+			found = append(found, c)
+		}
+	}
+	kinds := map[string]int{"title": 0, "artist": 1, "album": 2}
+	sort.Slice(found, func(i, j int) bool {
+		a, b := found[i], found[j]
+		if a.rank != b.rank {
+			return a.rank < b.rank
+		}
+		if len(a.Text) != len(b.Text) {
+			return len(a.Text) < len(b.Text)
+		}
+		if a.Kind != b.Kind {
+			return kinds[a.Kind] < kinds[b.Kind]
+		}
+		return a.Text < b.Text
+	})
+	if len(found) > limit {
+		found = found[:limit]
+	}
+	resp.Suggestions = append(resp.Suggestions, found...)
+	writeJSONResponse(w, resp, http.StatusOK)
+}
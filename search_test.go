@@ -0,0 +1,217 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"testing"
+)
+
+func TestParseSearchQuery(t *testing.T) {
+	tests := []struct {
+		in   string
+		want searchQuery
+		err  bool
+	}{
+		{in: "harbour lights", want: searchQuery{Text: "harbour lights"}},
+		{in: `artist:"the tidewaters" low tide`, want: searchQuery{Text: "low tide", Artist: "the tidewaters"}},
+		{in: `album:coast TITLE:"Low" genre:jazz genre:"acid jazz"`, want: searchQuery{Album: "coast", Title: "Low", Tags: []string{"jazz", "acid jazz"}}},
+		{in: "year:2019", want: searchQuery{YearMin: 2019, YearMax: 2019}},
+		{in: "year:>2010", want: searchQuery{YearMin: 2011}},
+		{in: "year:>=2010 year:<2020", want: searchQuery{YearMin: 2010, YearMax: 2019}},
+		{in: "year:2010..2015", want: searchQuery{YearMin: 2010, YearMax: 2015}},
+		{in: "source:upload,liked source:jamendo source:uploads", want: searchQuery{Sources: []string{"uploads", "liked", "jamendo"}}},
+		{in: `re:zero "exact phrase" "unclosed`, want: searchQuery{Text: "re:zero exact phrase unclosed"}},
+		{in: "artist: tide", want: searchQuery{Text: "tide"}},
+		{in: "year:recent", err: true},
+		{in: "year:2015..2010", err: true},
+		{in: "source:spotify", err: true},
+	}
+	for _, tt := range tests {
+		got, err := parseSearchQuery(tt.in)
+		if tt.err {
+			if err == nil {
+				t.Errorf("%q: no error", tt.in)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%q = %+v, %v; want %+v", tt.in, got, err, tt.want)
+		}
+	}
+}
+
+func TestRelevance(t *testing.T) {
+	song := Song{Title: "Harbour Lights", Artist: "The Tidewaters", Album: "Coastline"}
+	tests := []struct {
+		query string
+		want  int
+	}{
+		{"harbour  LIGHTS", scoreExactTitle},
+		{"the tidewaters", scoreExactArtist},
+		{"harb", scoreTitlePrefix},
+		{"the tide", scoreArtistPrefix},
+		{"coastline", scoreExactAlbum},
+		{"lights tide", scoreWordPrefix},
+		{"bour", scoreContains},
+		{"harbor lihgts", scoreFuzzy},
+		{"tidewatr", scoreFuzzy},
+		{"harbour sunset", 0},
+		{"hx", 0},
+		{"", scoreFilterOnly},
+	}
+	for _, tt := range tests {
+		if got := relevance(song, tt.query); got != tt.want {
+			t.Errorf("relevance(%q) = %d, want %d", tt.query, got, tt.want)
+		}
+	}
+}
+
+// searchIDs returns the IDs of hits in order.
+func searchIDs(hits []searchHit) []string {
+	ids := []string{}
+	for _, h := range hits {
+		ids = append(ids, h.ID)
+	}
+	return ids
+}
+
+// sectionIDs returns each section's result IDs by section name.
+func sectionIDs(res searchResponse) map[string][]string {
+	sections := map[string][]string{}
+	for _, s := range res.Sections {
+		sections[s.Name] = searchIDs(s.Results)
+	}
+	return sections
+}
+
+func TestFederatedSearch(t *testing.T) {
+	forEachStore(t, func(t *testing.T, srv *httptest.Server) {
+		jamendoAPI := newJamendoFixtures(t, map[string]string{"tracks": "tracks.json"})
+		archiveAPI := newArchiveFixtures(t)
+		newTestLibrary(t, map[string][]byte{"Tag Artist/03 Harbour.mp3": testMP3("Harbour Lights")})
+		c := newTestClient(t, srv)
+		search := func(query string) (searchResponse, int) {
+			var res searchResponse
+			code := c.do("GET", "/api/search?"+query, nil, &res)
+			return res, code
+		}
+
+		// Guests search the samples and the providers.
+		res, code := search("query=creative")
+		if code != http.StatusOK || res.Sections[0].Name != "samples" || len(res.Sections) != 3 || res.Results[0].ID != "sample-1" {
+			t.Fatalf("guest search: status %d, %+v", code, sectionIDs(res))
+		}
+
+		c.registerAndLogin("finn")
+		upload, _ := c.upload("Harbour Lights")
+		c.upload("Unrelated")
+		res, code = search("query=harbour")
+		if code != http.StatusOK {
+			t.Fatalf("status %d", code)
+		}
+		want := map[string][]string{
+			"uploads": {upload.ID},
+			"jamendo": {"jamendo-1712430", "jamendo-1886257"},
+			"archive": {"archive-harbour-sessions-2019", "archive-78_blue-skies_test-orchestra", "archive-untitled-field-recording"},
+			"library": {"library-Tag Artist/03 Harbour.mp3"},
+		}
+		if got := sectionIDs(res); !reflect.DeepEqual(got, want) {
+			t.Errorf("sections = %v, want %v", got, want)
+		}
+		// Title prefixes first, the user's own upload ahead of the catalog.
+		wantOrder := []string{upload.ID, "jamendo-1712430", "archive-harbour-sessions-2019", "library-Tag Artist/03 Harbour.mp3"}
+		if got := searchIDs(res.Results)[:4]; !reflect.DeepEqual(got, wantOrder) {
+			t.Errorf("ranking = %v, want %v", got, wantOrder)
+		}
+		if h := res.Results[0]; h.Score != scoreTitlePrefix+boostUpload || h.Section != "uploads" || res.Results[len(res.Results)-1].Score != scoreProviderMatch {
+			t.Errorf("scores: first %+v, last %d", h, res.Results[len(res.Results)-1].Score)
+		}
+		if j := res.Sources["jamendo"]; j == nil || j.Total != 7 || j.Attribution.Name != "Jamendo" || len(res.Sources) != 3 {
+			t.Errorf("sources = %+v", res.Sources)
+		}
+
+		// A liked catalog track moves from its provider's section to liked.
+		like := LikeRequest{SongID: "jamendo-1712430", JamendoID: "1712430", Title: "Harbour Lights", Artist: "The Tidewaters"}
+		if code := c.do("POST", "/api/songs/like", like, nil); code != http.StatusOK {
+			t.Fatalf("like: status %d", code)
+		}
+		res, _ = search("query=harbour")
+		if got := sectionIDs(res); !reflect.DeepEqual(got["liked"], []string{"jamendo-1712430"}) || !reflect.DeepEqual(got["jamendo"], []string{"jamendo-1886257"}) {
+			t.Errorf("after liking: %v", got)
+		}
+
+		// Field terms filter; source: limits the sections and skips providers.
+		calls := jamendoAPI.calls()
+		res, _ = search("query=" + url.QueryEscape(`artist:"tag artist" year:>2018 source:upload`))
+		if got := sectionIDs(res); len(got) != 1 || len(got["uploads"]) != 2 || len(res.Sources) != 0 || jamendoAPI.calls() != calls {
+			t.Errorf("filtered search: %v, sources %v", got, res.Sources)
+		}
+		if res, _ = search("query=" + url.QueryEscape("year:<2000 source:uploads")); len(res.Results) != 0 {
+			t.Errorf("year filter kept %v", searchIDs(res.Results))
+		}
+		res, _ = search("query=lights&sources=archive,library")
+		if got := sectionIDs(res); len(got) != 2 || got["library"] == nil || got["archive"] == nil {
+			t.Errorf("sources parameter: %v", got)
+		}
+
+		// A failing provider is reported; the rest still answer.
+		archiveAPI.fail(http.StatusInternalServerError)
+		res, code = search("query=harbour")
+		if code != http.StatusOK || res.Sources["archive"].Error != "request failed" || sectionIDs(res)["uploads"] == nil {
+			t.Errorf("archive failing: status %d, %+v", code, res.Sources["archive"])
+		}
+		if _, code := search("query=harbour+source:archive"); code != http.StatusBadGateway {
+			t.Errorf("only source failing: status %d", code)
+		}
+
+		for _, query := range []string{"", "query=+", "query=year:soon", "query=a&sources=spotify", "query=a&limit=0", "query=a&limit=51"} {
+			if _, code := search(query); code != http.StatusBadRequest {
+				t.Errorf("%q: status %d, want 400", query, code)
+			}
+		}
+	})
+}
+
+func TestSuggest(t *testing.T) {
+	forEachStore(t, func(t *testing.T, srv *httptest.Server) {
+		newTestLibrary(t, map[string][]byte{"lib.mp3": testMP3("Harbour Nights")})
+		c := newTestClient(t, srv)
+		suggest := func(q string) []suggestion {
+			var res struct {
+				Suggestions []suggestion `json:"suggestions"`
+			}
+			if code := c.do("GET", "/api/suggest?q="+url.QueryEscape(q), nil, &res); code != http.StatusOK {
+				t.Fatalf("suggest %q: status %d", q, code)
+			}
+			return res.Suggestions
+		}
+
+		// Guests get the samples and the library.
+		if got := suggest("min"); len(got) != 1 || got[0].Text != "Creative Minds" || got[0].Kind != "title" {
+			t.Errorf("guest suggestions = %+v", got)
+		}
+
+		c.registerAndLogin("gwen")
+		c.upload("Harbour Lights")
+		got := suggest("HAR")
+		if len(got) != 2 || got[0].Text != "Harbour Lights" || got[1].Text != "Harbour Nights" {
+			t.Errorf("suggestions = %+v", got)
+		}
+		got = suggest(`artist:"tag`)
+		if len(got) != 1 || got[0].Kind != "artist" || got[0].Query != `artist:"Tag Artist"` {
+			t.Errorf("artist suggestions = %+v", got)
+		}
+		// Whole-string prefixes come before word prefixes.
+		if got := suggest("tag"); len(got) != 2 || got[0].Text != "Tag Album" && got[0].Text != "Tag Artist" {
+			t.Errorf("tag suggestions = %+v", got)
+		}
+		if got := suggest(" "); len(got) != 0 {
+			t.Errorf("empty prefix suggested %+v", got)
+		}
+		if code := c.do("GET", "/api/suggest?q=a&limit=21", nil, nil); code != http.StatusBadRequest {
+			t.Errorf("limit 21: status %d", code)
+		}
+	})
+}
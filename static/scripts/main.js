@@ -62,6 +62,7 @@ document.addEventListener('DOMContentLoaded', () => {
     let repeatMode = 0; // 0: none, 1: one, 2: all
     let currentView = 'internal'; // 'internal', 'search', 'liked'
     let likedSongIds = new Set(); // Store IDs of liked songs for quick lookup
+    let offlineSongIds = new Set(); // Jamendo songs the user has saved on the server
 
     const DEFAULT_COVER = '/static/images/default-cover.jpg';
 
@@ -204,6 +205,16 @@ document.addEventListener('DOMContentLoaded', () => {
                 if (song.isLiked) likedSongIds.add(String(song.id));
             });
 
+            offlineSongIds.clear();
+            if (currentUser) {
+                try {
+                    const saves = await fetchAPI('/api/offline');
+                    (saves || []).forEach(t => { if (t.status === 'done') offlineSongIds.add(String(t.songId)); });
+                } catch (error) {
+                    console.warn("PLAYER: Could not fetch offline saves:", error);
+                }
+            }
+
             // Determine what to display (preserve view or default)
             const viewToRefresh = currentView || 'internal';
             switchToView(viewToRefresh, -1, true); // -1 to not auto-select, true to force playlist update
@@ -255,6 +266,25 @@ document.addEventListener('DOMContentLoaded', () => {
         }
     }
 
+    // Song fields the API needs to store a track it hasn't seen yet (e.g. a Jamendo result)
+    function songRequestBody(songData) {
+        return {
+            songId: songData.id, // Backend uses this to find/update DB record
+            title: songData.title, artist: songData.artist, album: songData.album,
+            filePath: songData.filePath, coverPath: songData.coverPath, duration: songData.duration,
+            isLocal: songData.isLocal, jamendoId: songData.jamendoId || (songData.id.startsWith('jamendo-') ? songData.id.substring(8) : null)
+        };
+    }
+
+    // --- Listening History ---
+    let currentPlay = null; // { song, startedAt } for the track playing now; reported when it ends or is skipped
+    function reportPlay(completed) {
+        const play = currentPlay; currentPlay = null;
+        if (!play || !currentUser || !audioPlayer || play.song.objectURL) return;
+        const body = { ...songRequestBody(play.song), startedAt: play.startedAt.toISOString(), msListened: Math.round((audioPlayer.currentTime || 0) * 1000), completed, skipped: !completed };
+        fetchAPI('/api/plays', { method: 'POST', headers: { 'Content-Type': 'application/json' }, body: JSON.stringify(body) }).catch(() => { /* history is best-effort */ });
+    }
+
     function loadTrack(playlistSource, index, playWhenLoaded = true) {
         // ... (mostly same logic as your original) ...
         // Ensure playlistSource is valid and index is in bounds
@@ -270,6 +300,7 @@ document.addEventListener('DOMContentLoaded', () => {
             }
         }
         if (!audioPlayer) return;
+        if (currentPlay) reportPlay(false); // Switching tracks before the end counts as a skip
         if (!audioPlayer.paused) audioPlayer.pause();
 
         currentTrackIndex = index; // Relative to playlistSource (which should be displayedPlaylist)
@@ -288,6 +319,7 @@ document.addEventListener('DOMContentLoaded', () => {
                 audioPlayer.src = newSrc; audioPlayer.load();
             }
             if (playWhenLoaded) {
+                currentPlay = { song: trackToLoad, startedAt: new Date() };
                 const playPromise = audioPlayer.play();
                 if (playPromise !== undefined) {
                     playPromise.then(() => { isPlaying = true; }).catch(e => { console.error("Play() error:", e); isPlaying = false; alert(`Could not play ${trackToLoad.title}: ${e.message}`); }).finally(updatePlayPauseButtonVisualState);
@@ -393,8 +425,16 @@ document.addEventListener('DOMContentLoaded', () => {
                 // If not liked, it shouldn't be in 'liked' view. If in 'internal' and not liked (e.g. from search, then view switch),
                 // a generic remove from current view might be an option, but complicates state.
                 // Let's assume liked songs are the main way non-local/non-uploaded songs persist in user's "internal" view from server.
+                if (currentUser && String(song.id).startsWith('jamendo-')) {
+                    const saved = offlineSongIds.has(song.id);
+                    actionButtonsHTML += `<button class="action-btn save-offline-btn${saved ? ' active' : ''}" data-id="${song.id}" title="${saved ? 'Saved offline' : 'Save Offline'}"><i class="fa-solid fa-download"></i></button>`;
+                }
             }
 
+            // Licensed tracks are only shared along with the credit their license asks for.
+            if (song.attribution) {
+                actionButtonsHTML += `<button class="action-btn share-track-btn" data-id="${song.id}" title="Share with credit"><i class="fa-solid fa-share-nodes"></i></button>`;
+            }
 
             actionButtonsHTML += `<button class="action-btn like-track-btn" data-id="${song.id}" title="${likeBtnTitle}"><i class="${likeIconClass}"></i></button>`;
 
@@ -403,7 +443,7 @@ document.addEventListener('DOMContentLoaded', () => {
                 <div class="track-number"><span>${index + 1}</span><i class="fa-solid fa-play"></i></div>
                 <div class="track-info">
                     <img src="${song.coverPath || DEFAULT_COVER}" alt="${song.title}" class="track-item-cover" onerror="this.src='${DEFAULT_COVER}';">
-                    <div class="track-details"><div class="track-title">${song.title}</div><div class="track-artist">${song.artist}</div></div>
+                    <div class="track-details"><div class="track-title"${song.attribution ? ` title="${song.attribution.replace(/"/g, '&quot;')}"` : ''}>${song.title}</div><div class="track-artist">${song.artist}</div></div>
                 </div>
                 <div class="track-artist-main">${song.artist || '---'}</div>
                 <div class="track-album">${song.album || (song.isUploaded ? 'My Uploads' : (song.isLocal ? 'Samples' : 'Jamendo'))}</div>
@@ -418,6 +458,10 @@ document.addEventListener('DOMContentLoaded', () => {
                         toggleLikeSong(song.id);
                     } else if (targetButton.classList.contains('delete-uploaded-track-btn')) {
                         handleDeleteUploadedSong(song.id, song.title);
+                    } else if (targetButton.classList.contains('save-offline-btn')) {
+                        saveOffline(song, targetButton);
+                    } else if (targetButton.classList.contains('share-track-btn')) {
+                        shareSong(song);
                     }
                     // Add other action button handlers if any
                 } else {
@@ -439,13 +483,7 @@ document.addEventListener('DOMContentLoaded', () => {
 
         const wasLiked = likedSongIds.has(String(songIdToToggle));
         const endpoint = wasLiked ? '/api/songs/unlike' : '/api/songs/like';
-        const body = {
-            songId: songData.id, // Backend uses this to find/update DB record
-            // For 'like', backend needs full song info if it's a new Jamendo song
-            title: songData.title, artist: songData.artist, album: songData.album,
-            filePath: songData.filePath, coverPath: songData.coverPath, duration: songData.duration,
-            isLocal: songData.isLocal, jamendoId: songData.jamendoId || (songData.id.startsWith('jamendo-') ? songData.id.substring(8) : null)
-        };
+        const body = songRequestBody(songData);
 
         try {
             const result = await fetchAPI(endpoint, { method: 'POST', headers: { 'Content-Type': 'application/json' }, body: JSON.stringify(body) });
@@ -469,6 +507,34 @@ document.addEventListener('DOMContentLoaded', () => {
         }
     }
 
+    // Asks the server to keep its own copy of a Jamendo track. The song's
+    // stream serves the copy once the download finishes.
+    async function saveOffline(song, button) {
+        try {
+            const saved = await fetchAPI('/api/offline', { method: 'POST', headers: { 'Content-Type': 'application/json' }, body: JSON.stringify({ songId: song.id }) });
+            button.classList.add('active');
+            button.title = saved.status === 'done' ? 'Saved offline' : 'Downloading for offline playback';
+            if (saved.status === 'done') fetchInitialPlaylist();
+        } catch (error) {
+            alert(`Failed to save offline: ${error.message}`);
+        }
+    }
+
+    // Shares a licensed track as its attribution line, which names the
+    // track, artist, source and license.
+    async function shareSong(song) {
+        try {
+            if (navigator.share) {
+                await navigator.share({ title: song.title, text: song.attribution });
+            } else {
+                await navigator.clipboard.writeText(song.attribution);
+                alert('Copied the track and its credit to the clipboard.');
+            }
+        } catch (error) {
+            if (error.name !== 'AbortError') alert(`Failed to share: ${error.message}`);
+        }
+    }
+
     function getLikedSongsPlaylist() { return currentInternalPlaylist.filter(song => likedSongIds.has(String(song.id))); }
 
     async function handleFileUpload(files) {
@@ -583,26 +649,61 @@ document.addEventListener('DOMContentLoaded', () => {
     }
 
 
-    // --- Jamendo Search (Adapted) ---
+    // --- Search (Jamendo, Internet Archive and the local library) ---
     async function searchJamendo(query) {
         query = query.trim();
         if (!query) { switchToView('internal', 0, true); return; } // Revert to internal on empty query
-        console.log(`SEARCH: Jamendo for: "${query}"`);
-        if(mainPlaylistTitleElement) mainPlaylistTitleElement.textContent = `Searching Jamendo for "${query}"...`;
+        console.log(`SEARCH: All sources for: "${query}"`);
+        if(mainPlaylistTitleElement) mainPlaylistTitleElement.textContent = `Searching for "${query}"...`;
         if(mainContentPlaylistTracksElement) mainContentPlaylistTracksElement.innerHTML = '<p class="empty-playlist-message">Searching...</p>';
         try {
-            const searchResults = await fetchAPI(`/api/jamendo/search?query=${encodeURIComponent(query)}`);
-            console.log("SEARCH: Received Jamendo results:", searchResults);
-            displayedPlaylist = (searchResults || []).map(s => ({ ...s, id: String(s.id), isLocal: false })); // Ensure ID is string
+            const searchResults = await fetchAPI(`/api/search?query=${encodeURIComponent(query)}`);
+            console.log("SEARCH: Received results:", searchResults);
+            displayedPlaylist = (searchResults?.results || []).map(s => ({ ...s, id: String(s.id) })); // Ensure ID is string
             switchToView('search', -1, true); // Display search results, don't auto-select
-            if (displayedPlaylist.length === 0 && mainContentPlaylistTracksElement) mainContentPlaylistTracksElement.innerHTML = `<p class="empty-playlist-message">No Jamendo results for "${query}".</p>`;
+            if (displayedPlaylist.length === 0 && mainContentPlaylistTracksElement) mainContentPlaylistTracksElement.innerHTML = `<p class="empty-playlist-message">No results for "${query}".</p>`;
         } catch (error) {
             console.error("SEARCH: Failed:", error);
             if(mainPlaylistTitleElement) mainPlaylistTitleElement.textContent = `Search Failed`;
-            if(mainContentPlaylistTracksElement) mainContentPlaylistTracksElement.innerHTML = `<p class="empty-playlist-message" style="color:red;">Jamendo search failed: ${error.message}</p>`;
+            if(mainContentPlaylistTracksElement) mainContentPlaylistTracksElement.innerHTML = `<p class="empty-playlist-message" style="color:red;">Search failed: ${error.message}</p>`;
         }
     }
 
+    // --- Explore (Jamendo charts, featured and genre top lists) ---
+    let exploreFeeds = [];
+    function showExploreFeed(feed) {
+        if (!feed) return;
+        displayedPlaylist = feed.tracks.map(s => ({ ...s, id: String(s.id) }));
+        switchToView('search', -1, true);
+        if (mainPlaylistTitleElement) mainPlaylistTitleElement.textContent = feed.title;
+    }
+    async function loadExplore(showFirst) {
+        const container = document.getElementById('exploreFeeds');
+        try {
+            if (exploreFeeds.length === 0) exploreFeeds = (await fetchAPI('/api/explore'))?.feeds || [];
+            if (container) {
+                container.innerHTML = '';
+                exploreFeeds.forEach(feed => { const btn = document.createElement('button'); btn.className = 'explore-feed-btn'; btn.textContent = feed.title; btn.addEventListener('click', () => showExploreFeed(feed)); container.appendChild(btn); });
+            }
+            if (showFirst) showExploreFeed(exploreFeeds[0]);
+        } catch (error) { console.warn("EXPLORE: Failed:", error); }
+    }
+
+    // Type-ahead: fill the search box's datalist from /api/suggest as the user types.
+    let suggestTimer = null;
+    function suggestSearches(prefix) {
+        clearTimeout(suggestTimer);
+        const list = document.getElementById('searchSuggestions');
+        if (!list || !prefix.trim()) { if (list) list.innerHTML = ''; return; }
+        suggestTimer = setTimeout(async () => {
+            try {
+                const res = await fetchAPI(`/api/suggest?q=${encodeURIComponent(prefix)}`);
+                list.innerHTML = '';
+                (res?.suggestions || []).forEach(sg => { const opt = document.createElement('option'); opt.value = sg.query; opt.label = `${sg.text} (${sg.kind})`; list.appendChild(opt); });
+            } catch (error) { console.warn("SUGGEST: Failed:", error); }
+        }, 150);
+    }
+
     // --- Attaching Event Listeners (Auth, Player, Upload, Search, Nav) ---
     console.log("--- Attaching Event Listeners ---");
     // Auth Modals & Header
@@ -633,7 +734,7 @@ document.addEventListener('DOMContentLoaded', () => {
         audioPlayer.addEventListener('timeupdate', updateProgressBarOnTimeUpdate);
         audioPlayer.addEventListener('play', () => { isPlaying = true; updatePlayPauseButtonVisualState(); });
         audioPlayer.addEventListener('pause', () => { isPlaying = false; updatePlayPauseButtonVisualState(); });
-        audioPlayer.addEventListener('ended', () => { console.log("PLAYER: Ended. Repeat:"+repeatMode); isPlaying = false; updatePlayPauseButtonVisualState(); if(repeatMode===1)loadTrack(displayedPlaylist,currentTrackIndex,true); else if(repeatMode===2 || isShuffleActive || currentTrackIndex<displayedPlaylist.length-1) playNextTrackLogic(); else console.log("PLAYER: End of playlist."); });
+        audioPlayer.addEventListener('ended', () => { console.log("PLAYER: Ended. Repeat:"+repeatMode); reportPlay(true); isPlaying = false; updatePlayPauseButtonVisualState(); if(repeatMode===1)loadTrack(displayedPlaylist,currentTrackIndex,true); else if(repeatMode===2 || isShuffleActive || currentTrackIndex<displayedPlaylist.length-1) playNextTrackLogic(); else console.log("PLAYER: End of playlist."); });
         audioPlayer.addEventListener('error', (e) => { console.error("Audio Player Error:", e, audioPlayer.error); alert(`Audio error: ${audioPlayer.error?.message || 'Unknown audio error'}. Check console.`); });
     } else console.error("CRITICAL: audioPlayer element not found!");
 
@@ -647,11 +748,15 @@ document.addEventListener('DOMContentLoaded', () => {
     if (jamendoSearchButton && jamendoSearchInput) {
         jamendoSearchButton.addEventListener('click', () => searchJamendo(jamendoSearchInput.value));
         jamendoSearchInput.addEventListener('keypress', (e) => { if (e.key === 'Enter') searchJamendo(jamendoSearchInput.value); });
+        jamendoSearchInput.addEventListener('input', () => suggestSearches(jamendoSearchInput.value));
     }
 
     // Sidebar Navigation
     if (homeNavItem) homeNavItem.closest('li').addEventListener('click', (e) => { e.preventDefault(); switchToView('internal'); });
     if (likedSongsNavItem) likedSongsNavItem.closest('li').addEventListener('click', (e) => { e.preventDefault(); if(currentUser) switchToView('liked'); else openLoginModal(); });
+    const exploreNavItem = document.getElementById('exploreNavItem');
+    if (exploreNavItem) exploreNavItem.addEventListener('click', (e) => { e.preventDefault(); loadExplore(true); });
+    loadExplore(false);
     // Add listeners for other nav items if they switch views (e.g., "Search", "Explore")
 
     // Keyboard shortcuts (your existing listener)
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"errors"
+	"time"
+)
+
+// errNotFound is returned (possibly wrapped) when a record does not exist or
+// is not visible to the requesting user.
+var errNotFound = errors.New("not found")
+
+// errOutOfRange is returned when a track position does not exist.
+var errOutOfRange = errors.New("position out of range")
+
+// errConflict is returned when a versioned write lost a race with another one.
+var errConflict = errors.New("modified concurrently")
+
+// errQuotaExceeded is returned when an upload would take a user past their
+// storage quota.
+var errQuotaExceeded = errors.New("storage quota exceeded")
+
+// Store is the persistence layer behind the HTTP handlers. sqlStore provides
+// the MySQL and SQLite implementations; DB_DRIVER picks one at startup.
+type Store interface {
+	CreateUser(username, password string) (*User, error)
+	GetUserByUsername(username string) (*User, error)
+
+	// GetSongsForUser returns the samples plus, for a logged-in user, their
+	// uploads and liked songs with IsLiked set. userID is nil for guests.
+	GetSongsForUser(userID *int) ([]Song, error)
+	// AddUploadedSong stores an upload owned by userID, assigning its ID and
+	// stream URL. s.StoragePath must point at the file under uploadsDir;
+	// when s.BlobSHA256 is set the blob's reference count goes up by one. The
+	// quota is checked in the same transaction, so concurrent uploads cannot
+	// overshoot it; errQuotaExceeded is returned when the song does not fit.
+	AddUploadedSong(userID int, s Song, quota StorageQuota) (Song, error)
+	// GetStorageUsage totals the user's uploads, overall and per MIME type.
+	GetStorageUsage(userID int) (*StorageUsage, error)
+	// EnsureSongExists inserts s into the songs table unless it is already
+	// there and returns the stored song ID. s.FilePath is ignored: the song
+	// is stored with its stream URL.
+	EnsureSongExists(s Song) (string, error)
+	// SetSongLicense replaces a song's license and attribution with those
+	// of s, as its provider reported them.
+	SetSongLicense(songID string, s Song) error
+
+	// GetSong returns a song stored in the songs table, or errNotFound.
+	GetSong(songID string) (*Song, error)
+
+	LikeSong(userID int, songID string) error
+	UnlikeSong(userID int, songID string) error
+	// DeleteUserUploadedSong removes the song's rows and returns the deleted
+	// song, so the caller can remove its files once the delete committed.
+	DeleteUserUploadedSong(userID int, songID string) (*Song, error)
+	// CoverInUse reports whether any song still shows coverPath.
+	CoverInUse(coverPath string) (bool, error)
+	// BlobInUse reports whether any song still references the blob.
+	BlobInUse(sha256 string) (bool, error)
+	// ListUploadedSongs returns every user's uploads, for reconciliation
+	// against the files in uploadsDir.
+	ListUploadedSongs() ([]Song, error)
+
+	// Loudness analysis. ListPendingLoudness returns uploads still waiting
+	// for it; SetSongLoudness stores the outcome (l is nil unless status is
+	// loudnessDone). ListAlbumUploads and SetAlbumGain let updateAlbumGain
+	// recompute the album gain of a user's album.
+	ListPendingLoudness() ([]Song, error)
+	SetSongLoudness(songID, status string, l *Loudness) error
+	ListAlbumUploads(userID int, album string) ([]Song, error)
+	SetAlbumGain(songID string, gainDB, peak float64) error
+
+	// Playlists are always scoped to their owner: a playlist belonging to
+	// someone else is reported as errNotFound.
+	CreatePlaylist(userID int, name string) (*Playlist, error)
+	ListPlaylists(userID int) ([]Playlist, error)
+	GetPlaylist(userID, playlistID int) (*Playlist, error)
+	RenamePlaylist(userID, playlistID int, name string) error
+	DeletePlaylist(userID, playlistID int) error
+	// AddPlaylistTrack inserts songID at position, or appends it when
+	// position is negative or past the end.
+	AddPlaylistTrack(userID, playlistID int, songID string, position int) error
+	RemovePlaylistTrack(userID, playlistID, position int) error
+	MovePlaylistTrack(userID, playlistID, from, to int) error
+
+	// GetQueue returns the user's play queue, empty if none was saved yet.
+	GetQueue(userID int) (*PlayQueue, error)
+	// SaveQueue replaces the stored queue if its version still equals
+	// q.Version, otherwise it returns errConflict. On success q.Version and
+	// q.UpdatedAt are updated.
+	SaveQueue(userID int, q *PlayQueue) error
+
+	// RecordPlay stores a play event and returns it with its ID set.
+	RecordPlay(userID int, ev PlayEvent) (*PlayEvent, error)
+	// ListPlays returns plays newest first, with Song filled in.
+	ListPlays(userID int, q HistoryQuery) ([]PlayEvent, error)
+	GetHistoryPaused(userID int) (bool, error)
+	SetHistoryPaused(userID int, paused bool) error
+
+	// Resumable upload sessions are scoped to their owner like playlists.
+	CreateUploadSession(userID int, length int64, metadata string, expiresAt time.Time) (*UploadSession, error)
+	GetUploadSession(userID int, sessionID string) (*UploadSession, error)
+	// ListUploadSessions returns the user's unfinished sessions, oldest first.
+	ListUploadSessions(userID int) ([]UploadSession, error)
+	// AdvanceUploadSession moves the offset from from to to and pushes the
+	// expiry out. It returns errConflict if the offset is no longer from.
+	AdvanceUploadSession(userID int, sessionID string, from, to int64, expiresAt time.Time) error
+	// CompleteUploadSession records the song an upload turned into.
+	CompleteUploadSession(userID int, sessionID, songID string, expiresAt time.Time) error
+	DeleteUploadSession(userID int, sessionID string) error
+	// DeleteExpiredUploadSessions removes and returns the sessions that
+	// expired before now, so their partial files can be deleted.
+	DeleteExpiredUploadSessions(now time.Time) ([]UploadSession, error)
+
+	// Offline copies of Jamendo tracks, one per Jamendo ID, shared by the
+	// users who saved them. AddOfflineTrack stores t as queued unless the
+	// track is already known (requeueing it if it failed) and records that
+	// the user saved it. UpdateOfflineTrack writes the download's progress.
+	// RemoveOfflineTrack forgets the user's save and, when nobody else saved
+	// the track, deletes it and returns it so the caller can remove the file.
+	AddOfflineTrack(userID int, t OfflineTrack) (*OfflineTrack, error)
+	GetOfflineTrack(jamendoID string) (*OfflineTrack, error)
+	// ListOfflineTracks returns the user's saved tracks, newest save first.
+	ListOfflineTracks(userID int) ([]OfflineTrack, error)
+	// ListPendingOfflineTracks returns the queued and interrupted downloads,
+	// oldest first.
+	ListPendingOfflineTracks() ([]OfflineTrack, error)
+	// ListAllOfflineTracks returns every offline track whatever its status,
+	// for reconciliation against the files in uploadsDir.
+	ListAllOfflineTracks() ([]OfflineTrack, error)
+	UpdateOfflineTrack(t OfflineTrack) error
+	RemoveOfflineTrack(userID int, jamendoID string) (*OfflineTrack, error)
+}
+
+var store Store
+
+// Initial sample songs (could also be loaded from DB if pre-populated)
+var initialSampleSongs = []Song{
+	{ID: "sample-1", Title: "Creative Minds", Artist: "Bensound", Album: "Royalty Free", FilePath: "/assets/audio/sample1.mp3", CoverPath: "/static/images/cover1.jpg", IsLocal: true, Duration: 146},
+	{ID: "sample-2", Title: "A New Beginning", Artist: "Bensound", Album: "Inspiring", FilePath: "/assets/audio/sample2.mp3", CoverPath: "/static/images/cover2.jpg", IsLocal: true, Duration: 150},
+}
+
+// buildSongList merges the samples, a user's uploads and their liked songs
+// into the single list served by /api/songs. Every Store implementation goes
+// through here so the merge rules stay identical across backends.
+func buildSongList(userID *int, uploads, liked []Song) []Song {
+	var finalPlaylist []Song
+
+	// 1. Add initial sample songs
+	finalPlaylist = append(finalPlaylist, initialSampleSongs...)
+	if userID == nil {
+		// Not logged in, only initial samples are marked as "not liked" by default
+		for i := range finalPlaylist {
+			finalPlaylist[i].IsLiked = false
+			finalPlaylist[i].FilePath = streamURL(finalPlaylist[i].ID)
+		}
+		return finalPlaylist
+	}
+
+	// 2. User's uploaded songs
+	finalPlaylist = append(finalPlaylist, uploads...)
+
+	// 3. Liked songs. A liked sample or upload is already in the list and
+	// only needs marking; liked external (e.g. Jamendo) songs are appended once.
+	likedSongIDs := make(map[string]bool)
+	for _, s := range liked {
+		likedSongIDs[s.ID] = true
+		isSample := false
+		for _, sample := range initialSampleSongs {
+			if sample.ID == s.ID {
+				isSample = true
+				break
+			}
+		}
+		if isSample || s.IsUploaded {
+			continue
+		}
+		found := false
+		for _, existingSong := range finalPlaylist {
+			if existingSong.ID == s.ID {
+				found = true
+				break
+			}
+		}
+		if !found {
+			finalPlaylist = append(finalPlaylist, s)
+		}
+	}
+
+	// Mark liked status for all songs in finalPlaylist. Everything plays
+	// through StreamHandler, never from a URL a client stored.
+	for i := range finalPlaylist {
+		if likedSongIDs[finalPlaylist[i].ID] {
+			finalPlaylist[i].IsLiked = true
+		}
+		if !finalPlaylist[i].IsUploaded {
+			finalPlaylist[i].FilePath = streamURL(finalPlaylist[i].ID)
+		}
+	}
+	return finalPlaylist
+}
+
+// moveIndex moves the element at from to index to, shifting the ones in
+// between. Both indexes must be in range.
+func moveIndex[T any](items []T, from, to int) []T {
+	item := items[from]
+	items = append(items[:from], items[from+1:]...)
+	items = append(items[:to], append([]T{item}, items[to:]...)...)
+	return items
+}
+
+// insertIndex inserts item at position, appending when position is negative
+// or past the end. It returns the new slice and the position actually used.
+func insertIndex[T any](items []T, item T, position int) ([]T, int) {
+	if position < 0 || position > len(items) {
+		position = len(items)
+	}
+	items = append(items[:position], append([]T{item}, items[position:]...)...)
+	return items, position
+}
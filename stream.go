@@ -0,0 +1,176 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// streamURL is the FilePath handed to the player for an uploaded song.
+func streamURL(songID string) string {
+	return "/api/stream/" + songID
+}
+
+// coverURL is the CoverPath of an embedded cover stored by saveCoverArt.
+func coverURL(userID int, name string) string {
+	return "/api/covers/" + strconv.Itoa(userID) + "/" + name
+}
+
+// uploadFilePath resolves a path relative to uploadsDir, refusing anything
+// that would escape it.
+func uploadFilePath(relative string) (string, error) {
+	cleaned := path.Clean("/" + relative)
+	if cleaned == "/" || strings.Contains(relative, "\x00") {
+		return "", fmt.Errorf("invalid upload path %q", relative)
+	}
+	return filepath.Join(uploadsDir, filepath.FromSlash(cleaned)), nil
+}
+
+// StreamHandler serves the audio of an uploaded song to its owner, with
+// Range, ETag and Last-Modified support for seeking and caching. Songs that
+// are public anyway (samples, provider tracks) are redirected to where they
+// play from, unless a Jamendo track has been saved for offline playback.
+func StreamHandler(w http.ResponseWriter, r *http.Request) { // Protected by TryAuthMiddleware
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		writeJSONError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	songID := r.PathValue("songID")
+	song, err := store.GetSong(songID)
+	if errors.Is(err, errNotFound) {
+		song = findSampleSong(songID)
+		err = nil
+		if song == nil {
+			err = fmt.Errorf("song %s: %w", songID, errNotFound)
+		}
+	}
+	if err != nil {
+		writeStoreError(w, err, "Failed to fetch song")
+		return
+	}
+
+	if !song.IsUploaded {
+		if serveOfflineCopy(w, r, song) {
+			return
+		}
+		target, ok := externalStreamURL(song)
+		if !ok {
+			writeJSONError(w, "Song not found", http.StatusNotFound)
+			return
+		}
+		http.Redirect(w, r, target, http.StatusFound)
+		return
+	}
+	claims := GetClaimsFromContext(r)
+	if claims == nil {
+		writeJSONError(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	// Someone else's upload looks exactly like a song that does not exist.
+	if song.UserID == nil || *song.UserID != claims.UserID {
+		writeJSONError(w, "Song not found", http.StatusNotFound)
+		return
+	}
+
+	contentType := song.MimeType
+	if contentType == "" {
+		contentType = mime.TypeByExtension(path.Ext(song.StoragePath))
+	}
+	serveUploadFile(w, r, song.StoragePath, contentType)
+}
+
+// externalStreamURL is where a song that isn't an upload plays from: the
+// bundled file of a sample, or its provider's stream endpoint. The song's
+// own FilePath is never used, since for liked songs it came from the client.
+func externalStreamURL(song *Song) (string, bool) {
+	if sample := findSampleSong(song.ID); sample != nil {
+		return sample.FilePath, true
+	}
+	id := song.ID
+	if song.JamendoID != nil && *song.JamendoID != "" {
+		id = jamendoSource + "-" + *song.JamendoID
+	}
+	if _, _, ok := providerFor(id); !ok {
+		return "", false
+	}
+	return "/api/tracks/" + url.PathEscape(id) + "/stream", true
+}
+
+// CoverHandler serves embedded cover art stored by saveCoverArt. Covers are
+// private to the user who uploaded the tracks they came from.
+func CoverHandler(w http.ResponseWriter, r *http.Request) { // Protected by AuthMiddleware
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		writeJSONError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	claims := GetClaimsFromContext(r)
+	if claims == nil {
+		writeJSONError(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	userID, err := strconv.Atoi(r.PathValue("userID"))
+	name := r.PathValue("name")
+	if err != nil || userID != claims.UserID || strings.ContainsAny(name, `/\`) {
+		writeJSONError(w, "Cover not found", http.StatusNotFound)
+		return
+	}
+	serveUploadFile(w, r, path.Join(strconv.Itoa(userID), coversDirName, name), mime.TypeByExtension(path.Ext(name)))
+}
+
+// serveUploadFile sends a file from uploadsDir. http.ServeContent takes care
+// of Range, If-Range, If-None-Match and If-Modified-Since.
+func serveUploadFile(w http.ResponseWriter, r *http.Request, relative, contentType string) {
+	fullPath, err := uploadFilePath(relative)
+	if err != nil {
+		writeJSONError(w, "File not found", http.StatusNotFound)
+		return
+	}
+	f, err := os.Open(fullPath)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Error().Err(err).Str("path", fullPath).Msg("Failed to open upload")
+		}
+		writeJSONError(w, "File not found", http.StatusNotFound)
+		return
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil || info.IsDir() {
+		writeJSONError(w, "File not found", http.StatusNotFound)
+		return
+	}
+
+	h := w.Header()
+	if contentType != "" {
+		h.Set("Content-Type", contentType)
+	}
+	h.Set("X-Content-Type-Options", "nosniff")
+	h.Set("Cache-Control", "private, max-age=86400")
+	h.Set("ETag", fmt.Sprintf(`"%x-%x"`, info.ModTime().UnixNano(), info.Size()))
+	// A whole track over a slow link takes longer than the server's
+	// WriteTimeout, which would cut it off part way.
+	http.NewResponseController(w).SetWriteDeadline(time.Time{})
+	http.ServeContent(w, r, info.Name(), info.ModTime(), f)
+}
+
+// findSampleSong returns one of the built-in samples, which are not
+// necessarily in the songs table.
+func findSampleSong(songID string) *Song {
+	for _, s := range initialSampleSongs {
+		if s.ID == songID {
+			s := s
+			return &s
+		}
+	}
+	return nil
+}
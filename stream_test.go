@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// fetch sends a request with the client's cookies and returns the raw
+// response with its body already read.
+func (c *testClient) fetch(method, path string, header http.Header) (*http.Response, []byte) {
+	c.t.Helper()
+	req, err := http.NewRequest(method, c.srv.URL+path, nil)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	client := *c.http
+	client.CheckRedirect = func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }
+	resp, err := client.Do(req)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	return resp, body
+}
+
+func TestStreamUpload(t *testing.T) {
+	forEachStore(t, func(t *testing.T, srv *httptest.Server) {
+		owner := newTestClient(t, srv)
+		owner.registerAndLogin("hana")
+		song, code := owner.uploadFile("art.mp3", testMP3("Streamed", id3APIC(3, "image/jpeg", testJPEG)), nil)
+		if code != http.StatusCreated {
+			t.Fatalf("upload: status %d", code)
+		}
+		content := testMP3("Streamed", id3APIC(3, "image/jpeg", testJPEG))
+
+		resp, body := owner.fetch("GET", song.FilePath, nil)
+		if resp.StatusCode != http.StatusOK || !bytes.Equal(body, content) {
+			t.Fatalf("GET stream: status %d, %d bytes", resp.StatusCode, len(body))
+		}
+		etag, lastModified := resp.Header.Get("ETag"), resp.Header.Get("Last-Modified")
+		if resp.Header.Get("Content-Type") != "audio/mpeg" || resp.Header.Get("Accept-Ranges") != "bytes" || etag == "" || lastModified == "" {
+			t.Errorf("stream headers: %v", resp.Header)
+		}
+
+		resp, body = owner.fetch("GET", song.FilePath, http.Header{"Range": {"bytes=10-19"}})
+		if resp.StatusCode != http.StatusPartialContent || !bytes.Equal(body, content[10:20]) {
+			t.Errorf("range request: status %d, body %q", resp.StatusCode, body)
+		}
+		if got := resp.Header.Get("Content-Range"); got != "bytes 10-19/"+strconv.Itoa(len(content)) {
+			t.Errorf("Content-Range %q", got)
+		}
+		if resp, _ := owner.fetch("GET", song.FilePath, http.Header{"If-None-Match": {etag}}); resp.StatusCode != http.StatusNotModified {
+			t.Errorf("If-None-Match: status %d, want 304", resp.StatusCode)
+		}
+		if resp, _ := owner.fetch("GET", song.FilePath, http.Header{"If-Modified-Since": {lastModified}}); resp.StatusCode != http.StatusNotModified {
+			t.Errorf("If-Modified-Since: status %d, want 304", resp.StatusCode)
+		}
+		if resp, body := owner.fetch("HEAD", song.FilePath, nil); resp.StatusCode != http.StatusOK || len(body) != 0 || resp.ContentLength != int64(len(content)) {
+			t.Errorf("HEAD: status %d, length %d", resp.StatusCode, resp.ContentLength)
+		}
+
+		guest := newTestClient(t, srv)
+		if resp, _ := guest.fetch("GET", song.FilePath, nil); resp.StatusCode != http.StatusUnauthorized {
+			t.Errorf("guest stream: status %d, want 401", resp.StatusCode)
+		}
+		if resp, _ := guest.fetch("GET", song.CoverPath, nil); resp.StatusCode != http.StatusUnauthorized {
+			t.Errorf("guest cover: status %d, want 401", resp.StatusCode)
+		}
+		other := newTestClient(t, srv)
+		other.registerAndLogin("ivan")
+		if resp, _ := other.fetch("GET", song.FilePath, nil); resp.StatusCode != http.StatusNotFound {
+			t.Errorf("stranger stream: status %d, want 404", resp.StatusCode)
+		}
+		if resp, _ := other.fetch("GET", song.CoverPath, nil); resp.StatusCode != http.StatusNotFound {
+			t.Errorf("stranger cover: status %d, want 404", resp.StatusCode)
+		}
+		// The old static route is gone; guessing file names gets nothing.
+		if resp, _ := other.fetch("GET", "/uploads/", nil); resp.StatusCode != http.StatusNotFound {
+			t.Errorf("GET /uploads/: status %d, want 404", resp.StatusCode)
+		}
+
+		if resp, _ := guest.fetch("GET", "/api/stream/sample-1", nil); resp.StatusCode != http.StatusFound || resp.Header.Get("Location") != "/assets/audio/sample1.mp3" {
+			t.Errorf("sample stream: status %d, location %q", resp.StatusCode, resp.Header.Get("Location"))
+		}
+		if resp, _ := owner.fetch("GET", "/api/stream/local-nope", nil); resp.StatusCode != http.StatusNotFound {
+			t.Errorf("unknown song: status %d, want 404", resp.StatusCode)
+		}
+	})
+}
+
+// Streams aren't bound by the server's WriteTimeout: a listener reading
+// slowly still gets the whole track.
+func TestStreamPastWriteTimeout(t *testing.T) {
+	store = newMemoryStore()
+	uploadsDir = t.TempDir()
+	srv := httptest.NewUnstartedServer(newRouter())
+	srv.Config.WriteTimeout = 200 * time.Millisecond
+	srv.Start()
+	t.Cleanup(srv.Close)
+
+	c := newTestClient(t, srv)
+	c.registerAndLogin("hana")
+	song, code := c.uploadFile("long.mp3", testMP3("Long"), nil)
+	if code != http.StatusCreated {
+		t.Fatalf("upload: status %d", code)
+	}
+	// Too big to sit in the socket buffers while the client isn't reading.
+	stored, err := store.GetSong(song.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fullPath, _ := uploadFilePath(stored.StoragePath)
+	content := bytes.Repeat([]byte("long track "), 3<<20)
+	if err := os.WriteFile(fullPath, content, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := c.http.Get(srv.URL + song.FilePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	time.Sleep(2 * srv.Config.WriteTimeout)
+	body, err := io.ReadAll(resp.Body)
+	if err != nil || len(body) != len(content) {
+		t.Errorf("slow read: %d of %d bytes, %v", len(body), len(content), err)
+	}
+}
+
+// The file path of a liked song comes from the client, so streams never
+// redirect to it.
+func TestStreamExternalRedirect(t *testing.T) {
+	forEachStore(t, func(t *testing.T, srv *httptest.Server) {
+		c := newTestClient(t, srv)
+		c.registerAndLogin("hana")
+		for _, like := range []map[string]interface{}{
+			{"songId": "jamendo-1886257", "jamendoId": "1886257", "title": "Morning Light", "filePath": "https://evil.example/phish"},
+			{"songId": "evil-1", "title": "Not a provider", "filePath": "https://evil.example/phish"},
+			{"songId": "sample-x", "title": "Not a sample", "isLocal": true, "filePath": "https://evil.example/phish"},
+		} {
+			if code := c.do("POST", "/api/songs/like", like, nil); code != http.StatusOK {
+				t.Fatalf("like %s: status %d", like["songId"], code)
+			}
+		}
+		for _, s := range c.songs() {
+			if s.FilePath != streamURL(s.ID) {
+				t.Errorf("%s plays from %q", s.ID, s.FilePath)
+			}
+		}
+		if resp, _ := c.fetch("GET", "/api/stream/jamendo-1886257", nil); resp.StatusCode != http.StatusFound || resp.Header.Get("Location") != "/api/tracks/jamendo-1886257/stream" {
+			t.Errorf("jamendo stream: status %d, location %q", resp.StatusCode, resp.Header.Get("Location"))
+		}
+		for _, id := range []string{"evil-1", "sample-x"} {
+			if resp, _ := c.fetch("GET", "/api/stream/"+id, nil); resp.StatusCode != http.StatusNotFound {
+				t.Errorf("%s: status %d, location %q", id, resp.StatusCode, resp.Header.Get("Location"))
+			}
+		}
+	})
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+
+	"github.com/mewkiz/flac"
+	"github.com/rs/zerolog/log"
+)
+
+// pcmToFLAC turns on storing uncompressed WAV and AIFF uploads as FLAC,
+// which typically takes about half the space. main loads it from
+// UPLOAD_PCM_TO_FLAC; it is off by default.
+var pcmToFLAC = false
+
+// loadPCMToFLAC reads UPLOAD_PCM_TO_FLAC.
+func loadPCMToFLAC() bool {
+	v := os.Getenv("UPLOAD_PCM_TO_FLAC")
+	if v == "" {
+		return false
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		log.Fatal().Str("UPLOAD_PCM_TO_FLAC", v).Msg("UPLOAD_PCM_TO_FLAC must be true or false")
+	}
+	return b
+}
+
+// canStoreAsFLAC reports whether an upload is integer PCM that FLAC holds
+// exactly: WAV or AIFF with up to 8 channels of up to 24 bits. Floating
+// point and companded (A-law, mu-law) audio is kept as it is.
+func canStoreAsFLAC(md *AudioMetadata) bool {
+	return (md.Format == formatWAV || md.Format == formatAIFF) && md.Codec == "pcm" &&
+		md.Channels >= 1 && md.Channels <= 8 && md.BitsPerSample >= 1 && md.BitsPerSample <= 24
+}
+
+// openRawPCM opens the WAV or AIFF file at path for reading its samples.
+func openRawPCM(path, format string) (*os.File, *rawPCMDecoder, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	dec, err := newPCMDecoder(f, format, 0)
+	if err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+	raw, ok := dec.(*rawPCMDecoder)
+	if !ok {
+		f.Close()
+		return nil, nil, fmt.Errorf("%s is not uncompressed audio", format)
+	}
+	return f, raw, nil
+}
+
+// transcodeToFLAC re-encodes the received WAV or AIFF file at src as FLAC
+// next to it in the blob store, with md's tags and cover art, and checks
+// the result by decoding it again. It returns the FLAC file's path, size and
+// hash; src is left for the caller to remove once it has switched over.
+func transcodeToFLAC(src string, md *AudioMetadata) (string, storedFile, error) {
+	in, dec, err := openRawPCM(src, md.Format)
+	if err != nil {
+		return "", storedFile{}, err
+	}
+	defer in.Close()
+	dst, err := newBlobTempPath()
+	if err != nil {
+		return "", storedFile{}, err
+	}
+	out, err := os.Create(dst)
+	if err != nil {
+		return "", storedFile{}, err
+	}
+	err = encodeFLAC(out, dec, flacMetadataBlocks(md))
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = verifyFLAC(dst, src, md.Format)
+	}
+	var stored storedFile
+	if err == nil {
+		stored, err = hashFile(dst)
+	}
+	if err != nil {
+		os.Remove(dst)
+		return "", storedFile{}, err
+	}
+	return dst, stored, nil
+}
+
+// verifyFLAC decodes the FLAC file at flacPath and compares every sample
+// with the WAV or AIFF file it was encoded from, so an encoder bug can never
+// cost an upload its audio.
+func verifyFLAC(flacPath, pcmPath, format string) error {
+	in, want, err := openRawPCM(pcmPath, format)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	f, err := os.Open(flacPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	stream, err := flac.New(f)
+	if err != nil {
+		return fmt.Errorf("verify: %w", err)
+	}
+	info := stream.Info
+	if int(info.NChannels) != want.Channels() || int(info.SampleRate) != want.SampleRate() || int(info.BitsPerSample) != want.BitsPerSample() {
+		return fmt.Errorf("verify: stream is %d channels at %d Hz and %d bits", info.NChannels, info.SampleRate, info.BitsPerSample)
+	}
+
+	channels := want.Channels()
+	expected := make([]int32, flacBlockSize*channels)
+	var frames uint64
+	for {
+		fr, err := stream.ParseNext()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("verify: frame after %d samples: %w", frames, err)
+		}
+		n := int(fr.BlockSize)
+		if n > flacBlockSize || len(fr.Subframes) != channels {
+			return fmt.Errorf("verify: block of %d samples in %d channels", n, len(fr.Subframes))
+		}
+		got, err := want.ReadInts(expected[:n*channels])
+		if err != nil && err != io.EOF {
+			return err
+		}
+		if got != n*channels {
+			return fmt.Errorf("verify: FLAC has more samples than the original (%d)", frames)
+		}
+		for ch, sub := range fr.Subframes {
+			for i := 0; i < n; i++ {
+				if sub.Samples[i] != expected[i*channels+ch] {
+					return fmt.Errorf("verify: sample %d of channel %d differs", frames+uint64(i), ch)
+				}
+			}
+		}
+		frames += uint64(n)
+	}
+	if n, _ := want.ReadInts(expected[:channels]); n > 0 {
+		return fmt.Errorf("verify: FLAC ends after %d of the original's samples", frames)
+	}
+	if info.NSamples != frames {
+		return fmt.Errorf("verify: stream info claims %d samples, found %d", info.NSamples, frames)
+	}
+	return nil
+}
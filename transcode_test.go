@@ -0,0 +1,216 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/mewkiz/flac"
+)
+
+// pcmFile writes samples, indexed [channel][frame], as a WAV or AIFF file
+// of the given sample width.
+func pcmFile(format string, rate, bitsPerSample int, samples [][]int32) []byte {
+	channels, width := len(samples), (bitsPerSample+7)/8
+	var data []byte
+	for i := range samples[0] {
+		for ch := range samples {
+			v := uint32(samples[ch][i])
+			if format == formatWAV && width == 1 {
+				v += 128 // 8-bit WAV is unsigned
+			}
+			for j := 0; j < width; j++ {
+				shift := 8 * j // Little-endian
+				if format == formatAIFF {
+					shift = 8 * (width - 1 - j)
+				}
+				data = append(data, byte(v>>shift))
+			}
+		}
+	}
+	if format == formatAIFF {
+		return aiffFile(aiffCOMM(channels, len(samples[0]), bitsPerSample, rate), iffChunk("SSND", append(make([]byte, 8), data...)))
+	}
+	fmtChunk := make([]byte, 16)
+	binary.LittleEndian.PutUint16(fmtChunk, waveFormatPCM)
+	binary.LittleEndian.PutUint16(fmtChunk[2:], uint16(channels))
+	binary.LittleEndian.PutUint32(fmtChunk[4:], uint32(rate))
+	binary.LittleEndian.PutUint32(fmtChunk[8:], uint32(rate*channels*width))
+	binary.LittleEndian.PutUint16(fmtChunk[12:], uint16(channels*width))
+	binary.LittleEndian.PutUint16(fmtChunk[14:], uint16(bitsPerSample))
+	body := bytes.Join([][]byte{[]byte("WAVE"), riffChunk("fmt ", fmtChunk), riffChunk("data", data)}, nil)
+	return append(append([]byte("RIFF"), binary.LittleEndian.AppendUint32(nil, uint32(len(body)))...), body...)
+}
+
+// noisy adds uniform noise of the given amplitude to every sample and
+// shifts the result left by shift bits.
+func noisy(samples [][]int32, amplitude int32, shift uint) [][]int32 {
+	rng := rand.New(rand.NewSource(1))
+	out := make([][]int32, len(samples))
+	for ch := range samples {
+		out[ch] = make([]int32, len(samples[ch]))
+		for i, v := range samples[ch] {
+			out[ch][i] = (v + rng.Int31n(2*amplitude+1) - amplitude) << shift
+		}
+	}
+	return out
+}
+
+// flacSamples decodes a FLAC file into [channel][frame] samples.
+func flacSamples(t *testing.T, path string) (*flac.Stream, [][]int32) {
+	t.Helper()
+	stream, err := flac.ParseFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	samples := make([][]int32, stream.Info.NChannels)
+	for {
+		f, err := stream.ParseNext()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		for ch, sub := range f.Subframes {
+			samples[ch] = append(samples[ch], sub.Samples...)
+		}
+	}
+	return stream, samples
+}
+
+func TestTranscodeToFLAC(t *testing.T) {
+	defer func(dir string) { uploadsDir = dir }(uploadsDir)
+	uploadsDir = t.TempDir()
+
+	stereo := noisy(sine(44100, 2, 2, 440, 0.5, 0), 200, 0)
+	stereo[1] = noisy(sine(44100, 1, 2, 660, 0.3, 1), 200, 0)[0] // Different channels
+	silent := sine(22050, 1, 0.5, 440, 0, 0)
+	silent[0][1000] = 5000 // One click in otherwise constant blocks
+	tests := []struct {
+		name          string
+		format        string
+		rate, bits    int
+		samples       [][]int32
+		maxCompressed float64 // Largest acceptable FLAC size as a fraction of the original
+	}{
+		{"16-bit stereo wav", formatWAV, 44100, 16, stereo, 0.7},
+		{"8-bit mono wav", formatWAV, 8000, 8, noisy(sine(8000, 1, 1, 300, 0.003, 0), 20, 0), 1},
+		{"24-bit aiff", formatAIFF, 48000, 24, noisy(sine(48000, 3, 1.3, 1000, 0.2, 0), 1000, 8), 0.8},
+		{"20 of 24 bits wav", formatWAV, 96000, 24, noisy(sine(96000, 2, 0.2, 5000, 0.001, 0), 50, 4), 0.8},
+		{"silence with a click", formatAIFF, 22050, 16, silent, 0.1},
+		{"identical channels", formatWAV, 44100, 16, sine(44100, 2, 0.1, 440, 0.9, 0), 0.5},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			content := pcmFile(tt.format, tt.rate, tt.bits, tt.samples)
+			src := filepath.Join(t.TempDir(), "upload")
+			if err := os.WriteFile(src, content, 0o644); err != nil {
+				t.Fatal(err)
+			}
+			md, err := extractMetadata(bytes.NewReader(content), int64(len(content)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !canStoreAsFLAC(md) {
+				t.Fatalf("%+v not convertible", md)
+			}
+			dst, stored, err := transcodeToFLAC(src, md)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ratio := float64(stored.Size) / float64(len(content)); ratio > tt.maxCompressed {
+				t.Errorf("FLAC is %.0f%% of the original", 100*ratio)
+			}
+			if sum, _ := hashFile(dst); sum != stored {
+				t.Errorf("stored %+v, file is %+v", stored, sum)
+			}
+
+			stream, got := flacSamples(t, dst)
+			if int(stream.Info.SampleRate) != tt.rate || int(stream.Info.NSamples) != len(tt.samples[0]) ||
+				stream.Info.BlockSizeMin < 16 {
+				t.Errorf("stream info %+v", stream.Info)
+			}
+			for ch := range tt.samples {
+				for i := range tt.samples[ch] {
+					if got[ch][i] != tt.samples[ch][i] {
+						t.Fatalf("channel %d sample %d: got %d, want %d", ch, i, got[ch][i], tt.samples[ch][i])
+					}
+				}
+			}
+		})
+	}
+
+	// Verification compares with the original sample by sample.
+	a := filepath.Join(t.TempDir(), "a.wav")
+	b := filepath.Join(t.TempDir(), "b.wav")
+	os.WriteFile(a, pcmFile(formatWAV, 44100, 16, sine(44100, 1, 1, 440, 0.5, 0)), 0o644)
+	os.WriteFile(b, pcmFile(formatWAV, 44100, 16, sine(44100, 1, 1, 440, 0.5, 0.001)), 0o644)
+	dst, _, err := transcodeToFLAC(a, &AudioMetadata{Format: formatWAV})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := verifyFLAC(dst, b, formatWAV); err == nil {
+		t.Errorf("FLAC of one file verified against another")
+	}
+}
+
+func TestUploadPCMAsFLAC(t *testing.T) {
+	defer func(enabled bool) { pcmToFLAC = enabled }(pcmToFLAC)
+	forEachStore(t, func(t *testing.T, srv *httptest.Server) {
+		c := newTestClient(t, srv)
+		c.registerAndLogin("flo")
+
+		pcmToFLAC = false
+		kept, code := c.uploadFile("kept.aiff", testAIFF(), nil)
+		if code != http.StatusCreated {
+			t.Fatalf("upload: status %d", code)
+		}
+		if kept.MimeType != "audio/aiff" || kept.OriginalMimeType != "audio/aiff" || kept.FileSize != int64(len(testAIFF())) {
+			t.Errorf("without conversion: %s (sent as %s), %d bytes", kept.MimeType, kept.OriginalMimeType, kept.FileSize)
+		}
+
+		pcmToFLAC = true
+		// A trailing ID3 chunk with cover art; parseWAV reads to the end of the file.
+		wav := append(testWAV(), riffChunk("id3 ", id3v2Tag(3, id3APIC(3, "image/jpeg", testJPEG)))...)
+		song, code := c.uploadFile("tagged.wav", wav, map[string]string{"genre": "Field Recording"})
+		if code != http.StatusCreated {
+			t.Fatalf("upload: status %d", code)
+		}
+		if song.MimeType != "audio/flac" || song.OriginalMimeType != "audio/wav" || song.Codec != "flac" ||
+			song.FileSize >= int64(len(wav))/10 || song.Title != "Wav Title" || song.DurationMs != 1500 {
+			t.Errorf("converted upload = %+v", song)
+		}
+		resp, body := c.fetch("GET", song.FilePath, nil)
+		if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "audio/flac" {
+			t.Fatalf("stream: status %d, type %q", resp.StatusCode, resp.Header.Get("Content-Type"))
+		}
+		md, err := extractMetadata(bytes.NewReader(body), int64(len(body)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		// The file keeps its own tags; the form's genre is only on the song.
+		if md.Format != formatFLAC || md.Title != "Wav Title" || md.Artist != "Wav Artist" || md.Album != "Wav Album" ||
+			md.Year != 2020 || md.TrackNumber != 5 || md.Genre != "" || md.BitsPerSample != 16 || md.DurationMs != 1500 ||
+			md.Picture == nil || !bytes.Equal(md.Picture.Data, testJPEG) {
+			t.Errorf("stored FLAC metadata = %+v", md)
+		}
+		if files := blobFiles(t); len(files) != 2 {
+			t.Errorf("blob store holds %v, want the AIFF and the FLAC only", files)
+		}
+
+		// Floating-point audio has no exact FLAC form and is kept as sent.
+		float := pcmFile(formatWAV, 8000, 16, sine(8000, 1, 1, 440, 0.5, 0))
+		binary.LittleEndian.PutUint16(float[20:], waveFormatIEEEFloat)
+		binary.LittleEndian.PutUint16(float[34:], 32)
+		if song, code := c.uploadFile("float.wav", float, nil); code != http.StatusCreated || song.MimeType != "audio/wav" {
+			t.Errorf("float upload: status %d, %s", code, song.MimeType)
+		}
+	})
+}
@@ -0,0 +1,455 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Resumable uploads follow the tus 1.0 core protocol plus its creation,
+// expiration and termination extensions (https://tus.io/protocols/resumable-upload):
+//
+//	POST   /api/uploads       create a session (Upload-Length, Upload-Metadata)
+//	HEAD   /api/uploads/{id}  current Upload-Offset, e.g. after reconnecting
+//	PATCH  /api/uploads/{id}  append a chunk at Upload-Offset
+//	DELETE /api/uploads/{id}  abandon the upload
+//
+// The PATCH that completes the file turns it into a song through the same
+// ingestUpload pipeline as /api/songs/upload and answers 200 with the song.
+// GET /api/uploads lists unfinished sessions and GET /api/uploads/{id}
+// reports one as JSON, including the song ID once it has been created.
+const (
+	tusVersion    = "1.0.0"
+	tusExtensions = "creation,expiration,termination"
+
+	// maxResumableUpload caps Upload-Length; quotas usually bite first.
+	maxResumableUpload = 4 << 30
+
+	// uploadSessionTTL is how long a session survives without activity.
+	uploadSessionTTL = 24 * time.Hour
+	// uploadChunkIdleTimeout replaces the server's ReadTimeout during a
+	// PATCH: the body may take as long as it needs while data keeps coming.
+	uploadChunkIdleTimeout = 30 * time.Second
+	// uploadJanitorInterval is how often expired sessions are cleaned up.
+	uploadJanitorInterval = 10 * time.Minute
+
+	// Partial files live in uploadsDir/<userID>/incoming until complete.
+	incomingDirName = "incoming"
+)
+
+// activeUploads holds the IDs of sessions with a PATCH or DELETE in flight.
+// A session accepts one writer at a time; the others get 423 Locked.
+var activeUploads = struct {
+	sync.Mutex
+	ids map[string]bool
+}{ids: map[string]bool{}}
+
+func lockUpload(id string) bool {
+	activeUploads.Lock()
+	defer activeUploads.Unlock()
+	if activeUploads.ids[id] {
+		return false
+	}
+	activeUploads.ids[id] = true
+	return true
+}
+
+func unlockUpload(id string) {
+	activeUploads.Lock()
+	defer activeUploads.Unlock()
+	delete(activeUploads.ids, id)
+}
+
+func uploadSessionURL(id string) string {
+	return "/api/uploads/" + id
+}
+
+func partialUploadPath(userID int, id string) string {
+	return filepath.Join(uploadsDir, strconv.Itoa(userID), incomingDirName, id+".part")
+}
+
+// parseUploadMetadata decodes a tus Upload-Metadata header: comma-separated
+// "key base64value" pairs, where the value may be omitted.
+func parseUploadMetadata(header string) (map[string]string, error) {
+	md := map[string]string{}
+	for _, pair := range strings.Split(header, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		key, encoded, _ := strings.Cut(pair, " ")
+		value, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+		if err != nil {
+			return nil, fmt.Errorf("Upload-Metadata value for %q is not base64", key)
+		}
+		md[key] = string(value)
+	}
+	return md, nil
+}
+
+// setTusHeaders adds the headers every tus response carries.
+func setTusHeaders(w http.ResponseWriter) {
+	w.Header().Set("Tus-Resumable", tusVersion)
+	w.Header().Set("Cache-Control", "no-store")
+}
+
+func setUploadOffsetHeaders(w http.ResponseWriter, sess *UploadSession) {
+	w.Header().Set("Upload-Offset", strconv.FormatInt(sess.Offset, 10))
+	w.Header().Set("Upload-Length", strconv.FormatInt(sess.Length, 10))
+	w.Header().Set("Upload-Expires", sess.ExpiresAt.UTC().Format(http.TimeFormat))
+}
+
+// checkTusVersion rejects requests for a protocol version we don't speak.
+// Plain HTTP clients that send no Tus-Resumable header are let through.
+func checkTusVersion(w http.ResponseWriter, r *http.Request) bool {
+	if v := r.Header.Get("Tus-Resumable"); v != "" && v != tusVersion {
+		w.Header().Set("Tus-Version", tusVersion)
+		writeJSONError(w, "Unsupported tus version", http.StatusPreconditionFailed)
+		return false
+	}
+	return true
+}
+
+// UploadSessionsHandler creates resumable uploads and lists unfinished ones.
+func UploadSessionsHandler(w http.ResponseWriter, r *http.Request) { // Protected by AuthMiddleware
+	setTusHeaders(w)
+	switch r.Method {
+	case http.MethodOptions:
+		w.Header().Set("Tus-Version", tusVersion)
+		w.Header().Set("Tus-Extension", tusExtensions)
+		w.Header().Set("Tus-Max-Size", strconv.FormatInt(maxResumableUpload, 10))
+		w.WriteHeader(http.StatusNoContent)
+		return
+	case http.MethodGet, http.MethodPost:
+	default:
+		writeJSONError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	claims := GetClaimsFromContext(r)
+	if claims == nil {
+		writeJSONError(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if r.Method == http.MethodGet {
+		sessions, err := store.ListUploadSessions(claims.UserID)
+		if err != nil {
+			writeStoreError(w, err, "Failed to list uploads")
+			return
+		}
+		writeJSONResponse(w, sessions, http.StatusOK)
+		return
+	}
+	if !checkTusVersion(w, r) {
+		return
+	}
+
+	length, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || length < 0 {
+		writeJSONError(w, "Upload-Length must be the file size in bytes", http.StatusBadRequest)
+		return
+	}
+	if length > maxResumableUpload {
+		writeJSONError(w, fmt.Sprintf("Uploads are limited to %d bytes", int64(maxResumableUpload)), http.StatusRequestEntityTooLarge)
+		return
+	}
+	metadata := r.Header.Get("Upload-Metadata")
+	md, err := parseUploadMetadata(metadata)
+	if err != nil {
+		writeJSONError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	// Validate the overrides now rather than after the whole file arrived.
+	if _, err := parseSongOverrides(func(key string) string { return md[key] }); err != nil {
+		writeJSONError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Unfinished sessions count against the quota, so a user can't get
+	// around it by starting many uploads at once.
+	usage, err := store.GetStorageUsage(claims.UserID)
+	if err != nil {
+		writeStoreError(w, err, "Failed to create upload")
+		return
+	}
+	pending, err := store.ListUploadSessions(claims.UserID)
+	if err != nil {
+		writeStoreError(w, err, "Failed to create upload")
+		return
+	}
+	for _, p := range pending {
+		usage.UsedBytes += p.Length
+		usage.Tracks++
+	}
+	if err := uploadQuota.check(usage.UsedBytes, usage.Tracks, length); err != nil {
+		writeStoreError(w, err, "Failed to create upload")
+		return
+	}
+
+	sess, err := store.CreateUploadSession(claims.UserID, length, metadata, time.Now().Add(uploadSessionTTL))
+	if err != nil {
+		writeStoreError(w, err, "Failed to create upload")
+		return
+	}
+	if err := createPartialUpload(partialUploadPath(claims.UserID, sess.ID)); err != nil {
+		log.Error().Err(err).Str("upload", sess.ID).Msg("Failed to create partial upload file")
+		store.DeleteUploadSession(claims.UserID, sess.ID)
+		writeJSONError(w, "Server error during upload", http.StatusInternalServerError)
+		return
+	}
+
+	log.Info().Str("upload", sess.ID).Int64("length", length).Str("user", claims.Username).Msg("Resumable upload created")
+	w.Header().Set("Location", uploadSessionURL(sess.ID))
+	setUploadOffsetHeaders(w, sess)
+	writeJSONResponse(w, sess, http.StatusCreated)
+}
+
+// UploadSessionHandler reports on, appends to and deletes one resumable upload.
+func UploadSessionHandler(w http.ResponseWriter, r *http.Request) { // Protected by AuthMiddleware
+	setTusHeaders(w)
+	claims := GetClaimsFromContext(r)
+	if claims == nil {
+		writeJSONError(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	id := r.PathValue("uploadID")
+
+	switch r.Method {
+	case http.MethodHead, http.MethodGet:
+		sess, err := store.GetUploadSession(claims.UserID, id)
+		if err != nil {
+			writeStoreError(w, err, "Failed to fetch upload")
+			return
+		}
+		setUploadOffsetHeaders(w, sess)
+		if r.Method == http.MethodHead {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		writeJSONResponse(w, sess, http.StatusOK)
+	case http.MethodPatch:
+		if !checkTusVersion(w, r) {
+			return
+		}
+		if !lockUpload(id) {
+			writeJSONError(w, "Another request is writing to this upload", http.StatusLocked)
+			return
+		}
+		defer unlockUpload(id)
+		patchUpload(w, r, claims, id)
+	case http.MethodDelete:
+		if !lockUpload(id) {
+			writeJSONError(w, "Another request is writing to this upload", http.StatusLocked)
+			return
+		}
+		defer unlockUpload(id)
+		if err := store.DeleteUploadSession(claims.UserID, id); err != nil {
+			writeStoreError(w, err, "Failed to delete upload")
+			return
+		}
+		removePartialUpload(claims.UserID, id)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeJSONError(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// patchUpload appends the request body to the session's partial file at
+// Upload-Offset. The caller holds the session's lock.
+func patchUpload(w http.ResponseWriter, r *http.Request, claims *Claims, id string) {
+	if r.Header.Get("Content-Type") != "application/offset+octet-stream" {
+		writeJSONError(w, "Content-Type must be application/offset+octet-stream", http.StatusUnsupportedMediaType)
+		return
+	}
+	offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil || offset < 0 {
+		writeJSONError(w, "Upload-Offset must be a byte offset", http.StatusBadRequest)
+		return
+	}
+	sess, err := store.GetUploadSession(claims.UserID, id)
+	if err != nil {
+		writeStoreError(w, err, "Failed to fetch upload")
+		return
+	}
+	if sess.SongID != nil {
+		// The response to the final chunk was lost; repeat it.
+		song, err := store.GetSong(*sess.SongID)
+		if err != nil {
+			writeStoreError(w, err, "Failed to fetch uploaded song")
+			return
+		}
+		setUploadOffsetHeaders(w, sess)
+		writeJSONResponse(w, song, http.StatusOK)
+		return
+	}
+	if offset != sess.Offset {
+		setUploadOffsetHeaders(w, sess)
+		writeJSONError(w, "Upload-Offset does not match the bytes received so far", http.StatusConflict)
+		return
+	}
+
+	// Large chunks over slow links outlive the server-wide ReadTimeout, so
+	// switch to an idle timeout that is refreshed as data arrives.
+	rc := http.NewResponseController(w)
+	body := &idleTimeoutReader{r: http.MaxBytesReader(w, r.Body, sess.Length-sess.Offset), rc: rc}
+
+	part := partialUploadPath(claims.UserID, id)
+	f, err := os.OpenFile(part, os.O_WRONLY, 0)
+	if err != nil {
+		log.Error().Err(err).Str("upload", id).Msg("Failed to open partial upload file")
+		writeJSONError(w, "Server error during upload", http.StatusInternalServerError)
+		return
+	}
+	// Bytes past the recorded offset were written by a request whose
+	// bookkeeping never finished; the client will send them again.
+	written, copyErr := int64(0), f.Truncate(sess.Offset)
+	if copyErr == nil {
+		if _, copyErr = f.Seek(sess.Offset, io.SeekStart); copyErr == nil {
+			written, copyErr = io.Copy(f, body)
+		}
+	}
+	if err := f.Close(); err != nil && copyErr == nil {
+		copyErr = err
+	}
+	rc.SetWriteDeadline(time.Now().Add(uploadChunkIdleTimeout))
+
+	// Keep whatever arrived, even if the connection dropped part way, so the
+	// client can resume from there.
+	sess.Offset += written
+	sess.ExpiresAt = time.Now().Add(uploadSessionTTL)
+	if err := store.AdvanceUploadSession(claims.UserID, id, offset, sess.Offset, sess.ExpiresAt); err != nil {
+		writeStoreError(w, err, "Failed to record upload progress")
+		return
+	}
+	if copyErr != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(copyErr, &tooLarge) {
+			setUploadOffsetHeaders(w, sess)
+			writeJSONError(w, "Chunk runs past Upload-Length", http.StatusRequestEntityTooLarge)
+			return
+		}
+		log.Warn().Err(copyErr).Str("upload", id).Int64("offset", sess.Offset).Msg("Upload chunk interrupted")
+		setUploadOffsetHeaders(w, sess)
+		writeJSONError(w, "Upload interrupted; resume from Upload-Offset", http.StatusBadRequest)
+		return
+	}
+
+	if sess.Offset < sess.Length {
+		setUploadOffsetHeaders(w, sess)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	// Ingesting (transcoding, cover extraction) can take longer than the
+	// idle timeout on large files; the response must still get through.
+	rc.SetWriteDeadline(time.Time{})
+	finishUpload(w, claims, sess)
+}
+
+// finishUpload ingests a completely received file. Whatever the outcome the
+// partial file is gone afterwards: it either became the song's file or was
+// rejected, and a rejected upload has to be started over.
+func finishUpload(w http.ResponseWriter, claims *Claims, sess *UploadSession) {
+	md, _ := parseUploadMetadata(sess.Metadata) // Validated when the session was created
+	overrides, _ := parseSongOverrides(func(key string) string { return md[key] })
+	filename := md["filename"]
+
+	part := partialUploadPath(claims.UserID, sess.ID)
+	f, err := os.Open(part)
+	if err != nil {
+		log.Error().Err(err).Str("upload", sess.ID).Msg("Failed to open completed upload")
+		writeJSONError(w, "Server error during upload", http.StatusInternalServerError)
+		return
+	}
+	save := func(dst string) (storedFile, error) {
+		f.Close()
+		if err := os.Rename(part, dst); err != nil {
+			return storedFile{}, err
+		}
+		return hashFile(dst)
+	}
+	song, err := ingestUpload(claims.UserID, f, sess.Length, filename, overrides, save)
+	f.Close()
+	if err != nil {
+		store.DeleteUploadSession(claims.UserID, sess.ID)
+		removePartialUpload(claims.UserID, sess.ID)
+		writeIngestError(w, err)
+		return
+	}
+
+	// Keep the finished session around for a while so a client that lost
+	// this response can still find out which song it created.
+	sess.ExpiresAt = time.Now().Add(uploadSessionTTL)
+	if err := store.CompleteUploadSession(claims.UserID, sess.ID, song.ID, sess.ExpiresAt); err != nil {
+		log.Warn().Err(err).Str("upload", sess.ID).Msg("Failed to mark upload complete")
+	}
+	log.Info().Str("upload", sess.ID).Str("filename", filename).Str("user", claims.Username).Msg("Resumable upload finished")
+	setUploadOffsetHeaders(w, sess)
+	writeJSONResponse(w, song, http.StatusOK)
+}
+
+// createPartialUpload creates the empty file PATCHes append to.
+func createPartialUpload(part string) error {
+	if err := os.MkdirAll(filepath.Dir(part), os.ModePerm); err != nil {
+		return err
+	}
+	f, err := os.Create(part)
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+func removePartialUpload(userID int, id string) {
+	if err := os.Remove(partialUploadPath(userID, id)); err != nil && !os.IsNotExist(err) {
+		log.Warn().Err(err).Str("upload", id).Msg("Failed to remove partial upload")
+	}
+}
+
+// idleTimeoutReader pushes the connection's read deadline forward before
+// every read, so a request body may take as long as it keeps flowing.
+type idleTimeoutReader struct {
+	r  io.Reader
+	rc *http.ResponseController
+}
+
+func (t *idleTimeoutReader) Read(p []byte) (int, error) {
+	t.rc.SetReadDeadline(time.Now().Add(uploadChunkIdleTimeout))
+	return t.r.Read(p)
+}
+
+// expireUploadSessions deletes sessions that saw no activity for
+// uploadSessionTTL, along with their partial files.
+func expireUploadSessions(now time.Time) {
+	expired, err := store.DeleteExpiredUploadSessions(now)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to expire upload sessions")
+		return
+	}
+	for _, sess := range expired {
+		if sess.SongID == nil {
+			removePartialUpload(sess.UserID, sess.ID)
+		}
+	}
+	if len(expired) > 0 {
+		log.Info().Int("sessions", len(expired)).Msg("Expired abandoned uploads")
+	}
+}
+
+// runUploadJanitor expires abandoned uploads every interval. main runs it in
+// its own goroutine.
+func runUploadJanitor(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		expireUploadSessions(now)
+	}
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// tus sends a tus protocol request with an optional body and returns the
+// response with its body already read.
+func (c *testClient) tus(method, path string, header http.Header, body []byte) (*http.Response, []byte) {
+	c.t.Helper()
+	req, err := http.NewRequest(method, c.srv.URL+path, bytes.NewReader(body))
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	req.Header.Set("Tus-Resumable", tusVersion)
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	out, err := io.ReadAll(resp.Body)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	return resp, out
+}
+
+// createUpload starts a resumable upload of length bytes and returns its URL.
+func (c *testClient) createUpload(length int, metadata map[string]string) string {
+	c.t.Helper()
+	var pairs []string
+	for k, v := range metadata {
+		pairs = append(pairs, k+" "+base64.StdEncoding.EncodeToString([]byte(v)))
+	}
+	header := http.Header{"Upload-Length": {strconv.Itoa(length)}, "Upload-Metadata": {strings.Join(pairs, ",")}}
+	resp, _ := c.tus("POST", "/api/uploads", header, nil)
+	if resp.StatusCode != http.StatusCreated || resp.Header.Get("Upload-Offset") != "0" {
+		c.t.Fatalf("create upload: status %d, headers %v", resp.StatusCode, resp.Header)
+	}
+	return resp.Header.Get("Location")
+}
+
+func (c *testClient) patchUpload(location string, offset int, chunk []byte) (*http.Response, []byte) {
+	c.t.Helper()
+	return c.tus("PATCH", location, http.Header{
+		"Content-Type":  {"application/offset+octet-stream"},
+		"Upload-Offset": {strconv.Itoa(offset)},
+	}, chunk)
+}
+
+func TestResumableUpload(t *testing.T) {
+	forEachStore(t, func(t *testing.T, srv *httptest.Server) {
+		c := newTestClient(t, srv)
+		c.registerAndLogin("uma")
+		content := testFLAC()
+		location := c.createUpload(len(content), map[string]string{"filename": "album.flac", "title": "Resumed"})
+
+		third := len(content) / 3
+		if resp, _ := c.patchUpload(location, 0, content[:third]); resp.StatusCode != http.StatusNoContent || resp.Header.Get("Upload-Offset") != strconv.Itoa(third) {
+			t.Fatalf("first chunk: status %d, offset %q", resp.StatusCode, resp.Header.Get("Upload-Offset"))
+		}
+		// A client that lost track of its position is told where to resume.
+		resp, _ := c.patchUpload(location, 0, content[:third])
+		if resp.StatusCode != http.StatusConflict || resp.Header.Get("Upload-Offset") != strconv.Itoa(third) {
+			t.Fatalf("PATCH at stale offset: status %d, offset %q", resp.StatusCode, resp.Header.Get("Upload-Offset"))
+		}
+		resp, _ = c.tus("HEAD", location, nil, nil)
+		if resp.StatusCode != http.StatusOK || resp.Header.Get("Upload-Offset") != strconv.Itoa(third) || resp.Header.Get("Upload-Length") != strconv.Itoa(len(content)) {
+			t.Fatalf("HEAD: status %d, headers %v", resp.StatusCode, resp.Header)
+		}
+		var pending []UploadSession
+		if code := c.do("GET", "/api/uploads", nil, &pending); code != http.StatusOK || len(pending) != 1 || pending[0].Offset != int64(third) {
+			t.Errorf("GET /api/uploads: status %d, %+v", code, pending)
+		}
+
+		if resp, _ := c.patchUpload(location, third, content[third:2*third]); resp.StatusCode != http.StatusNoContent {
+			t.Fatalf("second chunk: status %d", resp.StatusCode)
+		}
+		resp, body := c.patchUpload(location, 2*third, content[2*third:])
+		var song Song
+		if resp.StatusCode != http.StatusOK || json.Unmarshal(body, &song) != nil {
+			t.Fatalf("final chunk: status %d, body %s", resp.StatusCode, body)
+		}
+		if song.Title != "Resumed" || song.Artist != "Flac Artist" || song.Codec != "flac" || song.FileSize != int64(len(content)) || song.MimeType != "audio/flac" {
+			t.Errorf("finished upload: %+v", song)
+		}
+		if resp, streamed := c.fetch("GET", song.FilePath, nil); resp.StatusCode != http.StatusOK || !bytes.Equal(streamed, content) {
+			t.Errorf("stream resumable upload: status %d, %d bytes", resp.StatusCode, len(streamed))
+		}
+
+		// The finished session remembers its song, and repeating the final
+		// PATCH returns it again instead of creating a duplicate.
+		var sess UploadSession
+		if code := c.do("GET", location, nil, &sess); code != http.StatusOK || sess.SongID == nil || *sess.SongID != song.ID {
+			t.Errorf("GET finished session: status %d, %+v", code, sess)
+		}
+		resp, body = c.patchUpload(location, 2*third, content[2*third:])
+		var again Song
+		if resp.StatusCode != http.StatusOK || json.Unmarshal(body, &again) != nil || again.ID != song.ID {
+			t.Errorf("repeated final chunk: status %d, body %s", resp.StatusCode, body)
+		}
+		if code := c.do("GET", "/api/uploads", nil, &pending); code != http.StatusOK || len(pending) != 0 {
+			t.Errorf("finished upload still pending: %+v", pending)
+		}
+		if entries, _ := os.ReadDir(filepath.Join(uploadsDir, "1", incomingDirName)); len(entries) != 0 {
+			t.Errorf("%d partial files left behind", len(entries))
+		}
+
+		other := newTestClient(t, srv)
+		other.registerAndLogin("vic")
+		if resp, _ := other.tus("HEAD", location, nil, nil); resp.StatusCode != http.StatusNotFound {
+			t.Errorf("HEAD someone else's upload: status %d, want 404", resp.StatusCode)
+		}
+	})
+}
+
+func TestResumableUploadRejects(t *testing.T) {
+	forEachStore(t, func(t *testing.T, srv *httptest.Server) {
+		c := newTestClient(t, srv)
+		c.registerAndLogin("walt")
+
+		if resp, _ := c.tus("POST", "/api/uploads", http.Header{"Upload-Length": {"many"}}, nil); resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("bad Upload-Length: status %d, want 400", resp.StatusCode)
+		}
+		if resp, _ := c.tus("POST", "/api/uploads", http.Header{"Upload-Length": {"10"}, "Tus-Resumable": {"0.2.2"}}, nil); resp.StatusCode != http.StatusPreconditionFailed {
+			t.Errorf("old tus version: status %d, want 412", resp.StatusCode)
+		}
+		if resp, _ := c.tus("POST", "/api/uploads", http.Header{"Upload-Length": {"10"}, "Upload-Metadata": {"year " + base64.StdEncoding.EncodeToString([]byte("soon"))}}, nil); resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("bad year in metadata: status %d, want 400", resp.StatusCode)
+		}
+
+		// Content is sniffed once the file is complete, as for multipart uploads.
+		junk := []byte("this is not audio at all")
+		location := c.createUpload(len(junk), nil)
+		if resp, _ := c.patchUpload(location, 0, junk); resp.StatusCode != http.StatusUnsupportedMediaType {
+			t.Errorf("non-audio upload: status %d, want 415", resp.StatusCode)
+		}
+		if resp, _ := c.tus("HEAD", location, nil, nil); resp.StatusCode != http.StatusNotFound {
+			t.Errorf("rejected upload still exists: status %d", resp.StatusCode)
+		}
+
+		location = c.createUpload(4, nil)
+		if resp, _ := c.patchUpload(location, 0, []byte("too long")); resp.StatusCode != http.StatusRequestEntityTooLarge {
+			t.Errorf("chunk past Upload-Length: status %d, want 413", resp.StatusCode)
+		}
+		if resp, _ := c.tus("DELETE", location, nil, nil); resp.StatusCode != http.StatusNoContent {
+			t.Errorf("DELETE upload: status %d, want 204", resp.StatusCode)
+		}
+		if resp, _ := c.tus("HEAD", location, nil, nil); resp.StatusCode != http.StatusNotFound {
+			t.Errorf("deleted upload still exists: status %d", resp.StatusCode)
+		}
+	})
+}
+
+func TestResumableUploadQuota(t *testing.T) {
+	saved := uploadQuota
+	t.Cleanup(func() { uploadQuota = saved })
+	uploadQuota = StorageQuota{MaxBytes: 1000}
+
+	forEachStore(t, func(t *testing.T, srv *httptest.Server) {
+		c := newTestClient(t, srv)
+		c.registerAndLogin("xena")
+		if resp, _ := c.tus("POST", "/api/uploads", http.Header{"Upload-Length": {"1001"}}, nil); resp.StatusCode != http.StatusRequestEntityTooLarge {
+			t.Errorf("upload over quota: status %d, want 413", resp.StatusCode)
+		}
+		// Unfinished uploads reserve their space.
+		c.createUpload(600, nil)
+		if resp, _ := c.tus("POST", "/api/uploads", http.Header{"Upload-Length": {"600"}}, nil); resp.StatusCode != http.StatusRequestEntityTooLarge {
+			t.Errorf("second upload past quota: status %d, want 413", resp.StatusCode)
+		}
+	})
+}
+
+func TestExpireUploadSessions(t *testing.T) {
+	forEachStore(t, func(t *testing.T, srv *httptest.Server) {
+		c := newTestClient(t, srv)
+		c.registerAndLogin("yuri")
+		content := testMP3("Abandoned")
+		stale := c.createUpload(len(content), nil)
+		if resp, _ := c.patchUpload(stale, 0, content[:100]); resp.StatusCode != http.StatusNoContent {
+			t.Fatalf("chunk: status %d", resp.StatusCode)
+		}
+		part := filepath.Join(uploadsDir, "1", incomingDirName, filepath.Base(stale)+".part")
+		if info, err := os.Stat(part); err != nil || info.Size() != 100 {
+			t.Fatalf("partial file: %v, %v", info, err)
+		}
+
+		expireUploadSessions(time.Now().Add(time.Hour))
+		if resp, _ := c.tus("HEAD", stale, nil, nil); resp.StatusCode != http.StatusOK {
+			t.Fatalf("active upload expired early: status %d", resp.StatusCode)
+		}
+		expireUploadSessions(time.Now().Add(uploadSessionTTL + time.Minute))
+		if resp, _ := c.tus("HEAD", stale, nil, nil); resp.StatusCode != http.StatusNotFound {
+			t.Errorf("abandoned upload not expired: status %d", resp.StatusCode)
+		}
+		if _, err := os.Stat(part); !os.IsNotExist(err) {
+			t.Errorf("partial file of expired upload still on disk: %v", err)
+		}
+	})
+}
@@ -0,0 +1,356 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Waveforms are cached under uploadsDir/waveforms/<key>.peaks, keyed by the
+// blob hash for uploads in the blob store (so duplicates share one) and by
+// song ID for older uploads and the samples.
+const waveformsDirName = "waveforms"
+
+// Peaks are gathered at waveformBucketsPerSecond while decoding, then
+// stored at each of waveformResolutions (fewer for short tracks). Requests
+// are served from the smallest stored resolution that has enough points.
+const (
+	waveformBucketsPerSecond = 100
+	defaultWaveformPoints    = 1024
+)
+
+var waveformResolutions = []int{256, 1024, 4096}
+
+// maxWaveformPoints is the finest resolution a client may ask for.
+func maxWaveformPoints() int { return waveformResolutions[len(waveformResolutions)-1] }
+
+// waveformMagic starts every cache file; the byte after it is the version.
+const waveformMagic = "WFPK"
+
+// waveform holds a song's peaks at several resolutions, coarsest first.
+// Each level interleaves the minimum and maximum sample of every point,
+// scaled to -127..127 of full scale.
+type waveform struct {
+	levels [][]int8
+}
+
+// peaksBuilder collects the minimum and maximum over all channels of each
+// 1/waveformBucketsPerSecond of audio.
+type peaksBuilder struct {
+	channels        int
+	framesPerBucket int
+	frames          int
+	min, max        float64
+	mins, maxs      []float32
+}
+
+func newPeaksBuilder(sampleRate, channels int) *peaksBuilder {
+	return &peaksBuilder{
+		channels:        channels,
+		framesPerBucket: max(1, sampleRate/waveformBucketsPerSecond),
+		min:             math.Inf(1),
+		max:             math.Inf(-1),
+	}
+}
+
+// add feeds interleaved samples, a whole number of frames.
+func (p *peaksBuilder) add(samples []float64) {
+	for i := 0; i+p.channels <= len(samples); i += p.channels {
+		for _, v := range samples[i : i+p.channels] {
+			p.min = math.Min(p.min, v)
+			p.max = math.Max(p.max, v)
+		}
+		if p.frames++; p.frames == p.framesPerBucket {
+			p.flush()
+		}
+	}
+}
+
+func (p *peaksBuilder) flush() {
+	p.mins = append(p.mins, float32(p.min))
+	p.maxs = append(p.maxs, float32(p.max))
+	p.min, p.max, p.frames = math.Inf(1), math.Inf(-1), 0
+}
+
+func (p *peaksBuilder) finish() *waveform {
+	if p.frames > 0 {
+		p.flush()
+	}
+	wf := &waveform{}
+	for _, points := range waveformResolutions {
+		if points > len(p.mins) {
+			points = len(p.mins)
+		}
+		if len(wf.levels) > 0 && points == len(wf.levels[len(wf.levels)-1])/2 {
+			break // A short track: this level would repeat the last one
+		}
+		level := make([]int8, 0, 2*points)
+		for i := 0; i < points; i++ {
+			from, to := i*len(p.mins)/points, (i+1)*len(p.mins)/points
+			lo, hi := float32(math.Inf(1)), float32(math.Inf(-1))
+			for j := from; j < to; j++ {
+				lo, hi = min(lo, p.mins[j]), max(hi, p.maxs[j])
+			}
+			level = append(level, quantizePeak(lo), quantizePeak(hi))
+		}
+		wf.levels = append(wf.levels, level)
+	}
+	return wf
+}
+
+func quantizePeak(v float32) int8 {
+	return int8(math.Round(math.Max(-1, math.Min(1, float64(v))) * 127))
+}
+
+// peaks returns points min/max pairs, or fewer if the song is too short to
+// have that many, merging the pairs of the nearest finer level.
+func (wf *waveform) peaks(points int) []int8 {
+	if len(wf.levels) == 0 {
+		return []int8{}
+	}
+	level := wf.levels[len(wf.levels)-1]
+	for _, l := range wf.levels {
+		if len(l)/2 >= points {
+			level = l
+			break
+		}
+	}
+	have := len(level) / 2
+	if have <= points {
+		return level
+	}
+	out := make([]int8, 0, 2*points)
+	for i := 0; i < points; i++ {
+		from, to := i*have/points, (i+1)*have/points
+		lo, hi := int8(127), int8(-127)
+		for j := from; j < to; j++ {
+			lo, hi = min(lo, level[2*j]), max(hi, level[2*j+1])
+		}
+		out = append(out, lo, hi)
+	}
+	return out
+}
+
+func (wf *waveform) MarshalBinary() ([]byte, error) {
+	var b bytes.Buffer
+	b.WriteString(waveformMagic)
+	b.WriteByte(1)
+	b.WriteByte(byte(len(wf.levels)))
+	for _, level := range wf.levels {
+		binary.Write(&b, binary.LittleEndian, uint32(len(level)/2))
+		binary.Write(&b, binary.LittleEndian, level)
+	}
+	return b.Bytes(), nil
+}
+
+func (wf *waveform) UnmarshalBinary(data []byte) error {
+	if len(data) < 6 || string(data[:4]) != waveformMagic || data[4] != 1 {
+		return errors.New("not a version 1 waveform file")
+	}
+	r := bytes.NewReader(data[6:])
+	wf.levels = make([][]int8, data[5])
+	for i := range wf.levels {
+		var points uint32
+		if err := binary.Read(r, binary.LittleEndian, &points); err != nil {
+			return err
+		}
+		if int64(points)*2 > int64(r.Len()) {
+			return errors.New("truncated waveform file")
+		}
+		wf.levels[i] = make([]int8, 2*points)
+		if err := binary.Read(r, binary.LittleEndian, wf.levels[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func waveformKey(s Song) string {
+	if s.BlobSHA256 != "" {
+		return s.BlobSHA256
+	}
+	return s.ID
+}
+
+// waveformStoragePath is the cache file for key, relative to uploadsDir.
+func waveformStoragePath(key string) string {
+	return waveformsDirName + "/" + key + ".peaks"
+}
+
+// waveformLocks serialize generating the same waveform, so a request for a
+// song the worker is busy with waits for its result instead of decoding
+// the file a second time.
+var waveformLocks [16]sync.Mutex
+
+func lockWaveform(key string) func() {
+	h := fnv.New32a()
+	io.WriteString(h, key)
+	mu := &waveformLocks[h.Sum32()%uint32(len(waveformLocks))]
+	mu.Lock()
+	return mu.Unlock
+}
+
+func waveformCached(s Song) bool {
+	fullPath, err := uploadFilePath(waveformStoragePath(waveformKey(s)))
+	if err != nil {
+		return false
+	}
+	_, err = os.Stat(fullPath)
+	return err == nil
+}
+
+func loadWaveform(s Song) (*waveform, error) {
+	fullPath, err := uploadFilePath(waveformStoragePath(waveformKey(s)))
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(fullPath)
+	if err != nil {
+		return nil, err
+	}
+	wf := &waveform{}
+	return wf, wf.UnmarshalBinary(data)
+}
+
+// saveWaveform writes the cache file under a temporary name and renames it,
+// so readers never see half of one.
+func saveWaveform(s Song, wf *waveform) error {
+	fullPath, err := uploadFilePath(waveformStoragePath(waveformKey(s)))
+	if err != nil {
+		return err
+	}
+	data, _ := wf.MarshalBinary()
+	if err := os.MkdirAll(filepath.Dir(fullPath), os.ModePerm); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(fullPath), ".peaks-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), fullPath)
+}
+
+// removeWaveform deletes the cached waveform stored under key.
+func removeWaveform(key string) {
+	if fullPath, err := uploadFilePath(waveformStoragePath(key)); err == nil {
+		removeUploadFile(fullPath, "Failed to remove waveform")
+	}
+}
+
+// songWaveform returns the cached waveform, decoding the audio first for
+// songs that don't have one yet (older uploads, or uploads the worker has
+// not reached).
+func songWaveform(s Song) (*waveform, error) {
+	if wf, err := loadWaveform(s); err == nil {
+		return wf, nil
+	}
+	unlock := lockWaveform(waveformKey(s))
+	defer unlock()
+	if wf, err := loadWaveform(s); err == nil {
+		return wf, nil // Generated while we waited for the lock
+	}
+	path, err := songAudioPath(s)
+	if err != nil {
+		return nil, err
+	}
+	a, err := analyzeFile(path, s.Channels)
+	if err != nil {
+		return nil, err
+	}
+	if err := saveWaveform(s, a.Waveform); err != nil {
+		log.Error().Err(err).Str("song_id", s.ID).Msg("Failed to cache waveform")
+	}
+	return a.Waveform, nil
+}
+
+// waveformResponse is the JSON form of /api/songs/{id}/waveform. Peaks
+// interleaves the minimum and maximum of each point, scaled to -127..127.
+type waveformResponse struct {
+	SongID string `json:"songId"`
+	Points int    `json:"points"`
+	Peaks  []int8 `json:"peaks"`
+}
+
+// SongWaveformHandler serves GET /api/songs/{id}/waveform?points=N as JSON,
+// or as raw signed bytes (min, max per point) with ?format=binary or
+// Accept: application/octet-stream. Like the audio itself, an upload's
+// waveform is only shown to its owner.
+func SongWaveformHandler(w http.ResponseWriter, r *http.Request) { // Protected by TryAuthMiddleware
+	if r.Method != http.MethodGet {
+		writeJSONError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	points := defaultWaveformPoints
+	if v := r.URL.Query().Get("points"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxWaveformPoints() {
+			writeJSONError(w, fmt.Sprintf("points must be between 1 and %d", maxWaveformPoints()), http.StatusBadRequest)
+			return
+		}
+		points = n
+	}
+	binaryFormat := r.URL.Query().Get("format") == "binary" ||
+		(r.URL.Query().Get("format") == "" && strings.Contains(r.Header.Get("Accept"), "application/octet-stream"))
+
+	songID := r.PathValue("id")
+	song := findSampleSong(songID)
+	if song == nil {
+		s, err := store.GetSong(songID)
+		if err != nil {
+			writeStoreError(w, err, "Failed to fetch song")
+			return
+		}
+		claims := GetClaimsFromContext(r)
+		if !s.IsUploaded || claims == nil || s.UserID == nil || *s.UserID != claims.UserID {
+			writeJSONError(w, "Song not found", http.StatusNotFound)
+			return
+		}
+		song = s
+	}
+
+	wf, err := songWaveform(*song)
+	if err != nil {
+		if errors.Is(err, errNoDecoder) {
+			writeJSONError(w, "No waveform: this audio format can't be decoded", http.StatusUnprocessableEntity)
+			return
+		}
+		log.Error().Err(err).Str("song_id", songID).Msg("Failed to generate waveform")
+		writeJSONError(w, "Failed to generate waveform", http.StatusInternalServerError)
+		return
+	}
+	peaks := wf.peaks(points)
+	// A song's audio never changes, so neither does its waveform.
+	w.Header().Set("Cache-Control", "private, max-age=86400")
+	w.Header().Set("Vary", "Accept")
+	if binaryFormat {
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("X-Waveform-Points", strconv.Itoa(len(peaks)/2))
+		raw := make([]byte, len(peaks))
+		for i, v := range peaks {
+			raw[i] = byte(v)
+		}
+		w.Write(raw)
+		return
+	}
+	writeJSONResponse(w, waveformResponse{SongID: song.ID, Points: len(peaks) / 2, Peaks: peaks}, http.StatusOK)
+}
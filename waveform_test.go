@@ -0,0 +1,142 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+func TestWaveformPeaks(t *testing.T) {
+	p := newPeaksBuilder(8000, 1)
+	// Ten seconds: a second of silence, then a half-scale square wave.
+	for second := 0; second < 10; second++ {
+		samples := make([]float64, 8000)
+		for i := range samples {
+			if second > 0 {
+				samples[i] = 0.5
+				if i%2 == 1 {
+					samples[i] = -0.5
+				}
+			}
+		}
+		p.add(samples)
+	}
+	wf := p.finish()
+	// 1000 buckets of 10 ms: 256 points, then all 1000 in place of 1024.
+	if len(wf.levels) != 2 || len(wf.levels[0]) != 2*256 || len(wf.levels[1]) != 2*1000 {
+		t.Fatalf("levels of %d points", len(wf.levels))
+	}
+
+	peaks := wf.peaks(10)
+	if len(peaks) != 20 || peaks[0] != 0 || peaks[1] != 0 || peaks[2] != -64 || peaks[3] != 64 {
+		t.Errorf("peaks(10) = %v", peaks)
+	}
+	if got := wf.peaks(4096); len(got) != 2*1000 {
+		t.Errorf("peaks(4096) has %d points, want all 1000", len(got)/2)
+	}
+
+	data, _ := wf.MarshalBinary()
+	var decoded waveform
+	if err := decoded.UnmarshalBinary(data); err != nil {
+		t.Fatal(err)
+	}
+	if len(decoded.levels) != 2 || string(int8sToBytes(decoded.levels[1])) != string(int8sToBytes(wf.levels[1])) {
+		t.Errorf("waveform did not survive encoding")
+	}
+	if err := decoded.UnmarshalBinary(data[:len(data)-1]); err == nil {
+		t.Errorf("truncated waveform file decoded without error")
+	}
+}
+
+func int8sToBytes(v []int8) []byte {
+	b := make([]byte, len(v))
+	for i := range v {
+		b[i] = byte(v[i])
+	}
+	return b
+}
+
+func TestSongWaveform(t *testing.T) {
+	forEachStore(t, func(t *testing.T, srv *httptest.Server) {
+		owner := newTestClient(t, srv)
+		owner.registerAndLogin("wren")
+		song, code := owner.uploadFile("tone.wav", sineWAV(48000, sine(48000, 2, 3, 440, 0.5, 0)), nil)
+		if code != http.StatusCreated {
+			t.Fatalf("upload: status %d", code)
+		}
+		stored, err := store.GetSong(song.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cached := filepath.Join(uploadsDir, waveformStoragePath(waveformKey(*stored)))
+
+		// Nothing has analysed the upload yet, so the first request draws it.
+		var wf waveformResponse
+		if code := owner.do("GET", "/api/songs/"+song.ID+"/waveform?points=200", nil, &wf); code != http.StatusOK {
+			t.Fatalf("waveform: status %d", code)
+		}
+		if wf.SongID != song.ID || wf.Points != 200 || len(wf.Peaks) != 400 || wf.Peaks[0] > -63 || wf.Peaks[1] < 63 {
+			t.Errorf("waveform = %d points, starting %v", wf.Points, wf.Peaks[:2])
+		}
+		if _, err := os.Stat(cached); err != nil {
+			t.Errorf("waveform not cached: %v", err)
+		}
+
+		resp, body := owner.fetch("GET", "/api/songs/"+song.ID+"/waveform?points=50&format=binary", nil)
+		if resp.StatusCode != http.StatusOK || len(body) != 100 || resp.Header.Get("X-Waveform-Points") != "50" {
+			t.Errorf("binary waveform: status %d, %d bytes, header %q", resp.StatusCode, len(body), resp.Header.Get("X-Waveform-Points"))
+		}
+		resp, body = owner.fetch("GET", "/api/songs/"+song.ID+"/waveform", http.Header{"Accept": {"application/octet-stream"}})
+		// Three seconds is 300 buckets, fewer than the 1024 points asked for.
+		if resp.StatusCode != http.StatusOK || len(body) != 600 {
+			t.Errorf("default binary waveform: status %d, %d bytes", resp.StatusCode, len(body))
+		}
+
+		for _, points := range []int{0, maxWaveformPoints() + 1} {
+			if code := owner.do("GET", "/api/songs/"+song.ID+"/waveform?points="+strconv.Itoa(points), nil, nil); code != http.StatusBadRequest {
+				t.Errorf("points=%d: status %d, want 400", points, code)
+			}
+		}
+		other := newTestClient(t, srv)
+		other.registerAndLogin("xavi")
+		if code := other.do("GET", "/api/songs/"+song.ID+"/waveform", nil, nil); code != http.StatusNotFound {
+			t.Errorf("someone else's waveform: status %d, want 404", code)
+		}
+		guest := newTestClient(t, srv)
+		if code := guest.do("GET", "/api/songs/"+song.ID+"/waveform", nil, nil); code != http.StatusNotFound {
+			t.Errorf("guest: status %d, want 404", code)
+		}
+
+		if code := owner.do("DELETE", "/api/songs/delete?id="+song.ID, nil, nil); code != http.StatusOK {
+			t.Fatalf("delete: status %d", code)
+		}
+		if _, err := os.Stat(cached); !os.IsNotExist(err) {
+			t.Errorf("waveform left behind after delete: %v", err)
+		}
+	})
+}
+
+func TestAnalysisWorkerCachesWaveform(t *testing.T) {
+	forEachStore(t, func(t *testing.T, srv *httptest.Server) {
+		c := newTestClient(t, srv)
+		c.registerAndLogin("yuki")
+		song, code := c.uploadFile("tone.wav", sineWAV(44100, sine(44100, 1, 2, 440, 0.25, 0)), nil)
+		if code != http.StatusCreated {
+			t.Fatalf("upload: status %d", code)
+		}
+		s, err := store.GetSong(song.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		analyzeSong(*s)
+		if !waveformCached(*s) {
+			t.Errorf("worker did not cache the waveform")
+		}
+		if s, _ := store.GetSong(song.ID); s.Loudness == nil {
+			t.Errorf("worker did not measure loudness")
+		}
+	})
+}